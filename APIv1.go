@@ -0,0 +1,556 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/***************
+Version 1 of the REST API under /api/v1. Unlike the original routes every endpoint
+  - reads only the verb it is documented for, GET never changes anything
+  - takes and returns JSON described by the request and response types in the route table
+  - returns {"success":true,"data":...} on success or {"success":false,"error":{...}} with the matching status code
+  - refuses unknown fields in a request body with 400, a missing device with 404 and a lockout or interlock with 409
+
+Each route needs the role given in the table, see Auth.go.
+The OpenAPI document at /api/v1/openapi.json is generated from the same route table so it can't drift from the code.
+The original routes in setUpWebSite are kept for the existing web pages and call the same command functions.
+*/
+
+const APIV1PREFIX = "/api/v1"
+
+/*
+APIError is the error part of a failed response
+*/
+type APIError struct {
+	Status  int    `json:"status"`
+	Device  string `json:"device,omitempty"`
+	Message string `json:"message"`
+}
+
+/*
+APIResponse is the envelope around every response
+*/
+type APIResponse struct {
+	Success bool        `json:"success"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   *APIError   `json:"error,omitempty"`
+}
+
+// Request bodies
+
+type APIStateRequest struct {
+	State bool `json:"state"`
+}
+
+type APIRateRequest struct {
+	Rate int64 `json:"rate"`
+}
+
+type APIPressureRequest struct {
+	Pressure float64 `json:"pressure"` // bar, 2-35
+}
+
+type APIEmergencyStopRequest struct {
+	Reason string `json:"reason,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+type APINameRequest struct {
+	Name string `json:"name"`
+}
+
+type APICANRecordRequest struct {
+	Until time.Time `json:"until"`
+}
+
+// Response bodies
+
+type APIElectrolyser struct {
+	FullElectrolyserStatus
+	Device  int      `json:"device"`
+	Lockout *Lockout `json:"lockout,omitempty"`
+}
+
+type APIFuelCell struct {
+	FullFuelCellStatus
+	Device  uint8    `json:"device"`
+	Lockout *Lockout `json:"lockout,omitempty"`
+}
+
+type APIJobAccepted struct {
+	Job string `json:"job"`
+	URL string `json:"url"`
+}
+
+type APICANRecording struct {
+	Until time.Time `json:"until"`
+}
+
+/*
+apiRoute describes one endpoint. Request and Response are zero values of the body types and are only used to build
+the OpenAPI document; nil means there is no body.
+*/
+type apiRoute struct {
+	Method   string
+	Path     string
+	Summary  string
+	Tag      string
+	Request  interface{}
+	Response interface{}
+	Status   int  // Status returned on success, 200 if not set
+	Role     Role // Role needed, viewer to read and operator for anything else if not set
+	Handler  func(r *http.Request) (interface{}, *CommandError)
+}
+
+/*
+apiV1Routes returns the route table. It is a function rather than a variable because the openapi.json handler refers
+back to it.
+*/
+func apiV1Routes() []apiRoute {
+	return []apiRoute{
+		{Method: "GET", Path: "/status", Summary: "Full status of the plant", Tag: "System",
+			Response: FullStatus{}, Handler: apiGetStatus},
+
+		{Method: "GET", Path: "/electrolysers/rate", Summary: "Total electrolyser production rate", Tag: "Electrolysers",
+			Response: ElectrolyserRate{}, Handler: apiGetElectrolyserRate},
+		{Method: "PUT", Path: "/electrolysers/rate", Summary: "Set the total electrolyser production rate, 0-100%", Tag: "Electrolysers",
+			Request: APIRateRequest{}, Response: ElectrolyserRate{}, Handler: apiSetElectrolyserRate},
+		{Method: "GET", Path: "/electrolysers/{device:[0-9]+}", Summary: "Status of one electrolyser", Tag: "Electrolysers",
+			Response: APIElectrolyser{}, Handler: apiGetElectrolyser},
+		{Method: "PUT", Path: "/electrolysers/{device:[0-9]+}/power", Summary: "Turn the electrolyser power relay on or off", Tag: "Electrolysers",
+			Request: APIStateRequest{}, Handler: apiSetElectrolyserPower},
+		{Method: "POST", Path: "/electrolysers/{device:[0-9]+}/start", Summary: "Start the electrolyser now", Tag: "Electrolysers",
+			Handler: apiStartElectrolyser},
+		{Method: "POST", Path: "/electrolysers/{device:[0-9]+}/stop", Summary: "Stop the electrolyser now", Tag: "Electrolysers",
+			Handler: apiStopElectrolyser},
+		{Method: "POST", Path: "/electrolysers/{device:[0-9]+}/reboot", Summary: "Reboot the electrolyser", Tag: "Electrolysers",
+			Handler: apiRebootElectrolyser},
+		{Method: "POST", Path: "/electrolysers/{device:[0-9]+}/preheat", Summary: "Preheat the electrolyte", Tag: "Electrolysers",
+			Handler: apiPreheatElectrolyser},
+		{Method: "PUT", Path: "/electrolysers/{device:[0-9]+}/restart-pressure", Summary: "Set the pressure the electrolyser restarts at", Tag: "Electrolysers",
+			Request: APIPressureRequest{}, Response: APIJobAccepted{}, Status: http.StatusAccepted, Role: RoleEngineer, Handler: apiSetRestartPressure},
+
+		{Method: "GET", Path: "/fuel-cells/{device:[0-9]+}", Summary: "Status of one fuel cell", Tag: "Fuel cells",
+			Response: APIFuelCell{}, Handler: apiGetFuelCell},
+		{Method: "PUT", Path: "/fuel-cells/{device:[0-9]+}/enable", Summary: "Turn the fuel cell enable relay on or off. Turning it off returns the power down job with a 202", Tag: "Fuel cells",
+			Request: APIStateRequest{}, Response: APIJobAccepted{}, Handler: apiSetFuelCellEnable},
+		{Method: "PUT", Path: "/fuel-cells/{device:[0-9]+}/run", Summary: "Start or stop the fuel cell", Tag: "Fuel cells",
+			Request: APIStateRequest{}, Handler: apiSetFuelCellRun},
+		{Method: "POST", Path: "/fuel-cells/{device:[0-9]+}/restart", Summary: "Shut down and restart the fuel cell", Tag: "Fuel cells",
+			Response: APIJobAccepted{}, Status: http.StatusAccepted, Handler: apiRestartFuelCell},
+
+		{Method: "PUT", Path: "/relays/gas", Summary: "Turn the fuel cell gas supply on or off", Tag: "Relays",
+			Request: APIStateRequest{}, Handler: apiSetGas},
+		{Method: "PUT", Path: "/relays/spare", Summary: "Turn the spare relay on or off", Tag: "Relays",
+			Request: APIStateRequest{}, Handler: apiSetSpare},
+
+		{Method: "GET", Path: "/estop", Summary: "Emergency stop state", Tag: "Emergency stop",
+			Response: EmergencyStopStatus{}, Handler: apiGetEmergencyStop},
+		{Method: "POST", Path: "/estop", Summary: "Trigger the emergency stop", Tag: "Emergency stop",
+			Request: APIEmergencyStopRequest{}, Response: EmergencyStopStatus{}, Status: http.StatusAccepted, Handler: apiTriggerEmergencyStop},
+		{Method: "POST", Path: "/estop/reset", Summary: "Reset the emergency stop latch", Tag: "Emergency stop",
+			Request: APINameRequest{}, Response: EmergencyStopStatus{}, Handler: apiResetEmergencyStop},
+
+		{Method: "GET", Path: "/alarms", Summary: "Alarms on the alarm list", Tag: "Alarms",
+			Response: []Alarm{}, Handler: apiGetAlarms},
+		{Method: "POST", Path: "/alarms/{id:[0-9]+}/acknowledge", Summary: "Acknowledge an alarm", Tag: "Alarms",
+			Request: APINameRequest{}, Handler: apiAcknowledgeAlarm},
+
+		{Method: "GET", Path: "/jobs/{id}", Summary: "Progress and result of a background job", Tag: "Jobs",
+			Response: Job{}, Handler: apiGetJob},
+
+		{Method: "PUT", Path: "/can/recording", Summary: "Record the CAN frames until the given time", Tag: "CAN",
+			Request: APICANRecordRequest{}, Response: APICANRecording{}, Role: RoleEngineer, Handler: apiSetCANRecording},
+
+		{Method: "GET", Path: "/audit", Summary: "Audit trail of control actions filtered by from, to, days, actor, device, action, kind and result", Tag: "Audit",
+			Response: []AuditEntry{}, Role: RoleEngineer, Handler: apiGetAuditTrail},
+
+		{Method: "GET", Path: "/me", Summary: "Who is making the request", Tag: "Users",
+			Response: AuthUser{}, Handler: apiGetMe},
+		{Method: "PUT", Path: "/me/password", Summary: "Change your own password", Tag: "Users",
+			Request: APIPasswordChange{}, Role: RoleViewer, Handler: apiChangeMyPassword},
+		{Method: "GET", Path: "/users", Summary: "List the users", Tag: "Users",
+			Response: []UserInfo{}, Role: RoleAdmin, Handler: apiGetUsers},
+		{Method: "POST", Path: "/users", Summary: "Add a user", Tag: "Users",
+			Request: APIUserRequest{}, Response: UserInfo{}, Status: http.StatusCreated, Role: RoleAdmin, Handler: apiAddUser},
+		{Method: "PUT", Path: "/users/{name}", Summary: "Change a user's password, role or whether they can log in", Tag: "Users",
+			Request: APIUserUpdate{}, Response: UserInfo{}, Role: RoleAdmin, Handler: apiUpdateUser},
+		{Method: "DELETE", Path: "/users/{name}", Summary: "Remove a user", Tag: "Users",
+			Role: RoleAdmin, Handler: apiDeleteUser},
+		{Method: "GET", Path: "/tokens", Summary: "List the API tokens", Tag: "Users",
+			Response: []APITokenInfo{}, Role: RoleAdmin, Handler: apiGetTokens},
+		{Method: "POST", Path: "/tokens", Summary: "Create an API token. The token is only returned this once.", Tag: "Users",
+			Request: APITokenRequest{}, Response: APITokenInfo{}, Status: http.StatusCreated, Role: RoleAdmin, Handler: apiAddToken},
+		{Method: "DELETE", Path: "/tokens/{id}", Summary: "Revoke an API token", Tag: "Users",
+			Role: RoleAdmin, Handler: apiDeleteToken},
+	}
+}
+
+func (route *apiRoute) role() Role {
+	switch {
+	case route.Role != RolePublic:
+		return route.Role
+	case route.Method == http.MethodGet:
+		return RoleViewer
+	}
+	return RoleOperator
+}
+
+/*
+setUpAPIv1 registers the version 1 API on the router
+*/
+func setUpAPIv1(router *mux.Router) {
+	api := router.PathPrefix(APIV1PREFIX).Subrouter()
+	for _, route := range apiV1Routes() {
+		api.Handle(route.Path, apiHandler(route)).Methods(route.Method)
+		requireRole(route.Method, APIV1PREFIX+route.Path, route.role())
+	}
+	api.HandleFunc("/openapi.json", getOpenAPIDocument).Methods("GET")
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, "", commandRefused(http.StatusNotFound, "No such endpoint "+r.URL.Path))
+	})
+	api.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, "", commandRefused(http.StatusMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path))
+	})
+}
+
+/*
+apiHandler wraps a route handler to write the envelope
+*/
+func apiHandler(route apiRoute) http.Handler {
+	status := route.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := route.Handler(r)
+		if err != nil {
+			writeAPIError(w, route.Tag, err)
+			return
+		}
+		code := status
+		if job, ok := data.(*APIJobAccepted); ok {
+			w.Header().Set("Location", job.URL)
+			code = http.StatusAccepted
+		}
+		writeAPIResponse(w, code, &APIResponse{Success: true, Data: data})
+	})
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, response *APIResponse) {
+	bytesArray, err := json.Marshal(response)
+	if err != nil {
+		log.Println(err)
+		status = http.StatusInternalServerError
+		bytesArray, _ = json.Marshal(&APIResponse{Error: &APIError{Status: status, Message: err.Error()}})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+		log.Println(err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, device string, err *CommandError) {
+	if !err.Quiet && err.Status >= http.StatusInternalServerError {
+		log.Printf("API %s - %v", device, err)
+	}
+	writeAPIResponse(w, err.Status, &APIResponse{Error: &APIError{Status: err.Status, Device: device, Message: err.Error()}})
+}
+
+/*
+decodeAPIBody reads a JSON request body into v, refusing anything that isn't exactly one object of the right shape
+*/
+func decodeAPIBody(r *http.Request, v interface{}) *CommandError {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		if err == io.EOF {
+			return commandRefused(http.StatusBadRequest, "A JSON request body is required")
+		}
+		return commandRefused(http.StatusBadRequest, "Invalid request body - "+err.Error())
+	}
+	if decoder.More() {
+		return commandRefused(http.StatusBadRequest, "Invalid request body - only one JSON object is allowed")
+	}
+	return nil
+}
+
+/*
+apiDevice returns the {device:[0-9]+} path parameter
+*/
+func apiDevice(r *http.Request) (int64, *CommandError) {
+	device, err := strconv.ParseInt(mux.Vars(r)["device"], 10, 8)
+	if err != nil {
+		return 0, commandRefused(http.StatusNotFound, "Invalid device "+mux.Vars(r)["device"])
+	}
+	return device, nil
+}
+
+func apiJobAccepted(job *Job) *APIJobAccepted {
+	return &APIJobAccepted{Job: job.ID, URL: APIV1PREFIX + "/jobs/" + job.ID}
+}
+
+func apiGetStatus(_ *http.Request) (interface{}, *CommandError) {
+	return getFullStatus(), nil
+}
+
+func apiGetElectrolyserRate(_ *http.Request) (interface{}, *CommandError) {
+	return getElectrolyserRateStatus(), nil
+}
+
+func apiSetElectrolyserRate(r *http.Request) (interface{}, *CommandError) {
+	var request APIRateRequest
+	if err := decodeAPIBody(r, &request); err != nil {
+		return nil, err
+	}
+	if err := commandElectrolyserRate(request.Rate, requestSource(r)); err != nil {
+		return nil, err
+	}
+	return getElectrolyserRateStatus(), nil
+}
+
+func apiGetElectrolyser(r *http.Request) (interface{}, *CommandError) {
+	device, cmdErr := apiDevice(r)
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	SystemStatus.m.Lock()
+	defer SystemStatus.m.Unlock()
+	if device < 0 || device >= int64(len(SystemStatus.Electrolysers)) {
+		return nil, commandRefused(http.StatusNotFound, fmt.Sprintf("Electrolyser %d does not exist", device))
+	}
+	return &APIElectrolyser{
+		FullElectrolyserStatus: *newFullElectrolyserStatus(int(device), SystemStatus.Electrolysers[device]),
+		Device:                 int(device),
+		Lockout:                getLockout(LockoutElectrolyser, strconv.Itoa(int(device))),
+	}, nil
+}
+
+func apiSetElectrolyserPower(r *http.Request) (interface{}, *CommandError) {
+	device, cmdErr := apiDevice(r)
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	var request APIStateRequest
+	if err := decodeAPIBody(r, &request); err != nil {
+		return nil, err
+	}
+	return nil, commandElectrolyserPower(device, request.State, requestSource(r))
+}
+
+func apiStartElectrolyser(r *http.Request) (interface{}, *CommandError) {
+	device, cmdErr := apiDevice(r)
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	return nil, commandElectrolyserRun(device, true, requestSource(r))
+}
+
+func apiStopElectrolyser(r *http.Request) (interface{}, *CommandError) {
+	device, cmdErr := apiDevice(r)
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	return nil, commandElectrolyserRun(device, false, requestSource(r))
+}
+
+func apiRebootElectrolyser(r *http.Request) (interface{}, *CommandError) {
+	device, cmdErr := apiDevice(r)
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	return nil, commandElectrolyserReboot(device, requestSource(r))
+}
+
+func apiPreheatElectrolyser(r *http.Request) (interface{}, *CommandError) {
+	device, cmdErr := apiDevice(r)
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	return nil, commandElectrolyserPreheat(device, requestSource(r))
+}
+
+func apiSetRestartPressure(r *http.Request) (interface{}, *CommandError) {
+	device, cmdErr := apiDevice(r)
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	var request APIPressureRequest
+	if err := decodeAPIBody(r, &request); err != nil {
+		return nil, err
+	}
+	job, cmdErr := commandRestartPressure(device, request.Pressure, requestSource(r))
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	return apiJobAccepted(job), nil
+}
+
+func apiGetFuelCell(r *http.Request) (interface{}, *CommandError) {
+	device, cmdErr := apiDevice(r)
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	fc, found := canBus.fuelCell[uint8(device)]
+	if device < 0 || !found {
+		return nil, commandRefused(http.StatusNotFound, fmt.Sprintf("Fuel cell %d does not exist", device))
+	}
+	return &APIFuelCell{
+		FullFuelCellStatus: *newFullFuelCellStatus(uint8(device), fc),
+		Device:             uint8(device),
+		Lockout:            getLockout(LockoutFuelCell, strconv.Itoa(int(device))),
+	}, nil
+}
+
+func apiSetFuelCellEnable(r *http.Request) (interface{}, *CommandError) {
+	device, cmdErr := apiDevice(r)
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	var request APIStateRequest
+	if err := decodeAPIBody(r, &request); err != nil {
+		return nil, err
+	}
+	fc, cmdErr := fuelCellDevice(device, request.State)
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	job, cmdErr := commandFuelCellEnable(fc, request.State, requestSource(r))
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	if job != nil {
+		return apiJobAccepted(job), nil
+	}
+	return nil, nil
+}
+
+func apiSetFuelCellRun(r *http.Request) (interface{}, *CommandError) {
+	device, cmdErr := apiDevice(r)
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	var request APIStateRequest
+	if err := decodeAPIBody(r, &request); err != nil {
+		return nil, err
+	}
+	fc, cmdErr := fuelCellDevice(device, request.State)
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	return nil, commandFuelCellRun(fc, request.State, requestSource(r))
+}
+
+func apiRestartFuelCell(r *http.Request) (interface{}, *CommandError) {
+	device, cmdErr := apiDevice(r)
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	job, cmdErr := commandFuelCellRestart(device, requestSource(r))
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	return apiJobAccepted(job), nil
+}
+
+func apiSetGas(r *http.Request) (interface{}, *CommandError) {
+	var request APIStateRequest
+	if err := decodeAPIBody(r, &request); err != nil {
+		return nil, err
+	}
+	return nil, commandGas(request.State, requestSource(r))
+}
+
+func apiSetSpare(r *http.Request) (interface{}, *CommandError) {
+	var request APIStateRequest
+	if err := decodeAPIBody(r, &request); err != nil {
+		return nil, err
+	}
+	return nil, commandSpare(request.State, requestSource(r))
+}
+
+func apiGetEmergencyStop(_ *http.Request) (interface{}, *CommandError) {
+	return getEmergencyStopState(), nil
+}
+
+func apiTriggerEmergencyStop(r *http.Request) (interface{}, *CommandError) {
+	var request APIEmergencyStopRequest
+	// Never refuse an emergency stop because of a bad payload
+	if r.ContentLength != 0 {
+		if err := decodeAPIBody(r, &request); err != nil {
+			log.Println("Invalid emergency stop payload - ", err)
+		}
+	}
+	if request.Reason == "" {
+		request.Reason = "Emergency stop requested"
+	}
+	emergencyStop.Trigger(requestSource(r), request.Reason, request.Name)
+	return getEmergencyStopState(), nil
+}
+
+func apiResetEmergencyStop(r *http.Request) (interface{}, *CommandError) {
+	var request APINameRequest
+	if err := decodeAPIBody(r, &request); err != nil {
+		return nil, err
+	}
+	if err := commandResetEmergencyStop(request.Name); err != nil {
+		return nil, err
+	}
+	return getEmergencyStopState(), nil
+}
+
+func apiGetAlarms(_ *http.Request) (interface{}, *CommandError) {
+	return alarmManager.current(), nil
+}
+
+func apiAcknowledgeAlarm(r *http.Request) (interface{}, *CommandError) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return nil, commandRefused(http.StatusNotFound, "Invalid alarm "+mux.Vars(r)["id"])
+	}
+	var request APINameRequest
+	if err := decodeAPIBody(r, &request); err != nil {
+		return nil, err
+	}
+	name := operatorName(r, request.Name)
+	if name == "" {
+		return nil, commandRefused(http.StatusBadRequest, "A name is required to acknowledge an alarm")
+	}
+	if err := alarmManager.Acknowledge(id, name); err != nil {
+		return nil, &CommandError{Status: http.StatusNotFound, Err: err, Quiet: true}
+	}
+	return nil, nil
+}
+
+func apiGetJob(r *http.Request) (interface{}, *CommandError) {
+	id := mux.Vars(r)["id"]
+	job, err := getJob(id)
+	if err != nil {
+		return nil, commandFailed(err)
+	}
+	if job == nil {
+		return nil, &CommandError{Status: http.StatusNotFound, Err: errors.New("Job " + id + " not found"), Quiet: true}
+	}
+	return job, nil
+}
+
+func apiSetCANRecording(r *http.Request) (interface{}, *CommandError) {
+	var request APICANRecordRequest
+	if err := decodeAPIBody(r, &request); err != nil {
+		return nil, err
+	}
+	if err := commandCANRecord(request.Until); err != nil {
+		return nil, err
+	}
+	return &APICANRecording{Until: request.Until}, nil
+}
@@ -0,0 +1,903 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/***************
+An alarm is a fault or abnormal condition that an operator needs to see. Alarms are raised from the fuel cell fault
+bits, the electrolyser warning and error event codes, the dryer error and warning codes and the threshold rules.
+Each alarm stays on the alarm list until it has both cleared and been acknowledged by an operator. An operator can
+shelve an alarm for a limited time to stop it notifying while it is being dealt with. Every alarm is kept in the Alarms
+table so the history can be reviewed. Changes are pushed to the /wsAlarms websocket and to the notification channels.
+*/
+
+const ALARMSTABLE = `CREATE TABLE IF NOT EXISTS Alarms (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	AlarmKey VARCHAR(64) NOT NULL,
+	Source VARCHAR(16) NOT NULL,
+	Device VARCHAR(16) NULL,
+	Code VARCHAR(32) NULL,
+	Message VARCHAR(255) NOT NULL,
+	Severity VARCHAR(16) NOT NULL,
+	Raised DATETIME NOT NULL,
+	Cleared DATETIME NULL,
+	Acknowledged DATETIME NULL,
+	AcknowledgedBy VARCHAR(64) NULL,
+	ShelvedUntil DATETIME NULL,
+	ShelvedBy VARCHAR(64) NULL,
+	ShelveReason VARCHAR(255) NULL,
+	INDEX (Raised),
+	INDEX (AlarmKey))`
+
+const ALARMHISTORYDAYS = 7                      // Default number of days of alarm history returned
+const ALARMMAXSHELVE = time.Hour * 24           // Longest an alarm can be shelved for
+const ALARMSUBSCRIBERBUFFER = 64                // Updates buffered for each websocket subscriber
+const FUELCELLDATATIMEOUT = time.Second * 10    // Fuel cell fault bits older than this are not trusted
+const ALARMSUPERSEDED = "system - raised again" // Recorded against an unacknowledged alarm replaced by a new one
+
+type AlarmSeverity string
+
+const (
+	SeverityCritical AlarmSeverity = "critical"
+	SeverityHigh     AlarmSeverity = "high"
+	SeverityMedium   AlarmSeverity = "medium"
+	SeverityLow      AlarmSeverity = "low"
+)
+
+func (s AlarmSeverity) rank() int {
+	switch s {
+	case SeverityCritical:
+		return 0
+	case SeverityHigh:
+		return 1
+	case SeverityMedium:
+		return 2
+	}
+	return 3
+}
+
+const (
+	AlarmSourceFuelCell     = "fuelCell"
+	AlarmSourceElectrolyser = "electrolyser"
+	AlarmSourceDryer        = "dryer"
+	AlarmSourceThreshold    = "threshold"
+	AlarmSourceComms        = "comms"
+)
+
+const (
+	EventAlarmRaised  = "alarmRaised"
+	EventAlarmCleared = "alarmCleared"
+)
+
+/*
+AlarmSpec describes a condition that should be in alarm. Key identifies the condition so it is only raised once.
+*/
+type AlarmSpec struct {
+	Key      string
+	Source   string
+	Device   string
+	Code     string
+	Message  string
+	Severity AlarmSeverity
+}
+
+type Alarm struct {
+	ID             int64         `json:"id"`
+	Key            string        `json:"key"`
+	Source         string        `json:"source"`
+	Device         string        `json:"device"`
+	Code           string        `json:"code"`
+	Message        string        `json:"message"`
+	Severity       AlarmSeverity `json:"severity"`
+	Active         bool          `json:"active"`
+	Raised         time.Time     `json:"raised"`
+	Cleared        *time.Time    `json:"cleared,omitempty"`
+	Acknowledged   *time.Time    `json:"acknowledged,omitempty"`
+	AcknowledgedBy string        `json:"acknowledgedBy,omitempty"`
+	ShelvedUntil   *time.Time    `json:"shelvedUntil,omitempty"`
+	ShelvedBy      string        `json:"shelvedBy,omitempty"`
+	ShelveReason   string        `json:"shelveReason,omitempty"`
+}
+
+func (a *Alarm) shelved(now time.Time) bool {
+	return a.ShelvedUntil != nil && now.Before(*a.ShelvedUntil)
+}
+
+type AlarmUpdate struct {
+	Action string  `json:"action"` // snapshot, raised, cleared, acknowledged, shelved or unshelved
+	Alarm  *Alarm  `json:"alarm,omitempty"`
+	Alarms []Alarm `json:"alarms,omitempty"`
+}
+
+type AlarmManager struct {
+	alarms      map[string]*Alarm // Active alarms and cleared alarms that have not been acknowledged, by key
+	subscribers map[chan AlarmUpdate]bool
+	mu          sync.Mutex
+}
+
+var alarmManager = &AlarmManager{alarms: make(map[string]*Alarm), subscribers: make(map[chan AlarmUpdate]bool)}
+
+func init() {
+	databaseTables = append(databaseTables, ALARMSTABLE)
+	defaultNotificationTemplates[EventAlarmRaised] = &NotificationTemplate{
+		Subject: "{{.Details.Severity}} alarm on {{.Host}} - {{.Details.Message}}",
+		Body: `Alarm raised at {{.Details.Raised.Format "2006-01-02 15:04:05"}}
+Source = {{.Details.Source}} {{.Details.Device}}
+Code = {{.Details.Code}}
+Severity = {{.Details.Severity}}
+{{.Details.Message}}`,
+	}
+	defaultNotificationTemplates[EventAlarmCleared] = &NotificationTemplate{
+		Subject: "Alarm cleared on {{.Host}} - {{.Details.Message}}",
+		Body: `Alarm cleared at {{.Time.Format "2006-01-02 15:04:05"}}
+Source = {{.Details.Source}} {{.Details.Device}}
+Code = {{.Details.Code}}
+{{.Details.Message}}`,
+	}
+}
+
+/*
+publish sends the change to every websocket subscriber. Slow subscribers miss updates rather than holding up the
+alarm checks. The caller must hold the lock
+*/
+func (am *AlarmManager) publish(action string, alarm *Alarm) {
+	ac := *alarm
+	for ch := range am.subscribers {
+		select {
+		case ch <- AlarmUpdate{Action: action, Alarm: &ac}:
+		default:
+		}
+	}
+}
+
+/*
+subscribe returns a channel for alarm updates along with the current alarms
+*/
+func (am *AlarmManager) subscribe() (chan AlarmUpdate, []Alarm) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	ch := make(chan AlarmUpdate, ALARMSUBSCRIBERBUFFER)
+	am.subscribers[ch] = true
+	return ch, am.currentLocked()
+}
+
+func (am *AlarmManager) unsubscribe(ch chan AlarmUpdate) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	delete(am.subscribers, ch)
+}
+
+/*
+Raise puts a condition into alarm. Nothing happens if it is already active. A cleared alarm still waiting to be
+acknowledged is closed off and replaced by the new one.
+*/
+func (am *AlarmManager) Raise(spec AlarmSpec) {
+	am.mu.Lock()
+	existing, found := am.alarms[spec.Key]
+	if found && existing.Active {
+		am.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	alarm := &Alarm{Key: spec.Key, Source: spec.Source, Device: spec.Device, Code: spec.Code, Message: spec.Message,
+		Severity: spec.Severity, Active: true, Raised: now}
+	if found {
+		// A shelve carries over if the condition comes back while it is still shelved
+		if existing.shelved(now) {
+			alarm.ShelvedUntil, alarm.ShelvedBy, alarm.ShelveReason = existing.ShelvedUntil, existing.ShelvedBy, existing.ShelveReason
+		}
+		// The cleared alarm is replaced by the new one so close it off, otherwise its row is never acknowledged
+		am.acknowledgeLocked(existing, ALARMSUPERSEDED, now)
+	}
+	alarm.ID = alarm.insert()
+	am.alarms[spec.Key] = alarm
+	am.publish("raised", alarm)
+	ac := *alarm
+	am.mu.Unlock()
+
+	log.Printf("Alarm raised - %s %s %s - %s", ac.Severity, ac.Source, ac.Device, ac.Message)
+	if !ac.shelved(now) {
+		notify(EventAlarmRaised, ac.Key, &ac)
+	}
+}
+
+/*
+Clear takes a condition out of alarm. The alarm stays on the list until it has been acknowledged.
+*/
+func (am *AlarmManager) Clear(key string) {
+	am.mu.Lock()
+	alarm, found := am.alarms[key]
+	if !found || !alarm.Active {
+		am.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	alarm.Active = false
+	alarm.Cleared = &now
+	alarm.update()
+	am.publish("cleared", alarm)
+	if alarm.Acknowledged != nil {
+		delete(am.alarms, key)
+	}
+	ac := *alarm
+	am.mu.Unlock()
+
+	log.Printf("Alarm cleared - %s %s - %s", ac.Source, ac.Device, ac.Message)
+	if !ac.shelved(now) {
+		notify(EventAlarmCleared, ac.Key, &ac)
+	}
+}
+
+/*
+Sync raises every condition in active and clears any other active alarm whose key starts with prefix.
+Used by sources that report the whole set of current faults for a device each time they are read.
+*/
+func (am *AlarmManager) Sync(prefix string, active []AlarmSpec) {
+	keys := make(map[string]bool)
+	for _, spec := range active {
+		keys[spec.Key] = true
+		am.Raise(spec)
+	}
+	var clear []string
+	am.mu.Lock()
+	for key, alarm := range am.alarms {
+		if alarm.Active && !keys[key] && len(key) >= len(prefix) && key[:len(prefix)] == prefix {
+			clear = append(clear, key)
+		}
+	}
+	am.mu.Unlock()
+	for _, key := range clear {
+		am.Clear(key)
+	}
+}
+
+/*
+isActive says whether the condition is currently in alarm
+*/
+func (am *AlarmManager) isActive(key string) bool {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	alarm, found := am.alarms[key]
+	return found && alarm.Active
+}
+
+/*
+findLocked returns the alarm on the list with the given ID. The caller must hold the lock
+*/
+func (am *AlarmManager) findLocked(id int64) *Alarm {
+	for _, alarm := range am.alarms {
+		if alarm.ID == id {
+			return alarm
+		}
+	}
+	return nil
+}
+
+/*
+alarm returns a copy of the alarm on the alarm list or nil if it is not there
+*/
+func (am *AlarmManager) alarm(id int64) *Alarm {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	if alarm := am.findLocked(id); alarm != nil {
+		a := *alarm
+		return &a
+	}
+	return nil
+}
+
+/*
+Acknowledge records that an operator has seen the alarm. Once it has also cleared it drops off the list.
+*/
+func (am *AlarmManager) Acknowledge(id int64, name string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	alarm := am.findLocked(id)
+	if alarm == nil {
+		return fmt.Errorf("alarm %d is not on the alarm list", id)
+	}
+	if alarm.Acknowledged != nil {
+		return nil
+	}
+	am.acknowledgeLocked(alarm, name, time.Now())
+	return nil
+}
+
+/*
+AcknowledgeAll acknowledges every unacknowledged alarm and returns how many there were
+*/
+func (am *AlarmManager) AcknowledgeAll(name string) int {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	now := time.Now()
+	count := 0
+	for _, alarm := range am.alarms {
+		if alarm.Acknowledged == nil {
+			am.acknowledgeLocked(alarm, name, now)
+			count++
+		}
+	}
+	return count
+}
+
+func (am *AlarmManager) acknowledgeLocked(alarm *Alarm, name string, now time.Time) {
+	alarm.Acknowledged = &now
+	alarm.AcknowledgedBy = name
+	alarm.update()
+	am.publish("acknowledged", alarm)
+	if !alarm.Active {
+		delete(am.alarms, alarm.Key)
+	}
+	log.Printf("Alarm acknowledged by %s - %s %s - %s", name, alarm.Source, alarm.Device, alarm.Message)
+}
+
+/*
+Shelve stops an alarm notifying until the given time
+*/
+func (am *AlarmManager) Shelve(id int64, name string, reason string, duration time.Duration) error {
+	if duration <= 0 || duration > ALARMMAXSHELVE {
+		return fmt.Errorf("alarms can be shelved for up to %s", ALARMMAXSHELVE)
+	}
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	alarm := am.findLocked(id)
+	if alarm == nil {
+		return fmt.Errorf("alarm %d is not on the alarm list", id)
+	}
+	until := time.Now().Add(duration)
+	alarm.ShelvedUntil = &until
+	alarm.ShelvedBy = name
+	alarm.ShelveReason = reason
+	alarm.update()
+	am.publish("shelved", alarm)
+	log.Printf("Alarm shelved by %s until %s - %s %s - %s", name, until.Format("2006-01-02 15:04"), alarm.Source, alarm.Device, alarm.Message)
+	return nil
+}
+
+/*
+Unshelve puts a shelved alarm back into service
+*/
+func (am *AlarmManager) Unshelve(id int64, name string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	alarm := am.findLocked(id)
+	if alarm == nil {
+		return fmt.Errorf("alarm %d is not on the alarm list", id)
+	}
+	if alarm.ShelvedUntil == nil {
+		return fmt.Errorf("alarm %d is not shelved", id)
+	}
+	alarm.ShelvedUntil = nil
+	alarm.ShelvedBy = ""
+	alarm.ShelveReason = ""
+	alarm.update()
+	am.publish("unshelved", alarm)
+	log.Printf("Alarm unshelved by %s - %s %s - %s", name, alarm.Source, alarm.Device, alarm.Message)
+	return nil
+}
+
+/*
+expireShelves tells the subscribers about shelves that have run out
+*/
+func (am *AlarmManager) expireShelves() {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	now := time.Now()
+	for _, alarm := range am.alarms {
+		if alarm.ShelvedUntil != nil && !now.Before(*alarm.ShelvedUntil) {
+			alarm.ShelvedUntil = nil
+			alarm.ShelvedBy = ""
+			alarm.ShelveReason = ""
+			alarm.update()
+			am.publish("unshelved", alarm)
+		}
+	}
+}
+
+/*
+currentLocked returns copies of the alarms on the list, most severe then newest first. The caller must hold the lock
+*/
+func (am *AlarmManager) currentLocked() []Alarm {
+	alarms := make([]Alarm, 0, len(am.alarms))
+	for _, alarm := range am.alarms {
+		alarms = append(alarms, *alarm)
+	}
+	sort.Slice(alarms, func(i, j int) bool {
+		if alarms[i].Severity.rank() != alarms[j].Severity.rank() {
+			return alarms[i].Severity.rank() < alarms[j].Severity.rank()
+		}
+		return alarms[i].Raised.After(alarms[j].Raised)
+	})
+	return alarms
+}
+
+func (am *AlarmManager) current() []Alarm {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	return am.currentLocked()
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
+
+/*
+insert writes a new alarm to the history and returns its ID. Without a database the IDs are only unique for this run.
+*/
+func (a *Alarm) insert() int64 {
+	if pDB == nil {
+		return time.Now().UnixNano()
+	}
+	result, err := pDB.Exec(`INSERT INTO Alarms (AlarmKey, Source, Device, Code, Message, Severity, Raised, ShelvedUntil, ShelvedBy, ShelveReason)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, a.Key, a.Source, a.Device, a.Code, a.Message, string(a.Severity), a.Raised,
+		nullTime(a.ShelvedUntil), a.ShelvedBy, a.ShelveReason)
+	if err != nil {
+		log.Println("Error recording alarm - ", err)
+		return time.Now().UnixNano()
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Println("Error recording alarm - ", err)
+		return time.Now().UnixNano()
+	}
+	return id
+}
+
+/*
+update writes the clear, acknowledge and shelve details of an alarm to the history
+*/
+func (a *Alarm) update() {
+	if pDB == nil {
+		return
+	}
+	if _, err := pDB.Exec(`UPDATE Alarms SET Cleared = ?, Acknowledged = ?, AcknowledgedBy = ?, ShelvedUntil = ?, ShelvedBy = ?, ShelveReason = ? WHERE id = ?`,
+		nullTime(a.Cleared), nullTime(a.Acknowledged), a.AcknowledgedBy, nullTime(a.ShelvedUntil), a.ShelvedBy, a.ShelveReason, a.ID); err != nil {
+		log.Println("Error updating alarm - ", err)
+	}
+}
+
+const alarmColumns = `id, AlarmKey, Source, IFNULL(Device, ''), IFNULL(Code, ''), Message, Severity, UNIX_TIMESTAMP(Raised),
+	UNIX_TIMESTAMP(Cleared), UNIX_TIMESTAMP(Acknowledged), IFNULL(AcknowledgedBy, ''), UNIX_TIMESTAMP(ShelvedUntil),
+	IFNULL(ShelvedBy, ''), IFNULL(ShelveReason, '')`
+
+/*
+scanAlarm reads an alarm from a row selected with alarmColumns
+*/
+func scanAlarm(rows *sql.Rows) (*Alarm, error) {
+	var (
+		alarm                         Alarm
+		severity                      string
+		raised                        int64
+		cleared, acknowledged, shelve sql.NullInt64
+	)
+	if err := rows.Scan(&alarm.ID, &alarm.Key, &alarm.Source, &alarm.Device, &alarm.Code, &alarm.Message, &severity, &raised,
+		&cleared, &acknowledged, &alarm.AcknowledgedBy, &shelve, &alarm.ShelvedBy, &alarm.ShelveReason); err != nil {
+		return nil, err
+	}
+	alarm.Severity = AlarmSeverity(severity)
+	alarm.Raised = time.Unix(raised, 0)
+	toTime := func(n sql.NullInt64) *time.Time {
+		if !n.Valid {
+			return nil
+		}
+		t := time.Unix(n.Int64, 0)
+		return &t
+	}
+	alarm.Cleared = toTime(cleared)
+	alarm.Acknowledged = toTime(acknowledged)
+	alarm.ShelvedUntil = toTime(shelve)
+	alarm.Active = alarm.Cleared == nil
+	return &alarm, nil
+}
+
+/*
+loadAlarms puts the alarms that were on the list when the service stopped back on it. Conditions that cleared while
+we were stopped are cleared by the first check.
+*/
+func (am *AlarmManager) loadAlarms() {
+	if pDB == nil {
+		return
+	}
+	rows, err := pDB.Query(`SELECT ` + alarmColumns + ` FROM Alarms WHERE Cleared IS NULL OR Acknowledged IS NULL ORDER BY id`)
+	if err != nil {
+		log.Println("Error loading alarms - ", err)
+		return
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Println("Error closing query - ", err)
+		}
+	}()
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	for rows.Next() {
+		alarm, err := scanAlarm(rows)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		// Rows are read oldest first so an earlier row for the same condition has been replaced and is closed off
+		if earlier, found := am.alarms[alarm.Key]; found {
+			earlier.Acknowledged = &alarm.Raised
+			earlier.AcknowledgedBy = ALARMSUPERSEDED
+			earlier.update()
+		}
+		am.alarms[alarm.Key] = alarm
+	}
+}
+
+/*
+fuelCellSeverity maps the FCM804 fault level to an alarm severity
+*/
+func fuelCellSeverity(level FaultLevel) AlarmSeverity {
+	switch level {
+	case Critical:
+		return SeverityCritical
+	case Shutdown:
+		return SeverityHigh
+	case Controlled:
+		return SeverityMedium
+	}
+	return SeverityLow
+}
+
+/*
+fuelCellAlarms returns an alarm for every fault bit set on the fuel cell
+*/
+func fuelCellAlarms(device uint8, fc *FCM804) []AlarmSpec {
+	var alarms []AlarmSpec
+	level, _ := fc.GetFaultLevel()
+	severity := fuelCellSeverity(level)
+	faults := []struct {
+		flag  rune
+		value uint32
+		key   func(int) string
+	}{
+		{'A', fc.getFaultA(), getErrorAKey},
+		{'B', fc.getFaultB(), getErrorBKey},
+		{'C', fc.getFaultC(), getErrorCKey},
+		{'D', fc.getFaultD(), getErrorDKey},
+	}
+	for _, f := range faults {
+		if f.value == 0 || f.value == 0xffffffff {
+			continue
+		}
+		mask := uint32(0x80000000)
+		for i := 0; i < 32; i++ {
+			if (f.value & mask) != 0 {
+				code := fmt.Sprintf("%c%d", f.flag, i)
+				alarms = append(alarms, AlarmSpec{Key: fmt.Sprintf("fc%d.%s", device, code), Source: AlarmSourceFuelCell,
+					Device: strconv.Itoa(int(device)), Code: code, Message: fmt.Sprintf("Fuel cell %d - %s", device, f.key(i)), Severity: severity})
+			}
+			mask >>= 1
+		}
+	}
+	return alarms
+}
+
+/*
+electrolyserEventCodes returns the current warning and error event codes
+*/
+func (e *Electrolyser) electrolyserEventCodes() (warnings []uint16, errors []uint16) {
+	e.status.mu.Lock()
+	defer e.status.mu.Unlock()
+	for i := uint16(0); i < e.status.Warnings.count && int(i) < len(e.status.Warnings.codes); i++ {
+		warnings = append(warnings, e.status.Warnings.codes[i])
+	}
+	for i := uint16(0); i < e.status.Errors.count && int(i) < len(e.status.Errors.codes); i++ {
+		errors = append(errors, e.status.Errors.codes[i])
+	}
+	return
+}
+
+func electrolyserAlarms(device int, e *Electrolyser) []AlarmSpec {
+	var alarms []AlarmSpec
+	warnings, errors := e.electrolyserEventCodes()
+	for _, code := range errors {
+		alarms = append(alarms, AlarmSpec{Key: fmt.Sprintf("el%d.error.%d", device, code), Source: AlarmSourceElectrolyser,
+			Device: strconv.Itoa(device), Code: strconv.Itoa(int(code)), Severity: SeverityHigh,
+			Message: fmt.Sprintf("Electrolyser %d error - %s", device, decodeMessage(code))})
+	}
+	for _, code := range warnings {
+		alarms = append(alarms, AlarmSpec{Key: fmt.Sprintf("el%d.warning.%d", device, code), Source: AlarmSourceElectrolyser,
+			Device: strconv.Itoa(device), Code: strconv.Itoa(int(code)), Severity: SeverityLow,
+			Message: fmt.Sprintf("Electrolyser %d warning - %s", device, decodeMessage(code))})
+	}
+	return alarms
+}
+
+func dryerAlarms(dr DryerStatus) []AlarmSpec {
+	var alarms []AlarmSpec
+	codes := []struct {
+		eventType string
+		code      uint16
+		severity  AlarmSeverity
+	}{
+		{DryerEventError, dr.ErrorCode, SeverityHigh},
+		{DryerEventWarning, dr.WarningCode, SeverityLow},
+	}
+	for _, c := range codes {
+		for b := uint16(1); b != 0; b <<= 1 {
+			if (c.code & b) == 0 {
+				continue
+			}
+			message := fmt.Sprintf("Unknown dryer code %04x", b)
+			if decoded := decodeDryerMessage(b); len(decoded) > 0 {
+				message = decoded[0]
+			}
+			alarms = append(alarms, AlarmSpec{Key: fmt.Sprintf("dr%d.%s.%04x", dr.Device, c.eventType, b), Source: AlarmSourceDryer,
+				Device: strconv.Itoa(dr.Device), Code: fmt.Sprintf("%04x", b), Severity: c.severity,
+				Message: fmt.Sprintf("Dryer %d %s - %s", dr.Device, c.eventType, message)})
+		}
+	}
+	return alarms
+}
+
+/*
+checkAlarms raises and clears the device alarms. Devices we have no current data from are left as they are.
+Called once per logging cycle.
+*/
+func checkAlarms() {
+	for device, fc := range canBus.fuelCell {
+		if time.Since(fc.getLastUpdate()) > FUELCELLDATATIMEOUT || commsWatchdog.isStale(fcDataSource(device)) {
+			continue
+		}
+		alarmManager.Sync(fmt.Sprintf("fc%d.", device), fuelCellAlarms(device, fc))
+	}
+
+	type elAlarms struct {
+		prefix string
+		alarms []AlarmSpec
+	}
+	var found []elAlarms
+	SystemStatus.m.Lock()
+	for device, el := range SystemStatus.Electrolysers {
+		if !el.status.SwitchedOn || !el.clientConnected || commsWatchdog.isStale(elDataSource(device)) {
+			continue
+		}
+		found = append(found, elAlarms{fmt.Sprintf("el%d.", device), electrolyserAlarms(device, el)})
+	}
+	for _, device := range dryerDevices() {
+		dr := getDryerStatus(device)
+		if !dr.On || !dr.Connected || dr.Stale {
+			continue
+		}
+		found = append(found, elAlarms{fmt.Sprintf("dr%d.", device), dryerAlarms(dr)})
+	}
+	SystemStatus.m.Unlock()
+	for _, f := range found {
+		alarmManager.Sync(f.prefix, f.alarms)
+	}
+
+	alarmManager.expireShelves()
+}
+
+/*
+getAlarmList returns the active alarms and the cleared alarms that have not been acknowledged
+URL = /api/alarms
+*/
+func getAlarmList(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(alarmManager.current()); err != nil {
+		ReturnJSONError(w, "Alarms", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+getAlarmHistory returns the alarms raised in the last {days} days, newest first, optionally filtered
+URL = /api/alarms/history?days=7&source=fuelCell&device=0&severity=high
+*/
+func getAlarmHistory(w http.ResponseWriter, r *http.Request) {
+	if pDB == nil {
+		ReturnJSONErrorString(w, "Alarms", "Database not connected", http.StatusServiceUnavailable, true)
+		return
+	}
+	days := ALARMHISTORYDAYS
+	query := r.URL.Query()
+	if s := query.Get("days"); s != "" {
+		var err error
+		if days, err = strconv.Atoi(s); err != nil || days < 1 {
+			ReturnJSONErrorString(w, "Alarms", "Invalid number of days - "+s, http.StatusBadRequest, true)
+			return
+		}
+	}
+	sqlStr := `SELECT ` + alarmColumns + ` FROM Alarms WHERE Raised > DATE_ADD(NOW(), INTERVAL ? DAY)`
+	args := []interface{}{0 - days}
+	for _, filter := range []struct{ param, column string }{{"source", "Source"}, {"device", "Device"}, {"severity", "Severity"}} {
+		if value := query.Get(filter.param); value != "" {
+			sqlStr += " AND " + filter.column + " = ?"
+			args = append(args, value)
+		}
+	}
+	sqlStr += " ORDER BY Raised DESC"
+
+	rows, err := pDB.Query(sqlStr, args...)
+	if err != nil {
+		ReturnJSONError(w, "Alarms", err, http.StatusInternalServerError, true)
+		return
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Println("Error closing query - ", err)
+		}
+	}()
+	alarms := []*Alarm{}
+	for rows.Next() {
+		alarm, err := scanAlarm(rows)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		alarms = append(alarms, alarm)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(alarms); err != nil {
+		ReturnJSONError(w, "Alarms", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+readAlarmAction reads the alarm ID from the URL and the operator details from the body. When authentication is on
+the operator is the signed in user.
+*/
+func readAlarmAction(r *http.Request) (id int64, name string, reason string, minutes int, err error) {
+	var jBody struct {
+		Name    string `json:"name"`
+		Reason  string `json:"reason"`
+		Minutes int    `json:"minutes"`
+	}
+	if idStr, found := mux.Vars(r)["id"]; found {
+		if id, err = strconv.ParseInt(idStr, 10, 64); err != nil {
+			return
+		}
+	}
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &jBody)
+	}
+	if err != nil {
+		return
+	}
+	if name = operatorName(r, jBody.Name); name == "" {
+		err = fmt.Errorf("the operator name is required")
+		return
+	}
+	return id, name, jBody.Reason, jBody.Minutes, nil
+}
+
+/*
+acknowledgeAlarm acknowledges one alarm
+URL = /api/alarms/{id}/acknowledge
+payload = {"name":"Ian"}
+*/
+func acknowledgeAlarm(w http.ResponseWriter, r *http.Request) {
+	id, name, _, _, err := readAlarmAction(r)
+	if err != nil {
+		ReturnJSONError(w, "Alarms", err, http.StatusBadRequest, true)
+		return
+	}
+	if err := alarmManager.Acknowledge(id, name); err != nil {
+		ReturnJSONError(w, "Alarms", err, http.StatusNotFound, true)
+		return
+	}
+	returnJSONSuccess(w)
+}
+
+/*
+acknowledgeAllAlarms acknowledges every alarm on the list
+URL = /api/alarms/acknowledge
+payload = {"name":"Ian"}
+*/
+func acknowledgeAllAlarms(w http.ResponseWriter, r *http.Request) {
+	_, name, _, _, err := readAlarmAction(r)
+	if err != nil {
+		ReturnJSONError(w, "Alarms", err, http.StatusBadRequest, true)
+		return
+	}
+	alarmManager.AcknowledgeAll(name)
+	returnJSONSuccess(w)
+}
+
+/*
+shelveAlarm stops an alarm notifying for a while
+URL = /api/alarms/{id}/shelve
+payload = {"name":"Ian","reason":"Replacing the sensor","minutes":60}
+*/
+func shelveAlarm(w http.ResponseWriter, r *http.Request) {
+	id, name, reason, minutes, err := readAlarmAction(r)
+	if err == nil && reason == "" {
+		err = fmt.Errorf("a reason is required to shelve an alarm")
+	}
+	if err != nil {
+		ReturnJSONError(w, "Alarms", err, http.StatusBadRequest, true)
+		return
+	}
+	if err := alarmManager.Shelve(id, name, reason, time.Duration(minutes)*time.Minute); err != nil {
+		ReturnJSONError(w, "Alarms", err, http.StatusBadRequest, true)
+		return
+	}
+	returnJSONSuccess(w)
+}
+
+/*
+unshelveAlarm puts a shelved alarm back into service
+URL = /api/alarms/{id}/unshelve
+payload = {"name":"Ian"}
+*/
+func unshelveAlarm(w http.ResponseWriter, r *http.Request) {
+	id, name, _, _, err := readAlarmAction(r)
+	if err != nil {
+		ReturnJSONError(w, "Alarms", err, http.StatusBadRequest, true)
+		return
+	}
+	if err := alarmManager.Unshelve(id, name); err != nil {
+		ReturnJSONError(w, "Alarms", err, http.StatusBadRequest, true)
+		return
+	}
+	returnJSONSuccess(w)
+}
+
+/*
+startAlarmsWebSocket sends the current alarm list then every change as it happens
+URL = /wsAlarms
+*/
+func startAlarmsWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	defer serviceMetrics.websocketClient("alarms")()
+	updates, alarms := alarmManager.subscribe()
+	defer alarmManager.unsubscribe(updates)
+	if err := conn.WriteJSON(AlarmUpdate{Action: "snapshot", Alarms: alarms}); err != nil {
+		return
+	}
+	// Notice when the client goes away even if no alarms change
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-closed:
+			return
+		case update := <-updates:
+			if err := conn.WriteJSON(update); err != nil {
+				return
+			}
+		}
+	}
+}
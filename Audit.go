@@ -0,0 +1,676 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/***************
+Audit trail of every action that changes the plant or its configuration. Two kinds of entry are recorded:
+
+	command    every command run by the dispatcher, whoever asked for it - the web pages, the API, MQTT, Modbus, the
+	           automatic controllers, fault restarts, the auto shut down and the emergency stop. The pre-state is the
+	           device's relay and run state just before the command was sent.
+	request    every web request that changes something - settings, lockouts, rules, users, alarms, the emergency
+	           stop etc. The pre-state is read by the route's provider in auditPreStates, if it has one.
+
+Each entry has the actor (the user, token owner or controller), the client address, the parameters with any passwords
+masked, the result and how long it took. Entries are written to the AuditLog table in the background so recording
+one never holds up a command. /api/audit returns them filtered, as JSON or CSV.
+*/
+
+const AUDITTABLE = `CREATE TABLE IF NOT EXISTS AuditLog (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	Logged DATETIME(3) NOT NULL,
+	Kind VARCHAR(16) NOT NULL,
+	Actor VARCHAR(64) NOT NULL,
+	IP VARCHAR(64) NULL,
+	Source VARCHAR(128) NULL,
+	Action VARCHAR(128) NOT NULL,
+	Device VARCHAR(32) NULL,
+	Params TEXT NULL,
+	PreState TEXT NULL,
+	Result VARCHAR(16) NOT NULL,
+	Error VARCHAR(255) NULL,
+	DurationMs INT NOT NULL,
+	INDEX (Logged),
+	INDEX (Actor),
+	INDEX (Device))`
+
+const (
+	AUDITBUFFER      = 256   // Entries waiting to be written before new ones are only logged
+	AUDITHISTORYDAYS = 7     // Default number of days returned
+	AUDITMAXROWS     = 10000 // Most entries returned by one query
+	AUDITMAXBODY     = 16384 // Largest request body recorded in the parameters
+	AUDITMASK        = "********"
+)
+
+const (
+	AuditCommand = "command"
+	AuditRequest = "request"
+)
+
+const (
+	AuditOK      = "ok"
+	AuditRefused = "refused"
+	AuditFailed  = "failed"
+)
+
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	Time       time.Time       `json:"time"`
+	Kind       string          `json:"kind"`
+	Actor      string          `json:"actor"`
+	IP         string          `json:"ip,omitempty"`
+	Source     string          `json:"source"`
+	Action     string          `json:"action"`
+	Device     string          `json:"device,omitempty"`
+	Params     json.RawMessage `json:"params,omitempty"`
+	PreState   json.RawMessage `json:"preState,omitempty"`
+	Result     string          `json:"result"`
+	Error      string          `json:"error,omitempty"`
+	DurationMs int64           `json:"durationMs"`
+}
+
+type AuditTrail struct {
+	entries chan *AuditEntry
+}
+
+var auditTrail = &AuditTrail{entries: make(chan *AuditEntry, AUDITBUFFER)}
+
+func init() {
+	databaseTables = append(databaseTables, AUDITTABLE)
+}
+
+/*
+Record queues an entry to be written. It never blocks; if the writer has fallen behind the entry is only logged.
+*/
+func (a *AuditTrail) Record(entry *AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	select {
+	case a.entries <- entry:
+	default:
+		log.Printf("Audit buffer full - %s", entry)
+	}
+}
+
+func (e *AuditEntry) String() string {
+	s := fmt.Sprintf("%s %s by %s", e.Action, e.Result, e.Actor)
+	if e.Device != "" {
+		s += " on " + e.Device
+	}
+	if len(e.Params) > 0 {
+		s += " " + string(e.Params)
+	}
+	if e.Error != "" {
+		s += " - " + e.Error
+	}
+	return s
+}
+
+/*
+Run writes the entries to the database until the service stops
+*/
+func (a *AuditTrail) Run() {
+	for {
+		select {
+		case <-serviceContext.Done():
+			// Write whatever is still waiting
+			for {
+				select {
+				case entry := <-a.entries:
+					a.save(entry)
+				default:
+					return
+				}
+			}
+		case entry := <-a.entries:
+			a.save(entry)
+		}
+	}
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func (a *AuditTrail) save(e *AuditEntry) {
+	if pDB == nil {
+		log.Printf("Audit - %s", e)
+		return
+	}
+	errStr := e.Error
+	if len(errStr) > 255 {
+		errStr = errStr[:255]
+	}
+	if _, err := pDB.Exec(`INSERT INTO AuditLog (Logged, Kind, Actor, IP, Source, Action, Device, Params, PreState, Result, Error, DurationMs)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Time, e.Kind, e.Actor, nullString(e.IP), nullString(e.Source), e.Action, nullString(e.Device),
+		nullString(string(e.Params)), nullString(string(e.PreState)), e.Result, nullString(errStr), e.DurationMs); err != nil {
+		log.Printf("Error saving audit entry %s - %v", e, err)
+	}
+}
+
+/*
+auditJSON converts the parameters or state for the entry, masking anything that looks like a secret
+*/
+func auditJSON(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	bytesArray, err := json.Marshal(maskSecrets(v))
+	if err != nil {
+		return nil
+	}
+	return bytesArray
+}
+
+func isSecret(key string) bool {
+	key = strings.ToLower(key)
+	return strings.Contains(key, "password") || strings.Contains(key, "token") || strings.Contains(key, "secret")
+}
+
+func maskSecrets(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		masked := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			if isSecret(key) {
+				masked[key] = AUDITMASK
+			} else {
+				masked[key] = maskSecrets(item)
+			}
+		}
+		return masked
+	case []interface{}:
+		masked := make([]interface{}, len(value))
+		for idx, item := range value {
+			masked[idx] = maskSecrets(item)
+		}
+		return masked
+	}
+	return v
+}
+
+func hostOnly(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+/*
+auditActor splits a command source into who asked for it and where from
+*/
+func auditActor(source string) (actor string, ip string) {
+	switch {
+	case strings.HasPrefix(source, "API "):
+		rest := strings.TrimPrefix(source, "API ")
+		if at := strings.LastIndex(rest, "@"); at >= 0 {
+			return rest[:at], hostOnly(rest[at+1:])
+		}
+		return "anonymous", hostOnly(rest)
+	case strings.HasPrefix(source, "Modbus "):
+		return "modbus", hostOnly(strings.TrimPrefix(source, "Modbus "))
+	case strings.HasPrefix(source, "MQTT "):
+		return "mqtt", ""
+	}
+	return source, ""
+}
+
+/*
+commandPreState reads the state of the device a command is for. It only reads the values the polling loops keep
+up to date, taking the same locks they do, so it never waits on the device itself.
+*/
+func commandPreState(device string) map[string]interface{} {
+	SystemStatus.m.Lock()
+	relays := SystemStatus.Relays
+	electrolysers := SystemStatus.Electrolysers
+	SystemStatus.m.Unlock()
+
+	switch {
+	case device == RelayQueue:
+		return map[string]interface{}{"gas": relays.GasToFuelCell, "spare": relays.Spare}
+	case strings.HasPrefix(device, "el"):
+		n, err := strconv.Atoi(strings.TrimPrefix(device, "el"))
+		if err != nil {
+			return nil
+		}
+		state := map[string]interface{}{"powered": (n == 0 && relays.EL0) || (n == 1 && relays.EL1)}
+		if n >= 0 && n < len(electrolysers) {
+			el := electrolysers[n]
+			el.status.mu.Lock()
+			state["state"] = el.status.ElState
+			state["rate"] = el.status.CurrentProductionRate
+			el.status.mu.Unlock()
+		}
+		return state
+	case strings.HasPrefix(device, "fc"):
+		n, err := strconv.Atoi(strings.TrimPrefix(device, "fc"))
+		if err != nil {
+			return nil
+		}
+		state := map[string]interface{}{
+			"enabled": (n == 0 && relays.FC0Enable) || (n == 1 && relays.FC1Enable),
+			"running": (n == 0 && relays.FC0Run) || (n == 1 && relays.FC1Run),
+		}
+		if fc, found := canBus.fuelCell[uint8(n)]; found {
+			state["power"] = fc.liveValues().Power
+		}
+		return state
+	}
+	return nil
+}
+
+/*
+recordCommand audits a command the dispatcher has finished. c is a copy taken under the dispatcher lock.
+*/
+func (a *AuditTrail) recordCommand(c Command, preState map[string]interface{}) {
+	actor, ip := auditActor(c.Source)
+	params := c.Params
+	if c.Merged > 0 {
+		params = make(map[string]interface{}, len(c.Params)+1)
+		for key, value := range c.Params {
+			params[key] = value
+		}
+		params["merged"] = c.Merged
+	}
+	result := AuditOK
+	if c.Status == CommandFailed {
+		result = AuditFailed
+	}
+	entry := &AuditEntry{Time: c.Started, Kind: AuditCommand, Actor: actor, IP: ip, Source: c.Source,
+		Action: c.Name + " (" + c.Priority.String() + ")", Device: c.Device, Result: result, Error: c.Error,
+		DurationMs: c.Finished.Sub(c.Started).Milliseconds()}
+	if len(params) > 0 {
+		entry.Params = auditJSON(params)
+	}
+	if preState != nil {
+		entry.PreState = auditJSON(preState)
+	}
+	a.Record(entry)
+}
+
+/*
+auditPreStates read the state before a change for the routes that have one. Each reads the values directly under
+their own locks rather than through the route's GET handler so nothing but the value is touched.
+*/
+var auditPreStates = map[string]func() interface{}{
+	"/settings": func() interface{} {
+		// Only the simple values are on the settings page, the sections have their own routes
+		var all map[string]interface{}
+		settingsMu.Lock()
+		bytesArray, err := json.Marshal(params)
+		settingsMu.Unlock()
+		if err != nil || json.Unmarshal(bytesArray, &all) != nil {
+			return nil
+		}
+		for key, value := range all {
+			switch value.(type) {
+			case map[string]interface{}, []interface{}:
+				delete(all, key)
+			}
+		}
+		return all
+	},
+	"/notifications": func() interface{} {
+		settingsMu.Lock()
+		defer settingsMu.Unlock()
+		if params.Notifications == nil {
+			return nil
+		}
+		return params.Notifications.masked()
+	},
+	"/mqtt": func() interface{} {
+		settingsMu.Lock()
+		defer settingsMu.Unlock()
+		if params.MQTT == nil {
+			return nil
+		}
+		return params.MQTT.masked()
+	},
+	"/modbusServer": func() interface{} {
+		settingsMu.Lock()
+		defer settingsMu.Unlock()
+		if params.ModbusServer == nil {
+			return nil
+		}
+		return *params.ModbusServer
+	},
+	"/auth": func() interface{} {
+		return getAuthSettings()
+	},
+	"/webServer": func() interface{} {
+		return getWebServerSettings()
+	},
+	"/estop": func() interface{} {
+		return getEmergencyStopState()
+	},
+}
+
+/*
+auditResponseWriter keeps the status and the start of the body for the audit entry
+*/
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	limit  int
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if room := w.limit - w.body.Len(); room > 0 {
+		if len(b) < room {
+			room = len(b)
+		}
+		w.body.Write(b[:room])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+/*
+requestParams collects the path variables, query and body of a request. The body is put back for the handler.
+*/
+func requestParams(r *http.Request) map[string]interface{} {
+	params := make(map[string]interface{})
+	for key, value := range mux.Vars(r) {
+		params[key] = value
+	}
+	for key, values := range r.URL.Query() {
+		params[key] = strings.Join(values, ",")
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return params
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, AUDITMAXBODY+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	switch {
+	case err != nil || len(body) == 0:
+	case len(body) > AUDITMAXBODY:
+		params["body"] = fmt.Sprintf("%d+ bytes", AUDITMAXBODY)
+	case strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded"):
+		if form, err := url.ParseQuery(string(body)); err == nil {
+			for key, values := range form {
+				params[key] = strings.Join(values, ",")
+			}
+		}
+	default:
+		var payload interface{}
+		if json.Unmarshal(body, &payload) == nil {
+			params["body"] = payload
+		} else {
+			params["body"] = string(body)
+		}
+	}
+	return params
+}
+
+/*
+preState reads the resource a request is about to change, or nil if the route has no pre-state provider
+*/
+func (a *AuditTrail) preState(template string) interface{} {
+	if provider, found := auditPreStates[template]; found {
+		return provider()
+	}
+	return nil
+}
+
+/*
+Middleware records every request that changes something. It runs after the authentication middleware so it knows
+who made the request.
+*/
+func (a *AuditTrail) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		template := routeTemplate(r)
+		_, mutating := mutatingGETRoutes[template]
+		if (r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions) && !mutating {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if template == "/login" || template == "/logout" {
+			// Logins are logged but their parameters are the password
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		entry := &AuditEntry{Kind: AuditRequest, Actor: "anonymous", IP: hostOnly(r.RemoteAddr), Source: requestSource(r),
+			Action: r.Method + " " + template, Device: mux.Vars(r)["device"]}
+		if user := requestUser(r); user != nil {
+			entry.Actor = user.Name
+			if user.Token != "" {
+				entry.Actor += " (token " + user.Token + ")"
+			}
+		}
+		params := requestParams(r)
+		if len(params) > 0 {
+			entry.Params = auditJSON(params)
+		}
+		entry.PreState = auditJSON(a.preState(template))
+
+		writer := &auditResponseWriter{ResponseWriter: w, limit: 512}
+		entry.Time = time.Now()
+		next.ServeHTTP(writer, r)
+		entry.DurationMs = time.Since(entry.Time).Milliseconds()
+
+		switch {
+		case writer.status >= http.StatusInternalServerError:
+			entry.Result = AuditFailed
+		case writer.status >= http.StatusBadRequest:
+			entry.Result = AuditRefused
+		default:
+			entry.Result = AuditOK
+		}
+		if entry.Result != AuditOK {
+			entry.Error = strconv.Itoa(writer.status) + " " + strings.TrimSpace(writer.body.String())
+		}
+		a.Record(entry)
+	})
+}
+
+/*
+AuditFilter selects entries from the trail
+*/
+type AuditFilter struct {
+	From   time.Time
+	To     time.Time
+	Actor  string
+	Device string
+	Action string // Entries whose action starts with this
+	Kind   string
+	Result string
+	Limit  int
+}
+
+func parseAuditTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+/*
+auditFilterFromQuery reads the filter from ?from=2024-03-01&to=2024-03-02T12:00:00Z&days=7&actor=ian&device=el0&action=run&kind=command&result=failed&limit=500
+*/
+func auditFilterFromQuery(query url.Values) (*AuditFilter, error) {
+	f := &AuditFilter{To: time.Now(), Limit: AUDITMAXROWS, Actor: query.Get("actor"), Device: query.Get("device"),
+		Action: query.Get("action"), Kind: query.Get("kind"), Result: query.Get("result")}
+	days := AUDITHISTORYDAYS
+	if s := query.Get("days"); s != "" {
+		var err error
+		if days, err = strconv.Atoi(s); err != nil || days < 1 {
+			return nil, fmt.Errorf("invalid number of days - %s", s)
+		}
+	}
+	if s := query.Get("to"); s != "" {
+		t, err := parseAuditTime(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid to time - %s", s)
+		}
+		f.To = t
+	}
+	f.From = f.To.AddDate(0, 0, -days)
+	if s := query.Get("from"); s != "" {
+		t, err := parseAuditTime(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from time - %s", s)
+		}
+		f.From = t
+	}
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > AUDITMAXROWS {
+			return nil, fmt.Errorf("the limit must be between 1 and %d", AUDITMAXROWS)
+		}
+		f.Limit = limit
+	}
+	return f, nil
+}
+
+/*
+queryAudit returns the entries matching the filter, newest first
+*/
+func queryAudit(f *AuditFilter) ([]*AuditEntry, error) {
+	if pDB == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+	sqlStr := `SELECT id, Logged, Kind, Actor, IFNULL(IP, ''), IFNULL(Source, ''), Action, IFNULL(Device, ''), Params, PreState, Result, IFNULL(Error, ''), DurationMs
+		FROM AuditLog WHERE Logged >= ? AND Logged <= ?`
+	args := []interface{}{f.From, f.To}
+	for _, filter := range []struct{ value, column string }{{f.Actor, "Actor"}, {f.Device, "Device"}, {f.Kind, "Kind"}, {f.Result, "Result"}} {
+		if filter.value != "" {
+			sqlStr += " AND " + filter.column + " = ?"
+			args = append(args, filter.value)
+		}
+	}
+	if f.Action != "" {
+		sqlStr += " AND Action LIKE CONCAT(?, '%')"
+		args = append(args, f.Action)
+	}
+	sqlStr += " ORDER BY Logged DESC, id DESC LIMIT ?"
+	args = append(args, f.Limit)
+
+	rows, err := pDB.Query(sqlStr, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Println("Error closing query - ", err)
+		}
+	}()
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		var (
+			e        AuditEntry
+			params   sql.NullString
+			preState sql.NullString
+		)
+		if err := rows.Scan(&e.ID, &e.Time, &e.Kind, &e.Actor, &e.IP, &e.Source, &e.Action, &e.Device, &params, &preState, &e.Result, &e.Error, &e.DurationMs); err != nil {
+			log.Print(err)
+			continue
+		}
+		if params.Valid {
+			e.Params = json.RawMessage(params.String)
+		}
+		if preState.Valid {
+			e.PreState = json.RawMessage(preState.String)
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
+
+func writeAuditCSV(w io.Writer, entries []*AuditEntry) error {
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{"id", "time", "kind", "actor", "ip", "source", "action", "device", "params", "preState", "result", "error", "durationMs"}); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := out.Write([]string{strconv.FormatInt(e.ID, 10), e.Time.Format(time.RFC3339Nano), e.Kind, e.Actor, e.IP, e.Source,
+			e.Action, e.Device, string(e.Params), string(e.PreState), e.Result, e.Error, strconv.FormatInt(e.DurationMs, 10)}); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+/*
+getAuditTrail returns the audit trail, newest first. format=csv downloads it as a spreadsheet.
+URL = /api/audit?days=7&actor=ian&device=el0&action=run&kind=command&result=failed&format=csv
+*/
+func getAuditTrail(w http.ResponseWriter, r *http.Request) {
+	if pDB == nil {
+		ReturnJSONErrorString(w, "Audit", "Database not connected", http.StatusServiceUnavailable, true)
+		return
+	}
+	filter, err := auditFilterFromQuery(r.URL.Query())
+	if err != nil {
+		ReturnJSONError(w, "Audit", err, http.StatusBadRequest, false)
+		return
+	}
+	entries, err := queryAudit(filter)
+	if err != nil {
+		ReturnJSONError(w, "Audit", err, http.StatusInternalServerError, true)
+		return
+	}
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit-`+time.Now().Format("20060102-150405")+`.csv"`)
+		if err := writeAuditCSV(w, entries); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(entries); err != nil {
+		ReturnJSONError(w, "Audit", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func apiGetAuditTrail(r *http.Request) (interface{}, *CommandError) {
+	if pDB == nil {
+		return nil, commandRefused(http.StatusServiceUnavailable, "Database not connected")
+	}
+	filter, err := auditFilterFromQuery(r.URL.Query())
+	if err != nil {
+		return nil, commandRefused(http.StatusBadRequest, err.Error())
+	}
+	entries, err := queryAudit(filter)
+	if err != nil {
+		return nil, commandFailed(err)
+	}
+	return entries, nil
+}
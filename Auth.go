@@ -0,0 +1,633 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/***************
+Authentication and role based access control for the web server. Every route needs one of the roles below, each of
+which includes the ones before it:
+
+	viewer      read the status, history and settings pages
+	operator    start and stop the electrolysers, fuel cells, dryers and relays, set the rates, acknowledge alarms and
+	            trigger or reset the emergency stop
+	engineer    change the settings and calibration, notifications, MQTT, Modbus, rules and lockouts and record or dump
+	            the CAN bus
+	admin       manage the users and API tokens
+
+Reads need viewer and anything else needs operator unless the route is listed in routeRoles or mutatingGETRoutes. The web pages log in at
+/login and carry a session cookie, machine clients send an API token as "Authorization: Bearer <token>". The check is
+middleware on the router so it covers the websocket upgrades too, and those are also refused from another site's pages
+unless the origin is listed in the settings. Authentication is on for a new installation but stays off after an
+upgrade until it is turned on at /auth, so the existing clients keep working.
+*/
+
+const (
+	AUTHSESSIONCOOKIE   = "FireflySession"
+	AUTHSESSIONTIMEOUT  = time.Hour * 12
+	AUTHFAILUREDELAY    = time.Second // Slows down password guessing
+	AUTHMINPASSWORD     = 8
+	AUTHDEFAULTADMIN    = "admin"
+	AUTHBEARERPREFIX    = "Bearer "
+	AUTHSESSIONIDLENGTH = 32
+)
+
+/*
+Role is the level of access a user or token has
+*/
+type Role int
+
+const (
+	RolePublic Role = iota
+	RoleViewer
+	RoleOperator
+	RoleEngineer
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{
+	RolePublic:   "public",
+	RoleViewer:   "viewer",
+	RoleOperator: "operator",
+	RoleEngineer: "engineer",
+	RoleAdmin:    "admin",
+}
+
+func (r Role) String() string {
+	if name, found := roleNames[r]; found {
+		return name
+	}
+	return fmt.Sprintf("role %d", int(r))
+}
+
+func (r Role) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *Role) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	role, err := parseRole(name)
+	if err != nil {
+		return err
+	}
+	*r = role
+	return nil
+}
+
+func parseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if role != RolePublic && strings.EqualFold(name, roleName) {
+			return role, nil
+		}
+	}
+	return RolePublic, fmt.Errorf("unknown role %q - expected viewer, operator, engineer or admin", name)
+}
+
+/*
+routeRoles lists the routes that need something other than viewer to read and operator to change. The key is the
+method and the route template as registered on the router, * matches any method.
+*/
+var routeRoles = map[string]Role{
+	"* /login":   RolePublic,
+	"* /logout":  RolePublic,
+	"* /healthz": RolePublic,
+	"* /readyz":  RolePublic,
+
+	// Settings and calibration
+	"* /settings":                     RoleEngineer,
+	"* /notifications":                RoleEngineer,
+	"* /notifications/test":           RoleEngineer,
+	"* /mqtt":                         RoleEngineer,
+	"* /modbusServer":                 RoleEngineer,
+	"PUT /api/rules/{name}":           RoleEngineer,
+	"DELETE /api/rules/{name}":        RoleEngineer,
+	"PUT /lockout/{type}/{device}":    RoleEngineer,
+	"POST /lockout/{type}/{device}":   RoleEngineer,
+	"DELETE /lockout/{type}/{device}": RoleEngineer,
+	"PUT /fc/maintenance":             RoleEngineer,
+	"POST /el/search":                 RoleEngineer,
+	"GET /api/audit":                  RoleEngineer,
+
+	"* /auth":      RoleAdmin,
+	"* /webServer": RoleAdmin,
+}
+
+/*
+mutatingGETRoutes are the original routes that change something on a GET. They need the role given whatever the
+method and are audited like any other change.
+*/
+var mutatingGETRoutes = map[string]Role{
+	"/el/{device}/on":                    RoleOperator,
+	"/el/{device}/off":                   RoleOperator,
+	"/el/{device}/start":                 RoleOperator,
+	"/el/{device}/stop":                  RoleOperator,
+	"/el/{device}/reboot":                RoleOperator,
+	"/el/{device}/preheat":               RoleOperator,
+	"/el/{device}/setRate":               RoleOperator,
+	"/el/start":                          RoleOperator,
+	"/el/stop":                           RoleOperator,
+	"/el/preheat":                        RoleOperator,
+	"/el/{device}/restartPressure/{bar}": RoleEngineer,
+	"/canrecord/{to}":                    RoleEngineer,
+	"/candump/{from}/{to}":               RoleEngineer, // Writes a trace file
+	"/candumpEvent/{event}":              RoleEngineer, // Writes a trace file
+}
+
+var routeRolesMu sync.Mutex
+
+/*
+requireRole sets the role needed for a route
+*/
+func requireRole(method string, template string, role Role) {
+	routeRolesMu.Lock()
+	routeRoles[method+" "+template] = role
+	routeRolesMu.Unlock()
+}
+
+/*
+routeTemplate returns the template of the route the request matched, e.g. /el/{device}/start
+*/
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		template, _ := route.GetPathTemplate()
+		return template
+	}
+	return ""
+}
+
+/*
+requiredRole finds the role needed for the route the request matched
+*/
+func requiredRole(r *http.Request) Role {
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	template := routeTemplate(r)
+	if role, found := mutatingGETRoutes[template]; found {
+		return role
+	}
+	routeRolesMu.Lock()
+	defer routeRolesMu.Unlock()
+	if role, found := routeRoles[method+" "+template]; found {
+		return role
+	}
+	if role, found := routeRoles["* "+template]; found {
+		return role
+	}
+	if method == http.MethodGet || method == http.MethodOptions {
+		return RoleViewer
+	}
+	return RoleOperator
+}
+
+/*
+AuthSettings holds the authentication options
+*/
+type AuthSettings struct {
+	Enabled        bool          `json:"enabled"`
+	SessionTimeout time.Duration `json:"sessionTimeout"`
+	AllowedOrigins []string      `json:"allowedOrigins"` // Other sites whose pages may open the websockets, e.g. https://dashboard.example.com
+}
+
+func NewAuthSettings() *AuthSettings {
+	s := new(AuthSettings)
+	s.Enabled = true
+	s.SessionTimeout = AUTHSESSIONTIMEOUT
+	s.AllowedOrigins = []string{}
+	return s
+}
+
+func (s *AuthSettings) validate() error {
+	if s.SessionTimeout < time.Minute {
+		return fmt.Errorf("the session timeout must be at least a minute")
+	}
+	for _, origin := range s.AllowedOrigins {
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("allowed origin %q must look like https://host[:port]", origin)
+		}
+	}
+	return nil
+}
+
+func getAuthSettings() AuthSettings {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	return *params.Auth
+}
+
+/*
+AuthUser is who made a request
+*/
+type AuthUser struct {
+	Name  string `json:"name"`
+	Role  Role   `json:"role"`
+	Token string `json:"token,omitempty"` // Name of the API token used, empty when logged in with a password
+}
+
+type authContextKey struct{}
+
+/*
+requestUser returns who made the request, nil if the route didn't need anyone to be logged in
+*/
+func requestUser(r *http.Request) *AuthUser {
+	user, _ := r.Context().Value(authContextKey{}).(*AuthUser)
+	return user
+}
+
+/*
+operatorName returns who is acting on an alarm or a lockout. With authentication on it is always the signed in user
+so nobody can act in someone else's name, otherwise it is the name given in the request.
+*/
+func operatorName(r *http.Request, given string) string {
+	if user := requestUser(r); user != nil && getAuthSettings().Enabled {
+		return user.Name
+	}
+	return strings.TrimSpace(given)
+}
+
+/*
+requestSource describes who made the request for the command and job logs
+*/
+func requestSource(r *http.Request) string {
+	if user := requestUser(r); user != nil {
+		return "API " + user.Name + "@" + r.RemoteAddr
+	}
+	return "API " + r.RemoteAddr
+}
+
+type authSession struct {
+	user    string
+	expires time.Time
+}
+
+/*
+Authenticator checks every request against the sessions and the user store
+*/
+type Authenticator struct {
+	sessions map[string]*authSession
+	mu       sync.Mutex
+}
+
+var authenticator = &Authenticator{sessions: make(map[string]*authSession)}
+
+func randomHex(length int) string {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		// There is nothing safe we can do without random numbers
+		log.Panic("Cannot read random numbers - ", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+/*
+newSession logs the user in and returns the session ID for the cookie
+*/
+func (a *Authenticator) newSession(user string, timeout time.Duration) string {
+	id := randomHex(AUTHSESSIONIDLENGTH)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for key, session := range a.sessions {
+		if now.After(session.expires) {
+			delete(a.sessions, key)
+		}
+	}
+	a.sessions[id] = &authSession{user: user, expires: now.Add(timeout)}
+	return id
+}
+
+func (a *Authenticator) endSession(id string) {
+	a.mu.Lock()
+	delete(a.sessions, id)
+	a.mu.Unlock()
+}
+
+/*
+endUserSessions logs a user out everywhere, e.g. when their password is changed or they are removed
+*/
+func (a *Authenticator) endUserSessions(user string) {
+	a.mu.Lock()
+	for key, session := range a.sessions {
+		if session.user == user {
+			delete(a.sessions, key)
+		}
+	}
+	a.mu.Unlock()
+}
+
+/*
+requestCredentials returns the bearer token or the session ID the request was made with
+*/
+func requestCredentials(r *http.Request) (token string, session string) {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, AUTHBEARERPREFIX) {
+		return strings.TrimSpace(strings.TrimPrefix(header, AUTHBEARERPREFIX)), ""
+	}
+	if cookie, err := r.Cookie(AUTHSESSIONCOOKIE); err == nil {
+		return "", cookie.Value
+	}
+	return "", ""
+}
+
+/*
+sessionUser returns the user logged in with the session and extends the session
+*/
+func (a *Authenticator) sessionUser(id string, timeout time.Duration) *AuthUser {
+	a.mu.Lock()
+	session, found := a.sessions[id]
+	if found {
+		if time.Now().After(session.expires) {
+			delete(a.sessions, id)
+			found = false
+		} else {
+			session.expires = time.Now().Add(timeout)
+		}
+	}
+	a.mu.Unlock()
+	if !found {
+		return nil
+	}
+	// Look the user up every time so a changed role or a disabled account takes effect straight away
+	return userStore.user(session.user)
+}
+
+/*
+credentialsUser returns who the bearer token or the session belongs to, or nil if neither is valid any more
+*/
+func (a *Authenticator) credentialsUser(token string, session string, settings AuthSettings) *AuthUser {
+	switch {
+	case token != "":
+		return userStore.tokenUser(token)
+	case session != "":
+		return a.sessionUser(session, settings.SessionTimeout)
+	}
+	return nil
+}
+
+/*
+authenticate returns who is making the request from the bearer token or the session cookie
+*/
+func (a *Authenticator) authenticate(r *http.Request, settings AuthSettings) *AuthUser {
+	token, session := requestCredentials(r)
+	return a.credentialsUser(token, session, settings)
+}
+
+/*
+Middleware refuses requests from anyone without the role the route needs
+*/
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := requiredRole(r)
+		settings := getAuthSettings()
+		var user *AuthUser
+		switch {
+		case !settings.Enabled:
+			user = &AuthUser{Name: "anonymous", Role: RoleAdmin}
+		case role == RolePublic:
+			user = a.authenticate(r, settings)
+		default:
+			user = a.authenticate(r, settings)
+			if user == nil {
+				refuseUnauthenticated(w, r)
+				return
+			}
+			if user.Role < role {
+				refuseRequest(w, r, http.StatusForbidden, fmt.Sprintf("%s needs the %s role but %s only has %s", r.URL.Path, role, user.Name, user.Role))
+				return
+			}
+		}
+		if user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, user))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+refuseUnauthenticated sends a browser asking for a page to the login page and tells anything else to authenticate
+*/
+func refuseUnauthenticated(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") && r.Header.Get("Upgrade") == "" {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="FireflyWeb"`)
+	refuseRequest(w, r, http.StatusUnauthorized, "Log in or send an API token")
+}
+
+func refuseRequest(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if strings.HasPrefix(r.URL.Path, APIV1PREFIX+"/") {
+		writeAPIError(w, "Auth", commandRefused(status, message))
+		return
+	}
+	ReturnJSONErrorString(w, "Auth", message, status, false)
+}
+
+/*
+checkWebSocketOrigin only lets pages served from here, or from the allowed origins, open a websocket. Clients that are
+not browsers don't send an origin.
+*/
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	settings := getAuthSettings()
+	for _, allowed := range settings.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	log.Printf("Websocket from %s refused - origin %s is not allowed", r.RemoteAddr, origin)
+	return false
+}
+
+/*
+safeRedirect only follows redirects back to this site after logging in
+*/
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+const loginPage = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>Firefly - Log in</title>
+<style>body{font-family:sans-serif;display:flex;justify-content:center;margin-top:10%%}form{display:flex;flex-direction:column;gap:0.5em;min-width:16em}.error{color:#c00}</style>
+</head>
+<body>
+<form method="post" action="/login">
+<h2>Firefly</h2>
+%s
+<label>User <input name="name" autocomplete="username" required autofocus></label>
+<label>Password <input name="password" type="password" autocomplete="current-password" required></label>
+<input type="hidden" name="next" value="%s">
+<button type="submit">Log in</button>
+</form>
+</body>
+</html>`
+
+/*
+showLoginPage shows the login form
+URL = /login?next=/index.html
+*/
+func showLoginPage(w http.ResponseWriter, r *http.Request) {
+	message := ""
+	if r.URL.Query().Get("failed") != "" {
+		message = `<p class="error">Incorrect user name or password</p>`
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := fmt.Fprintf(w, loginPage, message, html.EscapeString(safeRedirect(r.URL.Query().Get("next")))); err != nil {
+		log.Println(err)
+	}
+}
+
+/*
+login checks the user name and password and starts a session. The web form is redirected, a JSON request gets the
+user back.
+URL = /login
+payload = {"name":"ian","password":"secret"} or the login form
+*/
+func login(w http.ResponseWriter, r *http.Request) {
+	var credentials struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		Next     string `json:"next"`
+	}
+	isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	if isJSON {
+		body, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &credentials)
+		}
+		if err != nil {
+			ReturnJSONError(w, "Auth", err, http.StatusBadRequest, false)
+			return
+		}
+	} else {
+		credentials.Name = r.PostFormValue("name")
+		credentials.Password = r.PostFormValue("password")
+		credentials.Next = r.PostFormValue("next")
+	}
+
+	user := userStore.checkPassword(credentials.Name, credentials.Password)
+	if user == nil {
+		log.Printf("Failed login for %q from %s", credentials.Name, r.RemoteAddr)
+		time.Sleep(AUTHFAILUREDELAY)
+		if isJSON {
+			ReturnJSONErrorString(w, "Auth", "Incorrect user name or password", http.StatusUnauthorized, false)
+		} else {
+			http.Redirect(w, r, "/login?failed=1&next="+url.QueryEscape(safeRedirect(credentials.Next)), http.StatusSeeOther)
+		}
+		return
+	}
+
+	settings := getAuthSettings()
+	http.SetCookie(w, &http.Cookie{
+		Name:     AUTHSESSIONCOOKIE,
+		Value:    authenticator.newSession(user.Name, settings.SessionTimeout),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	log.Printf("%s logged in from %s", user.Name, r.RemoteAddr)
+	if !isJSON {
+		http.Redirect(w, r, safeRedirect(credentials.Next), http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(user); err != nil {
+		ReturnJSONError(w, "Auth", err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+		log.Println(err)
+	}
+}
+
+/*
+logout ends the session
+URL = /logout
+*/
+func logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(AUTHSESSIONCOOKIE); err == nil {
+		authenticator.endSession(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: AUTHSESSIONCOOKIE, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	if r.Method == http.MethodGet {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	returnJSONSuccess(w)
+}
+
+/*
+getAuthSettingsHandler returns the authentication settings
+URL = /auth
+*/
+func getAuthSettingsHandler(w http.ResponseWriter, _ *http.Request) {
+	settings := getAuthSettings()
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(settings); err != nil {
+		ReturnJSONError(w, "Auth", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+setAuthSettings replaces the authentication settings
+URL = /auth
+payload = {"enabled":true,"sessionTimeout":43200000000000,"allowedOrigins":["https://dashboard.example.com"]}
+*/
+func setAuthSettings(w http.ResponseWriter, r *http.Request) {
+	settings := NewAuthSettings()
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, settings)
+	}
+	if err != nil {
+		ReturnJSONError(w, "Auth", err, http.StatusBadRequest, true)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		ReturnJSONError(w, "Auth", err, http.StatusBadRequest, true)
+		return
+	}
+
+	settingsMu.Lock()
+	params.Auth = settings
+	err = params.save()
+	settingsMu.Unlock()
+	if err != nil {
+		ReturnJSONError(w, "Auth", err, http.StatusInternalServerError, true)
+		return
+	}
+	if !settings.Enabled {
+		log.Printf("Authentication turned off by %s", requestSource(r))
+	}
+	returnJSONSuccess(w)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequiredRole(t *testing.T) {
+	var got Role
+	record := func(_ http.ResponseWriter, r *http.Request) {
+		got = requiredRole(r)
+	}
+	router := mux.NewRouter()
+	for _, template := range []string{"/status", "/settings", "/el/{device}/on", "/api/rules/{name}", "/api/audit",
+		"/lockout/{type}/{device}", "/login", "/auth"} {
+		router.HandleFunc(template, record)
+	}
+	requireRole(http.MethodPut, "/api/v1/test", RoleAdmin)
+	t.Cleanup(func() {
+		routeRolesMu.Lock()
+		delete(routeRoles, http.MethodPut+" /api/v1/test")
+		routeRolesMu.Unlock()
+	})
+	router.HandleFunc("/api/v1/test", record)
+
+	tests := []struct {
+		method string
+		path   string
+		want   Role
+	}{
+		{http.MethodGet, "/status", RoleViewer},
+		{http.MethodHead, "/status", RoleViewer},
+		{http.MethodOptions, "/status", RoleViewer},
+		{http.MethodPost, "/status", RoleOperator},
+		{http.MethodDelete, "/status", RoleOperator},
+		{http.MethodGet, "/settings", RoleEngineer},
+		{http.MethodPost, "/settings", RoleEngineer},
+		{http.MethodGet, "/el/0/on", RoleOperator},
+		{http.MethodHead, "/el/0/on", RoleOperator},
+		{http.MethodGet, "/api/rules/pressure", RoleViewer},
+		{http.MethodPut, "/api/rules/pressure", RoleEngineer},
+		{http.MethodDelete, "/api/rules/pressure", RoleEngineer},
+		{http.MethodGet, "/api/audit", RoleEngineer},
+		{http.MethodGet, "/lockout/el/0", RoleViewer},
+		{http.MethodPut, "/lockout/el/0", RoleEngineer},
+		{http.MethodPost, "/login", RolePublic},
+		{http.MethodGet, "/auth", RoleAdmin},
+		{http.MethodPut, "/api/v1/test", RoleAdmin},
+		{http.MethodGet, "/api/v1/test", RoleViewer},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			got = -1
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(test.method, test.path, nil))
+			if got != test.want {
+				t.Errorf("requiredRole = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
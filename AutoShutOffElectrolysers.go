@@ -45,26 +45,67 @@ where el1StateCode = 3 and logged > date_add(current_date, interval -7 day)`); e
 	}
 }
 
+var shutDownBusy = make(chan struct{}, 1) // Holds a token while the auto shut down is in progress
+
+/*
+startShutDownElectrolysers runs ShutDownElectrolysers in the background, unless it is already running, so waiting for
+the power commands never holds up the logging loop. shutDown waits for it to finish.
+*/
+func startShutDownElectrolysers() {
+	select {
+	case shutDownBusy <- struct{}{}:
+	default:
+		return
+	}
+	serviceGroup.Add(1)
+	go func() {
+		defer serviceGroup.Done()
+		defer func() { <-shutDownBusy }()
+		ShutDownElectrolysers()
+	}()
+}
+
 func ShutDownElectrolysers() bool {
-	if !SystemStatus.Relays.EL0 && !SystemStatus.Relays.EL1 {
+	if commsWatchdog.isStale(DataSourceIO) {
+		// We cannot trust the relay states so try again later
+		return false
+	}
+	SystemStatus.m.Lock()
+	relays := SystemStatus.Relays
+	electrolysers := SystemStatus.Electrolysers
+	SystemStatus.m.Unlock()
+	if !relays.EL0 && !relays.EL1 {
 		// Already off
 		return true
 	}
-	for _, el := range SystemStatus.Electrolysers {
-		if el.status.StackVoltage > 30 {
+	for device, el := range electrolysers {
+		if commsWatchdog.isStale(elDataSource(device)) {
+			// We don't know the stack voltage so wait for fresh data
+			return false
+		}
+		el.status.mu.Lock()
+		stackVoltage := el.status.StackVoltage
+		el.status.mu.Unlock()
+		if stackVoltage > 30 {
 			// Stack voltage on one electrolyser is too high
 			return false
 		}
 	}
 	log.Println("Auto-shutting down electrolysers.")
-	if err := mbusRTU.EL1OnOff(false); err != nil {
+	if err := runCommandWithParams(elQueue(1), "power", PriorityAutomatic, "auto shut down", CommandParams{"on": false}, func() error {
+		return mbusRTU.EL1OnOff(false)
+	}); err != nil {
 		log.Print(err)
 		return false
 	}
+	intendedState.SetElectrolyserPower(1, false)
 
-	if err := mbusRTU.EL0OnOff(false); err != nil {
+	if err := runCommandWithParams(elQueue(0), "power", PriorityAutomatic, "auto shut down", CommandParams{"on": false}, func() error {
+		return mbusRTU.EL0OnOff(false)
+	}); err != nil {
 		log.Print(err)
 		return false
 	}
+	intendedState.SetElectrolyserPower(0, false)
 	return true
 }
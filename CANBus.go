@@ -12,6 +12,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"time"
 )
 
@@ -201,55 +202,100 @@ func (pLogger *CANBus) clearBuffers() {
 	}
 }
 
+/*
+fuelCellDevices returns the device numbers of the fuel cells on the bus, lowest first, so they are always listed in
+the same order
+*/
+func (pLogger *CANBus) fuelCellDevices() []uint8 {
+	devices := make([]uint8, 0, len(pLogger.fuelCell))
+	for device := range pLogger.fuelCell {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i] < devices[j]
+	})
+	return devices
+}
+
 var next0x400id uint64
 
+/*
+logCANData writes completed 0x400 frame sets to the database until the service is stopped
+*/
 func (pLogger *CANBus) logCANData() {
 	for {
-		frame := <-CanLogChannel
-
-		if time.Now().Before(pLogger.onDemandEnd) {
-			pLogger.OnDemand = true
-			pLogger.setEventDateTime()
-		}
-		if (params.FuelCellLogOnEnable && SystemStatus.Relays.FC0Enable) ||
-			(params.FuelCellLogOnRun && SystemStatus.Relays.FC0Run) {
-			pLogger.OnDemand = true
-			pLogger.setEventDateTime()
+		select {
+		case frame := <-CanLogChannel:
+			pLogger.writeFrame(frame)
+		case <-serviceContext.Done():
+			// Write anything still waiting before closing the statement
+			for {
+				select {
+				case frame := <-CanLogChannel:
+					pLogger.writeFrame(frame)
+				default:
+					if pLogger.LogStatement != nil {
+						if err := pLogger.LogStatement.Close(); err != nil {
+							log.Println(err)
+						}
+						pLogger.LogStatement = nil
+					}
+					return
+				}
+			}
 		}
+	}
+}
 
-		if pLogger.OnDemand {
-			if (pDB == nil) || (pLogger.LogStatement == nil) {
-				log.Print("Database is not connected or log statment is closed in CAN logger")
-				var err error
-				err = pLogger.ConnectToDatabase()
-				if err != nil {
-					log.Print("Failed to connect ot the database - ", err)
-				}
+/*
+writeFrame logs one set of 0x400 frames if we are recording
+*/
+func (pLogger *CANBus) writeFrame(frame *Frame0x400Data) {
+	if time.Now().Before(pLogger.onDemandEnd) {
+		pLogger.OnDemand = true
+		pLogger.setEventDateTime()
+	}
+	if (params.FuelCellLogOnEnable && SystemStatus.Relays.FC0Enable) ||
+		(params.FuelCellLogOnRun && SystemStatus.Relays.FC0Run) {
+		pLogger.OnDemand = true
+		pLogger.setEventDateTime()
+	}
+
+	if pLogger.OnDemand {
+		if (pDB == nil) || (pLogger.LogStatement == nil) {
+			log.Print("Database is not connected or log statment is closed in CAN logger")
+			var err error
+			err = pLogger.ConnectToDatabase()
+			if err != nil {
+				log.Print("Failed to connect ot the database - ", err)
 			}
-			if pDB != nil {
-				_, err := pLogger.LogStatement.Exec(frame.Cell,
-					frame.FrameData[0].data[:], frame.FrameData[0].tOffset, frame.FrameData[1].data[:], frame.FrameData[1].tOffset, frame.FrameData[2].data[:], frame.FrameData[2].tOffset, frame.FrameData[3].data[:], frame.FrameData[3].tOffset,
-					frame.FrameData[4].data[:], frame.FrameData[4].tOffset, frame.FrameData[5].data[:], frame.FrameData[5].tOffset, frame.FrameData[6].data[:], frame.FrameData[6].tOffset, frame.FrameData[7].data[:], frame.FrameData[7].tOffset,
-					frame.FrameData[8].data[:], frame.FrameData[8].tOffset, frame.FrameData[9].data[:], frame.FrameData[9].tOffset, frame.FrameData[10].data[:], frame.FrameData[11].tOffset, frame.FrameData[11].data[:], frame.FrameData[11].tOffset,
-					frame.FrameData[12].data[:], frame.FrameData[12].tOffset, frame.FrameData[13].data[:], frame.FrameData[13].tOffset, frame.FrameData[14].data[:], frame.FrameData[14].tOffset, frame.FrameData[15].data[:], frame.FrameData[15].tOffset,
-					frame.FrameData[16].data[:], frame.FrameData[16].tOffset, frame.FrameData[17].data[:], frame.FrameData[17].tOffset, frame.FrameData[18].data[:], frame.FrameData[18].tOffset, frame.FrameData[19].data[:], frame.FrameData[19].tOffset,
-					frame.FrameData[20].data[:], frame.FrameData[20].tOffset, frame.FrameData[21].data[:], frame.FrameData[21].tOffset, frame.FrameData[22].data[:], frame.FrameData[22].tOffset, frame.FrameData[23].data[:], frame.FrameData[23].tOffset,
-					frame.FrameData[24].data[:], frame.FrameData[24].tOffset, frame.FrameData[25].data[:], frame.FrameData[25].tOffset, frame.FrameData[26].data[:], frame.FrameData[26].tOffset, frame.FrameData[27].data[:], frame.FrameData[27].tOffset,
-					frame.FrameData[28].data[:], frame.FrameData[28].tOffset, frame.FrameData[29].data[:], frame.FrameData[29].tOffset, frame.FrameData[30].data[:], frame.FrameData[30].tOffset, frame.FrameData[31].data[:], frame.FrameData[31].tOffset,
-					frame.FrameData[32].data[:], frame.FrameData[32].tOffset, frame.FrameData[33].data[:], frame.FrameData[33].tOffset, frame.FrameData[34].data[:], frame.FrameData[34].tOffset, frame.FrameData[35].data[:], frame.FrameData[35].tOffset,
-					frame.FrameData[36].data[:], frame.FrameData[36].tOffset, frame.FrameData[37].data[:], frame.FrameData[37].tOffset, frame.FrameData[38].data[:], frame.FrameData[38].tOffset, frame.FrameData[39].data[:], frame.FrameData[39].tOffset,
-					frame.FrameData[40].data[:], frame.FrameData[40].tOffset, frame.FrameData[41].data[:], frame.FrameData[41].tOffset, frame.FrameData[42].data[:], frame.FrameData[42].tOffset, frame.FrameData[43].data[:], frame.FrameData[43].tOffset,
-					frame.FrameData[44].data[:], frame.FrameData[44].tOffset, frame.FrameData[45].data[:], frame.FrameData[45].tOffset, frame.FrameData[46].data[:], frame.FrameData[46].tOffset, pLogger.EventTime, pLogger.OnDemand)
-				if err != nil {
-					log.Println("CAN Bus log to database error", err)
-					if err := pDB.Close(); err != nil {
-						log.Println(err)
-					}
-					pDB = nil
+		}
+		if pDB != nil {
+			started := time.Now()
+			_, err := pLogger.LogStatement.Exec(frame.Cell,
+				frame.FrameData[0].data[:], frame.FrameData[0].tOffset, frame.FrameData[1].data[:], frame.FrameData[1].tOffset, frame.FrameData[2].data[:], frame.FrameData[2].tOffset, frame.FrameData[3].data[:], frame.FrameData[3].tOffset,
+				frame.FrameData[4].data[:], frame.FrameData[4].tOffset, frame.FrameData[5].data[:], frame.FrameData[5].tOffset, frame.FrameData[6].data[:], frame.FrameData[6].tOffset, frame.FrameData[7].data[:], frame.FrameData[7].tOffset,
+				frame.FrameData[8].data[:], frame.FrameData[8].tOffset, frame.FrameData[9].data[:], frame.FrameData[9].tOffset, frame.FrameData[10].data[:], frame.FrameData[11].tOffset, frame.FrameData[11].data[:], frame.FrameData[11].tOffset,
+				frame.FrameData[12].data[:], frame.FrameData[12].tOffset, frame.FrameData[13].data[:], frame.FrameData[13].tOffset, frame.FrameData[14].data[:], frame.FrameData[14].tOffset, frame.FrameData[15].data[:], frame.FrameData[15].tOffset,
+				frame.FrameData[16].data[:], frame.FrameData[16].tOffset, frame.FrameData[17].data[:], frame.FrameData[17].tOffset, frame.FrameData[18].data[:], frame.FrameData[18].tOffset, frame.FrameData[19].data[:], frame.FrameData[19].tOffset,
+				frame.FrameData[20].data[:], frame.FrameData[20].tOffset, frame.FrameData[21].data[:], frame.FrameData[21].tOffset, frame.FrameData[22].data[:], frame.FrameData[22].tOffset, frame.FrameData[23].data[:], frame.FrameData[23].tOffset,
+				frame.FrameData[24].data[:], frame.FrameData[24].tOffset, frame.FrameData[25].data[:], frame.FrameData[25].tOffset, frame.FrameData[26].data[:], frame.FrameData[26].tOffset, frame.FrameData[27].data[:], frame.FrameData[27].tOffset,
+				frame.FrameData[28].data[:], frame.FrameData[28].tOffset, frame.FrameData[29].data[:], frame.FrameData[29].tOffset, frame.FrameData[30].data[:], frame.FrameData[30].tOffset, frame.FrameData[31].data[:], frame.FrameData[31].tOffset,
+				frame.FrameData[32].data[:], frame.FrameData[32].tOffset, frame.FrameData[33].data[:], frame.FrameData[33].tOffset, frame.FrameData[34].data[:], frame.FrameData[34].tOffset, frame.FrameData[35].data[:], frame.FrameData[35].tOffset,
+				frame.FrameData[36].data[:], frame.FrameData[36].tOffset, frame.FrameData[37].data[:], frame.FrameData[37].tOffset, frame.FrameData[38].data[:], frame.FrameData[38].tOffset, frame.FrameData[39].data[:], frame.FrameData[39].tOffset,
+				frame.FrameData[40].data[:], frame.FrameData[40].tOffset, frame.FrameData[41].data[:], frame.FrameData[41].tOffset, frame.FrameData[42].data[:], frame.FrameData[42].tOffset, frame.FrameData[43].data[:], frame.FrameData[43].tOffset,
+				frame.FrameData[44].data[:], frame.FrameData[44].tOffset, frame.FrameData[45].data[:], frame.FrameData[45].tOffset, frame.FrameData[46].data[:], frame.FrameData[46].tOffset, pLogger.EventTime, pLogger.OnDemand)
+			serviceMetrics.dbInsert(DBTableCAN, started, err)
+			if err != nil {
+				log.Println("CAN Bus log to database error", err)
+				if err := pDB.Close(); err != nil {
+					log.Println(err)
 				}
-			} else {
-				log.Println("Missed logging a CAN frame because of a database error")
+				pDB = nil
 			}
+		} else {
+			log.Println("Missed logging a CAN frame because of a database error")
+			serviceMetrics.dbInsert(DBTableCAN, time.Now(), fmt.Errorf("database not connected"))
 		}
 	}
 }
@@ -258,6 +304,8 @@ func (pLogger *CANBus) logCANData() {
 func (pLogger *CANBus) handleCANFrame(frm can.Frame) {
 	var data uint64
 
+	serviceMetrics.canFrame()
+
 	// Ignore everything on the CAN bus during fuel cell maintenance
 	if params.FuelCellMaintenance {
 		return
@@ -277,6 +325,7 @@ func (pLogger *CANBus) handleCANFrame(frm can.Frame) {
 			// We don't have this device in our map, so we should add it.
 			pLogger.fuelCell[device] = NewFCM804(pLogger, device)
 			fcm = pLogger.fuelCell[device]
+			intendedState.AddFuelCell(device)
 		}
 		fcm.LastUpdate = time.Now()
 		if fcm.ProcessFrame(frameID, frm.Data[:]) {
@@ -299,6 +348,7 @@ func (pLogger *CANBus) handleCANFrame(frm can.Frame) {
 	id := data >> 56
 	if id != next0x400id {
 		log.Printf("CAN log expected id = %02x but got %02x", next0x400id, id)
+		serviceMetrics.canSequenceError()
 	}
 	id = id + 1
 	if id > 0x2E {
@@ -323,7 +373,11 @@ func (pLogger *CANBus) handleCANFrame(frm can.Frame) {
 	}
 	if FrameNumber == 0x2E {
 		// Last frame so switch to allow saving the completed set to the database
-		CanLogChannel <- RecordingFrame
+		select {
+		case CanLogChannel <- RecordingFrame:
+		case <-serviceContext.Done():
+			log.Println("CAN frame set dropped during shutdown")
+		}
 		RecordingFrame = nil
 	}
 }
@@ -409,24 +463,49 @@ func (pLogger *CANBus) CanBusMonitor() {
 		bus, err := can.NewBusForInterfaceWithName("can0")
 		if err != nil {
 			log.Println("CAN interface not available.", err)
+			healthFailure(HealthCAN, err)
 		} else {
 			if pDB == nil {
 				if err = pLogger.ConnectToDatabase(); err != nil {
 					log.Println(err)
+					healthFailure(HealthCAN, err)
 					return
 				}
 			}
 			log.Println("Subscribing the handleCANFrame function")
 			bus.SubscribeFunc(pLogger.handleCANFrame)
+			healthSuccess(HealthCAN)
+			// Disconnecting the bus makes ConnectAndPublish return so we can stop
+			published := make(chan struct{})
+			go func() {
+				select {
+				case <-serviceContext.Done():
+					if err := bus.Disconnect(); err != nil {
+						log.Println("Error disconnecting the CAN bus - ", err)
+					}
+				case <-published:
+				}
+			}()
 			err = bus.ConnectAndPublish()
+			close(published)
+			if serviceContext.Err() != nil {
+				log.Println("CAN bus disconnected")
+				return
+			}
 			if err != nil {
 				log.Println("ConnectAndPublish failed, cannot log CAN frames.", err)
+				healthFailure(HealthCAN, err)
 			} else {
 				log.Println("Logging CAN data from the fuel cells from can0")
+				healthFailure(HealthCAN, fmt.Errorf("disconnected from can0"))
 			}
 		}
 		// If something goes wrong sleep for 10 seconds and try again.
-		time.Sleep(time.Second * 10)
+		select {
+		case <-serviceContext.Done():
+			return
+		case <-time.After(time.Second * 10):
+		}
 	}
 }
 
@@ -633,18 +712,10 @@ func canRecord(w http.ResponseWriter, r *http.Request) {
 		ReturnJSONError(w, "canDump", err, 400, true)
 		return
 	}
-	n := time.Now()
-	if !toTime.After(n) {
-		errString := fmt.Sprintf("End of recording (%v) is in the past. (%v)", toTime, n)
-		ReturnJSONErrorString(w, "canRecord", errString, 400, true)
-		return
-	}
-	if toTime.Sub(time.Now()) > time.Hour*8 {
-		ReturnJSONErrorString(w, "canRecord", "You can only ask for up to 8 hours of on demand CAN logging.", 400, true)
+	if err := commandCANRecord(toTime); err != nil {
+		ReturnCommandError(w, "canRecord", err)
 		return
 	}
-
-	canBus.setOnDemandRecording(toTime)
 	toTimeStr := toTime.Format(time.RFC850)
 	_, err = fmt.Fprintf(w, `<html>
 	<head>
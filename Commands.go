@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+/***************
+Control actions that can be requested from more than one interface. The HTTP handlers, MQTT and anything else that
+lets an operator or another system change the plant call these so every request gets the same validation and
+interlocks whichever way it arrives.
+*/
+
+/*
+CommandError is returned when a command is refused or fails. Status is the HTTP status code that best describes the
+failure so each interface can report it in its own way.
+*/
+type CommandError struct {
+	Status int
+	Err    error
+	Quiet  bool // An expected refusal that is not worth logging as an error
+}
+
+func (e *CommandError) Error() string {
+	return e.Err.Error()
+}
+
+func commandRefused(status int, message string) *CommandError {
+	return &CommandError{Status: status, Err: errors.New(message)}
+}
+
+/*
+commandFailed reports an error from a device. A command refused because the device is locked out is a conflict.
+*/
+func commandFailed(err error) *CommandError {
+	if _, locked := err.(*LockoutError); locked {
+		return &CommandError{Status: http.StatusConflict, Err: err}
+	}
+	return &CommandError{Status: http.StatusInternalServerError, Err: err}
+}
+
+/*
+electrolyserDevice returns the given electrolyser if it exists. If checkLockout is set it must not be locked out,
+commands that only turn it off or stop it leave it unset so it can always be made safe.
+*/
+func electrolyserDevice(device int64, checkLockout bool) (*Electrolyser, *CommandError) {
+	if device < 0 || device >= int64(len(SystemStatus.Electrolysers)) {
+		return nil, commandRefused(http.StatusNotFound, fmt.Sprintf("Electrolyser %d does not exist", device))
+	}
+	if !checkLockout {
+		return SystemStatus.Electrolysers[device], nil
+	}
+	if err := checkElectrolyserLockout(int(device)); err != nil {
+		return nil, commandFailed(err)
+	}
+	return SystemStatus.Electrolysers[device], nil
+}
+
+/*
+fuelCellDevice checks the fuel cell is 0 or 1 and, if checkLockout is set, is not locked out. Commands that only turn
+it off or stop it leave checkLockout unset so it can always be made safe.
+*/
+func fuelCellDevice(device int64, checkLockout bool) (uint8, *CommandError) {
+	if device < 0 || device > 1 {
+		return 0, commandRefused(http.StatusNotFound, fmt.Sprintf("Fuel cell %d does not exist", device))
+	}
+	if !checkLockout {
+		return uint8(device), nil
+	}
+	if err := checkFuelCellLockout(uint8(device)); err != nil {
+		return 0, commandFailed(err)
+	}
+	return uint8(device), nil
+}
+
+/*
+commandElectrolyserRate sets the total electrolyser production rate, 0-100%. The electrolysers are stopped instead if
+a fuel cell is running.
+*/
+func commandElectrolyserRate(rate int64, source string) *CommandError {
+	debugPrint("Set electrolyser : %d", rate)
+	if pDB != nil {
+		if _, err := pDB.Exec("INSERT INTO ElectrolyserRequests (RateRequested) VALUES (?)", rate); err != nil {
+			log.Println("Log Electrolyser Request - ", err)
+		}
+	}
+
+	// Refuse anything outside the acceptable range of 0..100%
+	if rate > 100 || rate < 0 {
+		return commandRefused(http.StatusBadRequest, "Rate must be between 0 and 100")
+	}
+
+	if (SystemStatus.Relays.FC0Run || SystemStatus.Relays.FC1Run) && rate > 0 {
+		// Do not allow the electrolysers to run if one or more fuel cells are also running
+		for device, el := range SystemStatus.Electrolysers {
+			// Immediate shut down
+			el := el
+			dispatcher.SubmitWithParams(elQueue(device), "run", PriorityManual, source, CommandParams{"run": false}, func() error {
+				el.Stop(true)
+				return nil
+			})
+			CurrentRate = 0
+		}
+		intendedState.SetRate(0)
+		err := commandRefused(http.StatusBadRequest, "One or more Fuel cells are running. All electrolysers are stopped.")
+		err.Quiet = true
+		return err
+	}
+
+	if err := setProductionRates(uint8(rate), PriorityManual, source); err != nil {
+		return commandFailed(err)
+	}
+	return nil
+}
+
+/*
+commandElectrolyserPower turns the power relay of an electrolyser on or off. It will not turn off an electrolyser
+while the stack voltage is above the configured limit.
+*/
+func commandElectrolyserPower(device int64, on bool, source string) *CommandError {
+	if device < 0 || device > 1 {
+		return commandRefused(http.StatusNotFound, fmt.Sprintf("Electrolyser %d does not exist", device))
+	}
+	if on {
+		// Turning it off is always allowed so a locked out electrolyser can be made safe
+		if err := checkElectrolyserLockout(int(device)); err != nil {
+			return commandFailed(err)
+		}
+	}
+	if !on && device < int64(len(SystemStatus.Electrolysers)) {
+		if SystemStatus.Electrolysers[device].status.StackVoltage > jsonFloat32(params.ElectrolyserMaxStackVoltsTurnOff) {
+			return commandRefused(http.StatusConflict, fmt.Sprintf("Electrolyser %d not turned off because stack voltage is too high.", device))
+		}
+	}
+	if err := runCommandWithParams(elQueue(int(device)), "power", PriorityManual, source, CommandParams{"on": on}, func() error {
+		return mbusRTU.ELOnOff(uint8(device), on)
+	}); err != nil {
+		return commandFailed(err)
+	}
+	intendedState.SetElectrolyserPower(int(device), on)
+	return nil
+}
+
+/*
+commandElectrolyserRun starts or stops an electrolyser immediately, ignoring the hold off time
+*/
+func commandElectrolyserRun(device int64, run bool, source string) *CommandError {
+	el, cmdErr := electrolyserDevice(device, run)
+	if cmdErr != nil {
+		return cmdErr
+	}
+	if run {
+		if err := checkEmergencyStop(); err != nil {
+			return commandRefused(http.StatusConflict, err.Error())
+		}
+	}
+	if !el.IsSwitchedOn() {
+		return commandRefused(http.StatusConflict, fmt.Sprintf("Electrolyser %d is not powered on", device))
+	}
+	if err := runCommandWithParams(elQueue(int(device)), "run", PriorityManual, source, CommandParams{"run": run}, func() error {
+		if run {
+			if !el.Start(true) {
+				return fmt.Errorf("Failed to start the electrolyser")
+			}
+		} else if !el.Stop(true) {
+			return fmt.Errorf("Failed to stop the electrolyser")
+		}
+		return nil
+	}); err != nil {
+		return commandFailed(err)
+	}
+	return nil
+}
+
+/*
+commandElectrolyserReboot reboots an electrolyser
+*/
+func commandElectrolyserReboot(device int64, source string) *CommandError {
+	el, cmdErr := electrolyserDevice(device, true)
+	if cmdErr != nil {
+		return cmdErr
+	}
+	if err := runCommand(elQueue(int(device)), "reboot", PriorityManual, source, func() error {
+		el.Reboot()
+		return nil
+	}); err != nil {
+		return commandFailed(err)
+	}
+	return nil
+}
+
+/*
+commandElectrolyserPreheat tells an electrolyser to preheat the electrolyte
+*/
+func commandElectrolyserPreheat(device int64, source string) *CommandError {
+	el, cmdErr := electrolyserDevice(device, true)
+	if cmdErr != nil {
+		return cmdErr
+	}
+	if err := runCommand(elQueue(int(device)), "preheat", PriorityManual, source, func() error {
+		el.Preheat()
+		return nil
+	}); err != nil {
+		return commandFailed(err)
+	}
+	return nil
+}
+
+/*
+commandRestartPressure programs the pressure below which an electrolyser restarts by itself, 2-35 bar. The setting
+is committed to the electrolyser's flash in the background so the job is returned for the caller to follow.
+*/
+func commandRestartPressure(device int64, pressure float64, source string) (*Job, *CommandError) {
+	if pressure < 2.0 || pressure > 35.0 {
+		return nil, commandRefused(http.StatusBadRequest, "Invalid pressure specified (2..35)")
+	}
+	el, cmdErr := electrolyserDevice(device, true)
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	job := startJob("restart pressure", elQueue(int(device)), source, func(job *Job) error {
+		job.Step("Setting electrolyser %d restart pressure to %0.1f bar", device, pressure)
+		if err := runCommandWithParams(elQueue(int(device)), "restartPressure", PriorityManual, job.Source, CommandParams{"pressure": pressure}, func() error {
+			return el.SetRestartPressure(float32(pressure))
+		}); err != nil {
+			return err
+		}
+		job.Step("Restart pressure committed")
+		return nil
+	})
+	return job, nil
+}
+
+/*
+commandFuelCellEnable turns the enable relay of a fuel cell on or off. Turning it off is done by the power down job,
+which is returned so the caller can follow it. The job is nil when the fuel cell is turned on.
+*/
+func commandFuelCellEnable(device uint8, on bool, source string) (*Job, *CommandError) {
+	if device > 1 {
+		return nil, commandRefused(http.StatusBadRequest, "Invalid fuel cell in 'on/off' request")
+	}
+	var job *Job
+	if err := runCommandWithParams(fcQueue(device), "power", PriorityManual, source, CommandParams{"on": on}, func() error {
+		if on {
+			log.Print("Turn on the fuel cell")
+			return turnOnFuelCell(device)
+		}
+		log.Print("Turn off the fuel cell")
+		var err error
+		job, err = turnOffFuelCell(device, source)
+		return err
+	}); err != nil {
+		return nil, commandFailed(err)
+	}
+	intendedState.SetFuelCellEnable(device, on)
+	return job, nil
+}
+
+/*
+commandFuelCellRestart does a complete shut down and restart of a fuel cell in the background. A restart that is
+already in progress is returned rather than starting a second one.
+*/
+func commandFuelCellRestart(device int64, source string) (*Job, *CommandError) {
+	fc, cmdErr := fuelCellDevice(device, true)
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	job := runningJob("fuel cell restart", fcQueue(fc))
+	if job == nil {
+		job = startJob("fuel cell restart", fcQueue(fc), source, func(job *Job) error {
+			return restartFc(fc, job)
+		})
+	}
+	return job, nil
+}
+
+/*
+commandFuelCellRun starts or stops a fuel cell
+*/
+func commandFuelCellRun(device uint8, run bool, source string) *CommandError {
+	// Device should be 0 or 1.
+	if device > 1 {
+		return commandRefused(http.StatusBadRequest, "Invalid fuel cell in 'run' request")
+	}
+	if err := runCommandWithParams(fcQueue(device), "run", PriorityManual, source, CommandParams{"run": run}, func() error {
+		if run {
+			// Start the cell
+			return startFuelCell(device)
+		}
+		// Stop the cell
+		return stopFuelCell(device)
+	}); err != nil {
+		return commandFailed(err)
+	}
+	intendedState.SetFuelCellRun(device, run)
+	return nil
+}
+
+/*
+commandGas turns the fuel cell gas supply on or off
+*/
+func commandGas(on bool, source string) *CommandError {
+	if err := runCommandWithParams(RelayQueue, "gas", PriorityManual, source, CommandParams{"on": on}, func() error {
+		return mbusRTU.GasOnOff(on)
+	}); err != nil {
+		return commandFailed(err)
+	}
+	return nil
+}
+
+/*
+commandSpare turns the spare relay on or off
+*/
+func commandSpare(on bool, source string) *CommandError {
+	if err := runCommandWithParams(RelayQueue, "spare", PriorityManual, source, CommandParams{"on": on}, func() error {
+		return mbusRTU.SpareOnOff(on)
+	}); err != nil {
+		return commandFailed(err)
+	}
+	return nil
+}
+
+/*
+commandCANRecord records the CAN frames until the given time, at most 8 hours from now
+*/
+func commandCANRecord(until time.Time) *CommandError {
+	now := time.Now()
+	if !until.After(now) {
+		return commandRefused(http.StatusBadRequest, fmt.Sprintf("End of recording (%v) is in the past. (%v)", until, now))
+	}
+	if until.Sub(now) > time.Hour*8 {
+		return commandRefused(http.StatusBadRequest, "You can only ask for up to 8 hours of on demand CAN logging.")
+	}
+	canBus.setOnDemandRecording(until)
+	return nil
+}
+
+/*
+commandResetEmergencyStop clears the emergency stop latch. The name of the person resetting it is required.
+*/
+func commandResetEmergencyStop(name string) *CommandError {
+	if name == "" {
+		return commandRefused(http.StatusBadRequest, "A name is required to reset the emergency stop")
+	}
+	if err := emergencyStop.Reset(name); err != nil {
+		return &CommandError{Status: http.StatusConflict, Err: err}
+	}
+	return nil
+}
+
+/*
+parseOnOff accepts the usual ways of saying on or off from systems that don't send JSON
+*/
+func parseOnOff(value string) (bool, error) {
+	switch value {
+	case "ON", "on", "On", "true", "TRUE", "1":
+		return true, nil
+	case "OFF", "off", "Off", "false", "FALSE", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected ON or OFF but got %q", value)
+}
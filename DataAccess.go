@@ -10,6 +10,24 @@ import (
 	"time"
 )
 
+// databaseTables holds the DDL for tables added by the optional subsystems. Each is created if it is missing.
+var databaseTables []string
+
+/**
+createTables makes sure every table registered in databaseTables exists
+*/
+func createTables() {
+	if pDB == nil {
+		log.Println("Cannot create tables - database is not connected")
+		return
+	}
+	for _, ddl := range databaseTables {
+		if _, err := pDB.Exec(ddl); err != nil {
+			log.Println("Error creating table - ", err)
+		}
+	}
+}
+
 /**
 Get fuel cell recorded values
 */
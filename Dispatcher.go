@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/***************
+Every command that changes the state of a device goes through the dispatcher so that only one command at a time is
+sent to each device. Each device has its own queue which is worked in priority order, safety first, then manual
+commands from the operators and finally the automatic controllers. A request for a command that is already waiting in
+the queue with the same name and the same parameters is merged into it rather than queued a second time, as long as it
+is at least as urgent, so a lower priority request can never change what a higher priority one asked for. Safety
+commands go to the front of the queue and are never merged. They run as soon as the command in progress for the
+device has finished, so only one command at a time ever reaches a device.
+Every command gets an ID and a tracked result which the caller can wait on or poll through /commands/{id}.
+*/
+
+type CommandPriority int
+
+const (
+	PrioritySafety CommandPriority = iota
+	PriorityManual
+	PriorityAutomatic
+)
+
+func (p CommandPriority) String() string {
+	switch p {
+	case PrioritySafety:
+		return "safety"
+	case PriorityManual:
+		return "manual"
+	case PriorityAutomatic:
+		return "automatic"
+	}
+	return "unknown"
+}
+
+func (p CommandPriority) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+const (
+	CommandQueued  = "queued"
+	CommandRunning = "running"
+	CommandDone    = "done"
+	CommandFailed  = "failed"
+)
+
+const COMMANDHISTORYSIZE = 200             // Number of finished commands kept for polling
+const COMMANDWAITTIMEOUT = time.Minute * 5 // Longest a caller will wait for a command to finish
+
+/*
+CommandParams are the values a command was asked to set, e.g. the rate or whether to switch on, for the audit trail
+*/
+type CommandParams map[string]interface{}
+
+type Command struct {
+	ID       uint64          `json:"id"`
+	Device   string          `json:"device"`
+	Name     string          `json:"name"`
+	Priority CommandPriority `json:"priority"`
+	Source   string          `json:"source"`
+	Status   string          `json:"status"`
+	Error    string          `json:"error,omitempty"`
+	Merged   int             `json:"merged"` // Number of later requests merged into this command while it was queued
+	Params   CommandParams   `json:"params,omitempty"`
+	Queued   time.Time       `json:"queued"`
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+	action   func() error
+	err      error
+	done     chan struct{}
+}
+
+/*
+Wait blocks until the command has finished and returns its result
+*/
+func (c *Command) Wait() error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-time.After(COMMANDWAITTIMEOUT):
+		return fmt.Errorf("timed out waiting for %s on %s", c.Name, c.Device)
+	}
+}
+
+type deviceQueue struct {
+	pending []*Command
+	running bool
+}
+
+type CommandDispatcher struct {
+	nextID   uint64
+	queues   map[string]*deviceQueue
+	commands map[uint64]*Command
+	history  []uint64 // IDs of finished commands, oldest first
+	mu       sync.Mutex
+}
+
+var dispatcher = &CommandDispatcher{queues: make(map[string]*deviceQueue), commands: make(map[uint64]*Command)}
+
+func elQueue(device int) string {
+	return "el" + strconv.Itoa(device)
+}
+
+func fcQueue(device uint8) string {
+	return "fc" + strconv.Itoa(int(device))
+}
+
+func drQueue(device int) string {
+	return "dr" + strconv.Itoa(device)
+}
+
+const RelayQueue = "relays" // Gas and spare relays
+
+/*
+Submit queues a command for a device and returns it so the caller can wait on or track the result
+*/
+func (d *CommandDispatcher) Submit(device string, name string, priority CommandPriority, source string, action func() error) *Command {
+	return d.SubmitWithParams(device, name, priority, source, nil, action)
+}
+
+/*
+SubmitWithParams queues a command recording the values it sets
+*/
+func (d *CommandDispatcher) SubmitWithParams(device string, name string, priority CommandPriority, source string, params CommandParams, action func() error) *Command {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	q, found := d.queues[device]
+	if !found {
+		q = new(deviceQueue)
+		d.queues[device] = q
+	}
+
+	if priority != PrioritySafety {
+		for _, c := range q.pending {
+			if c.Name == name && priority <= c.Priority && reflect.DeepEqual(c.Params, params) {
+				// The same request again so the queued command already does what was asked. Keep its action, so
+				// anyone waiting on it gets the result of what they asked for, and take the more urgent priority.
+				c.Merged++
+				if priority < c.Priority {
+					c.Priority = priority
+					d.sortQueue(q)
+				}
+				return c
+			}
+		}
+	}
+
+	d.nextID++
+	c := &Command{ID: d.nextID, Device: device, Name: name, Priority: priority, Source: source, Params: params,
+		Status: CommandQueued, Queued: time.Now(), action: action, done: make(chan struct{})}
+	d.commands[c.ID] = c
+
+	q.pending = append(q.pending, c)
+	d.sortQueue(q)
+	if !q.running {
+		q.running = true
+		go d.work(q)
+	}
+	return c
+}
+
+/*
+sortQueue orders the pending commands by priority then by the time they were queued. The caller must hold the lock
+*/
+func (d *CommandDispatcher) sortQueue(q *deviceQueue) {
+	sort.SliceStable(q.pending, func(i, j int) bool {
+		return q.pending[i].Priority < q.pending[j].Priority
+	})
+}
+
+/*
+work runs the commands for one device until its queue is empty
+*/
+func (d *CommandDispatcher) work(q *deviceQueue) {
+	for {
+		d.mu.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			d.mu.Unlock()
+			return
+		}
+		c := q.pending[0]
+		q.pending = q.pending[1:]
+		d.mu.Unlock()
+
+		d.run(c)
+	}
+}
+
+/*
+run executes a single command and records the result
+*/
+func (d *CommandDispatcher) run(c *Command) {
+	d.mu.Lock()
+	c.Status = CommandRunning
+	c.Started = time.Now()
+	action := c.action
+	d.mu.Unlock()
+
+	preState := commandPreState(c.Device)
+	err := action()
+
+	d.mu.Lock()
+	c.Finished = time.Now()
+	c.err = err
+	if err != nil {
+		c.Status = CommandFailed
+		c.Error = err.Error()
+		log.Printf("Command %d %s on %s from %s failed - %v", c.ID, c.Name, c.Device, c.Source, err)
+	} else {
+		c.Status = CommandDone
+	}
+	d.history = append(d.history, c.ID)
+	if len(d.history) > COMMANDHISTORYSIZE {
+		delete(d.commands, d.history[0])
+		d.history = d.history[1:]
+	}
+	finished := *c
+	d.mu.Unlock()
+	close(c.done)
+	auditTrail.recordCommand(finished, preState)
+}
+
+/*
+runCommand submits a command and waits for its result
+*/
+func runCommand(device string, name string, priority CommandPriority, source string, action func() error) error {
+	return dispatcher.Submit(device, name, priority, source, action).Wait()
+}
+
+/*
+runCommandWithParams submits a command recording the values it sets and waits for its result
+*/
+func runCommandWithParams(device string, name string, priority CommandPriority, source string, params CommandParams, action func() error) error {
+	return dispatcher.SubmitWithParams(device, name, priority, source, params, action).Wait()
+}
+
+/*
+getCommand returns a copy of the command with the given ID
+*/
+func (d *CommandDispatcher) getCommand(id uint64) (Command, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, found := d.commands[id]
+	if !found {
+		return Command{}, false
+	}
+	return *c, true
+}
+
+/*
+getCommands returns copies of all the tracked commands, newest first
+*/
+func (d *CommandDispatcher) getCommands() []Command {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	commands := make([]Command, 0, len(d.commands))
+	for _, c := range d.commands {
+		commands = append(commands, *c)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].ID > commands[j].ID
+	})
+	return commands
+}
+
+/*
+getCommandList returns the queued, running and recently finished commands
+URL = /commands
+*/
+func getCommandList(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(dispatcher.getCommands()); err != nil {
+		ReturnJSONError(w, "Commands", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+getCommandStatus returns the current state and result of a single command
+URL = /commands/{id}
+*/
+func getCommandStatus(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		ReturnJSONError(w, "Commands", err, http.StatusBadRequest, true)
+		return
+	}
+	c, found := dispatcher.getCommand(id)
+	if !found {
+		ReturnJSONErrorString(w, "Commands", fmt.Sprintf("command %d not found", id), http.StatusNotFound, false)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(c); err != nil {
+		ReturnJSONError(w, "Commands", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDispatcherMerge(t *testing.T) {
+	type submission struct {
+		name     string
+		rate     float64
+		priority CommandPriority
+	}
+	tests := []struct {
+		name        string
+		submissions []submission
+		commands    []int             // The submission whose command each submission got back
+		pending     []int             // The queue by submission, in the order it will run
+		priorities  []CommandPriority // The priority of each queued command
+		merged      []int             // The merge count of each queued command
+	}{
+		{"same request merged",
+			[]submission{{"rate", 50, PriorityManual}, {"rate", 50, PriorityManual}},
+			[]int{0, 0}, []int{0}, []CommandPriority{PriorityManual}, []int{1}},
+		{"different values kept",
+			[]submission{{"rate", 50, PriorityManual}, {"rate", 60, PriorityManual}},
+			[]int{0, 1}, []int{0, 1}, []CommandPriority{PriorityManual, PriorityManual}, []int{0, 0}},
+		{"different commands kept",
+			[]submission{{"rate", 50, PriorityManual}, {"start", 50, PriorityManual}},
+			[]int{0, 1}, []int{0, 1}, []CommandPriority{PriorityManual, PriorityManual}, []int{0, 0}},
+		{"less urgent duplicate kept",
+			[]submission{{"rate", 50, PriorityManual}, {"rate", 50, PriorityAutomatic}},
+			[]int{0, 1}, []int{0, 1}, []CommandPriority{PriorityManual, PriorityAutomatic}, []int{0, 0}},
+		{"more urgent duplicate raises the queued command",
+			[]submission{{"start", 0, PriorityAutomatic}, {"rate", 50, PriorityAutomatic}, {"rate", 50, PriorityManual}},
+			[]int{0, 1, 1}, []int{1, 0}, []CommandPriority{PriorityManual, PriorityAutomatic}, []int{1, 0}},
+		{"safety never merged",
+			[]submission{{"stop", 0, PriorityManual}, {"stop", 0, PrioritySafety}, {"stop", 0, PrioritySafety}},
+			[]int{0, 1, 2}, []int{1, 2, 0}, []CommandPriority{PrioritySafety, PrioritySafety, PriorityManual}, []int{0, 0, 0}},
+		{"queued in order within a priority",
+			[]submission{{"a", 0, PriorityAutomatic}, {"b", 0, PriorityManual}, {"c", 0, PriorityAutomatic}, {"d", 0, PriorityManual}},
+			[]int{0, 1, 2, 3}, []int{1, 3, 0, 2},
+			[]CommandPriority{PriorityManual, PriorityManual, PriorityAutomatic, PriorityAutomatic}, []int{0, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &CommandDispatcher{queues: make(map[string]*deviceQueue), commands: make(map[uint64]*Command)}
+
+			// Hold the queue with a running command so the submissions stay pending
+			started := make(chan struct{})
+			release := make(chan struct{})
+			blocking := d.Submit("test", "block", PriorityManual, "test", func() error {
+				close(started)
+				<-release
+				return nil
+			})
+			<-started
+
+			var commands []*Command
+			for i, s := range test.submissions {
+				c := d.SubmitWithParams("test", s.name, s.priority, "test", CommandParams{"rate": s.rate}, func() error { return nil })
+				commands = append(commands, c)
+				if want := commands[test.commands[i]]; c != want {
+					t.Errorf("submission %d got command %d, want command %d", i, c.ID, want.ID)
+				}
+			}
+
+			d.mu.Lock()
+			var pending []*Command
+			var priorities []CommandPriority
+			var merged []int
+			for _, c := range d.queues["test"].pending {
+				pending = append(pending, c)
+				priorities = append(priorities, c.Priority)
+				merged = append(merged, c.Merged)
+			}
+			d.mu.Unlock()
+
+			var want []*Command
+			for _, i := range test.pending {
+				want = append(want, commands[i])
+			}
+			if !reflect.DeepEqual(pending, want) {
+				t.Errorf("queue holds %d commands, want %d in submission order %v", len(pending), len(want), test.pending)
+			}
+			if !reflect.DeepEqual(priorities, test.priorities) {
+				t.Errorf("priorities = %v, want %v", priorities, test.priorities)
+			}
+			if !reflect.DeepEqual(merged, test.merged) {
+				t.Errorf("merged = %v, want %v", merged, test.merged)
+			}
+
+			close(release)
+			if err := blocking.Wait(); err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range commands {
+				if err := c.Wait(); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/***************
+The hydrogen dryer is controlled through the Modbus TCP interface of the electrolyser it is attached to.
+Normally one dryer is fitted to electrolyser 0 but some installations have one dryer per electrolyser so
+dryers are numbered by the electrolyser they are connected to.
+*/
+
+const DRYEREVENTSTABLE = `CREATE TABLE IF NOT EXISTS DryerEvents (
+	id INT AUTO_INCREMENT PRIMARY KEY,
+	logged DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	Device TINYINT NOT NULL,
+	EventType VARCHAR(16) NOT NULL,
+	Code SMALLINT UNSIGNED NOT NULL,
+	Raised BOOLEAN NOT NULL,
+	Message VARCHAR(255) NOT NULL,
+	INDEX (logged))`
+
+const DRYERLOGTABLE = `CREATE TABLE IF NOT EXISTS DryerLog (
+	logged DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	Device TINYINT NOT NULL,
+	Temp0 SMALLINT NULL,
+	Temp1 SMALLINT NULL,
+	Temp2 SMALLINT NULL,
+	Temp3 SMALLINT NULL,
+	InputPressure SMALLINT NULL,
+	OutputPressure SMALLINT NULL,
+	Errors SMALLINT UNSIGNED NULL,
+	Warnings SMALLINT UNSIGNED NULL,
+	INDEX (logged, Device))`
+
+const (
+	DryerEventError   = "error"
+	DryerEventWarning = "warning"
+)
+
+type DryerStatus struct {
+	Device         int         `json:"device"`
+	On             bool        `json:"on"`
+	Connected      bool        `json:"connected"`
+	Stale          bool        `json:"stale"` // No fresh readings so the values cannot be trusted
+	Temp0          jsonFloat32 `json:"temp0"`
+	Temp1          jsonFloat32 `json:"temp1"`
+	Temp2          jsonFloat32 `json:"temp2"`
+	Temp3          jsonFloat32 `json:"temp3"`
+	InputPressure  jsonFloat32 `json:"inputPressure"`
+	OutputPressure jsonFloat32 `json:"outputPressure"`
+	ErrorCode      uint16      `json:"errorCode"`
+	WarningCode    uint16      `json:"warningCode"`
+	Errors         []string    `json:"errors"`
+	Warnings       []string    `json:"warnings"`
+	Lockout        *Lockout    `json:"lockout,omitempty"`
+}
+
+/*
+DryerMonitor tracks the dryer error and warning codes so transitions can be recorded as events
+*/
+type DryerMonitor struct {
+	errors   map[int]uint16
+	warnings map[int]uint16
+	mu       sync.Mutex
+}
+
+var dryerMonitor = &DryerMonitor{errors: make(map[int]uint16), warnings: make(map[int]uint16)}
+
+func init() {
+	databaseTables = append(databaseTables, DRYEREVENTSTABLE, DRYERLOGTABLE)
+}
+
+/*
+dryerDevices returns the electrolysers that have a dryer attached
+*/
+func dryerDevices() []int {
+	var devices []int
+	for device := range SystemStatus.Electrolysers {
+		if device == 0 || params.DryerPerElectrolyser {
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
+
+/*
+validateDryer checks that the given device has a dryer attached and returns its electrolyser
+*/
+func validateDryer(device int64) (*Electrolyser, error) {
+	if device < 0 || device >= int64(len(SystemStatus.Electrolysers)) || (device > 0 && !params.DryerPerElectrolyser) {
+		return nil, fmt.Errorf("invalid dryer - %d", device)
+	}
+	return SystemStatus.Electrolysers[device], nil
+}
+
+/*
+getDryerStatus returns the current status of the dryer attached to the given electrolyser.
+The caller must hold the SystemStatus lock
+*/
+func getDryerStatus(device int) (dr DryerStatus) {
+	el := SystemStatus.Electrolysers[device]
+	dr.Device = device
+	dr.On = el.status.SwitchedOn
+	dr.Connected = el.clientConnected
+	dr.Stale = commsWatchdog.isStale(elDataSource(device))
+	dr.Errors = []string{}
+	dr.Warnings = []string{}
+	dr.Lockout = getLockout(LockoutDryer, strconv.Itoa(device))
+	if !dr.On {
+		return
+	}
+	dr.Temp0 = el.status.DryerTemp1
+	dr.Temp1 = el.status.DryerTemp2
+	dr.Temp2 = el.status.DryerTemp3
+	dr.Temp3 = el.status.DryerTemp4
+	dr.InputPressure = el.status.DryerInputPressure
+	dr.OutputPressure = el.status.DryerOutputPressure
+	dr.ErrorCode = el.status.DryerErrors
+	dr.WarningCode = el.status.DryerWarnings
+	dr.Errors = append(dr.Errors, el.GetDryerErrors()...)
+	dr.Warnings = append(dr.Warnings, el.GetDryerWarnings()...)
+	return
+}
+
+/*
+Check records the dryer readings and any change in the dryer error and warning codes. Called once per logging cycle.
+*/
+func (dm *DryerMonitor) Check() {
+	var dryers []DryerStatus
+
+	SystemStatus.m.Lock()
+	for _, device := range dryerDevices() {
+		dryers = append(dryers, getDryerStatus(device))
+	}
+	SystemStatus.m.Unlock()
+
+	for _, dr := range dryers {
+		if !dr.On || !dr.Connected || dr.Stale {
+			continue
+		}
+		dm.mu.Lock()
+		lastErrors, foundErrors := dm.errors[dr.Device]
+		lastWarnings, foundWarnings := dm.warnings[dr.Device]
+		dm.errors[dr.Device] = dr.ErrorCode
+		dm.warnings[dr.Device] = dr.WarningCode
+		dm.mu.Unlock()
+
+		// On the first reading treat everything as clear so any existing faults are recorded as raised
+		if !foundErrors {
+			lastErrors = 0
+		}
+		if !foundWarnings {
+			lastWarnings = 0
+		}
+		dm.recordTransitions(dr.Device, DryerEventError, lastErrors, dr.ErrorCode)
+		dm.recordTransitions(dr.Device, DryerEventWarning, lastWarnings, dr.WarningCode)
+		logDryer(dr)
+	}
+}
+
+/*
+recordTransitions writes an event for every bit that has changed between the previous and current codes
+*/
+func (dm *DryerMonitor) recordTransitions(device int, eventType string, previous uint16, current uint16) {
+	changed := previous ^ current
+	if changed == 0 {
+		return
+	}
+	for b := uint16(1); b != 0; b <<= 1 {
+		if (changed & b) == 0 {
+			continue
+		}
+		raised := (current & b) != 0
+		message := fmt.Sprintf("Unknown dryer code %04x", b)
+		if decoded := decodeDryerMessage(b); len(decoded) > 0 {
+			message = decoded[0]
+		}
+		if raised {
+			log.Printf("Dryer %d %s raised - %s", device, eventType, message)
+		} else {
+			log.Printf("Dryer %d %s cleared - %s", device, eventType, message)
+		}
+		if pDB == nil {
+			continue
+		}
+		if _, err := pDB.Exec("INSERT INTO DryerEvents (Device, EventType, Code, Raised, Message) VALUES (?, ?, ?, ?, ?)",
+			device, eventType, b, raised, message); err != nil {
+			log.Println("Error recording dryer event - ", err)
+		}
+	}
+}
+
+/*
+logDryer writes the dryer readings to the DryerLog table
+*/
+func logDryer(dr DryerStatus) {
+	if pDB == nil {
+		return
+	}
+	if _, err := pDB.Exec(`INSERT INTO DryerLog (Device, Temp0, Temp1, Temp2, Temp3, InputPressure, OutputPressure, Errors, Warnings)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, dr.Device,
+		int16(dr.Temp0*10), int16(dr.Temp1*10), int16(dr.Temp2*10), int16(dr.Temp3*10),
+		int16(dr.InputPressure*10), int16(dr.OutputPressure*10), dr.ErrorCode, dr.WarningCode); err != nil {
+		log.Println("Error logging dryer data - ", err)
+	}
+}
+
+/*
+getAllDryersJsonStatus returns the status of every dryer
+*/
+func getAllDryersJsonStatus(w http.ResponseWriter, _ *http.Request) {
+	var dryers []DryerStatus
+
+	SystemStatus.m.Lock()
+	for _, device := range dryerDevices() {
+		dryers = append(dryers, getDryerStatus(device))
+	}
+	SystemStatus.m.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(dryers); err != nil {
+		ReturnJSONError(w, "Dryer", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+getDryerJsonStatus returns the readings of the electrolyser the dryer is attached to, as it always has. Use
+/dr/{device} for the dryer on its own.
+URL = /dr/{device}/status
+*/
+func getDryerJsonStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	device, err := strconv.ParseInt(vars["device"], 10, 8)
+	var el *Electrolyser
+	if err == nil {
+		el, err = validateDryer(device)
+	}
+	if err != nil {
+		ReturnJSONErrorString(w, "Dryer", "Invalid dryer - "+vars["device"], http.StatusBadRequest, true)
+		return
+	}
+
+	SystemStatus.m.Lock()
+	bytesArray, err := json.Marshal(&el.status)
+	SystemStatus.m.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		ReturnJSONError(w, "Dryer", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+getDryerDeviceJsonStatus returns the status of one dryer
+URL = /dr/{device}
+*/
+func getDryerDeviceJsonStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	device, err := strconv.ParseInt(vars["device"], 10, 8)
+	if err == nil {
+		_, err = validateDryer(device)
+	}
+	if err != nil {
+		ReturnJSONErrorString(w, "Dryer", "Invalid dryer - "+vars["device"], http.StatusBadRequest, true)
+		return
+	}
+
+	SystemStatus.m.Lock()
+	dr := getDryerStatus(int(device))
+	SystemStatus.m.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(dr); err != nil {
+		ReturnJSONError(w, "Dryer", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+dryerCommand starts, stops or reboots a dryer
+URL = /dr/{device}/{command}
+*/
+func dryerCommand(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	device, err := strconv.ParseInt(vars["device"], 10, 8)
+	var el *Electrolyser
+	if err == nil {
+		el, err = validateDryer(device)
+	}
+	if err != nil {
+		ReturnJSONErrorString(w, "Dryer", "Invalid dryer - "+vars["device"], http.StatusBadRequest, true)
+		return
+	}
+	if err := checkDryerLockout(int(device)); err != nil {
+		ReturnJSONError(w, "Dryer", err, http.StatusConflict, true)
+		return
+	}
+	if !el.IsSwitchedOn() {
+		ReturnJSONErrorString(w, "Dryer", "Dryer is not powered on", http.StatusBadRequest, true)
+		return
+	}
+	var action func() error
+	switch vars["command"] {
+	case "start":
+		action = func() error {
+			el.StartDryer()
+			return nil
+		}
+	case "stop":
+		action = func() error {
+			el.StopDryer()
+			return nil
+		}
+	case "reboot":
+		action = el.RebootDryer
+	default:
+		ReturnJSONErrorString(w, "Dryer", "Unknown command - "+vars["command"], http.StatusBadRequest, true)
+		return
+	}
+	// Start and stop share a name so only the latest of them is kept if both are queued
+	name := "run"
+	if vars["command"] == "reboot" {
+		name = "reboot"
+	}
+	err = runCommand(drQueue(int(device)), name, PriorityManual, requestSource(r), action)
+	if err != nil {
+		ReturnJSONError(w, "Dryer", err, http.StatusInternalServerError, true)
+		return
+	}
+	log.Printf("Dryer %d %s requested", device, vars["command"])
+	returnJSONSuccess(w)
+}
+
+/*
+getDryerHistory returns the recorded dryer values between {from} and {to}
+URL = /dr/{device}/history/{from}/{to}
+*/
+func getDryerHistory(w http.ResponseWriter, r *http.Request) {
+	type Row struct {
+		Logged         int64   `json:"logged"`
+		Temp0          float64 `json:"temp0"`
+		Temp1          float64 `json:"temp1"`
+		Temp2          float64 `json:"temp2"`
+		Temp3          float64 `json:"temp3"`
+		InputPressure  float64 `json:"inputPressure"`
+		OutputPressure float64 `json:"outputPressure"`
+		Errors         uint16  `json:"errors"`
+		Warnings       uint16  `json:"warnings"`
+	}
+	var results []*Row
+
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	device, err := strconv.ParseInt(vars["device"], 10, 8)
+	if err == nil {
+		_, err = validateDryer(device)
+	}
+	if err != nil {
+		ReturnJSONErrorString(w, "Dryer", "Invalid dryer - "+vars["device"], http.StatusBadRequest, true)
+		return
+	}
+	tFrom, err := time.Parse("2006-1-2 15:4", vars["from"])
+	var tTo time.Time
+	if err == nil {
+		tTo, err = time.Parse("2006-1-2 15:4", vars["to"])
+	}
+	if err != nil {
+		ReturnJSONError(w, "Dryer", err, http.StatusBadRequest, true)
+		return
+	}
+	if tTo.Sub(tFrom) < 0 {
+		ReturnJSONErrorString(w, "Dryer", "From time must be before To time.", http.StatusBadRequest, true)
+		return
+	}
+	if pDB == nil {
+		ReturnJSONErrorString(w, "Dryer", "database is not connected", http.StatusServiceUnavailable, true)
+		return
+	}
+
+	var rows *sql.Rows
+	// If one hour or less return all data otherwise average out over one minute intervals
+	if tTo.Sub(tFrom) <= time.Hour {
+		rows, err = pDB.Query(`SELECT UNIX_TIMESTAMP(logged), Temp0 / 10, Temp1 / 10, Temp2 / 10, Temp3 / 10,
+       InputPressure / 10, OutputPressure / 10, Errors, Warnings
+  FROM DryerLog
+ WHERE Device = ? AND logged BETWEEN ? AND ?
+ ORDER BY logged`, device, vars["from"], vars["to"])
+	} else {
+		rows, err = pDB.Query(`SELECT (UNIX_TIMESTAMP(logged) DIV 60) * 60, ROUND(AVG(Temp0) / 10, 1), ROUND(AVG(Temp1) / 10, 1),
+       ROUND(AVG(Temp2) / 10, 1), ROUND(AVG(Temp3) / 10, 1), ROUND(AVG(InputPressure) / 10, 1), ROUND(AVG(OutputPressure) / 10, 1),
+       BIT_OR(Errors), BIT_OR(Warnings)
+  FROM DryerLog
+ WHERE Device = ? AND logged BETWEEN ? AND ?
+ GROUP BY UNIX_TIMESTAMP(logged) DIV 60
+ ORDER BY 1`, device, vars["from"], vars["to"])
+	}
+	if err != nil {
+		ReturnJSONError(w, "Dryer", err, http.StatusInternalServerError, true)
+		return
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Println("Error closing query - ", err)
+		}
+	}()
+	for rows.Next() {
+		row := new(Row)
+		var temp0, temp1, temp2, temp3, inputPressure, outputPressure sql.NullFloat64
+		var errors, warnings sql.NullInt64
+		if err := rows.Scan(&row.Logged, &temp0, &temp1, &temp2, &temp3, &inputPressure, &outputPressure, &errors, &warnings); err != nil {
+			log.Print(err)
+		} else {
+			row.Temp0 = temp0.Float64
+			row.Temp1 = temp1.Float64
+			row.Temp2 = temp2.Float64
+			row.Temp3 = temp3.Float64
+			row.InputPressure = inputPressure.Float64
+			row.OutputPressure = outputPressure.Float64
+			row.Errors = uint16(errors.Int64)
+			row.Warnings = uint16(warnings.Int64)
+			results = append(results, row)
+		}
+	}
+	if JSON, err := json.Marshal(results); err != nil {
+		ReturnJSONError(w, "Dryer", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(JSON)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+getDryerEvents returns the dryer warning and error transitions recorded over the last {days} days
+URL = /dr/{device}/events/{days}
+*/
+func getDryerEvents(w http.ResponseWriter, r *http.Request) {
+	type Row struct {
+		Logged    string `json:"logged"`
+		EventType string `json:"type"`
+		Code      uint16 `json:"code"`
+		Raised    bool   `json:"raised"`
+		Message   string `json:"message"`
+	}
+	var results []*Row
+
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	device, err := strconv.ParseInt(vars["device"], 10, 8)
+	if err == nil {
+		_, err = validateDryer(device)
+	}
+	if err != nil {
+		ReturnJSONErrorString(w, "Dryer", "Invalid dryer - "+vars["device"], http.StatusBadRequest, true)
+		return
+	}
+	days, err := strconv.Atoi(vars["days"])
+	if err != nil || days < 1 || days > 366 {
+		ReturnJSONErrorString(w, "Dryer", "days must be between 1 and 366", http.StatusBadRequest, true)
+		return
+	}
+	if pDB == nil {
+		ReturnJSONErrorString(w, "Dryer", "database is not connected", http.StatusServiceUnavailable, true)
+		return
+	}
+	rows, err := pDB.Query(`SELECT DATE_FORMAT(logged, '%Y-%m-%d %H:%i:%s'), EventType, Code, Raised, Message
+  FROM DryerEvents
+ WHERE Device = ? AND logged > DATE_ADD(NOW(), INTERVAL ? DAY)
+ ORDER BY logged`, device, 0-days)
+	if err != nil {
+		ReturnJSONError(w, "Dryer", err, http.StatusInternalServerError, true)
+		return
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Println("Error closing query - ", err)
+		}
+	}()
+	for rows.Next() {
+		row := new(Row)
+		if err := rows.Scan(&row.Logged, &row.EventType, &row.Code, &row.Raised, &row.Message); err != nil {
+			log.Print(err)
+		} else {
+			results = append(results, row)
+		}
+	}
+	if JSON, err := json.Marshal(results); err != nil {
+		ReturnJSONError(w, "Dryer", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(JSON)); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -67,6 +67,7 @@ type electrolyserStatus struct {
 	H2Flow                jsonFloat32        // 1008
 	ElState               uint16             // 1200
 	ElectrolyteLevel      electrolyteLevel   // (7000 - 7003 four booleans)
+	levelRead             bool               // ElectrolyteLevel has been read since the electrolyser was switched on
 	StackCurrent          jsonFloat32        // 7508
 	StackVoltage          jsonFloat32        // 7510
 	InnerH2Pressure       jsonFloat32        // 7512
@@ -87,6 +88,7 @@ type electrolyserStatus struct {
 	DryerOutputPressure   jsonFloat32
 	DryerErrors           uint16
 	DryerWarnings         uint16
+	lastUpdate            time.Time // When the values were last read successfully
 	mu                    sync.Mutex
 }
 
@@ -96,14 +98,16 @@ type Electrolyser struct {
 	OffDelayTime       time.Time
 	OffRequested       *time.Timer
 	ip                 net.IP
+	device             int // Position in SystemStatus.Electrolysers, fixed when the electrolyser is added
 	Client             *modbus.ModbusClient
 	clientConnected    bool
 	lastConnectAttempt time.Time
 	mu                 sync.Mutex
 }
 
-func NewElectrolyser(ip net.IP) *Electrolyser {
+func NewElectrolyser(ip net.IP, device int) *Electrolyser {
 	e := new(Electrolyser)
+	e.device = device
 	e.OnOffTime = time.Now().Add(0 - (time.Minute * 30))
 	e.OffDelayTime = time.Now()
 	e.OffRequested = nil
@@ -209,6 +213,7 @@ func (e *Electrolyser) CheckConnected() bool {
 		if time.Since(e.lastConnectAttempt) > time.Minute {
 			if err := e.Client.Open(); err != nil {
 				log.Print("Modbus client.open error - ", err)
+				healthFailure(elDataSource(e.index()), err)
 			} else {
 				e.clientConnected = true
 			}
@@ -218,6 +223,49 @@ func (e *Electrolyser) CheckConnected() bool {
 	return e.clientConnected
 }
 
+/*
+Close closes the Modbus TCP connection to the electrolyser
+*/
+func (e *Electrolyser) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.Client != nil && e.clientConnected {
+		if err := e.Client.Close(); err != nil {
+			log.Print(err)
+		}
+		e.clientConnected = false
+	}
+}
+
+/*
+index returns the position of the electrolyser in the system
+*/
+func (e *Electrolyser) index() int {
+	return e.device
+}
+
+/*
+lockedOut returns true and logs the reason if the electrolyser has been taken out of service
+*/
+func (e *Electrolyser) lockedOut() bool {
+	if err := checkElectrolyserLockout(e.index()); err != nil {
+		log.Print(err)
+		return true
+	}
+	return false
+}
+
+/*
+dryerLockedOut returns true and logs the reason if the dryer attached to this electrolyser has been taken out of service
+*/
+func (e *Electrolyser) dryerLockedOut() bool {
+	if err := checkDryerLockout(e.index()); err != nil {
+		log.Print(err)
+		return true
+	}
+	return false
+}
+
 func (e *Electrolyser) readEvents() {
 	if !e.CheckConnected() {
 		return
@@ -254,6 +302,12 @@ func (e *Electrolyser) ReadValues() {
 	if !e.CheckConnected() {
 		return
 	}
+	defer func() {
+		// Any read error closes the connection
+		if !e.clientConnected {
+			healthFailure(elDataSource(e.index()), fmt.Errorf("connection to %s lost while reading values", e.ip))
+		}
+	}()
 	values, err := e.Client.ReadFloat32s(7508, 6, modbus.INPUT_REGISTER)
 	if err != nil {
 		log.Print("Modbus reading float32 values - ", err)
@@ -352,6 +406,7 @@ func (e *Electrolyser) ReadValues() {
 	default:
 		e.status.ElectrolyteLevel = veryHigh
 	}
+	e.status.levelRead = true
 
 	rate, err := e.Client.ReadFloat32(1002, modbus.HOLDING_REGISTER)
 	//	log.Println("Current rate = ", rate)
@@ -399,6 +454,8 @@ func (e *Electrolyser) ReadValues() {
 	if e.status.Serial == "" {
 		e.status.Serial = e.ReadSerialNumber()
 	}
+	e.status.lastUpdate = time.Now()
+	healthSuccess(elDataSource(e.index()))
 }
 
 func (e *Electrolyser) GetSystemState() string {
@@ -722,7 +779,7 @@ func (e *Electrolyser) SendRateToElectrolyser(rate float32) error {
 func (e *Electrolyser) SetProduction(rate uint8) {
 	debugPrint("Set electrolyser %s to %d", e.ip, rate)
 
-	if !e.CheckConnected() {
+	if e.lockedOut() || !e.CheckConnected() {
 		return
 	}
 	if rate < 60 {
@@ -751,6 +808,9 @@ func (e *Electrolyser) SetProduction(rate uint8) {
 }
 
 func (e *Electrolyser) SetRestartPressure(pressure float32) error {
+	if err := checkElectrolyserLockout(e.index()); err != nil {
+		return err
+	}
 	if !e.CheckConnected() {
 		return fmt.Errorf("electrolyser is not turned on")
 	}
@@ -807,7 +867,11 @@ func (e *Electrolyser) SetRestartPressure(pressure float32) error {
 //Start -  Attempt to start the electrolyser - return true if successful
 // overrideHolOff will force an immediate start
 func (e *Electrolyser) Start(overrideHoldOff bool) bool {
-	if !e.CheckConnected() {
+	if err := checkEmergencyStop(); err != nil {
+		log.Print(err)
+		return false
+	}
+	if e.lockedOut() || !e.CheckConnected() {
 		return false
 	}
 	if overrideHoldOff || e.OnOffTime.Add(params.ElectrolyserHoldOffTime).Before(time.Now()) {
@@ -846,7 +910,12 @@ func (e *Electrolyser) setDelayedStop() {
 		}
 		select {
 		case <-e.OffRequested.C:
-			e.Stop(true)
+			if err := runCommand(elQueue(e.index()), "run", PriorityAutomatic, "delayed stop", func() error {
+				e.Stop(true)
+				return nil
+			}); err != nil {
+				log.Print(err)
+			}
 		}
 	}
 }
@@ -854,6 +923,7 @@ func (e *Electrolyser) setDelayedStop() {
 //Stop -  Attempt to stop the electrolyser - return true if successful
 // overrideHolOff will force an immediate stop
 func (e *Electrolyser) Stop(overrideHoldOff bool) bool {
+	// A locked out electrolyser can still be stopped so it can be made safe
 	if !e.CheckConnected() {
 		return false
 	}
@@ -893,10 +963,10 @@ func (e *Electrolyser) Stop(overrideHoldOff bool) bool {
 }
 
 func (e *Electrolyser) Preheat() {
-	if !e.CheckConnected() {
+	if checkEmergencyStop() != nil || e.lockedOut() || !e.CheckConnected() {
 		return
 	}
-	if e.status.ElectrolyteTemp < 26 {
+	if float32(e.status.ElectrolyteTemp) < params.PreheatTemperature {
 		err := e.Client.WriteRegister(1014, 1)
 		if err != nil {
 			log.Print("Preheat Request failed - ", err)
@@ -904,14 +974,38 @@ func (e *Electrolyser) Preheat() {
 				log.Print("Error closing modbus client - ", err)
 			}
 			e.clientConnected = false
-		} else {
-			debugPrint("Preheat request ignored as temperature is already %f C", e.status.ElectrolyteTemp)
 		}
+	} else {
+		debugPrint("Preheat request ignored as temperature is already %f C", e.status.ElectrolyteTemp)
 	}
 }
 
-func (e *Electrolyser) Reboot() {
+/*
+EmergencyStop sends the stop command straight away ignoring any hold off time, delayed stop or lockout
+*/
+func (e *Electrolyser) EmergencyStop() error {
 	if !e.CheckConnected() {
+		return fmt.Errorf("electrolyser is not connected")
+	}
+	if e.OffRequested != nil {
+		e.OffRequested.Stop()
+		e.OffRequested = nil
+	}
+	err := e.Client.WriteRegister(1000, 0)
+	if err != nil {
+		log.Print("Emergency stop of electrolyser failed - ", err)
+		if err := e.Client.Close(); err != nil {
+			log.Print("Error closing modbus client - ", err)
+		}
+		e.clientConnected = false
+		return err
+	}
+	e.OnOffTime = time.Now()
+	return nil
+}
+
+func (e *Electrolyser) Reboot() {
+	if e.lockedOut() || !e.CheckConnected() {
 		return
 	}
 	err := e.Client.WriteRegister(4, 1)
@@ -939,7 +1033,7 @@ func (e *Electrolyser) Locate() {
 }
 
 func (e *Electrolyser) EnableMaintenance() {
-	if !e.CheckConnected() {
+	if e.lockedOut() || !e.CheckConnected() {
 		return
 	}
 	err := e.Client.WriteRegister(6, 1)
@@ -953,7 +1047,7 @@ func (e *Electrolyser) EnableMaintenance() {
 }
 
 func (e *Electrolyser) DisableMaintenance() {
-	if !e.CheckConnected() {
+	if e.lockedOut() || !e.CheckConnected() {
 		return
 	}
 	err := e.Client.WriteRegister(6, 0)
@@ -967,7 +1061,7 @@ func (e *Electrolyser) DisableMaintenance() {
 }
 
 func (e *Electrolyser) Blowdown() {
-	if !e.CheckConnected() {
+	if e.lockedOut() || !e.CheckConnected() {
 		return
 	}
 	err := e.Client.WriteRegister(1010, 1)
@@ -981,7 +1075,7 @@ func (e *Electrolyser) Blowdown() {
 }
 
 func (e *Electrolyser) Refill() {
-	if !e.CheckConnected() {
+	if e.lockedOut() || !e.CheckConnected() {
 		return
 	}
 	err := e.Client.WriteRegister(1011, 1)
@@ -995,7 +1089,7 @@ func (e *Electrolyser) Refill() {
 }
 
 func (e *Electrolyser) StartDryer() {
-	if !e.CheckConnected() {
+	if e.dryerLockedOut() || !e.CheckConnected() {
 		return
 	}
 	err := e.Client.WriteRegister(6018, 1)
@@ -1009,7 +1103,7 @@ func (e *Electrolyser) StartDryer() {
 }
 
 func (e *Electrolyser) StopDryer() {
-	if !e.CheckConnected() {
+	if e.dryerLockedOut() || !e.CheckConnected() {
 		return
 	}
 	err := e.Client.WriteRegister(6019, 1)
@@ -1023,6 +1117,9 @@ func (e *Electrolyser) StopDryer() {
 }
 
 func (e *Electrolyser) RebootDryer() error {
+	if err := checkDryerLockout(e.index()); err != nil {
+		return err
+	}
 	if !e.CheckConnected() {
 		return fmt.Errorf("Dryer is not connected")
 	}
@@ -122,6 +122,8 @@ var RateArray = []Rate{{0, 0, 0},
 
 var CurrentRate uint8
 
+var rateRefreshBusy = make(chan struct{}, 1) // Holds a token while a rate refresh is in progress
+
 func init() {
 	CurrentRate = 0
 }
@@ -132,19 +134,11 @@ elCommand handles the On, Off, Start and Stop web commands to each electrolyser
 func elCommand(w http.ResponseWriter, r *http.Request) {
 	var body struct {
 		Command string `json:"command"`
-		device  int
 	}
 
-	vars := mux.Vars(r)
-	deviceStr := vars["device"]
-
-	switch deviceStr {
-	case "0":
-		body.device = 0
-	case "1":
-		body.device = 1
-	default:
-		ReturnJSONErrorString(w, "Electrolyser", "Invalid device - "+deviceStr, http.StatusBadRequest, true)
+	device, err := strconv.ParseInt(mux.Vars(r)["device"], 10, 8)
+	if err != nil {
+		ReturnJSONErrorString(w, "Electrolyser", "Invalid device - "+mux.Vars(r)["device"], http.StatusBadRequest, true)
 		return
 	}
 
@@ -158,66 +152,26 @@ func elCommand(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	body.Command = strings.ToLower(body.Command)
 
-	var err error
-	switch body.Command {
+	var cmdErr *CommandError
+	source := requestSource(r)
+	switch strings.ToLower(body.Command) {
 	case "on":
-
-		if body.device == 0 {
-			err = mbusRTU.EL0OnOff(true)
-		} else {
-			err = mbusRTU.EL1OnOff(true)
-		}
-		if err != nil {
-			ReturnJSONError(w, "Electrolyser", err, http.StatusInternalServerError, true)
-		}
+		cmdErr = commandElectrolyserPower(device, true, source)
 	case "off":
-		if body.device == 0 {
-			if len(SystemStatus.Electrolysers) > 0 {
-				if SystemStatus.Electrolysers[0].status.StackVoltage > jsonFloat32(params.ElectrolyserMaxStackVoltsTurnOff) {
-					ReturnJSONErrorString(w, "Electrolyser", "Electrolyser 0 not turned off because stack voltage is too high.", http.StatusBadRequest, true)
-					return
-				}
-			}
-			err = mbusRTU.EL0OnOff(false)
-		} else {
-			if len(SystemStatus.Electrolysers) > 1 {
-				if SystemStatus.Electrolysers[1].status.StackVoltage > jsonFloat32(params.ElectrolyserMaxStackVoltsTurnOff) {
-					ReturnJSONErrorString(w, "Electrolyser", "Electrolyser 1 not turned off because stack voltage is too high.", http.StatusBadRequest, true)
-					return
-				}
-			}
-			err = mbusRTU.EL1OnOff(false)
-		}
-		if err != nil {
-			ReturnJSONError(w, "Electrolyser", err, http.StatusInternalServerError, true)
-			return
-		}
+		cmdErr = commandElectrolyserPower(device, false, source)
 	case "start":
-		if SystemStatus.Electrolysers[body.device].IsSwitchedOn() {
-			if !SystemStatus.Electrolysers[body.device].Start(true) {
-				ReturnJSONErrorString(w, "Electrolyser", "Failed to start the electrolyser", http.StatusInternalServerError, true)
-				return
-			}
-		} else {
-			ReturnJSONErrorString(w, "Electrolyser", "Failed to start the electrolyser - it is not powered on", http.StatusBadRequest, true)
-			return
-		}
+		cmdErr = commandElectrolyserRun(device, true, source)
 	case "stop":
-		if SystemStatus.Electrolysers[body.device].IsSwitchedOn() {
-			if !SystemStatus.Electrolysers[body.device].Stop(true) {
-				ReturnJSONErrorString(w, "Electrolyser", "Failed to stop the electrolyser", http.StatusInternalServerError, true)
-				return
-			}
-		} else {
-			ReturnJSONErrorString(w, "Electrolyser", "Failed to stop the electrolyser - it is not powered on", http.StatusBadRequest, true)
-			return
-		}
+		cmdErr = commandElectrolyserRun(device, false, source)
 	default:
 		ReturnJSONErrorString(w, "Electrolyser", "Unknown command -"+body.Command, http.StatusBadRequest, true)
 		return
 	}
+	if cmdErr != nil {
+		ReturnCommandError(w, "Electrolyser", cmdErr)
+		return
+	}
 	returnJSONSuccess(w)
 }
 
@@ -228,6 +182,17 @@ func setElectrolyserPercentRate(rate uint8, device uint8) error {
 	if uint8(len(SystemStatus.Electrolysers)) <= device {
 		return fmt.Errorf("Invalid electrolyser")
 	}
+	if err := checkElectrolyserLockout(int(device)); err != nil {
+		return err
+	}
+	if rate > 0 {
+		if err := checkEmergencyStop(); err != nil {
+			return err
+		}
+	}
+	if rate > 0 && waterManager.ProductionBlocked() {
+		return fmt.Errorf("hydrogen production is blocked because the water conductivity is too high")
+	}
 	if SystemStatus.Electrolysers[device].status.SwitchedOn {
 		if rate > 0 {
 			if SystemStatus.Electrolysers[device].status.ElState == ElIdle && (rate > 0) {
@@ -253,6 +218,8 @@ func setElectrolyserPercentRate(rate uint8, device uint8) error {
 			}
 			if err != nil {
 				log.Print(err)
+			} else {
+				intendedState.SetElectrolyserPower(int(device), true)
 			}
 		}
 	}
@@ -263,17 +230,15 @@ func setElectrolyserPercentRate(rate uint8, device uint8) error {
 preheatElectrolyser tells the given electrolyser to preheat the electrolyte
 */
 func preheatElectrolyser(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	device := vars["device"]
-	deviceNum, err := strconv.ParseInt(device, 10, 8)
+	deviceNum, err := strconv.ParseInt(mux.Vars(r)["device"], 10, 8)
 	if err != nil {
-		log.Println("Failed to get the device. - ", err)
+		ReturnJSONError(w, "Electrolyser", err, http.StatusBadRequest, true)
+		return
 	}
-	if err := validateDevice(uint8(deviceNum)); err != nil {
-		log.Println("Invalid device requeted in preheat - ", err)
+	if err := commandElectrolyserPreheat(deviceNum, requestSource(r)); err != nil {
+		ReturnCommandError(w, "Electrolyser", err)
+		return
 	}
-
-	SystemStatus.Electrolysers[deviceNum].Preheat()
 	if _, err := fmt.Fprintf(w, "Electrolyser %d preheat requested", deviceNum); err != nil {
 		log.Println("Error returning status after electrolyser preheat request. - ", err)
 	}
@@ -282,9 +247,13 @@ func preheatElectrolyser(w http.ResponseWriter, r *http.Request) {
 /*
 preheatAllElectrolysers tells all electrolysers to preheat the electrolyte
 */
-func preheatAllElectrolysers(w http.ResponseWriter, _ *http.Request) {
-	for _, el := range SystemStatus.Electrolysers {
-		el.Preheat()
+func preheatAllElectrolysers(w http.ResponseWriter, r *http.Request) {
+	for device, el := range SystemStatus.Electrolysers {
+		el := el
+		dispatcher.Submit(elQueue(device), "preheat", PriorityManual, requestSource(r), func() error {
+			el.Preheat()
+			return nil
+		})
 	}
 	if _, err := fmt.Fprintf(w, "Electrolyser preheat requested"); err != nil {
 		log.Println("Error returning status after electrolyser preheat all request. - ", err)
@@ -295,18 +264,15 @@ func preheatAllElectrolysers(w http.ResponseWriter, _ *http.Request) {
 startElectrolyser starts the given electrolyser
 */
 func startElectrolyser(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	device := vars["device"]
-	deviceNum, err := strconv.ParseInt(device, 10, 8)
+	deviceNum, err := strconv.ParseInt(mux.Vars(r)["device"], 10, 8)
 	if err != nil {
-		log.Println("Failed to get the device. - ", err)
+		ReturnJSONError(w, "Electrolyser", err, http.StatusBadRequest, true)
+		return
 	}
-	if err := validateDevice(uint8(deviceNum)); err != nil {
-		log.Println("Invalid device requeted in selElOn - ", err)
+	if err := commandElectrolyserRun(deviceNum, true, requestSource(r)); err != nil {
+		ReturnCommandError(w, "Electrolyser", err)
+		return
 	}
-
-	// Start immediately
-	SystemStatus.Electrolysers[deviceNum].Start(true)
 	if _, err := fmt.Fprintf(w, "Electrolyser start requested"); err != nil {
 		log.Println("Error returning status after electrolyser start request. - ", err)
 	}
@@ -315,10 +281,14 @@ func startElectrolyser(w http.ResponseWriter, r *http.Request) {
 /*
 startAllElectrolysers starts all electrolysers
 */
-func startAllElectrolysers(w http.ResponseWriter, _ *http.Request) {
-	for _, el := range SystemStatus.Electrolysers {
+func startAllElectrolysers(w http.ResponseWriter, r *http.Request) {
+	for device, el := range SystemStatus.Electrolysers {
 		// Start all immediately
-		el.Start(true)
+		el := el
+		dispatcher.SubmitWithParams(elQueue(device), "run", PriorityManual, requestSource(r), CommandParams{"run": true}, func() error {
+			el.Start(true)
+			return nil
+		})
 	}
 	if _, err := fmt.Fprintf(w, "Electrolyser start requested"); err != nil {
 		log.Println("Error returning status after electrolyser start request. - ", err)
@@ -329,29 +299,29 @@ func startAllElectrolysers(w http.ResponseWriter, _ *http.Request) {
 stopElectrolyser stops the given electrolyser immediately
 */
 func stopElectrolyser(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	device := vars["device"]
-	deviceNum, err := strconv.ParseInt(device, 10, 8)
+	deviceNum, err := strconv.ParseInt(mux.Vars(r)["device"], 10, 8)
 	if err != nil {
 		ReturnJSONError(w, "Electrolyser", err, http.StatusBadRequest, true)
 		return
 	}
-	if err := validateDevice(uint8(deviceNum)); err != nil {
-		ReturnJSONError(w, "Electrolyser", err, http.StatusBadRequest, true)
+	if err := commandElectrolyserRun(deviceNum, false, requestSource(r)); err != nil {
+		ReturnCommandError(w, "Electrolyser", err)
 		return
 	}
-
-	SystemStatus.Electrolysers[deviceNum].Stop(true)
 	returnJSONSuccess(w)
 }
 
 /*
 stopAllElectrolysers stops all electrolysers
 */
-func stopAllElectrolysers(w http.ResponseWriter, _ *http.Request) {
-	for _, el := range SystemStatus.Electrolysers {
+func stopAllElectrolysers(w http.ResponseWriter, r *http.Request) {
+	for device, el := range SystemStatus.Electrolysers {
 		// Immediate shut down
-		el.Stop(true)
+		el := el
+		dispatcher.SubmitWithParams(elQueue(device), "run", PriorityManual, requestSource(r), CommandParams{"run": false}, func() error {
+			el.Stop(true)
+			return nil
+		})
 	}
 	if _, err := fmt.Fprintf(w, "Electrolyser stop requested"); err != nil {
 		log.Println("Error returning status after electrolyser stop request. - ", err)
@@ -362,25 +332,28 @@ func stopAllElectrolysers(w http.ResponseWriter, _ *http.Request) {
 rebootElectrolyser reboots the given electrolyser
 */
 func rebootElectrolyser(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	device := vars["device"]
-	deviceNum, err := strconv.ParseInt(device, 10, 8)
+	deviceNum, err := strconv.ParseInt(mux.Vars(r)["device"], 10, 8)
 	if err != nil {
-		log.Println("Failed to get the device. - ", err)
+		ReturnJSONError(w, "Electrolyser", err, http.StatusBadRequest, true)
+		return
 	}
-	if err := validateDevice(uint8(deviceNum)); err != nil {
-		log.Println("Invalid device requeted in selElOn - ", err)
+	if err := commandElectrolyserReboot(deviceNum, requestSource(r)); err != nil {
+		ReturnCommandError(w, "Electrolyser", err)
+		return
 	}
-	SystemStatus.Electrolysers[deviceNum].Reboot()
 	returnJSONSuccess(w)
 }
 
 /*
 rebootAllElectrolysers sends a reboot command to all electrolysers
 */
-func rebootAllElectrolysers(w http.ResponseWriter, _ *http.Request) {
-	for _, el := range SystemStatus.Electrolysers {
-		el.Reboot()
+func rebootAllElectrolysers(w http.ResponseWriter, r *http.Request) {
+	for device, el := range SystemStatus.Electrolysers {
+		el := el
+		dispatcher.Submit(elQueue(device), "reboot", PriorityManual, requestSource(r), func() error {
+			el.Reboot()
+			return nil
+		})
 	}
 	returnJSONSuccess(w)
 }
@@ -388,8 +361,9 @@ func rebootAllElectrolysers(w http.ResponseWriter, _ *http.Request) {
 /*
 setProductionRates sets all electrolysers to the selected rate.
 */
-func setProductionRates(rate uint8) error {
+func setProductionRates(rate uint8, priority CommandPriority, source string) error {
 	CurrentRate = rate
+	intendedState.SetRate(rate)
 	var elRates Rate
 	if len(SystemStatus.Electrolysers) > 1 {
 		elRates = RateArray[rate]
@@ -402,29 +376,31 @@ func setProductionRates(rate uint8) error {
 			elRates.el0 = uint8((rate*4)/10) + 60
 		}
 	}
-	if err := setElectrolyserPercentRate(elRates.el0, 0); err != nil {
-		return err
-	}
-	if len(SystemStatus.Electrolysers) > 1 {
-		if err := setElectrolyserPercentRate(elRates.el1, 1); err != nil {
-			return err
+	// Electrolysers that are locked out are left alone
+	var commands []*Command
+	if checkElectrolyserLockout(0) == nil {
+		commands = append(commands, dispatcher.SubmitWithParams(elQueue(0), "rate", priority, source, CommandParams{"rate": elRates.el0}, func() error {
+			return setElectrolyserPercentRate(elRates.el0, 0)
+		}))
+	}
+	if len(SystemStatus.Electrolysers) > 1 && checkElectrolyserLockout(1) == nil {
+		commands = append(commands, dispatcher.SubmitWithParams(elQueue(1), "rate", priority, source, CommandParams{"rate": elRates.el1}, func() error {
+			return setElectrolyserPercentRate(elRates.el1, 1)
+		}))
+	}
+	var result error
+	for _, c := range commands {
+		if err := c.Wait(); err != nil && result == nil {
+			result = err
 		}
 	}
-	return nil
+	return result
 }
 
 /**
 set the electrolyser selected rate.
 */
 func setElectrolyserRate(w http.ResponseWriter, r *http.Request) {
-	var responseJson struct {
-		EL0     int16    `json:"el0"`
-		EL1     int16    `json:"el1"`
-		Success bool     `json:"success"`
-		Errors  []string `json:"errors"`
-	}
-
-	responseJson.Success = true
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		ReturnJSONError(w, "Electrolyser", err, http.StatusInternalServerError, true)
@@ -434,63 +410,35 @@ func setElectrolyserRate(w http.ResponseWriter, r *http.Request) {
 		Rate int64 `json:"rate"`
 	}
 	if err = json.Unmarshal(body, &jRate); err != nil {
-		log.Println(err)
-		return
-	}
-	debugPrint("Set electrolyser : %d", jRate.Rate)
-
-	_, err = pDB.Exec("INSERT INTO ElectrolyserRequests (RateRequested) VALUES (?)", jRate.Rate)
-	if err != nil {
-		log.Println("Log Electrolyser Request - ", err)
-	}
-
-	// Return bad request if outside acceptable range of 0..100%
-	if jRate.Rate > 100 || jRate.Rate < 0 {
-		ReturnJSONErrorString(w, "Electrolyser", "Rate must be between 0 and 100", http.StatusBadRequest, true)
-		return
-	}
-
-	if (SystemStatus.Relays.FC0Run || SystemStatus.Relays.FC1Run) && jRate.Rate > 0 {
-		// Do not allow the electrolysers to run if one or more fuel cells are also running
-		jRate.Rate = 0
-
-		for _, el := range SystemStatus.Electrolysers {
-			// Immediate shut down
-			el.Stop(true)
-			CurrentRate = 0
-		}
-		ReturnJSONErrorString(w, "Electrolyser", "One or more Fuel cells are running. All electrolysers are stopped.", http.StatusBadRequest, false)
+		ReturnJSONError(w, "Electrolyser", err, http.StatusBadRequest, true)
 		return
 	}
-
-	if err := setProductionRates(uint8(jRate.Rate)); err != nil {
-		ReturnJSONError(w, "Electrolyser", err, http.StatusInternalServerError, true)
+	if err := commandElectrolyserRate(jRate.Rate, requestSource(r)); err != nil {
+		ReturnCommandError(w, "Electrolyser", err)
 		return
 	}
 	returnJSONSuccess(w)
 }
 
-/**
-Return the total electrolyser rate as a percentage, 0-100%
-*/
-func getElectrolyserRate(w http.ResponseWriter, _ *http.Request) {
+type ElectrolyserRate struct {
+	Rate     uint8   `json:"rate"`
+	Gas      float64 `json:"gas"`
+	GasValid bool    `json:"gasValid"` // False when the I/O board has stopped responding
+	Status   string  `json:"status"`
+}
 
-	var jReturnData struct {
-		Rate   uint8   `json:"rate"`
-		Gas    float64 `json:"gas"`
-		Status string  `json:"status"`
-	}
+/*
+getElectrolyserRateStatus returns the total electrolyser rate, the tank pressure and whether the electrolysers are
+idle, in standby or active
+*/
+func getElectrolyserRateStatus() *ElectrolyserRate {
+	jReturnData := new(ElectrolyserRate)
 
 	// Set the gas pressure
 	jReturnData.Gas = SystemStatus.Gas.TankPressure
+	jReturnData.GasValid = !commsWatchdog.isStale(DataSourceIO)
 	jReturnData.Rate = CurrentRate
 
-	// Perhaps we should ensure that the electrolysers are where we are saying they are.
-	//	debugPrint("Forcing rates in GetRate command")
-	if err := setProductionRates(CurrentRate); err != nil {
-		log.Println(err)
-	}
-
 	// Loop through and find if any of the electrolysers are on
 	ElectrolysersSwitchedOn := false
 	for _, e := range SystemStatus.Electrolysers {
@@ -539,11 +487,43 @@ func getElectrolyserRate(w http.ResponseWriter, _ *http.Request) {
 	} else {
 		// all electrolysers are off, so we report as OFF.
 		jReturnData.Rate = 0
-		CurrentRate = 0
+		// Keep the requested rate while the electrolysers that should be powered are still powering up
+		if !SystemStatus.Relays.EL0 && !SystemStatus.Relays.EL1 && !intendedState.ElectrolysersPowered() {
+			CurrentRate = 0
+			intendedState.SetRate(0)
+		}
 		jReturnData.Status = "OFF"
 	}
+	return jReturnData
+}
+
+/*
+refreshProductionRates sends the current rate to the electrolysers again so they are where we say they are. It is
+called from the logging loop and does nothing while the last refresh is still waiting on the dispatcher, while the
+emergency stop is latched or when no electrolyser should be powered.
+*/
+func refreshProductionRates() {
+	if len(SystemStatus.Electrolysers) == 0 || emergencyStop.Latched() || !intendedState.ElectrolysersPowered() {
+		return
+	}
+	select {
+	case rateRefreshBusy <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		defer func() { <-rateRefreshBusy }()
+		if err := setProductionRates(CurrentRate, PriorityAutomatic, "rate refresh"); err != nil {
+			log.Println(err)
+		}
+	}()
+}
 
-	if bytesArray, err := json.Marshal(jReturnData); err != nil {
+/**
+Return the total electrolyser rate as a percentage, 0-100%
+*/
+func getElectrolyserRate(w http.ResponseWriter, _ *http.Request) {
+	if bytesArray, err := json.Marshal(getElectrolyserRateStatus()); err != nil {
 		ReturnJSONError(w, "Electrolyser", err, http.StatusInternalServerError, true)
 	} else {
 		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
@@ -572,20 +552,12 @@ func setRestartPressure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := validateDevice(uint8(device)); err != nil {
-		log.Println("Invalid device requeted in setRestartPressure - ", err)
-	}
-	if (pressure < 2.0) || (pressure > 35.0) {
-		ReturnJSONErrorString(w, "Electrolyser", "Invalid pressure specified (2..35)", http.StatusBadRequest, true)
-		return
-	}
-
-	err = SystemStatus.Electrolysers[device].SetRestartPressure(float32(pressure))
-	if err != nil {
-		ReturnJSONError(w, "Electrolyser", err, http.StatusInternalServerError, true)
+	job, cmdErr := commandRestartPressure(device, pressure, requestSource(r))
+	if cmdErr != nil {
+		ReturnCommandError(w, "Electrolyser", cmdErr)
 		return
 	}
-	returnJSONSuccess(w)
+	returnJSONJob(w, job)
 }
 
 func getElectrolyserDetail(w http.ResponseWriter, r *http.Request) {
@@ -754,7 +726,13 @@ func getElectrolyserJsonStatus(w http.ResponseWriter, r *http.Request) {
 		getStatus(w, r)
 		return
 	}
-	bytesArray, err := json.Marshal(&SystemStatus.Electrolysers[device].status)
+	var status struct {
+		*electrolyserStatus
+		Lockout *Lockout `json:"lockout,omitempty"`
+	}
+	status.electrolyserStatus = &SystemStatus.Electrolysers[device].status
+	status.Lockout = getLockout(LockoutElectrolyser, strconv.Itoa(int(device)))
+	bytesArray, err := json.Marshal(&status)
 	if err != nil {
 		log.Println(&SystemStatus.Electrolysers[device].status)
 		if _, err := fmt.Fprint(w, errorToJson(err)); err != nil {
@@ -864,17 +842,12 @@ func getElectrolyserHistory(w http.ResponseWriter, r *http.Request) {
 /**
 Turn all electrolysers off
 */
-func setAllElOff(w http.ResponseWriter, _ *http.Request) {
-	//	log.Println("Setting all electrolysers off")
-	err := mbusRTU.EL1OnOff(false)
-	if err != nil {
-		ReturnJSONError(w, "Electrolyser", err, http.StatusInternalServerError, true)
-		return
-	}
-	err = mbusRTU.EL0OnOff(false)
-	if err != nil {
-		ReturnJSONError(w, "Electrolyser", err, http.StatusInternalServerError, true)
-		return
+func setAllElOff(w http.ResponseWriter, r *http.Request) {
+	for _, device := range []int64{1, 0} {
+		if err := commandElectrolyserPower(device, false, requestSource(r)); err != nil {
+			ReturnCommandError(w, fmt.Sprintf("Electrolyser-%d", device), err)
+			return
+		}
 	}
 	returnJSONSuccess(w)
 }
@@ -883,65 +856,29 @@ func setAllElOff(w http.ResponseWriter, _ *http.Request) {
 Turn the given electrolyser off
 */
 func setElOff(w http.ResponseWriter, r *http.Request) {
-	var jErr JSONError
-	vars := mux.Vars(r)
-	device := vars["device"]
-	switch device {
-	case "0":
-		if SystemStatus.Electrolysers[0].status.StackVoltage > 30 {
-			log.Println("Electrolyser 1 not turned off because stack voltage is too high.")
-			var jErr JSONError
-			log.Println(jErr.AddErrorString("Electrolyser", "Electrolyser 1 not turned off because stack voltage is too high."))
-			jErr.ReturnError(w, 400)
-			return
-		}
-		if err := mbusRTU.EL0OnOff(false); err != nil {
-			ReturnJSONError(w, "Electrolyser-0", err, http.StatusInternalServerError, true)
-			return
-		}
-	case "1":
-		if len(SystemStatus.Electrolysers) > 1 {
-			if SystemStatus.Electrolysers[1].status.StackVoltage > 30 {
-				log.Println(jErr.AddErrorString("Electrolyser", "Electrolyser 2 not turned off because stack voltage is too high."))
-				jErr.ReturnError(w, 400)
-				return
-			}
-		}
-		if err := mbusRTU.EL1OnOff(false); err != nil {
-			ReturnJSONError(w, "Electrolyser-1", err, http.StatusInternalServerError, true)
-			return
-		}
-	default:
-		ReturnJSONErrorString(w, "Electrolyser", fmt.Sprintf("Invalid electrolyser specified - %s", device), http.StatusBadRequest, false)
+	device, err := strconv.ParseInt(mux.Vars(r)["device"], 10, 8)
+	if err != nil {
+		ReturnJSONErrorString(w, "Electrolyser", fmt.Sprintf("Invalid electrolyser specified - %s", mux.Vars(r)["device"]), http.StatusBadRequest, false)
+		return
+	}
+	if err := commandElectrolyserPower(device, false, requestSource(r)); err != nil {
+		ReturnCommandError(w, fmt.Sprintf("Electrolyser-%d", device), err)
 		return
 	}
 	returnJSONSuccess(w)
 }
 
 /**
-Turn the given electrolyser on
+Turn the given electrolyser on. This route numbers the electrolysers from 1.
 */
 func setElOn(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	device := vars["device"]
-	deviceNum, err := strconv.ParseInt(device, 10, 8)
-	if err != nil {
-		log.Println("Failed to get the device. - ", err)
-	}
-	if err := validateDevice(uint8(deviceNum)); err != nil {
-		log.Println("Invalid device requeted in selElOn - ", err)
-	}
-	switch deviceNum {
-	case 1:
-		err = mbusRTU.EL0OnOff(true)
-	case 2:
-		err = mbusRTU.EL1OnOff(true)
-	default:
+	deviceNum, err := strconv.ParseInt(mux.Vars(r)["device"], 10, 8)
+	if err != nil || deviceNum < 1 || deviceNum > 2 {
 		ReturnJSONErrorString(w, "Electrolyser", "Invalid electrolyser specified", http.StatusBadRequest, false)
 		return
 	}
-	if err != nil {
-		ReturnJSONError(w, "Electrolyser", err, http.StatusInternalServerError, true)
+	if err := commandElectrolyserPower(deviceNum-1, true, requestSource(r)); err != nil {
+		ReturnCommandError(w, "Electrolyser", err)
 		return
 	}
 	returnJSONSuccess(w)
@@ -950,21 +887,22 @@ func setElOn(w http.ResponseWriter, r *http.Request) {
 /**
 Turn all electrolysers on
 */
-func setAllElOn(w http.ResponseWriter, _ *http.Request) {
-
-	if err := mbusRTU.EL0OnOff(true); err != nil {
-		ReturnJSONError(w, "Electrolyser-0", err, http.StatusInternalServerError, true)
-		return
-	}
-	if err := mbusRTU.EL1OnOff(true); err != nil {
-		ReturnJSONError(w, "Electrolyser-1", err, http.StatusInternalServerError, true)
-		return
+func setAllElOn(w http.ResponseWriter, r *http.Request) {
+	for _, device := range []int64{0, 1} {
+		if err := commandElectrolyserPower(device, true, requestSource(r)); err != nil {
+			ReturnCommandError(w, fmt.Sprintf("Electrolyser-%d", device), err)
+			return
+		}
 	}
 	returnJSONSuccess(w)
 }
 
-func rebootDryer(w http.ResponseWriter, _ *http.Request) {
-	if err := SystemStatus.Electrolysers[0].RebootDryer(); err != nil {
+func rebootDryer(w http.ResponseWriter, r *http.Request) {
+	if err := checkDryerLockout(0); err != nil {
+		ReturnJSONError(w, "Dryer", err, http.StatusConflict, true)
+		return
+	}
+	if err := runCommand(drQueue(0), "reboot", PriorityManual, requestSource(r), SystemStatus.Electrolysers[0].RebootDryer); err != nil {
 		ReturnJSONError(w, "Dryer", err, http.StatusInternalServerError, true)
 		return
 	}
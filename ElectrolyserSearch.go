@@ -5,6 +5,7 @@ import (
 	"github.com/simonvetter/modbus"
 	"log"
 	"net"
+	"net/http"
 	"time"
 )
 
@@ -31,7 +32,7 @@ func GetOurIP() (net.IP, error) {
 SearchForElectrolyser will turn on the relevant relay and search the subnet that we are in for an electorlyser to come on line.
 If a new electrolyser is found it adds it to the chain.
 */
-func SearchForElectrolyser() error {
+func SearchForElectrolyser(source string) error {
 	device := len(SystemStatus.Electrolysers)
 	OurIP, err := GetOurIP()
 	if err != nil {
@@ -41,46 +42,54 @@ func SearchForElectrolyser() error {
 	// First we lock the electrolysers so they do not get turned off when we are searching
 	SystemStatus.ElectrolyserLock = true
 	defer func() { SystemStatus.ElectrolyserLock = false }()
-	switch device {
-	case 0:
-		if err := mbusRTU.EL0OnOff(true); err != nil {
-			log.Print(err)
-		}
-	case 1:
-		if err := mbusRTU.EL1OnOff(true); err != nil {
-			log.Print(err)
-		}
-	default:
+	if device > 1 {
 		return fmt.Errorf("we already have two electrolysers registered")
 	}
+	if err := searchPower(device, true, source); err != nil {
+		log.Print(err)
+	}
 
 	// Delay for 15 seconds to let the electrolyser power up.
 	time.Sleep(time.Second * 15)
 
 	if IP := scan(OurIP); IP != nil {
-		SystemStatus.Electrolysers = append(SystemStatus.Electrolysers, NewElectrolyser(IP))
+		SystemStatus.Electrolysers = append(SystemStatus.Electrolysers, NewElectrolyser(IP, device))
 	}
 	return nil
 }
 
 /*
-AcquireElectrolysers attempts to find two electrolysers
+searchPower turns an electrolyser's power relay on or off for the search through its command queue
 */
-func AcquireElectrolysers() {
-	// Wait for the ModbusRTU system to get started so we can turn the relays on.
+func searchPower(device int, on bool, source string) error {
+	return runCommandWithParams(elQueue(device), "power", PriorityManual, source, CommandParams{"on": on}, func() error {
+		return mbusRTU.ELOnOff(uint8(device), on)
+	})
+}
+
+/*
+AcquireElectrolysers attempts to find two electrolysers. Each one has to be powered up on its own to tell them apart,
+so any that were on are turned off for the search and turned back on again afterwards. It is run as a job.
+*/
+func AcquireElectrolysers(job *Job) error {
+	// Wait for the ModbusRTU system to get started and read the relays so we can turn them on.
+	job.Step("Waiting for the Modbus relays")
 	for {
-		if mbusRTU.Active {
+		if err := waitForModbus(time.Second * 5); err == nil {
 			break
 		}
-		time.Sleep(time.Second * 5)
 	}
+	mbusRTU.muBuffer.Lock()
+	wasOn0, wasOn1 := mbusRTU.el0, mbusRTU.el1
+	mbusRTU.muBuffer.Unlock()
 
 	// Electrolyser to off if they are on.
-	if mbusRTU.el0 || mbusRTU.el1 {
-		if err := mbusRTU.EL0OnOff(false); err != nil {
+	if wasOn0 || wasOn1 {
+		job.Step("Turning the electrolysers off for the search")
+		if err := searchPower(0, false, job.Source); err != nil {
 			log.Println(err)
 		}
-		if err := mbusRTU.EL1OnOff(false); err != nil {
+		if err := searchPower(1, false, job.Source); err != nil {
 			log.Println(err)
 		}
 
@@ -89,17 +98,18 @@ func AcquireElectrolysers() {
 
 	// Clear any existing electrolyser registrations
 	params.Electrolysers = nil
-	// Make sure we turn the electrolysers off when we are done.
+	// Make sure we put the electrolyser power back the way we found it when we are done.
 	defer func() {
-		if err := mbusRTU.EL0OnOff(false); err != nil {
+		if err := searchPower(0, wasOn0, job.Source); err != nil {
 			log.Print(err)
 		}
-		if err := mbusRTU.EL1OnOff(false); err != nil {
+		if err := searchPower(1, wasOn1, job.Source); err != nil {
 			log.Print(err)
 		}
 	}()
 	// Search for the first electrolyser
-	if err := SearchForElectrolyser(); err == nil {
+	job.Step("Searching for the first electrolyser")
+	if err := SearchForElectrolyser(job.Source); err == nil && len(SystemStatus.Electrolysers) > 0 {
 		// Give it 5 seconds then get the serial number
 		time.Sleep(time.Second * 10)
 
@@ -109,20 +119,24 @@ func AcquireElectrolysers() {
 		log.Print("Got serial, adding to settings.")
 		el.IP = SystemStatus.Electrolysers[0].GetIPString()
 		params.Electrolysers = append(params.Electrolysers, el)
+		job.Step("Found electrolyser %s at %s", el.Serial, el.IP)
 
 		// Search for a second electrolyser
-		if err := SearchForElectrolyser(); err == nil {
+		job.Step("Searching for a second electrolyser")
+		if err := SearchForElectrolyser(job.Source); err == nil && len(SystemStatus.Electrolysers) > 1 {
 			time.Sleep(time.Second * 10)
 
 			el := new(ElectrolyserConfig)
 			el.Serial = SystemStatus.Electrolysers[1].GetSerial()
 			el.IP = SystemStatus.Electrolysers[1].GetIPString()
 			params.Electrolysers = append(params.Electrolysers, el)
-		} else {
+			job.Step("Found electrolyser %s at %s", el.Serial, el.IP)
+		} else if err != nil {
 			log.Print(err)
 		}
-	} else {
+	} else if err != nil {
 		log.Print(err)
+		return err
 	}
 	if len(params.Electrolysers) > 0 {
 		if err := params.WriteSettings(); err != nil {
@@ -134,12 +148,32 @@ func AcquireElectrolysers() {
 		plural = "s"
 	}
 	log.Printf("Found %d electrolyser%s", len(SystemStatus.Electrolysers), plural)
-	if err := mbusRTU.EL0OnOff(false); err != nil {
-		log.Print(err)
+	job.Step("Found %d electrolyser%s", len(SystemStatus.Electrolysers), plural)
+	if len(SystemStatus.Electrolysers) == 0 {
+		return fmt.Errorf("no electrolysers found")
 	}
-	if err := mbusRTU.EL1OnOff(false); err != nil {
-		log.Print(err)
+	return nil
+}
+
+/*
+searchElectrolysers starts a search for the electrolysers. Only allowed when none are registered.
+URL = /el/search
+*/
+func searchElectrolysers(w http.ResponseWriter, r *http.Request) {
+	if err := checkEmergencyStop(); err != nil {
+		ReturnJSONError(w, "Electrolyser", err, http.StatusConflict, true)
+		return
+	}
+	if job := runningJob("electrolyser search", "el"); job != nil {
+		returnJSONJob(w, job)
+		return
+	}
+	if len(SystemStatus.Electrolysers) > 0 {
+		ReturnJSONErrorString(w, "Electrolyser", "electrolysers are already registered", http.StatusConflict, true)
+		return
 	}
+	job := startJob("electrolyser search", "el", requestSource(r), AcquireElectrolysers)
+	returnJSONJob(w, job)
 }
 
 func tryConnect(host net.IP, port int) error {
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/***************
+Emergency stop brings the whole plant to a safe state with a single command or from a hardware input.
+The sequence is run in order: stop the fuel cells, close the gas solenoid, stop the electrolysers and then drop the
+electrolyser power relays. Once triggered the emergency stop stays latched, refusing any command that would start
+something, until it is explicitly reset. Off commands are allowed through device lockouts while it is latched.
+*/
+
+const ESTOPELECTROLYSERSTOPDELAY = time.Second * 5 // Time allowed for the electrolysers to stop before the power is removed
+const ESTOPDEFAULTTHRESHOLD = 500                  // Default raw analogue reading below which the hardware input is active
+
+const (
+	EStopStepPending = "pending"
+	EStopStepRunning = "running"
+	EStopStepDone    = "done"
+	EStopStepFailed  = "failed"
+)
+
+type EStopStep struct {
+	Name     string    `json:"name"`
+	Status   string    `json:"status"`
+	Errors   []string  `json:"errors"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+type EmergencyStop struct {
+	latched   bool
+	running   bool
+	source    string
+	reason    string
+	name      string
+	triggered time.Time
+	steps     []*EStopStep
+	sequence  sync.WaitGroup
+	mu        sync.Mutex
+}
+
+var emergencyStop = new(EmergencyStop)
+
+/*
+Latched returns true if the emergency stop has been triggered and not yet reset
+*/
+func (es *EmergencyStop) Latched() bool {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.latched
+}
+
+/*
+checkEmergencyStop returns an error if the emergency stop is latched. Use it to refuse any command that would start something.
+*/
+func checkEmergencyStop() error {
+	if emergencyStop.Latched() {
+		return fmt.Errorf("emergency stop is active - reset it before starting anything")
+	}
+	return nil
+}
+
+/*
+Trigger latches the emergency stop and starts the safe-state sequence. It does nothing if it is already latched.
+*/
+func (es *EmergencyStop) Trigger(source string, reason string, name string) {
+	es.mu.Lock()
+	if es.latched {
+		es.mu.Unlock()
+		return
+	}
+	es.latched = true
+	es.running = true
+	es.source = source
+	es.reason = reason
+	es.name = name
+	es.triggered = time.Now()
+	es.steps = []*EStopStep{
+		{Name: "Stop fuel cells", Status: EStopStepPending},
+		{Name: "Close gas solenoid", Status: EStopStepPending},
+		{Name: "Stop electrolysers", Status: EStopStepPending},
+		{Name: "Turn off electrolyser power", Status: EStopStepPending},
+	}
+	es.mu.Unlock()
+
+	log.Printf("EMERGENCY STOP triggered from %s by %s - %s", source, name, reason)
+	intendedState.SetEmergencyStop(true, source, reason, name, es.triggered)
+	es.sequence.Add(1)
+	go es.run()
+}
+
+/*
+runStep executes one step of the sequence and records its progress
+*/
+func (es *EmergencyStop) runStep(idx int, step func() []error) {
+	es.mu.Lock()
+	es.steps[idx].Status = EStopStepRunning
+	es.steps[idx].Started = time.Now()
+	name := es.steps[idx].Name
+	es.mu.Unlock()
+
+	errs := step()
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.steps[idx].Finished = time.Now()
+	es.steps[idx].Status = EStopStepDone
+	for _, err := range errs {
+		log.Printf("Emergency stop : %s - %v", name, err)
+		es.steps[idx].Errors = append(es.steps[idx].Errors, err.Error())
+		es.steps[idx].Status = EStopStepFailed
+	}
+	if len(errs) == 0 {
+		log.Printf("Emergency stop : %s - done", name)
+	}
+}
+
+/*
+run carries out the safe-state sequence. Every step is attempted even if an earlier one fails.
+*/
+func (es *EmergencyStop) run() {
+	defer func() {
+		es.mu.Lock()
+		es.running = false
+		es.mu.Unlock()
+		es.sequence.Done()
+	}()
+
+	es.runStep(0, func() (errs []error) {
+		for device := uint8(0); device < 2; device++ {
+			device := device
+			if err := runCommandWithParams(fcQueue(device), "run", PrioritySafety, "emergency stop", CommandParams{"run": false}, func() error {
+				return mbusRTU.FCRunStop(device, false)
+			}); err != nil {
+				errs = append(errs, fmt.Errorf("fuel cell %d - %v", device, err))
+			}
+		}
+		return
+	})
+	es.runStep(1, func() (errs []error) {
+		if err := runCommandWithParams(RelayQueue, "gas", PrioritySafety, "emergency stop", CommandParams{"on": false}, func() error {
+			return mbusRTU.GasOnOff(false)
+		}); err != nil {
+			errs = append(errs, err)
+		}
+		return
+	})
+	es.runStep(2, func() (errs []error) {
+		for device, el := range SystemStatus.Electrolysers {
+			if !el.IsSwitchedOn() {
+				continue
+			}
+			if err := runCommandWithParams(elQueue(device), "run", PrioritySafety, "emergency stop", CommandParams{"run": false}, el.EmergencyStop); err != nil {
+				errs = append(errs, fmt.Errorf("electrolyser %d - %v", device, err))
+			}
+		}
+		if len(SystemStatus.Electrolysers) > 0 {
+			time.Sleep(ESTOPELECTROLYSERSTOPDELAY)
+		}
+		return
+	})
+	es.runStep(3, func() (errs []error) {
+		for device := uint8(0); device < 2; device++ {
+			device := device
+			if err := runCommandWithParams(elQueue(int(device)), "power", PrioritySafety, "emergency stop", CommandParams{"on": false}, func() error {
+				return mbusRTU.ELOnOff(device, false)
+			}); err != nil {
+				errs = append(errs, fmt.Errorf("electrolyser %d - %v", device, err))
+			} else {
+				intendedState.SetElectrolyserPower(int(device), false)
+			}
+		}
+		return
+	})
+	log.Println("Emergency stop sequence complete")
+}
+
+/*
+Wait blocks until any running safe-state sequence has finished
+*/
+func (es *EmergencyStop) Wait() {
+	es.sequence.Wait()
+}
+
+/*
+Reset clears the latch. It is refused while the sequence is still running or the hardware input is still active.
+*/
+func (es *EmergencyStop) Reset(name string) error {
+	if active, err := hardwareEmergencyStopActive(); err != nil {
+		return fmt.Errorf("the emergency stop input is faulty - %v", err)
+	} else if active {
+		return fmt.Errorf("the emergency stop input is still active")
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if !es.latched {
+		return fmt.Errorf("emergency stop is not active")
+	}
+	if es.running {
+		return fmt.Errorf("emergency stop sequence is still running")
+	}
+	es.latched = false
+	intendedState.SetEmergencyStop(false, "", "", "", time.Time{})
+	log.Printf("Emergency stop reset by %s", name)
+	return nil
+}
+
+/*
+restore latches the emergency stop after a restart without running the sequence again
+*/
+func (es *EmergencyStop) restore(source string, reason string, name string, triggered time.Time) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.latched = true
+	es.source = source
+	es.reason = reason
+	es.name = name
+	es.triggered = triggered
+	log.Printf("Emergency stop is still latched from %s by %s - %s", source, name, reason)
+}
+
+/*
+hardwareEmergencyStopActive reads the configured emergency stop input.
+Inputs are treated as normally closed so a broken wire trips the emergency stop unless the input is inverted.
+An error is returned if the input can't be trusted, because it doesn't exist, because the I/O board has never been
+read or because the inputs have not been read for longer than the stale data timeout.
+*/
+func hardwareEmergencyStopActive() (bool, error) {
+	if mbusRTU == nil || params.EmergencyStopInput == 0 {
+		return false, nil
+	}
+	if commsWatchdog.isStale(DataSourceIO) {
+		return false, fmt.Errorf("the I/O board data is stale")
+	}
+	timeout := staleDataTimeout()
+	mbusRTU.muBuffer.Lock()
+	defer mbusRTU.muBuffer.Unlock()
+	if mbusRTU.lastIOUpdate.IsZero() {
+		return false, fmt.Errorf("the I/O board has not been read")
+	}
+	if time.Since(mbusRTU.lastIOUpdate) > timeout {
+		return false, fmt.Errorf("the inputs have not been read since %s", mbusRTU.lastIOUpdate.Format("2006-01-02 15:04:05"))
+	}
+	var active bool
+	if params.EmergencyStopInput > 0 {
+		// Analogue channel
+		if params.EmergencyStopInput > len(mbusRTU.rawInputs) {
+			return false, fmt.Errorf("there is no analogue input %d", params.EmergencyStopInput)
+		}
+		active = mbusRTU.rawInputs[params.EmergencyStopInput-1] < uint16(params.EmergencyStopThreshold)
+	} else {
+		// Digital channel
+		channel := 0 - params.EmergencyStopInput
+		if mbusRTU.lastDigitalUpdate.IsZero() {
+			return false, fmt.Errorf("the digital inputs have not been read")
+		}
+		if channel > len(mbusRTU.digitalInputs) {
+			return false, fmt.Errorf("there is no digital input %d", channel)
+		}
+		if time.Since(mbusRTU.lastDigitalUpdate) > timeout {
+			return false, fmt.Errorf("the digital inputs have not been read since %s", mbusRTU.lastDigitalUpdate.Format("2006-01-02 15:04:05"))
+		}
+		active = !mbusRTU.digitalInputs[channel-1]
+	}
+	if params.EmergencyStopInvert {
+		active = !active
+	}
+	return active, nil
+}
+
+/*
+checkHardwareEmergencyStop triggers the emergency stop if the hardware input is active or can't be read
+*/
+func checkHardwareEmergencyStop() {
+	active, err := hardwareEmergencyStopActive()
+	if err != nil {
+		emergencyStop.Trigger("hardware input", "Emergency stop input fault - "+err.Error(), "")
+	} else if active {
+		emergencyStop.Trigger("hardware input", "Emergency stop input activated", "")
+	}
+}
+
+type EmergencyStopStatus struct {
+	Latched     bool         `json:"latched"`
+	Running     bool         `json:"running"`
+	InputActive bool         `json:"inputActive"`
+	InputFault  string       `json:"inputFault,omitempty"`
+	Source      string       `json:"source,omitempty"`
+	Reason      string       `json:"reason,omitempty"`
+	Name        string       `json:"name,omitempty"`
+	Triggered   string       `json:"triggered,omitempty"`
+	Steps       []*EStopStep `json:"steps"`
+}
+
+/*
+getEmergencyStopState returns the emergency stop state and the progress of the safe-state sequence
+*/
+func getEmergencyStopState() *EmergencyStopStatus {
+	status := new(EmergencyStopStatus)
+	active, err := hardwareEmergencyStopActive()
+	status.InputActive = active || err != nil
+	if err != nil {
+		status.InputFault = err.Error()
+	}
+	emergencyStop.mu.Lock()
+	status.Latched = emergencyStop.latched
+	status.Running = emergencyStop.running
+	status.Source = emergencyStop.source
+	status.Reason = emergencyStop.reason
+	status.Name = emergencyStop.name
+	if !emergencyStop.triggered.IsZero() {
+		status.Triggered = emergencyStop.triggered.Format("2006-01-02 15:04:05")
+	}
+	status.Steps = []*EStopStep{}
+	for _, step := range emergencyStop.steps {
+		s := *step
+		status.Steps = append(status.Steps, &s)
+	}
+	emergencyStop.mu.Unlock()
+	return status
+}
+
+/*
+getEmergencyStopStatus returns the emergency stop state and the progress of the safe-state sequence
+URL = /estop
+*/
+func getEmergencyStopStatus(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(getEmergencyStopState()); err != nil {
+		ReturnJSONError(w, "Emergency Stop", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+setEmergencyStop triggers the emergency stop
+URL = /estop
+payload = {"reason":"Gas leak","name":"Ian"} both are optional
+*/
+func setEmergencyStop(w http.ResponseWriter, r *http.Request) {
+	var jBody struct {
+		Reason string `json:"reason"`
+		Name   string `json:"name"`
+	}
+	// Never refuse an emergency stop because of a bad payload
+	if body, err := io.ReadAll(r.Body); err == nil && len(body) > 0 {
+		if err := json.Unmarshal(body, &jBody); err != nil {
+			log.Println("Invalid emergency stop payload - ", err)
+		}
+	}
+	if jBody.Reason == "" {
+		jBody.Reason = "Emergency stop requested"
+	}
+	emergencyStop.Trigger(requestSource(r), jBody.Reason, jBody.Name)
+	returnJSONSuccess(w)
+}
+
+/*
+resetEmergencyStop clears the emergency stop latch
+URL = /estop/reset
+payload = {"name":"Ian"}
+*/
+func resetEmergencyStop(w http.ResponseWriter, r *http.Request) {
+	var jBody struct {
+		Name string `json:"name"`
+	}
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &jBody)
+	}
+	if err != nil {
+		ReturnJSONError(w, "Emergency Stop", err, http.StatusBadRequest, true)
+		return
+	}
+	if err := commandResetEmergencyStop(jBody.Name); err != nil {
+		ReturnCommandError(w, "Emergency Stop", err)
+		return
+	}
+	returnJSONSuccess(w)
+}
@@ -6,9 +6,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"net/smtp"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
@@ -158,7 +155,7 @@ func (fcm *FCM804) Clear() {
 func (fcm *FCM804) getLastUpdate() time.Time {
 	fcm.mu.Lock()
 	defer fcm.mu.Unlock()
-	return fcm.FaultTime
+	return fcm.LastUpdate
 }
 func (fcm *FCM804) getClearTime() time.Time {
 	fcm.mu.Lock()
@@ -647,6 +644,66 @@ func (fcm *FCM804) GetState() (state string) {
 	return
 }
 
+/*
+CANLiveValues are the values last received from a fuel cell over the CAN bus, scaled to engineering units
+*/
+type CANLiveValues struct {
+	LastUpdate          time.Time `json:"lastUpdate"`
+	Power               int16     `json:"power"`               // W
+	Volts               float32   `json:"volts"`               // V
+	Amps                float32   `json:"amps"`                // A
+	AnodePressure       float32   `json:"anodePressure"`       // mBar
+	InletTemp           float32   `json:"inletTemp"`           // C
+	OutletTemp          float32   `json:"outletTemp"`          // C
+	DCDCVoltageSetpoint float32   `json:"dcdcVoltageSetpoint"` // V
+	DCDCCurrentLimit    float32   `json:"dcdcCurrentLimit"`    // A
+	LouverPosition      float32   `json:"louverPosition"`      // % open
+	FanDuty             float32   `json:"fanDuty"`             // %
+	Run                 bool      `json:"run"`
+	Standby             bool      `json:"standby"`
+	Fault               bool      `json:"fault"`
+	Inactive            bool      `json:"inactive"`
+	OnLoad              bool      `json:"onLoad"`
+	Derated             bool      `json:"derated"`
+	DCDCEnabled         bool      `json:"dcdcEnabled"`
+	FaultA              uint32    `json:"faultA"`
+	FaultB              uint32    `json:"faultB"`
+	FaultC              uint32    `json:"faultC"`
+	FaultD              uint32    `json:"faultD"`
+}
+
+/*
+liveValues copies the latest CAN values under a single lock so they are consistent with each other
+*/
+func (fcm *FCM804) liveValues() *CANLiveValues {
+	fcm.mu.Lock()
+	defer fcm.mu.Unlock()
+	return &CANLiveValues{
+		LastUpdate:          fcm.LastUpdate,
+		Power:               fcm.OutputPower,
+		Volts:               float32(fcm.OutputVolts) / 100,
+		Amps:                float32(fcm.OutputCurrent) / 100,
+		AnodePressure:       float32(fcm.AnodePressure) / 10,
+		InletTemp:           float32(fcm.InletTemp) / 100,
+		OutletTemp:          float32(fcm.OutletTemp) / 100,
+		DCDCVoltageSetpoint: float32(fcm.DCDCvoltageSetpoint) / 100,
+		DCDCCurrentLimit:    float32(fcm.DCDCcurrentlimit) / 100,
+		LouverPosition:      float32(fcm.LouverPosition) / 100,
+		FanDuty:             float32(fcm.FanSPduty) / 100,
+		Run:                 fcm.StateInformation.Run,
+		Standby:             fcm.StateInformation.Standby,
+		Fault:               fcm.StateInformation.Fault,
+		Inactive:            fcm.StateInformation.Inactive,
+		OnLoad:              fcm.LoadLogic.OnLoad,
+		Derated:             fcm.LoadLogic.Derated,
+		DCDCEnabled:         fcm.OutputBits.DCDCEnabled,
+		FaultA:              fcm.FaultA,
+		FaultB:              fcm.FaultB,
+		FaultC:              fcm.FaultC,
+		FaultD:              fcm.FaultD,
+	}
+}
+
 func (fcm *FCM804) GetFaultLevel() (FaultLevel, bool) {
 	fcm.mu.Lock()
 	defer fcm.mu.Unlock()
@@ -819,11 +876,15 @@ where logged > ?
 
 func (fcm *FCM804) restartTheFuelCell() {
 	if fcm.runState {
-		if err := startFuelCell(fcm.device); err != nil {
+		if err := runCommandWithParams(fcQueue(fcm.device), "run", PriorityAutomatic, "fault restart", CommandParams{"run": true}, func() error {
+			return startFuelCell(fcm.device)
+		}); err != nil {
 			log.Println(err)
 		}
 	} else {
-		if err := turnOnFuelCell(fcm.device); err != nil {
+		if err := runCommandWithParams(fcQueue(fcm.device), "power", PriorityAutomatic, "fault restart", CommandParams{"on": true}, func() error {
+			return turnOnFuelCell(fcm.device)
+		}); err != nil {
 			log.Println(err)
 		}
 	}
@@ -861,29 +922,18 @@ func (fcm *FCM804) checkFuelCell() {
 					} else {
 						fcm.runState = SystemStatus.Relays.FC1Run
 					}
-					go func() {
-						if err := turnOffFuelCell(fcm.device); err != nil {
-							log.Println(err)
-						}
-					}()
+					dispatcher.SubmitWithParams(fcQueue(fcm.device), "power", PriorityAutomatic, "fault restart", CommandParams{"on": false}, func() error {
+						_, err := turnOffFuelCell(fcm.device, "fault restart")
+						return err
+					})
 
 					time.AfterFunc(OFFTIMEFORFUELCELLRESTART, func() {
 						fcm.restartTheFuelCell()
 					})
-					err := smtp.SendMail("smtp.titan.email:587",
-						smtp.PlainAuth("", "pi@cedartechnology.com", "7444561", "smtp.titan.email"),
-						"pi@cedartechnology.com", []string{"ian.abercrombie@cedartechnology.com"}, []byte(`From: Aberhome1
-To: Ian.Abercrombie@cedartechnology.com
-Subject: Fuelcell Error encountered
-The fuel cell has reported an error. I am attempting to restart it.
-Fault A = `+strings.Join(getFuelCellError('A', fcm.FaultA), " : ")+`
-Fault B = `+strings.Join(getFuelCellError('B', fcm.FaultB), " : ")+`
-Fault C = `+strings.Join(getFuelCellError('C', fcm.FaultC), " : ")+`
-Fault D = `+strings.Join(getFuelCellError('D', fcm.FaultD), " : ")+`
-Restart number = `+strconv.Itoa(fcm.NumRestarts)))
-					if err != nil {
-						log.Println(err)
-					}
+					notify(EventFuelCellFault, fcQueue(fcm.device), &FuelCellFaultDetails{Device: fcm.device,
+						FaultA: getFuelCellError('A', fcm.FaultA), FaultB: getFuelCellError('B', fcm.FaultB),
+						FaultC: getFuelCellError('C', fcm.FaultC), FaultD: getFuelCellError('D', fcm.FaultD),
+						Restart: fcm.NumRestarts})
 				}
 				fcm.ClearTime = *new(time.Time)
 			}
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
+	"html"
 	"io"
 	"log"
 	"math"
@@ -34,6 +35,7 @@ const ELECTROLYSERRESTARTPRESSURE = 33
 const ELECTROLYSEROFFDELAYTIME = time.Minute * 3
 const ELECTROLYSERSHUTDOWNDELAY = time.Minute * 15
 const ELECTROLYSERMAXSTACKVOLTSFORTURNOFF = 30 // Cannot turn off the electrolyser above this voltage
+const ELECTROLYSERRATEREFRESH = time.Minute    // How often the current rate is sent to the electrolysers again
 const MAXFUELCELLRESTARTS = 10
 const OFFTIMEFORFUELCELLRESTART = time.Second * 20
 const FUELCELLENABLETORUNDELAY = time.Second * 2
@@ -302,7 +304,7 @@ var (
 		valid            bool
 		Relays           relayStatus
 		Electrolysers    []*Electrolyser
-		ElectrolyserLock bool // Prevents electrolysers from being turned off when set
+		ElectrolyserLock bool // Set while searching the network for electrolysers so their power is not turned off part way through. Use Lockouts to hold a single device.
 		Gas              gasStatus
 		TDS              tdsStatus
 		AC               acStatus
@@ -311,6 +313,8 @@ var (
 	electrolyserShutDownTime time.Time
 
 	jsonSettings string
+	stateFile    string
+	usersFile    string
 	params       *JsonSettings
 
 	canBus  *CANBus
@@ -479,6 +483,16 @@ th.RelayOff {
 	</div>`, getRelayHtmlStatus()); err != nil {
 		log.Print(err)
 	}
+	if emergencyStop.Latched() {
+		if _, err := fmt.Fprint(w, `<div><h2 style="color:red">EMERGENCY STOP ACTIVE</h2></div>`); err != nil {
+			log.Print(err)
+		}
+	}
+	for _, l := range getLockouts() {
+		if _, err := fmt.Fprintf(w, `<div><h3 style="text-align:center">%s</h3></div>`, html.EscapeString(l.String())); err != nil {
+			log.Print(err)
+		}
+	}
 	for idx, el := range SystemStatus.Electrolysers {
 		if _, err := fmt.Fprintf(w, `<div><h2>Electrolyser %d</h2>%s</div>`, idx, getElectrolyserHtmlStatus(el)); err != nil {
 			log.Print(err)
@@ -530,31 +544,6 @@ func errorToJson(err error) string {
 	return string(byteArray)
 }
 
-/**
-Get the dryer status as a JSON object
-*/
-func getDryerJsonStatus(w http.ResponseWriter, r *http.Request) {
-	// Set the returned type to application/json
-	w.Header().Set("Content-Type", "application/json")
-
-	vars := mux.Vars(r)
-	device, err := strconv.ParseInt(vars["device"], 10, 8)
-	if (err != nil) || (device > 1) || (device < 0) {
-		log.Print("Invalid dryer in status request")
-		getStatus(w, r)
-		return
-	}
-	bytesArray, err := json.Marshal(&SystemStatus.Electrolysers[device].status)
-	if err != nil {
-		if _, err := fmt.Fprint(w, errorToJson(err)); err != nil {
-			log.Print(err)
-		}
-	}
-	if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
-		log.Print(err)
-	}
-}
-
 /**
 Return the current system status
 */
@@ -591,6 +580,7 @@ func getSystemStatus() {
 		// If the electrolyser is showing on but the relay is off, immediately set the electrolyser status to powered off
 		if !ElectrolyserOn {
 			SystemStatus.Electrolysers[device].status.SwitchedOn = false
+			SystemStatus.Electrolysers[device].status.levelRead = false
 		}
 		// If the electrolyser shows powered up, get the current status
 		if SystemStatus.Electrolysers[device].status.SwitchedOn {
@@ -608,6 +598,8 @@ func logStatus() {
 	if pDB == nil {
 		if pDB, err = connectToDatabase(); err != nil {
 			log.Print(err)
+			healthFailure(HealthDatabase, err)
+			serviceMetrics.dbInsert(DBTableLogging, time.Now(), err)
 			return
 		}
 	}
@@ -721,7 +713,9 @@ func logStatus() {
 	params.fc1OutputVoltage.Valid = false
 
 	if len(SystemStatus.Electrolysers) > 0 {
-		if SystemStatus.Relays.EL0 {
+		if commsWatchdog.isStale(elDataSource(0)) {
+			// Leave everything NULL, the readings we have are stale
+		} else if SystemStatus.Relays.EL0 {
 			params.el0SystemState.Byte = uint8(SystemStatus.Electrolysers[0].status.SystemState)
 			params.el0SystemState.Valid = true
 			params.el0ElectrolyteLevel.Byte = byte(SystemStatus.Electrolysers[0].status.ElectrolyteLevel)
@@ -751,7 +745,9 @@ func logStatus() {
 		}
 	}
 	if len(SystemStatus.Electrolysers) > 1 {
-		if SystemStatus.Relays.EL1 {
+		if commsWatchdog.isStale(elDataSource(1)) {
+			// Leave everything NULL, the readings we have are stale
+		} else if SystemStatus.Relays.EL1 {
 			params.el1SystemState.Byte = uint8(SystemStatus.Electrolysers[1].status.SystemState)
 			params.el1SystemState.Valid = true
 			params.el1ElectrolyteLevel.Byte = byte(SystemStatus.Electrolysers[1].status.ElectrolyteLevel)
@@ -780,7 +776,7 @@ func logStatus() {
 		}
 	}
 	if len(SystemStatus.Electrolysers) > 0 {
-		if SystemStatus.Relays.EL0 {
+		if SystemStatus.Relays.EL0 && !commsWatchdog.isStale(elDataSource(0)) {
 			params.drInputPressure.Int16 = int16(SystemStatus.Electrolysers[0].status.DryerInputPressure * 10)
 			params.drInputPressure.Valid = true
 			params.drOutputPressure.Int16 = int16(SystemStatus.Electrolysers[0].status.DryerOutputPressure * 10)
@@ -800,7 +796,9 @@ func logStatus() {
 		}
 	}
 	if fc, found := canBus.fuelCell[0]; found {
-		if SystemStatus.Relays.FC0Enable {
+		if commsWatchdog.isStale(fcDataSource(0)) {
+			// Leave everything NULL, the readings we have are stale
+		} else if SystemStatus.Relays.FC0Enable {
 			params.fc0AnodePressure.Int16 = int16(fc.AnodePressure) // millibar x 10
 			params.fc0AnodePressure.Valid = true
 			params.fc0FaultFlagA = fc.getFaultA()
@@ -825,7 +823,9 @@ func logStatus() {
 		}
 	}
 	if fc, found := canBus.fuelCell[1]; found {
-		if SystemStatus.Relays.FC1Enable {
+		if commsWatchdog.isStale(fcDataSource(1)) {
+			// Leave everything NULL, the readings we have are stale
+		} else if SystemStatus.Relays.FC1Enable {
 			params.fc1AnodePressure.Int16 = int16(fc.AnodePressure) // millibar
 			params.fc1AnodePressure.Valid = true
 			params.fc1FaultFlagA = fc.getFaultA()
@@ -872,22 +872,32 @@ func logStatus() {
 	       ?, ?, ?, ?, ?, ?,
 	       ?, ?, ?, ?, ?, ?);`
 
-	_, err = pDB.Exec(strCommand,
+	args := []interface{}{
 		params.el0Rate, params.el0ElectrolyteLevel, params.el0ElectrolyteTemp, params.el0State, params.el0H2Flow, params.el0H2InnerPressure, params.el0H2OuterPressure, params.el0StackVoltage, params.el0StackCurrent, params.el0SystemState, params.el0WaterPressure,
 		params.drTemp0, params.drTemp1, params.drTemp2, params.drTemp3, params.drInputPressure, params.drOutputPressure, params.drWarning, params.drError,
 		params.el1Rate, params.el1ElectrolyteLevel, params.el1ElectrolyteTemp, params.el1State, params.el1H2Flow, params.el1H2InnerPressure, params.el1H2OuterPressure, params.el1StackVoltage, params.el1StackCurrent, params.el1SystemState, params.el1WaterPressure,
 		params.fc0State, params.fc0AnodePressure, params.fc0FaultFlagA, params.fc0FaultFlagB, params.fc0FaultFlagC, params.fc0FaultFlagD, params.fc0InletTemp, params.fc0OutletTemp, params.fc0OutputPower, params.fc0OutputCurrent, params.fc0OutputVoltage,
-		params.fc1State, params.fc1AnodePressure, params.fc1FaultFlagA, params.fc1FaultFlagB, params.fc1FaultFlagC, params.fc1FaultFlagD, params.fc1InletTemp, params.fc1OutletTemp, params.fc1OutputPower, params.fc1OutputCurrent, params.fc1OutputVoltage,
+		params.fc1State, params.fc1AnodePressure, params.fc1FaultFlagA, params.fc1FaultFlagB, params.fc1FaultFlagC, params.fc1FaultFlagD, params.fc1InletTemp, params.fc1OutletTemp, params.fc1OutputPower, params.fc1OutputCurrent, params.fc1OutputVoltage}
+	args = append(args, nullIfStale(DataSourceIO,
 		SystemStatus.Gas.RawFuelCellPressure, SystemStatus.Gas.RawTankPressure,
 		SystemStatus.TDS.RawTdsReading,
-		SystemStatus.Relays.GasToFuelCell, SystemStatus.Relays.FC0Enable, SystemStatus.Relays.FC0Run, SystemStatus.Relays.FC1Enable, SystemStatus.Relays.FC1Run, SystemStatus.Relays.EL0, SystemStatus.Relays.EL1, SystemStatus.Relays.Spare,
-		SystemStatus.AC.ACPower, SystemStatus.AC.ACVolts, SystemStatus.AC.ACCurrent, SystemStatus.AC.ACFrequency, SystemStatus.AC.ACPowerFactor, SystemStatus.AC.ACEnergy,
-		SystemStatus.HP.ACPower, SystemStatus.HP.ACVolts, SystemStatus.HP.ACCurrent, SystemStatus.HP.ACFrequency, SystemStatus.HP.ACPowerFactor, SystemStatus.HP.ACEnergy)
+		SystemStatus.Relays.GasToFuelCell, SystemStatus.Relays.FC0Enable, SystemStatus.Relays.FC0Run, SystemStatus.Relays.FC1Enable, SystemStatus.Relays.FC1Run, SystemStatus.Relays.EL0, SystemStatus.Relays.EL1, SystemStatus.Relays.Spare)...)
+	args = append(args, nullIfStale(DataSourceAC,
+		SystemStatus.AC.ACPower, SystemStatus.AC.ACVolts, SystemStatus.AC.ACCurrent, SystemStatus.AC.ACFrequency, SystemStatus.AC.ACPowerFactor, SystemStatus.AC.ACEnergy)...)
+	args = append(args, nullIfStale(DataSourceHP,
+		SystemStatus.HP.ACPower, SystemStatus.HP.ACVolts, SystemStatus.HP.ACCurrent, SystemStatus.HP.ACFrequency, SystemStatus.HP.ACPowerFactor, SystemStatus.HP.ACEnergy)...)
+
+	started := time.Now()
+	_, err = pDB.Exec(strCommand, args...)
+	serviceMetrics.dbInsert(DBTableLogging, started, err)
 
 	if err != nil {
 		log.Printf("Error writing values to the database - %s", err)
+		healthFailure(HealthDatabase, err)
 		_ = pDB.Close()
 		pDB = nil
+	} else {
+		healthSuccess(HealthDatabase)
 	}
 }
 
@@ -916,8 +926,14 @@ func getMinJsonStatus() string {
 		Electrolysers []*minElectrolyserStatus
 		FuelCells     []*minFuelCellStatus
 		Gas           float64
+		Lockouts      []*Lockout
+		EmergencyStop bool
+		Stale         []string // Data sources whose values cannot be trusted
 	}
 	minStatus.Gas = SystemStatus.Gas.TankPressure
+	minStatus.Stale = commsWatchdog.staleSources()
+	minStatus.Lockouts = getLockouts()
+	minStatus.EmergencyStop = emergencyStop.Latched()
 	for elnum, el := range SystemStatus.Electrolysers {
 		minEl := new(minElectrolyserStatus)
 		if elnum == 0 {
@@ -932,7 +948,8 @@ func getMinJsonStatus() string {
 		}
 		minStatus.Electrolysers = append(minStatus.Electrolysers, minEl)
 	}
-	for _, fc := range canBus.fuelCell {
+	for _, device := range canBus.fuelCellDevices() {
+		fc := canBus.fuelCell[device]
 		minFc := new(minFuelCellStatus)
 		minFc.State = fc.GetState()
 		minFc.Output = float32(fc.getOutputPower())
@@ -949,98 +966,125 @@ func getMinJsonStatus() string {
 	}
 }
 
-/**
-Get running status as a JSON object
+type FullElectrolyserStatus struct {
+	On                    bool        `json:"on"`
+	State                 string      `json:"state"`
+	Serial                string      `json:"serial"`
+	SystemState           string      `json:"systemstate"`
+	H2Flow                jsonFloat32 `json:"h2flow"`
+	ElState               string      `json:"elstate"`
+	ElectrolyteLevel      string      `json:"level"`
+	StackCurrent          jsonFloat32 `json:"current"`
+	StackVoltage          jsonFloat32 `json:"voltage"`
+	InnerH2Pressure       jsonFloat32 `json:"innerpressure"`
+	OuterH2Pressure       jsonFloat32 `json:"outerpressure"`
+	WaterPressure         jsonFloat32 `json:"waterpressure"`
+	ElectrolyteTemp       jsonFloat32 `json:"temp"`
+	CurrentProductionRate int         `json:"rate"`
+	DefaultProductionRate int         `json:"defrate"`
+	MaxTankPressure       jsonFloat32 `json:"maxtank"`
+	RestartPressure       jsonFloat32 `json:"restart"`
+	Warnings              string      `json:"warnings"`
+	Errors                string      `json:"errors"`
+	IP                    string      `json:"ip"`
+	Valid                 bool        `json:"valid"`
+}
+
+type FullDryerStatus struct {
+	On             bool        `json:"on"`
+	Temp0          jsonFloat32 `json:"temp0"`
+	Temp1          jsonFloat32 `json:"temp1"`
+	Temp2          jsonFloat32 `json:"temp2"`
+	Temp3          jsonFloat32 `json:"temp3"`
+	InputPressure  jsonFloat32 `json:"inputPressure"`
+	OutputPressure jsonFloat32 `json:"outputPressure"`
+	Errors         string      `json:"errors"`
+	Warnings       string      `json:"warnings"`
+	Valid          bool        `json:"valid"`
+}
+
+type FullFuelCellStatus struct {
+	Device        uint8       `json:"device"`
+	On            bool        `json:"on"`
+	State         string      `json:"state"`
+	Power         int16       `json:"power"`
+	Volts         jsonFloat32 `json:"volts"`
+	Amps          jsonFloat32 `json:"amps"`
+	FaultA        string      `json:"faultA"`
+	FaultB        string      `json:"faultB"`
+	FaultC        string      `json:"faultC"`
+	FaultD        string      `json:"faultD"`
+	AnodePressure jsonFloat32 `json:"anodePressure"`
+	InletTemp     jsonFloat32 `json:"inletTemp"`
+	OutletTemp    jsonFloat32 `json:"outletTemp"`
+	Serial        string      `json:"serial"`
+	Version       string      `json:"version"`
+	Valid         bool        `json:"valid"`
+}
+
+type FullGasStatus struct {
+	FuelCellPressure jsonFloat32 `json:"fcpressure"`
+	TankPressure     jsonFloat32 `json:"tankpressure"`
+	Valid            bool        `json:"valid"`
+}
+
+type FullACStatus struct {
+	Power       jsonFloat32 `json:"watts"`
+	Current     jsonFloat32 `json:"amps"`
+	Voltage     jsonFloat32 `json:"volts"`
+	Frequency   jsonFloat32 `json:"hertz"`
+	PowerFactor jsonFloat32 `json:"powerfactor"`
+	Energy      jsonFloat32 `json:"energy"`
+	Valid       bool        `json:"valid"`
+}
+
+type FullRelaysStatus struct {
+	El0       bool `json:"el0"`
+	El1       bool `json:"el1"`
+	Gas       bool `json:"gas"`
+	FC0Enable bool `json:"fc0en"`
+	FC0Run    bool `json:"fc0run"`
+	FC1Enable bool `json:"fc1en"`
+	FC1Run    bool `json:"fc1run"`
+	Spare     bool `json:"spare"`
+	Valid     bool `json:"valid"`
+}
+
+/*
+FullStatus is the complete running status sent to the status page, MQTT and the API
 */
-func getFullJsonStatus() string {
+type FullStatus struct {
+	Relays        FullRelaysStatus          `json:"relays"`
+	Electrolysers []*FullElectrolyserStatus `json:"el"`
+	Dryer         FullDryerStatus           `json:"dr"`
+	FuelCells     []*FullFuelCellStatus     `json:"fc"`
+	Gas           FullGasStatus             `json:"gas"`
+	Tds           float32                   `json:"tds"`
+	TdsValid      bool                      `json:"tdsValid"`
+	AC            FullACStatus              `json:"ac"`
+	HP            FullACStatus              `json:"hp"`
+	Lockouts      []*Lockout                `json:"lockouts"`
+	EmergencyStop bool                      `json:"estop"`
+	Stale         []string                  `json:"stale"`
+}
+
+/*
+getFullStatus builds the complete running status
+*/
+func getFullStatus() *FullStatus {
 	SystemStatus.m.Lock()
 	defer SystemStatus.m.Unlock()
 
-	type ElectrolyserStatus struct {
-		On                    bool        `json:"on"`
-		State                 string      `json:"state"`
-		Serial                string      `json:"serial"`
-		SystemState           string      `json:"systemstate"`
-		H2Flow                jsonFloat32 `json:"h2flow"`
-		ElState               string      `json:"elstate"`
-		ElectrolyteLevel      string      `json:"level"`
-		StackCurrent          jsonFloat32 `json:"current"`
-		StackVoltage          jsonFloat32 `json:"voltage"`
-		InnerH2Pressure       jsonFloat32 `json:"innerpressure"`
-		OuterH2Pressure       jsonFloat32 `json:"outerpressure"`
-		WaterPressure         jsonFloat32 `json:"waterpressure"`
-		ElectrolyteTemp       jsonFloat32 `json:"temp"`
-		CurrentProductionRate int         `json:"rate"`
-		DefaultProductionRate int         `json:"defrate"`
-		MaxTankPressure       jsonFloat32 `json:"maxtank"`
-		RestartPressure       jsonFloat32 `json:"restart"`
-		Warnings              string      `json:"warnings"`
-		Errors                string      `json:"errors"`
-		IP                    string      `json:"ip"`
-	}
-	type DryerStatus struct {
-		On             bool        `json:"on"`
-		Temp0          jsonFloat32 `json:"temp0"`
-		Temp1          jsonFloat32 `json:"temp1"`
-		Temp2          jsonFloat32 `json:"temp2"`
-		Temp3          jsonFloat32 `json:"temp3"`
-		InputPressure  jsonFloat32 `json:"inputPressure"`
-		OutputPressure jsonFloat32 `json:"outputPressure"`
-		Errors         string      `json:"errors"`
-		Warnings       string      `json:"warnings"`
-	}
-	type FuelCellStatus struct {
-		On            bool        `json:"on"`
-		State         string      `json:"state"`
-		Power         int16       `json:"power"`
-		Volts         jsonFloat32 `json:"volts"`
-		Amps          jsonFloat32 `json:"amps"`
-		FaultA        string      `json:"faultA"`
-		FaultB        string      `json:"faultB"`
-		FaultC        string      `json:"faultC"`
-		FaultD        string      `json:"faultD"`
-		AnodePressure jsonFloat32 `json:"anodePressure"`
-		InletTemp     jsonFloat32 `json:"inletTemp"`
-		OutletTemp    jsonFloat32 `json:"outletTemp"`
-		Serial        string      `json:"serial"`
-		Version       string      `json:"version"`
-	}
-
-	type GasStatus struct {
-		FuelCellPressure jsonFloat32 `json:"fcpressure"`
-		TankPressure     jsonFloat32 `json:"tankpressure"`
-	}
-
-	type ACStatus struct {
-		Power       jsonFloat32 `json:"watts"`
-		Current     jsonFloat32 `json:"amps"`
-		Voltage     jsonFloat32 `json:"volts"`
-		Frequency   jsonFloat32 `json:"hertz"`
-		PowerFactor jsonFloat32 `json:"powerfactor"`
-		Energy      jsonFloat32 `json:"energy"`
-	}
-
-	type RelaysStatus struct {
-		El0       bool `json:"el0"`
-		El1       bool `json:"el1"`
-		Gas       bool `json:"gas"`
-		FC0Enable bool `json:"fc0en"`
-		FC0Run    bool `json:"fc0run"`
-		FC1Enable bool `json:"fc1en"`
-		FC1Run    bool `json:"fc1run"`
-		Spare     bool `json:"spare"`
-	}
-
-	var Status struct {
-		Relays        RelaysStatus          `json:"relays"`
-		Electrolysers []*ElectrolyserStatus `json:"el"`
-		Dryer         DryerStatus           `json:"dr"`
-		FuelCells     []*FuelCellStatus     `json:"fc"`
-		Gas           GasStatus             `json:"gas"`
-		Tds           float32               `json:"tds"`
-		AC            ACStatus              `json:"ac"`
-		HP            ACStatus              `json:"hp"`
-	}
+	Status := new(FullStatus)
+	ioValid := !commsWatchdog.isStale(DataSourceIO)
+	Status.Relays.Valid = ioValid
+	Status.Gas.Valid = ioValid
+	Status.TdsValid = ioValid
+	Status.AC.Valid = !commsWatchdog.isStale(DataSourceAC)
+	Status.HP.Valid = !commsWatchdog.isStale(DataSourceHP)
+	Status.Stale = commsWatchdog.staleSources()
+	Status.Lockouts = getLockouts()
+	Status.EmergencyStop = emergencyStop.Latched()
 	Status.Gas.FuelCellPressure = jsonFloat32(math.Round(float64(SystemStatus.Gas.FuelCellPressure)*10) / 10)
 	Status.Gas.TankPressure = jsonFloat32(math.Round(float64(SystemStatus.Gas.TankPressure)*10) / 10)
 	Status.Relays.Gas = SystemStatus.Relays.GasToFuelCell
@@ -1074,37 +1118,13 @@ func getFullJsonStatus() string {
 	Status.Dryer.OutputPressure = 0
 	Status.Dryer.Warnings = ""
 	for elnum, el := range SystemStatus.Electrolysers {
-		ElStatus := new(ElectrolyserStatus)
-		ElStatus.IP = el.ip.String()
-		if elnum == 0 {
-			ElStatus.On = SystemStatus.Relays.EL0
-		} else {
-			ElStatus.On = SystemStatus.Relays.EL1
-		}
-		if ElStatus.On {
-			ElStatus.Serial = el.status.Serial
-			ElStatus.ElState = el.getState()
-			ElStatus.H2Flow = jsonFloat32(math.Round(float64(el.status.H2Flow*10)) / 10)
-			ElStatus.SystemState = el.GetSystemState()
-			ElStatus.ElectrolyteLevel = el.status.ElectrolyteLevel.String()
-			ElStatus.StackCurrent = jsonFloat32(math.Round(float64(el.status.StackCurrent*10)) / 10)
-			ElStatus.StackVoltage = jsonFloat32(math.Round(float64(el.status.StackVoltage*10)) / 10)
-			ElStatus.InnerH2Pressure = jsonFloat32(math.Round(float64(el.status.InnerH2Pressure*10)) / 10)
-			ElStatus.OuterH2Pressure = jsonFloat32(math.Round(float64(el.status.OuterH2Pressure*10)) / 10)
-			ElStatus.WaterPressure = jsonFloat32(math.Round(float64(el.status.WaterPressure*10)) / 10)
-			ElStatus.ElectrolyteTemp = jsonFloat32(math.Round(float64(el.status.ElectrolyteTemp*10)) / 10)
-			ElStatus.CurrentProductionRate = int(el.status.CurrentProductionRate)
-			ElStatus.DefaultProductionRate = int(el.status.DefaultProductionRate)
-			ElStatus.MaxTankPressure = jsonFloat32(math.Round(float64(el.status.MaxTankPressure*10)) / 10)
-			ElStatus.RestartPressure = jsonFloat32(math.Round(float64(el.status.RestartPressure*10)) / 10)
-			ElStatus.Warnings = strings.Join(el.GetWarnings(), ":")
-			ElStatus.Errors = strings.Join(el.GetErrors(), ":")
-		}
+		ElStatus := newFullElectrolyserStatus(elnum, el)
 		Status.Electrolysers = append(Status.Electrolysers, ElStatus)
 
 		// If this is the first electrolyser get the dryer details from it
 		if elnum == 0 {
 			Status.Dryer.On = el.status.SwitchedOn
+			Status.Dryer.Valid = ElStatus.Valid
 			Status.Dryer.InputPressure = jsonFloat32(math.Round(float64(el.status.DryerInputPressure*10)) / 10)
 			Status.Dryer.OutputPressure = jsonFloat32(math.Round(float64(el.status.DryerOutputPressure*10)) / 10)
 			Status.Dryer.Temp0 = jsonFloat32(math.Round(float64(el.status.DryerTemp1*10)) / 10)
@@ -1115,28 +1135,78 @@ func getFullJsonStatus() string {
 			Status.Dryer.Warnings = el.GetDryerWarningText()
 		}
 	}
-	for _, fc := range canBus.fuelCell {
-		FcStatus := new(FuelCellStatus)
-		FcStatus.On = fc.IsSwitchedOn()
-		FcStatus.Version = fmt.Sprintf("%d.%d.%d", fc.Software.Version, fc.Software.Major, fc.Software.Minor)
-		FcStatus.Serial = string(fc.Serial[:])
-		FcStatus.InletTemp = jsonFloat32(math.Round(float64(fc.InletTemp)/10) / 10)
-		FcStatus.OutletTemp = jsonFloat32(math.Round(float64(fc.OutletTemp)/10) / 10)
-		FcStatus.Power = fc.OutputPower
-		FcStatus.Amps = jsonFloat32(math.Round(float64(fc.OutputCurrent)/10) / 10)
-		FcStatus.Volts = jsonFloat32(math.Round(float64(fc.OutputVolts)/10) / 10)
-		FcStatus.State = fc.GetState()
-		FcStatus.FaultA = strings.Join(getFuelCellError('A', fc.getFaultA()), ":")
-		FcStatus.FaultB = strings.Join(getFuelCellError('B', fc.getFaultB()), ":")
-		FcStatus.FaultC = strings.Join(getFuelCellError('C', fc.getFaultC()), ":")
-		FcStatus.FaultD = strings.Join(getFuelCellError('D', fc.getFaultD()), ":")
-		//		log.Println("Anode pressure = ", fc.AnodePressure)
-		FcStatus.AnodePressure = jsonFloat32(float32(fc.AnodePressure) / 10)
-
+	for _, device := range canBus.fuelCellDevices() {
+		FcStatus := newFullFuelCellStatus(device, canBus.fuelCell[device])
 		Status.FuelCells = append(Status.FuelCells, FcStatus)
 	}
 
-	bytes, err := json.Marshal(Status)
+	return Status
+}
+
+/*
+newFullElectrolyserStatus builds the status of one electrolyser. The caller must hold the SystemStatus lock.
+*/
+func newFullElectrolyserStatus(elnum int, el *Electrolyser) *FullElectrolyserStatus {
+	ElStatus := new(FullElectrolyserStatus)
+	ElStatus.IP = el.ip.String()
+	if elnum == 0 {
+		ElStatus.On = SystemStatus.Relays.EL0
+	} else {
+		ElStatus.On = SystemStatus.Relays.EL1
+	}
+	ElStatus.Valid = !commsWatchdog.isStale(elDataSource(elnum))
+	if ElStatus.On {
+		ElStatus.Serial = el.status.Serial
+		ElStatus.ElState = el.getState()
+		ElStatus.H2Flow = jsonFloat32(math.Round(float64(el.status.H2Flow*10)) / 10)
+		ElStatus.SystemState = el.GetSystemState()
+		ElStatus.ElectrolyteLevel = el.status.ElectrolyteLevel.String()
+		ElStatus.StackCurrent = jsonFloat32(math.Round(float64(el.status.StackCurrent*10)) / 10)
+		ElStatus.StackVoltage = jsonFloat32(math.Round(float64(el.status.StackVoltage*10)) / 10)
+		ElStatus.InnerH2Pressure = jsonFloat32(math.Round(float64(el.status.InnerH2Pressure*10)) / 10)
+		ElStatus.OuterH2Pressure = jsonFloat32(math.Round(float64(el.status.OuterH2Pressure*10)) / 10)
+		ElStatus.WaterPressure = jsonFloat32(math.Round(float64(el.status.WaterPressure*10)) / 10)
+		ElStatus.ElectrolyteTemp = jsonFloat32(math.Round(float64(el.status.ElectrolyteTemp*10)) / 10)
+		ElStatus.CurrentProductionRate = int(el.status.CurrentProductionRate)
+		ElStatus.DefaultProductionRate = int(el.status.DefaultProductionRate)
+		ElStatus.MaxTankPressure = jsonFloat32(math.Round(float64(el.status.MaxTankPressure*10)) / 10)
+		ElStatus.RestartPressure = jsonFloat32(math.Round(float64(el.status.RestartPressure*10)) / 10)
+		ElStatus.Warnings = strings.Join(el.GetWarnings(), ":")
+		ElStatus.Errors = strings.Join(el.GetErrors(), ":")
+	}
+	return ElStatus
+}
+
+/*
+newFullFuelCellStatus builds the status of one fuel cell
+*/
+func newFullFuelCellStatus(device uint8, fc *FCM804) *FullFuelCellStatus {
+	FcStatus := new(FullFuelCellStatus)
+	FcStatus.Device = device
+	FcStatus.On = fc.IsSwitchedOn()
+	FcStatus.Valid = !commsWatchdog.isStale(fcDataSource(device))
+	FcStatus.Version = fmt.Sprintf("%d.%d.%d", fc.Software.Version, fc.Software.Major, fc.Software.Minor)
+	FcStatus.Serial = string(fc.Serial[:])
+	FcStatus.InletTemp = jsonFloat32(math.Round(float64(fc.InletTemp)/10) / 10)
+	FcStatus.OutletTemp = jsonFloat32(math.Round(float64(fc.OutletTemp)/10) / 10)
+	FcStatus.Power = fc.OutputPower
+	FcStatus.Amps = jsonFloat32(math.Round(float64(fc.OutputCurrent)/10) / 10)
+	FcStatus.Volts = jsonFloat32(math.Round(float64(fc.OutputVolts)/10) / 10)
+	FcStatus.State = fc.GetState()
+	FcStatus.FaultA = strings.Join(getFuelCellError('A', fc.getFaultA()), ":")
+	FcStatus.FaultB = strings.Join(getFuelCellError('B', fc.getFaultB()), ":")
+	FcStatus.FaultC = strings.Join(getFuelCellError('C', fc.getFaultC()), ":")
+	FcStatus.FaultD = strings.Join(getFuelCellError('D', fc.getFaultD()), ":")
+	//		log.Println("Anode pressure = ", fc.AnodePressure)
+	FcStatus.AnodePressure = jsonFloat32(float32(fc.AnodePressure) / 10)
+	return FcStatus
+}
+
+/**
+Get running status as a JSON object
+*/
+func getFullJsonStatus() string {
+	bytes, err := json.Marshal(getFullStatus())
 	if err != nil {
 		log.Print(err)
 	}
@@ -1168,8 +1238,8 @@ func setGas(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	if err := mbusRTU.GasOnOff(body.State); err != nil {
-		ReturnJSONError(w, "Gas", err, http.StatusInternalServerError, true)
+	if err := commandGas(body.State, requestSource(r)); err != nil {
+		ReturnCommandError(w, "Gas", err)
 		return
 	}
 	returnJSONSuccess(w)
@@ -1192,8 +1262,8 @@ func setSpare(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	if err := mbusRTU.SpareOnOff(body.State); err != nil {
-		ReturnJSONError(w, "Spare", err, http.StatusInternalServerError, true)
+	if err := commandSpare(body.State, requestSource(r)); err != nil {
+		ReturnCommandError(w, "Spare", err)
 		return
 	}
 	returnJSONSuccess(w)
@@ -1235,6 +1305,7 @@ func getSystem(w http.ResponseWriter, _ *http.Request) {
 		NumElectrolyser     uint8
 		NumFuelCell         uint8
 		FuelCellMaintenance bool
+		Lockouts            []*Lockout
 	}
 	SystemStatus.m.Lock()
 	defer SystemStatus.m.Unlock()
@@ -1247,6 +1318,7 @@ func getSystem(w http.ResponseWriter, _ *http.Request) {
 	System.NumElectrolyser = uint8(len(SystemStatus.Electrolysers))
 	System.NumFuelCell = uint8(len(canBus.fuelCell))
 	System.FuelCellMaintenance = params.FuelCellMaintenance
+	System.Lockouts = getLockouts()
 	bytesArray, err := json.Marshal(System)
 	if err != nil {
 		ReturnJSONError(w, "Relays", err, http.StatusInternalServerError, true)
@@ -1468,7 +1540,11 @@ func getCO2Saved(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
-func init() {
+/*
+setUp reads the command line and the settings and connects to the database and the devices. It is called at the start
+of main rather than from init so the tests can load the package without a plant to talk to.
+*/
+func setUp() {
 	var (
 		CommsPort         string
 		BaudRate          uint
@@ -1496,6 +1572,8 @@ func init() {
 	flag.StringVar(&databasePort, "dbPort", "3306", "Database port")
 	flag.StringVar(&CANInterface, "can", "can0", "CAN Interface Name")
 	flag.StringVar(&jsonSettings, "jsonSettings", "/etc/FireFlyWeb.json", "JSON file containing the system control parameters")
+	flag.StringVar(&stateFile, "stateFile", "/etc/FireFlyState.json", "JSON file holding the intended operating state across restarts")
+	flag.StringVar(&usersFile, "usersFile", "/etc/FireFlyUsers.json", "JSON file holding the web users and API tokens")
 
 	// Modbus RTU stuff
 	flag.StringVar(&CommsPort, "Port", "rtu:///dev/ttyUSB0", "communication port for the Modbus RTU equipment")
@@ -1530,6 +1608,17 @@ func init() {
 	canBus = initCANLogger()
 	mbusRTU = NewModbusRTUIO(CommsPort, BaudRate, DataBits, StopBits, Parity, TimeoutSecs, uint8(RelaySlaveAddress), uint8(ACSlaveAddress), uint8(HPSlaveAddress))
 
+	waterManager = NewWaterManager()
+
+	if err := intendedState.ReadState(stateFile); err != nil {
+		log.Println("Error reading the intended state file - ", err)
+	}
+	restoreState()
+
+	if err := userStore.ReadUsers(usersFile); err != nil {
+		log.Println("Error reading the users file - ", err)
+	}
+
 	go setUpWebSite()
 
 	// Calculate the time we should start trying to turn the electorlysers off and archive the old data
@@ -1537,28 +1626,41 @@ func init() {
 }
 
 func loggingLoop() {
-	done := make(chan bool)
 	loggingTime := time.NewTicker(time.Second)
 	fcPolling := time.NewTicker(time.Millisecond * 200)
+	rateRefresh := time.NewTicker(ELECTROLYSERRATEREFRESH)
+	defer loggingTime.Stop()
+	defer fcPolling.Stop()
+	defer rateRefresh.Stop()
 
 	for {
 		select {
-		case <-done:
+		case <-serviceContext.Done():
 			return
 		case <-loggingTime.C:
 			{
 				getSystemStatus()
+				commsWatchdog.Check()
+				serviceMetrics.sampleCANRate()
 				if SystemStatus.valid {
 					logStatus()
-					for _, fc := range canBus.fuelCell {
+					waterManager.Check()
+					dryerMonitor.Check()
+					thresholdMonitor.Check()
+					checkAlarms()
+					preheatScheduler.Check()
+					for device, fc := range canBus.fuelCell {
+						if commsWatchdog.isStale(fcDataSource(device)) {
+							continue // Don't act on a fault state we are no longer receiving
+						}
 						fc.checkFuelCell() // Check for errors and reset the fuel cell if there are any.
 					}
 				}
-				dataSignal.Broadcast()
-				statusSignal.Broadcast()
+				wsHub.Tick()
 				if time.Now().After(electrolyserShutDownTime) {
-					ShutDownElectrolysers()
+					startShutDownElectrolysers()
 				}
+				healthSuccess(HealthLoggingLoop)
 				h, _, s := time.Now().Clock()
 				if h == 1 && s == 0 && electrolyserShutDownTime.Before(time.Now()) {
 					// At 1AM we recalculate the shutoff time and archive the old data
@@ -1570,41 +1672,35 @@ func loggingLoop() {
 			{
 				logFuelCellData()
 			}
+		case <-rateRefresh.C:
+			if SystemStatus.valid {
+				refreshProductionRates()
+			}
 		}
 	}
 }
 
 /*
-AcquireFuelCells will turn on the fuel cells and wait 30 secnds then turn them off again
+AcquireFuelCells will turn on the fuel cells and wait 15 secnds then turn them off again so they show up on the CAN bus.
+Fuel cells that are already on, or that are about to be turned on because they were requested, are left alone.
 */
-func AcquireFuelCells() {
-	for s := 0; s < 10; s++ {
-		if mbusRTU.Active {
-			break
-		}
-		time.Sleep(time.Second)
-	}
-
-	if !mbusRTU.Active {
-		log.Fatal("Timed out waiting for Modbus Relays to come on line.")
-	}
-
-	if !mbusRTU.fc0en {
-		if err := mbusRTU.FC0OnOff(true); err != nil {
-			log.Print(err)
+func AcquireFuelCells(intents [2]FuelCellIntent) {
+	mbusRTU.muBuffer.Lock()
+	enabled := [2]bool{mbusRTU.fc0en, mbusRTU.fc1en}
+	mbusRTU.muBuffer.Unlock()
+	for device := uint8(0); device < 2; device++ {
+		if enabled[device] || intents[device].Enable {
+			continue
 		}
-		time.AfterFunc(time.Second*15, func() {
-			if err := mbusRTU.FC0OnOff(false); err != nil {
-				log.Print(err)
-			}
-		})
-	}
-	if !mbusRTU.fc1en {
-		if err := mbusRTU.FC1OnOff(true); err != nil {
+		device := device
+		if err := runCommandWithParams(fcQueue(device), "power", PriorityAutomatic, "fuel cell search", CommandParams{"on": true}, func() error {
+			return mbusRTU.FCOnOff(device, true)
+		}); err != nil {
 			log.Print(err)
+			continue
 		}
 		time.AfterFunc(time.Second*15, func() {
-			if err := mbusRTU.FC1OnOff(false); err != nil {
+			if err := fuelCellPowerOff(device, "fuel cell search"); err != nil {
 				log.Print(err)
 			}
 		})
@@ -1612,20 +1708,20 @@ func AcquireFuelCells() {
 }
 
 func main() {
-	dataSignal = sync.NewCond(&sync.Mutex{})
-	statusSignal = sync.NewCond(&sync.Mutex{})
+	setUp()
+	fuelCellsKnown := registerKnownFuelCells()
 
 	log.Println("Starting the CAN logger")
-	go canBus.logCANData()
+	startService("CAN logger", canBus.logCANData)
 	log.Println("Starting the CAN monitor")
-	go canBus.CanBusMonitor()
+	startService("CAN monitor", canBus.CanBusMonitor)
 	log.Println("Starting the Modbus RTU manager")
-	go mbusRTU.StartModbusIO()
+	startService("Modbus RTU manager", mbusRTU.StartModbusIO)
 
 	for _, el := range params.Electrolysers {
 		if el.ID == 0 {
 			IP := net.ParseIP(el.IP)
-			electrolyser := NewElectrolyser(IP)
+			electrolyser := NewElectrolyser(IP, len(SystemStatus.Electrolysers))
 			SystemStatus.Electrolysers = append(SystemStatus.Electrolysers, electrolyser)
 		}
 	}
@@ -1633,17 +1729,32 @@ func main() {
 		for _, el := range params.Electrolysers {
 			if el.ID == 1 {
 				IP := net.ParseIP(el.IP)
-				electrolyser := NewElectrolyser(IP)
+				electrolyser := NewElectrolyser(IP, len(SystemStatus.Electrolysers))
 				SystemStatus.Electrolysers = append(SystemStatus.Electrolysers, electrolyser)
 			}
 		}
 	}
 
-	if len(SystemStatus.Electrolysers) == 0 {
-		go AcquireElectrolysers()
-	}
-	AcquireFuelCells()
+	createTables()
+	alarmManager.loadAlarms()
+	reconcileState(fuelCellsKnown)
 
+	// Push the status, alarms and jobs to the websocket clients
+	startService("Websocket hub", wsHub.Run)
+	// Write the audit trail of control actions
+	startService("Audit log", auditTrail.Run)
+	// Write the water management events
+	startService("Water events", waterManager.Run)
 	// Start the logging loop
-	loggingLoop()
+	startService("Logging loop", loggingLoop)
+	// Publish to the MQTT broker if one is configured
+	startService("MQTT client", mqttClient.Run)
+	// Serve the register map to PLCs and SCADA if the Modbus TCP server is enabled
+	startService("Modbus TCP server", modbusServer.Run)
+	// Read the TLS certificate again on SIGHUP
+	startService("Certificate reloader", webServer.ReloadCertificates)
+
+	sig := waitForShutdownSignal()
+	log.Printf("Received %v - shutting down", sig)
+	shutDown()
 }
@@ -254,7 +254,7 @@ func getFuelCellHtmlStatus(status *FCM804) (html string) {
  <tr><td class="label">Fault Flag A</td><td>%s</td><td class="label">Fault Flag B</td><td>%s</td></tr>
  <tr><td class="label">Fault Flag C</td><td>%s</td><td class="label">Fault Flag D</td><td>%s</td></tr>
 </table>`, status.getSerial(), status.Software.Version, status.Software.Major, status.Software.Minor,
-		status.OutputPower, status.OutputVolts, status.OutputCurrent,
+		status.getOutputPower(), status.getOutputVolts(), status.getOutputCurrent(),
 		status.getAnodePressure(), status.getInletTemp(), status.getOutletTemp(), status.GetState(),
 		buildToolTip(getFuelCellError('A', status.getFaultA())),
 		buildToolTip(getFuelCellError('B', status.getFaultB())),
@@ -580,7 +580,7 @@ func turnOnFuelCell(device uint8) error {
 			}
 		}
 	default:
-		log.Print("Cannot turn on unknown device %d", device)
+		log.Printf("Cannot turn on unknown device %d", device)
 		return fmt.Errorf("Unknown device %d", device)
 	}
 	time.Sleep(time.Second * 2)
@@ -592,10 +592,16 @@ startFuelCell turns on then starts the fuel cell - device is 0 based
 	Also starts an on demand trace
 */
 func startFuelCell(device uint8) error {
+	if err := checkEmergencyStop(); err != nil {
+		return err
+	}
+	if err := checkFuelCellLockout(device); err != nil {
+		return err
+	}
 	if err := turnOnFuelCell(device); err != nil {
 		log.Print(err)
 	}
-	if err := mbusRTU.GasOnOff(true); err != nil {
+	if err := fuelCellGas(true, fmt.Sprintf("fuel cell %d start", device)); err != nil {
 		log.Print(err)
 	}
 
@@ -632,7 +638,7 @@ func stopFuelCell(device uint8) error {
 			return err
 		}
 	default:
-		log.Print("Cannot stop unknown device %d", device)
+		log.Printf("Cannot stop unknown device %d", device)
 		return fmt.Errorf("Unknown device %d", device)
 	}
 
@@ -645,67 +651,85 @@ func stopFuelCell(device uint8) error {
 	return nil
 }
 
+/*
+fuelCellGas turns the gas to the fuel cells on or off. The gas relay is shared by both fuel cells so it is switched
+through the relay queue rather than the queue of the fuel cell asking for it.
+*/
+func fuelCellGas(on bool, source string) error {
+	return runCommandWithParams(RelayQueue, "gas", PriorityAutomatic, source, CommandParams{"on": on}, func() error {
+		return mbusRTU.GasOnOff(on)
+	})
+}
+
+/*
+fuelCellPowerOff turns the enable relay of the fuel cell off through its command queue
+*/
+func fuelCellPowerOff(device uint8, source string) error {
+	return runCommandWithParams(fcQueue(device), "power", PriorityAutomatic, source, CommandParams{"on": false}, func() error {
+		return mbusRTU.FCOnOff(device, false)
+	})
+}
+
 /***
 PowerDown waits for the fuel cell to stop delivering power then turns the enable relay off
 If it is outputting power it will wait 2 seconds and try again. After 2 minutes it will turn the fuel cell off even if it didn't stop
 */
-func PowerDown(device uint8) {
+func PowerDown(device uint8, job *Job) error {
+	job.Step("Waiting for fuel cell %d to stop delivering power", device)
 	for i := 0; i < 60; i++ {
-		// If the fuel cell is registered and we have data from it...
-		if len(canBus.fuelCell) > int(device) {
-			// If the fuel cell is not outputting power turn it off
-			if canBus.fuelCell[device].OutputPower <= 0 {
-				switch device {
-				case 0:
-					if err := mbusRTU.FC0OnOff(false); err != nil {
-						log.Print(err)
-					} else {
-						if !mbusRTU.fc1en {
-							canBus.clearEventDateTime()
-							if err := mbusRTU.GasOnOff(false); err != nil {
-								log.Println(err)
-							}
-						}
-						return
-					}
-				case 1:
-					if err := mbusRTU.FC0OnOff(false); err != nil {
-						log.Print(err)
+		fc, found := canBus.fuelCell[device]
+		if !found {
+			// Without data from the fuel cell we can't tell when it has stopped so there is no point waiting
+			log.Printf("No data from fuel cell %d. Turning fuel cell off now!", device)
+			job.Step("No data from fuel cell %d - turning it off without waiting", device)
+			return fuelCellPowerOff(device, job.Source)
+		}
+		// If the fuel cell is not outputting power turn it off
+		if power := fc.getOutputPower(); power <= 0 {
+			if err := fuelCellPowerOff(device, job.Source); err != nil {
+				log.Print(err)
+			} else {
+				job.Step("Fuel cell %d turned off", device)
+				// Turn the gas off if the other fuel cell is not using it
+				if (device == 0 && !mbusRTU.fc1en) || (device == 1 && !mbusRTU.fc0en) {
+					canBus.clearEventDateTime()
+					if err := fuelCellGas(false, job.Source); err != nil {
+						log.Println(err)
 					} else {
-						if !mbusRTU.fc0en {
-							canBus.clearEventDateTime()
-							if err := mbusRTU.GasOnOff(false); err != nil {
-								log.Println(err)
-							}
-						}
-						return
+						job.Step("Gas turned off")
 					}
 				}
-			} else {
-				// Just to be sure, tell it to stop again
-				if err := stopFuelCell(device); err != nil {
-					log.Print(err)
-				}
-				// Wait 2 seconds and try again
-				time.Sleep(time.Second * 2)
+				return nil
+			}
+		} else {
+			// Just to be sure, tell it to stop again
+			job.Step("Fuel cell %d is still delivering %dW - stopping it again", device, power)
+			if err := runCommandWithParams(fcQueue(device), "run", PriorityAutomatic, job.Source, CommandParams{"run": false}, func() error {
+				return stopFuelCell(device)
+			}); err != nil {
+				log.Print(err)
 			}
 		}
+		// Wait 2 seconds and try again
+		time.Sleep(time.Second * 2)
 	}
 	log.Printf("Times out waiting for fuel cell %d to stop. Turning fuel cell off now!", device)
-	if err := mbusRTU.FCOnOff(device, false); err != nil {
-		log.Print(err)
-	}
+	job.Step("Timed out waiting for fuel cell %d to stop - turning it off anyway", device)
+	return fuelCellPowerOff(device, job.Source)
 }
 
 /***
-turnOffFuelCell first stops then turns off the fuel cell. device is 0 based
+turnOffFuelCell first stops the fuel cell then starts the job that turns it off once it has stopped delivering power.
+device is 0 based
 */
-func turnOffFuelCell(device uint8) error {
+func turnOffFuelCell(device uint8, source string) (*Job, error) {
 	if err := stopFuelCell(device); err != nil {
 		log.Print(err)
 	}
 
-	go PowerDown(device)
+	job := startJob("fuel cell power down", fcQueue(device), source, func(job *Job) error {
+		return PowerDown(device, job)
+	})
 
 	//	strCommand := fmt.Sprintf("fc off %d", device)
 	//	log.Println("Turning fuel cell", device, "off")
@@ -714,7 +738,7 @@ func turnOffFuelCell(device uint8) error {
 	//		return err
 	//	}
 	//	log.Println("Fuel cell", device, "turned off")
-	return nil
+	return job, nil
 }
 
 //func restartFc(w http.ResponseWriter, r *http.Request) {
@@ -740,14 +764,22 @@ func fcEnabled(device uint8) bool {
 
 func NewStartFuelCellFFunc(device uint8) func() {
 	return func() {
-		if err := startFuelCell(device); err != nil {
-			log.Println("Error starting fuel cell %d -", device, err)
+		if err := runCommandWithParams(fcQueue(device), "run", PriorityAutomatic, "restart", CommandParams{"run": true}, func() error {
+			return startFuelCell(device)
+		}); err != nil {
+			log.Printf("Error starting fuel cell %d - %v", device, err)
 			return
 		}
 	}
 }
 
-func restartFc(device uint8) error {
+/*
+restartFc turns the fuel cell off, waits for it to power down then starts it again. It is run as a job.
+*/
+func restartFc(device uint8, job *Job) error {
+	if err := checkFuelCellLockout(device); err != nil {
+		return err
+	}
 	var pFC *FCM804
 	switch device {
 	case 0:
@@ -765,16 +797,18 @@ func restartFc(device uint8) error {
 	}
 
 	// Turn the fuel cell off first
-	if err := turnOffFuelCell(0); err != nil {
-		log.Print(err)
+	job.Step("Turning fuel cell %d off", device)
+	if err := runCommandWithParams(fcQueue(device), "power", PriorityManual, job.Source, CommandParams{"on": false}, func() error {
+		_, err := turnOffFuelCell(device, job.Source)
+		return err
+	}); err != nil {
+		return err
 	}
 
 	// Wait up to 3 minutes for the fuel cell to be turned off
-	for i := 0; i < 180; i++ {
-		if fcEnabled(device) {
-			// Wait another 2 seconds and check again
-			time.Sleep(time.Second * 2)
-		}
+	for i := 0; i < 90 && fcEnabled(device); i++ {
+		// Wait another 2 seconds and check again
+		time.Sleep(time.Second * 2)
 	}
 	if fcEnabled(device) {
 		err := fmt.Errorf("Failed to turn Fuel Cell %d off.", device)
@@ -784,21 +818,30 @@ func restartFc(device uint8) error {
 	delayTime := OFFTIMEFORFUELCELLRESTART
 	if pFC != nil {
 		// If this is not the first restart, add 10 seconds delay for each time we have tried
-		delayTime = OFFTIMEFORFUELCELLRESTART + (time.Second * time.Duration(canBus.fuelCell[0].NumRestarts*10))
+		delayTime = OFFTIMEFORFUELCELLRESTART + (time.Second * time.Duration(pFC.NumRestarts*10))
 	}
-	time.AfterFunc(delayTime, NewStartFuelCellFFunc(device))
+	job.Step("Fuel cell %d is off - waiting %s before starting it again", device, delayTime)
+	time.Sleep(delayTime)
 
+	job.Step("Starting fuel cell %d", device)
+	if err := runCommandWithParams(fcQueue(device), "run", PriorityManual, job.Source, CommandParams{"run": true}, func() error {
+		return startFuelCell(device)
+	}); err != nil {
+		return err
+	}
+	job.Step("Fuel cell %d started", device)
 	return nil
 }
 
 func fcStatus(w http.ResponseWriter, r *http.Request) {
 	var jErr JSONError
 	var jStatus struct {
-		On        bool    `json:"on"`
-		Power     int16   `json:"power"`
-		Volts     float32 `json:"volts"`
-		Amps      float32 `json:"amps"`
-		InletTemp float32 `json:"temp"`
+		On        bool     `json:"on"`
+		Power     int16    `json:"power"`
+		Volts     float32  `json:"volts"`
+		Amps      float32  `json:"amps"`
+		InletTemp float32  `json:"temp"`
+		Lockout   *Lockout `json:"lockout,omitempty"`
 	}
 	vars := mux.Vars(r)
 	device, err := parseDevice(vars["device"])
@@ -808,6 +851,7 @@ func fcStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	jStatus.Lockout = getLockout(LockoutFuelCell, strconv.Itoa(int(device)))
 	if device == 0 {
 		jStatus.On = SystemStatus.Relays.FC0Run
 	} else {
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/***************
+Health and readiness checks for systemd, monitoring hosts and load balancers. The subsystems record their successes and
+failures here as they run and the checks combine those with the current state of each subsystem.
+
+/healthz is the liveness probe. It returns 503 only when the logging loop has stopped ticking, which means the service
+is wedged and should be restarted. It does not fail while the service is still starting up.
+/readyz is the readiness probe. It returns 503 when any critical subsystem (the database, the Modbus RTU bus or the
+logging loop) is failing. Failures of the CAN bus, an electrolyser link or the MQTT broker are reported as degraded but
+still return 200.
+Both return every check with its timing and last error.
+*/
+
+const HEALTHDBTIMEOUT = time.Second * 2         // Maximum time to wait for the database to answer a ping
+const LOGGINGLOOPTIMEOUT = time.Second * 10     // The logging loop is stuck if it has not ticked for this long
+const MODBUSRTUHEALTHTIMEOUT = time.Second * 15 // The Modbus RTU bus is failing if the I/O board has not answered for this long
+
+const (
+	HealthDatabase    = "database"
+	HealthModbusRTU   = "modbusRTU"
+	HealthCAN         = "can"
+	HealthLoggingLoop = "loggingLoop"
+)
+
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+	HealthFailing  = "failing"
+)
+
+type healthRecord struct {
+	lastSuccess   time.Time
+	lastError     string
+	lastErrorTime time.Time
+	errors        uint64 // Number of failures since the service started
+}
+
+var healthRecords = make(map[string]*healthRecord)
+var healthMu sync.Mutex
+
+/*
+healthSuccess records that a subsystem has just worked
+*/
+func healthSuccess(name string) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	record, found := healthRecords[name]
+	if !found {
+		record = new(healthRecord)
+		healthRecords[name] = record
+	}
+	record.lastSuccess = time.Now()
+}
+
+/*
+healthFailure records the error from a subsystem
+*/
+func healthFailure(name string, err error) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	record, found := healthRecords[name]
+	if !found {
+		record = new(healthRecord)
+		healthRecords[name] = record
+	}
+	record.lastError = err.Error()
+	record.lastErrorTime = time.Now()
+	record.errors++
+}
+
+func getHealthRecord(name string) healthRecord {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	if record, found := healthRecords[name]; found {
+		return *record
+	}
+	return healthRecord{}
+}
+
+type HealthCheck struct {
+	Name          string     `json:"name"`
+	Healthy       bool       `json:"healthy"`
+	Critical      bool       `json:"critical"` // The service is not ready while a critical check is failing
+	Message       string     `json:"message"`
+	DurationMs    float64    `json:"durationMs"`
+	LastSuccess   *time.Time `json:"lastSuccess,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+type HealthReport struct {
+	Status string         `json:"status"`
+	Time   time.Time      `json:"time"`
+	Checks []*HealthCheck `json:"checks"`
+}
+
+/*
+runCheck times a check and fills in the recorded history for it
+*/
+func runCheck(name string, critical bool, check func() (bool, string)) *HealthCheck {
+	start := time.Now()
+	healthy, message := check()
+	result := &HealthCheck{Name: name, Healthy: healthy, Critical: critical, Message: message,
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000}
+	record := getHealthRecord(name)
+	if !record.lastSuccess.IsZero() {
+		t := record.lastSuccess
+		result.LastSuccess = &t
+	}
+	if !record.lastErrorTime.IsZero() {
+		t := record.lastErrorTime
+		result.LastError = record.lastError
+		result.LastErrorTime = &t
+	}
+	return result
+}
+
+func ageText(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return time.Since(t).Round(time.Millisecond).String() + " ago"
+}
+
+func checkDatabase() (bool, string) {
+	db := pDB
+	if db == nil {
+		return false, "not connected"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), HEALTHDBTIMEOUT)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		healthFailure(HealthDatabase, err)
+		return false, "ping failed - " + err.Error()
+	}
+	return true, "connected"
+}
+
+func checkModbusRTU() (bool, string) {
+	if mbusRTU == nil {
+		return false, "not configured"
+	}
+	mbusRTU.muBuffer.Lock()
+	active, io, ac, hp := mbusRTU.Active, mbusRTU.lastIOUpdate, mbusRTU.lastACUpdate, mbusRTU.lastHPUpdate
+	mbusRTU.muBuffer.Unlock()
+	message := fmt.Sprintf("I/O board updated %s, AC meter updated %s, heat pump meter updated %s", ageText(io), ageText(ac), ageText(hp))
+	if !active {
+		return false, "port not open - " + message
+	}
+	return !io.IsZero() && time.Since(io) < MODBUSRTUHEALTHTIMEOUT, message
+}
+
+func checkCANBus() (bool, string) {
+	record := getHealthRecord(HealthCAN)
+	var lastFrame time.Time
+	for _, fc := range canBus.fuelCell {
+		if t := fc.getLastUpdate(); t.After(lastFrame) {
+			lastFrame = t
+		}
+	}
+	if record.lastSuccess.IsZero() || record.lastErrorTime.After(record.lastSuccess) {
+		return false, "not subscribed to can0, last fuel cell frame " + ageText(lastFrame)
+	}
+	return true, "subscribed to can0, last fuel cell frame " + ageText(lastFrame)
+}
+
+func checkLoggingLoop() (bool, string) {
+	record := getHealthRecord(HealthLoggingLoop)
+	if record.lastSuccess.IsZero() {
+		return false, "not started"
+	}
+	return time.Since(record.lastSuccess) < LOGGINGLOOPTIMEOUT, "last tick " + ageText(record.lastSuccess)
+}
+
+/*
+checkElectrolyser reports on the Modbus TCP link to one electrolyser. An electrolyser that is switched off is healthy.
+The electrolyser lock is held for the whole of a read so we don't wait for it.
+*/
+func checkElectrolyser(el *Electrolyser) func() (bool, string) {
+	return func() (bool, string) {
+		SystemStatus.m.Lock()
+		on, connected, ip := el.status.SwitchedOn, el.clientConnected, el.ip.String()
+		SystemStatus.m.Unlock()
+		lastUpdate := el.getLastUpdate()
+		switch {
+		case !on:
+			return true, ip + " switched off"
+		case !connected:
+			return false, ip + " not connected, last read " + ageText(lastUpdate)
+		}
+		return !lastUpdate.IsZero() && time.Since(lastUpdate) < MODBUSRTUHEALTHTIMEOUT, ip + " connected, last read " + ageText(lastUpdate)
+	}
+}
+
+/*
+healthReport runs every check
+*/
+func healthReport() *HealthReport {
+	report := &HealthReport{Time: time.Now()}
+	report.Checks = append(report.Checks,
+		runCheck(HealthDatabase, true, checkDatabase),
+		runCheck(HealthModbusRTU, true, checkModbusRTU),
+		runCheck(HealthCAN, false, checkCANBus),
+		runCheck(HealthLoggingLoop, true, checkLoggingLoop))
+	settingsMu.Lock()
+	mqttEnabled := params.MQTT.Enabled
+	settingsMu.Unlock()
+	if mqttEnabled {
+		report.Checks = append(report.Checks, runCheck(HealthMQTT, false, checkMQTT))
+	}
+	SystemStatus.m.Lock()
+	electrolysers := append([]*Electrolyser{}, SystemStatus.Electrolysers...)
+	SystemStatus.m.Unlock()
+	for device, el := range electrolysers {
+		report.Checks = append(report.Checks, runCheck(elDataSource(device), false, checkElectrolyser(el)))
+	}
+
+	report.Status = HealthOK
+	for _, check := range report.Checks {
+		if !check.Healthy {
+			if check.Critical {
+				report.Status = HealthFailing
+				break
+			}
+			report.Status = HealthDegraded
+		}
+	}
+	return report
+}
+
+func returnHealthReport(w http.ResponseWriter, report *HealthReport, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if bytesArray, err := json.Marshal(report); err != nil {
+		log.Println(err)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+getHealth is the liveness probe. It fails only if the logging loop has started and then stopped.
+URL = /healthz
+*/
+func getHealth(w http.ResponseWriter, _ *http.Request) {
+	report := healthReport()
+	status := http.StatusOK
+	if tick := getHealthRecord(HealthLoggingLoop).lastSuccess; !tick.IsZero() && time.Since(tick) > LOGGINGLOOPTIMEOUT {
+		status = http.StatusServiceUnavailable
+	}
+	returnHealthReport(w, report, status)
+}
+
+/*
+getReadiness is the readiness probe. It fails if any critical subsystem is failing.
+URL = /readyz
+*/
+func getReadiness(w http.ResponseWriter, _ *http.Request) {
+	report := healthReport()
+	status := http.StatusOK
+	if report.Status == HealthFailing {
+		status = http.StatusServiceUnavailable
+	}
+	returnHealthReport(w, report, status)
+}
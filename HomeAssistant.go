@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/***************
+Home Assistant MQTT discovery. When it is turned on in the MQTT settings a retained config message is published under
+the discovery prefix for every entity, so Home Assistant builds its devices and entities straight from the status
+topics without any YAML:
+
+	Firefly                  tank and fuel cell gas pressure, water conductivity, AC and heat pump power and energy,
+	                         the electrolyser rate as a number and the gas and spare relays as switches
+	Electrolyser {n}         state, rate, hydrogen flow, stack current and voltage and electrolyte temperature
+	Fuel cell {n}            state, output power, voltage and current and the run relay as a switch
+
+The electrolyser devices carry the serial number and the fuel cell devices the serial number and firmware version from
+the FCM804 frames. A config is only sent again when it changes, e.g. when a serial number is first read. The number
+and switches need MQTT commands to be enabled; without them the same values are published as read only sensors.
+*/
+
+const HADISCOVERYPREFIX = "homeassistant"
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	SerialNumber string   `json:"serial_number,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+	ViaDevice    string   `json:"via_device,omitempty"`
+}
+
+type haAvailability struct {
+	Topic string `json:"topic"`
+}
+
+type haEntity struct {
+	Name              string           `json:"name"`
+	UniqueID          string           `json:"unique_id"`
+	StateTopic        string           `json:"state_topic"`
+	ValueTemplate     string           `json:"value_template,omitempty"`
+	CommandTopic      string           `json:"command_topic,omitempty"`
+	UnitOfMeasurement string           `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string           `json:"device_class,omitempty"`
+	StateClass        string           `json:"state_class,omitempty"`
+	PayloadOn         string           `json:"payload_on,omitempty"`
+	PayloadOff        string           `json:"payload_off,omitempty"`
+	Min               *float64         `json:"min,omitempty"`
+	Max               *float64         `json:"max,omitempty"`
+	Step              *float64         `json:"step,omitempty"`
+	Mode              string           `json:"mode,omitempty"`
+	Availability      []haAvailability `json:"availability"`
+	AvailabilityMode  string           `json:"availability_mode,omitempty"`
+	Device            *haDevice        `json:"device"`
+	component         string
+	objectID          string
+}
+
+/*
+haDiscovery builds the discovery configs for the plant as it is now
+*/
+type haDiscovery struct {
+	mc       *MQTTClient
+	settings MQTTSettings
+	node     string // Discovery node ID, the client ID cleaned up for use in a topic
+	entities []*haEntity
+	unused   []string // Discovery topics of the entities we are not using, e.g. switches when commands are disabled
+}
+
+/*
+haNodeID turns the client ID into something Home Assistant accepts in a discovery topic
+*/
+func haNodeID(clientID string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, clientID)
+}
+
+func (d *haDiscovery) configTopic(component string, objectID string) string {
+	return strings.Join([]string{d.settings.DiscoveryPrefix, component, d.node, objectID, "config"}, "/")
+}
+
+func (d *haDiscovery) availability(topics ...string) []haAvailability {
+	available := []haAvailability{{d.mc.topic("status")}}
+	for _, topic := range topics {
+		available = append(available, haAvailability{topic})
+	}
+	return available
+}
+
+/*
+sensor adds a read only value from one of the status topics
+*/
+func (d *haDiscovery) sensor(device *haDevice, objectID string, name string, stateTopic string, field string, units string, deviceClass string, stateClass string) *haEntity {
+	e := &haEntity{component: "sensor", objectID: objectID, Name: name, UniqueID: d.node + "_" + objectID,
+		StateTopic: stateTopic, ValueTemplate: "{{ value_json." + field + " }}", UnitOfMeasurement: units,
+		DeviceClass: deviceClass, StateClass: stateClass, Device: device}
+	d.entities = append(d.entities, e)
+	return e
+}
+
+/*
+relaySwitch adds a switch for a relay, or a binary sensor if commands are disabled
+*/
+func (d *haDiscovery) relaySwitch(device *haDevice, objectID string, name string, relay string, commandTopic string) *haEntity {
+	e := &haEntity{component: "switch", objectID: objectID, Name: name, UniqueID: d.node + "_" + objectID,
+		StateTopic: d.mc.topic("relays"), ValueTemplate: "{{ 'ON' if value_json." + relay + " else 'OFF' }}",
+		CommandTopic: commandTopic, PayloadOn: "ON", PayloadOff: "OFF", Device: device}
+	if !d.settings.Commands {
+		e.component = "binary_sensor"
+		e.CommandTopic = ""
+		d.unused = append(d.unused, d.configTopic("switch", objectID))
+	} else {
+		d.unused = append(d.unused, d.configTopic("binary_sensor", objectID))
+	}
+	d.entities = append(d.entities, e)
+	return e
+}
+
+func haFloat(f float64) *float64 {
+	return &f
+}
+
+/*
+build creates every entity from the device list in the status
+*/
+func (d *haDiscovery) build(electrolysers []json.RawMessage, fuelCells []json.RawMessage) {
+	system := &haDevice{Identifiers: []string{d.node}, Name: "Firefly", Model: "FireflyWeb"}
+	systemAvailability := d.availability()
+
+	for _, e := range []*haEntity{
+		d.sensor(system, "tank_pressure", "Tank pressure", d.mc.topic("gas"), "tankpressure", "bar", "pressure", "measurement"),
+		d.sensor(system, "fuel_cell_gas_pressure", "Fuel cell gas pressure", d.mc.topic("gas"), "fcpressure", "bar", "pressure", "measurement"),
+		d.sensor(system, "water_conductivity", "Water conductivity", d.mc.topic("water"), "tds", "µS/cm", "", "measurement"),
+		d.sensor(system, "ac_power", "AC power", d.mc.topic("ac"), "watts", "W", "power", "measurement"),
+		d.sensor(system, "ac_energy", "AC energy", d.mc.topic("ac"), "energy", "kWh", "energy", "total_increasing"),
+		d.sensor(system, "hp_power", "Heat pump power", d.mc.topic("hp"), "watts", "W", "power", "measurement"),
+		d.sensor(system, "hp_energy", "Heat pump energy", d.mc.topic("hp"), "energy", "kWh", "energy", "total_increasing"),
+		d.relaySwitch(system, "gas", "Fuel cell gas", "gas", d.mc.topic("gas", "set")),
+		d.relaySwitch(system, "spare", "Spare relay", "spare", d.mc.topic("spare", "set")),
+	} {
+		e.Availability = systemAvailability
+	}
+
+	rate := d.sensor(system, "electrolyser_rate", "Electrolyser rate", d.mc.topic("system"), "rate", "%", "", "measurement")
+	rate.Availability = systemAvailability
+	if d.settings.Commands {
+		rate.component = "number"
+		rate.CommandTopic = d.mc.topic("el", "rate", "set")
+		rate.StateClass = ""
+		rate.Min, rate.Max, rate.Step = haFloat(0), haFloat(100), haFloat(1)
+		rate.Mode = "slider"
+		d.unused = append(d.unused, d.configTopic("sensor", rate.objectID))
+	} else {
+		d.unused = append(d.unused, d.configTopic("number", rate.objectID))
+	}
+
+	var info struct {
+		Device  uint8  `json:"device"`
+		Serial  string `json:"serial"`
+		Version string `json:"version"`
+	}
+	for device, el := range electrolysers {
+		info.Serial = ""
+		_ = json.Unmarshal(el, &info)
+		n := strconv.Itoa(device)
+		dev := &haDevice{Identifiers: []string{d.node + "_el" + n}, Name: "Electrolyser " + n, Manufacturer: "Enapter",
+			Model: "EL21", SerialNumber: info.Serial, ViaDevice: d.node}
+		topic := d.mc.topic("el", n)
+		availability := d.availability(d.mc.topic("el", n, "availability"))
+		for _, e := range []*haEntity{
+			d.sensor(dev, "el"+n+"_state", "State", topic, "state", "", "", ""),
+			d.sensor(dev, "el"+n+"_rate", "Production rate", topic, "rate", "%", "", "measurement"),
+			d.sensor(dev, "el"+n+"_h2_flow", "Hydrogen flow", topic, "h2flow", "NL/h", "", "measurement"),
+			d.sensor(dev, "el"+n+"_stack_current", "Stack current", topic, "current", "A", "current", "measurement"),
+			d.sensor(dev, "el"+n+"_stack_voltage", "Stack voltage", topic, "voltage", "V", "voltage", "measurement"),
+			d.sensor(dev, "el"+n+"_electrolyte_temperature", "Electrolyte temperature", topic, "temp", "°C", "temperature", "measurement"),
+		} {
+			e.Availability = availability
+			e.AvailabilityMode = "all"
+		}
+	}
+
+	for _, fc := range fuelCells {
+		info.Device, info.Serial, info.Version = 0, "", ""
+		if json.Unmarshal(fc, &info) != nil {
+			continue
+		}
+		// Use the CAN bus device number, the position in the list is not the device
+		device := info.Device
+		n := strconv.Itoa(int(device))
+		dev := &haDevice{Identifiers: []string{d.node + "_fc" + n}, Name: "Fuel cell " + n, Manufacturer: "Intelligent Energy",
+			Model: "FCM804", SerialNumber: strings.TrimRight(info.Serial, "\x00 "), SWVersion: info.Version, ViaDevice: d.node}
+		topic := d.mc.topic("fc", n)
+		availability := d.availability(d.mc.topic("fc", n, "availability"))
+		for _, e := range []*haEntity{
+			d.sensor(dev, "fc"+n+"_state", "State", topic, "state", "", "", ""),
+			d.sensor(dev, "fc"+n+"_power", "Output power", topic, "power", "W", "power", "measurement"),
+			d.sensor(dev, "fc"+n+"_voltage", "Output voltage", topic, "volts", "V", "voltage", "measurement"),
+			d.sensor(dev, "fc"+n+"_current", "Output current", topic, "amps", "A", "current", "measurement"),
+		} {
+			e.Availability = availability
+			e.AvailabilityMode = "all"
+		}
+		// The run relay is on the I/O board so it is available whenever we are
+		run := d.relaySwitch(dev, "fc"+n+"_run", "Run", fmt.Sprintf("fc%drun", device), d.mc.topic("fc", n, "run", "set"))
+		run.Availability = systemAvailability
+	}
+}
+
+/*
+publishDiscovery sends the Home Assistant configs that have changed since they were last sent on this connection
+*/
+func (mc *MQTTClient) publishDiscovery(settings MQTTSettings, electrolysers []json.RawMessage, fuelCells []json.RawMessage) {
+	if !settings.HomeAssistant {
+		return
+	}
+	d := &haDiscovery{mc: mc, settings: settings, node: haNodeID(settings.ClientID)}
+	d.build(electrolysers, fuelCells)
+
+	configs := make(map[string]string)
+	for _, e := range d.entities {
+		if payload, err := json.Marshal(e); err == nil {
+			configs[d.configTopic(e.component, e.objectID)] = string(payload)
+		}
+	}
+	// An empty retained config removes an entity we have switched to a different component
+	for _, topic := range d.unused {
+		configs[topic] = ""
+	}
+
+	for topic, payload := range configs {
+		mc.mu.Lock()
+		sent, found := mc.discovery[topic]
+		changed := !found || sent != payload
+		mc.discovery[topic] = payload
+		mc.mu.Unlock()
+		if changed {
+			mc.publish(topic, true, payload)
+		}
+	}
+}
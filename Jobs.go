@@ -0,0 +1,453 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/***************
+Jobs are long running operations such as a fuel cell restart or an electrolyser search. The endpoint that starts one
+returns straight away with the job ID. The job records each step it takes and its final result. Progress can be
+polled at /api/jobs/{id} or followed over the /wsJobs websocket, and finished jobs are written to the Jobs table so
+operators can look back at what happened to an earlier request.
+*/
+
+const JOBSTABLE = `CREATE TABLE IF NOT EXISTS Jobs (
+	id VARCHAR(32) NOT NULL PRIMARY KEY,
+	JobType VARCHAR(64) NOT NULL,
+	Device VARCHAR(16) NULL,
+	Source VARCHAR(128) NULL,
+	Status VARCHAR(16) NOT NULL,
+	Started DATETIME NOT NULL,
+	Finished DATETIME NULL,
+	Steps TEXT NULL,
+	Error VARCHAR(255) NULL,
+	INDEX (Started))`
+
+const JOBHISTORYDAYS = 7       // Default number of days of job history returned
+const JOBRETENTION = time.Hour // Finished jobs are kept in memory for this long after they finish
+const JOBSUBSCRIBERBUFFER = 32 // Updates buffered for each websocket subscriber
+
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+type JobStep struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+type Job struct {
+	ID       string     `json:"id"`
+	Type     string     `json:"type"`
+	Device   string     `json:"device"`
+	Source   string     `json:"source"`
+	Status   string     `json:"status"`
+	Steps    []JobStep  `json:"steps"`
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	done     chan struct{} // Closed when a job started by startJob has finished
+}
+
+type JobManager struct {
+	lastID      int64
+	jobs        map[string]*Job
+	subscribers map[chan Job]bool
+	mu          sync.Mutex
+}
+
+var jobManager = &JobManager{jobs: make(map[string]*Job), subscribers: make(map[chan Job]bool)}
+
+func init() {
+	databaseTables = append(databaseTables, JOBSTABLE)
+}
+
+/*
+newID returns a unique job ID based on the time so IDs never repeat across restarts. The caller must hold the lock
+*/
+func (jm *JobManager) newID() string {
+	id := time.Now().UnixNano() / int64(time.Millisecond)
+	if id <= jm.lastID {
+		id = jm.lastID + 1
+	}
+	jm.lastID = id
+	return strconv.FormatInt(id, 36)
+}
+
+/*
+publish sends a copy of the job to every websocket subscriber. Slow subscribers miss updates rather than holding up the job.
+The caller must hold the lock
+*/
+func (jm *JobManager) publish(job *Job) {
+	jc := *job
+	jc.Steps = append([]JobStep{}, job.Steps...)
+	for ch := range jm.subscribers {
+		select {
+		case ch <- jc:
+		default:
+		}
+	}
+}
+
+func (jm *JobManager) subscribe() chan Job {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	ch := make(chan Job, JOBSUBSCRIBERBUFFER)
+	jm.subscribers[ch] = true
+	return ch
+}
+
+func (jm *JobManager) unsubscribe(ch chan Job) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	delete(jm.subscribers, ch)
+}
+
+/*
+Step records the progress of the job
+*/
+func (job *Job) Step(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	jobManager.mu.Lock()
+	job.Steps = append(job.Steps, JobStep{Time: time.Now(), Message: message})
+	jobManager.publish(job)
+	jobManager.mu.Unlock()
+	debugPrint("Job %s %s - %s", job.ID, job.Type, message)
+}
+
+/*
+startJob creates a job and runs fn in the background. fn reports its progress with job.Step and returns the result.
+*/
+func startJob(jobType string, device string, source string, fn func(job *Job) error) *Job {
+	jobManager.mu.Lock()
+	job := &Job{ID: jobManager.newID(), Type: jobType, Device: device, Source: source, Status: JobRunning, Started: time.Now(), Steps: []JobStep{},
+		done: make(chan struct{})}
+	jobManager.jobs[job.ID] = job
+	jobManager.publish(job)
+	jobManager.mu.Unlock()
+
+	log.Printf("Job %s started - %s %s from %s", job.ID, jobType, device, source)
+	job.save()
+	go func() {
+		err := fn(job)
+
+		jobManager.mu.Lock()
+		finished := time.Now()
+		job.Finished = &finished
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = err.Error()
+		} else {
+			job.Status = JobDone
+		}
+		jobManager.publish(job)
+		jobManager.mu.Unlock()
+
+		if err != nil {
+			log.Printf("Job %s %s failed - %v", job.ID, jobType, err)
+		} else {
+			log.Printf("Job %s %s done", job.ID, jobType)
+		}
+		job.save()
+		close(job.done)
+		time.AfterFunc(JOBRETENTION, func() {
+			jobManager.mu.Lock()
+			delete(jobManager.jobs, job.ID)
+			jobManager.mu.Unlock()
+		})
+	}()
+	return job
+}
+
+/*
+wait blocks until the job has finished. It returns false if the service is stopping first.
+*/
+func (job *Job) wait() bool {
+	select {
+	case <-job.done:
+		return true
+	case <-serviceContext.Done():
+		return false
+	}
+}
+
+/*
+runningJob returns the job of the given type and device that is still running, if there is one
+*/
+func runningJob(jobType string, device string) *Job {
+	jobManager.mu.Lock()
+	defer jobManager.mu.Unlock()
+	for _, job := range jobManager.jobs {
+		if job.Type == jobType && job.Device == device && job.Status == JobRunning {
+			return job
+		}
+	}
+	return nil
+}
+
+/*
+current returns copies of the jobs still held in memory, the running ones and those that finished recently
+*/
+func (jm *JobManager) current() []Job {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	jobs := make([]Job, 0, len(jm.jobs))
+	for _, job := range jm.jobs {
+		jc := *job
+		jc.Steps = append([]JobStep{}, job.Steps...)
+		jobs = append(jobs, jc)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Started.After(jobs[j].Started)
+	})
+	return jobs
+}
+
+/*
+save writes the job to the Jobs table
+*/
+func (job *Job) save() {
+	if pDB == nil {
+		return
+	}
+	jobManager.mu.Lock()
+	steps, err := json.Marshal(job.Steps)
+	finished := sql.NullTime{}
+	if job.Finished != nil {
+		finished = sql.NullTime{Time: *job.Finished, Valid: true}
+	}
+	errStr := job.Error
+	if len(errStr) > 255 {
+		errStr = errStr[:255]
+	}
+	source := job.Source
+	if len(source) > 128 {
+		source = source[:128]
+	}
+	args := []interface{}{job.ID, job.Type, job.Device, source, job.Status, job.Started, finished, string(steps), errStr}
+	jobManager.mu.Unlock()
+	if err != nil {
+		log.Println("Error converting job steps - ", err)
+		return
+	}
+	if _, err := pDB.Exec(`REPLACE INTO Jobs (id, JobType, Device, Source, Status, Started, Finished, Steps, Error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, args...); err != nil {
+		log.Println("Error saving job - ", err)
+	}
+}
+
+/*
+scanJob reads a job from a row selected by the job history queries
+*/
+func scanJob(rows *sql.Rows) (*Job, error) {
+	var (
+		job      Job
+		started  int64
+		finished sql.NullInt64
+		steps    sql.NullString
+		errStr   sql.NullString
+	)
+	if err := rows.Scan(&job.ID, &job.Type, &job.Device, &job.Source, &job.Status, &started, &finished, &steps, &errStr); err != nil {
+		return nil, err
+	}
+	job.Started = time.Unix(started, 0)
+	if finished.Valid {
+		t := time.Unix(finished.Int64, 0)
+		job.Finished = &t
+	}
+	job.Steps = []JobStep{}
+	if steps.Valid {
+		if err := json.Unmarshal([]byte(steps.String), &job.Steps); err != nil {
+			log.Println("Error reading job steps - ", err)
+		}
+	}
+	job.Error = errStr.String
+	return &job, nil
+}
+
+const jobColumns = `id, JobType, IFNULL(Device, ''), IFNULL(Source, ''), Status, UNIX_TIMESTAMP(Started), UNIX_TIMESTAMP(Finished), Steps, Error`
+
+/*
+getJob returns the job with the given ID from memory or the job history
+*/
+func getJob(id string) (*Job, error) {
+	jobManager.mu.Lock()
+	if job, found := jobManager.jobs[id]; found {
+		jc := *job
+		jc.Steps = append([]JobStep{}, job.Steps...)
+		jobManager.mu.Unlock()
+		return &jc, nil
+	}
+	jobManager.mu.Unlock()
+
+	if pDB == nil {
+		return nil, nil
+	}
+	rows, err := pDB.Query(`SELECT `+jobColumns+` FROM Jobs WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Println("Error closing query - ", err)
+		}
+	}()
+	if rows.Next() {
+		return scanJob(rows)
+	}
+	return nil, nil
+}
+
+/*
+getJobStatus returns the progress and result of a job
+URL = /api/jobs/{id}
+*/
+func getJobStatus(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	job, err := getJob(id)
+	if err != nil {
+		ReturnJSONError(w, "Jobs", err, http.StatusInternalServerError, true)
+		return
+	}
+	if job == nil {
+		ReturnJSONErrorString(w, "Jobs", "job "+id+" not found", http.StatusNotFound, false)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(job); err != nil {
+		ReturnJSONError(w, "Jobs", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+getJobHistory returns the running jobs and the job history for the last {days} days, newest first
+URL = /api/jobs?days=7
+*/
+func getJobHistory(w http.ResponseWriter, r *http.Request) {
+	days := JOBHISTORYDAYS
+	if s := r.URL.Query().Get("days"); s != "" {
+		var err error
+		if days, err = strconv.Atoi(s); err != nil || days < 1 {
+			ReturnJSONErrorString(w, "Jobs", "Invalid number of days - "+s, http.StatusBadRequest, true)
+			return
+		}
+	}
+	jobs := []*Job{}
+	seen := make(map[string]bool)
+	jobManager.mu.Lock()
+	for _, job := range jobManager.jobs {
+		if job.Status == JobRunning {
+			jc := *job
+			jc.Steps = append([]JobStep{}, job.Steps...)
+			jobs = append(jobs, &jc)
+			seen[job.ID] = true
+		}
+	}
+	jobManager.mu.Unlock()
+
+	if pDB != nil {
+		rows, err := pDB.Query(`SELECT `+jobColumns+` FROM Jobs WHERE Started > DATE_ADD(NOW(), INTERVAL ? DAY) ORDER BY Started DESC`, 0-days)
+		if err != nil {
+			ReturnJSONError(w, "Jobs", err, http.StatusInternalServerError, true)
+			return
+		}
+		for rows.Next() {
+			job, err := scanJob(rows)
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			if !seen[job.ID] {
+				jobs = append(jobs, job)
+			}
+		}
+		if err := rows.Close(); err != nil {
+			log.Println("Error closing query - ", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(jobs); err != nil {
+		ReturnJSONError(w, "Jobs", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+returnJSONJob tells the caller the job has been accepted and where to follow it
+*/
+func returnJSONJob(w http.ResponseWriter, job *Job) {
+	var jBody struct {
+		Success bool   `json:"success"`
+		Job     string `json:"job"`
+		URL     string `json:"url"`
+	}
+	jBody.Success = true
+	jBody.Job = job.ID
+	jBody.URL = "/api/jobs/" + job.ID
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", jBody.URL)
+	w.WriteHeader(http.StatusAccepted)
+	if bytesArray, err := json.Marshal(jBody); err != nil {
+		log.Println(err)
+	} else if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+		log.Println(err)
+	}
+}
+
+/*
+startJobsWebSocket streams every job update to the client as it happens
+URL = /wsJobs
+*/
+func startJobsWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	defer serviceMetrics.websocketClient("jobs")()
+	updates := jobManager.subscribe()
+	defer jobManager.unsubscribe(updates)
+	// Notice when the client goes away even if no jobs are running
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-closed:
+			return
+		case job := <-updates:
+			if err := conn.WriteJSON(job); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/***************
+Lockout/tagout lets an operator take a single electrolyser, fuel cell, dryer or relay out of service.
+While a device is locked out every command to it, whether from the API or one of the automatic controllers,
+is refused, except that it can still be stopped and turned off so it can always be made safe. Lockouts are saved
+with the settings so they survive a restart and expire automatically if an expiry time is given.
+*/
+
+const (
+	LockoutElectrolyser = "el"
+	LockoutFuelCell     = "fc"
+	LockoutDryer        = "dr"
+	LockoutRelay        = "relay"
+)
+
+type Lockout struct {
+	DeviceType string    `json:"type"`
+	Device     string    `json:"device"`
+	Reason     string    `json:"reason"`
+	Name       string    `json:"name"`
+	Placed     time.Time `json:"placed"`
+	Expires    time.Time `json:"expires"` // Zero time means the lockout stays until it is removed
+}
+
+// relayNames maps the relay coils to the names used to lock them out
+var relayNames = map[uint16]string{
+	RELAYGAS:    "gas",
+	RELAYSPARE:  "spare",
+	RELAYEL0:    "el0",
+	RELAYEL1:    "el1",
+	RELAYFC0EN:  "fc0en",
+	RELAYFC0RUN: "fc0run",
+	RELAYFC1EN:  "fc1en",
+	RELAYFC1RUN: "fc1run",
+}
+
+/*
+LockoutError is returned when a command is refused because the device is locked out
+*/
+type LockoutError struct {
+	Lockout *Lockout
+}
+
+func (e *LockoutError) Error() string {
+	return e.Lockout.String()
+}
+
+func (l *Lockout) expired(now time.Time) bool {
+	return !l.Expires.IsZero() && now.After(l.Expires)
+}
+
+func (l *Lockout) String() string {
+	s := fmt.Sprintf("%s %s is locked out by %s - %s", l.DeviceType, l.Device, l.Name, l.Reason)
+	if !l.Expires.IsZero() {
+		s += " until " + l.Expires.Format("2006-01-02 15:04")
+	}
+	return s
+}
+
+/*
+expireLockouts removes any lockouts that have passed their expiry time. The caller must hold settingsMu
+*/
+func expireLockouts() {
+	now := time.Now()
+	var current []*Lockout
+	for _, l := range params.Lockouts {
+		if l.expired(now) {
+			log.Printf("Lockout expired - %s", l)
+		} else {
+			current = append(current, l)
+		}
+	}
+	if len(current) != len(params.Lockouts) {
+		params.Lockouts = current
+		if err := params.save(); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+/*
+getLockout returns the lockout for the given device or nil if it is not locked out
+*/
+func getLockout(deviceType string, device string) *Lockout {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	expireLockouts()
+	for _, l := range params.Lockouts {
+		if l.DeviceType == deviceType && l.Device == device {
+			return l
+		}
+	}
+	return nil
+}
+
+/*
+getLockouts returns a copy of all the current lockouts
+*/
+func getLockouts() []*Lockout {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	expireLockouts()
+	lockouts := []*Lockout{}
+	for _, l := range params.Lockouts {
+		lc := *l
+		lockouts = append(lockouts, &lc)
+	}
+	return lockouts
+}
+
+/*
+checkLockout returns an error if the given device is locked out
+*/
+func checkLockout(deviceType string, device string) error {
+	if l := getLockout(deviceType, device); l != nil {
+		lc := *l
+		return &LockoutError{Lockout: &lc}
+	}
+	return nil
+}
+
+func checkElectrolyserLockout(device int) error {
+	return checkLockout(LockoutElectrolyser, strconv.Itoa(device))
+}
+
+func checkFuelCellLockout(device uint8) error {
+	return checkLockout(LockoutFuelCell, strconv.Itoa(int(device)))
+}
+
+func checkDryerLockout(device int) error {
+	return checkLockout(LockoutDryer, strconv.Itoa(device))
+}
+
+/*
+checkRelayLockout checks the relay itself and the device it powers
+*/
+func checkRelayLockout(relay uint16) error {
+	if err := checkLockout(LockoutRelay, relayNames[relay]); err != nil {
+		return err
+	}
+	switch relay {
+	case RELAYEL0:
+		return checkElectrolyserLockout(0)
+	case RELAYEL1:
+		return checkElectrolyserLockout(1)
+	case RELAYFC0EN, RELAYFC0RUN:
+		return checkFuelCellLockout(0)
+	case RELAYFC1EN, RELAYFC1RUN:
+		return checkFuelCellLockout(1)
+	}
+	return nil
+}
+
+/*
+deviceRegistered says whether the electrolyser, its dryer or the fuel cell has been found
+*/
+func deviceRegistered(deviceType string, device int) bool {
+	if deviceType == LockoutFuelCell {
+		if canBus == nil {
+			return false
+		}
+		_, found := canBus.fuelCell[uint8(device)]
+		return found
+	}
+	// Each dryer is attached to the electrolyser with the same number
+	SystemStatus.m.Lock()
+	defer SystemStatus.m.Unlock()
+	return device < len(SystemStatus.Electrolysers)
+}
+
+/*
+validLockoutTarget checks that the device type and device name refer to something we can lock out
+*/
+func validLockoutTarget(deviceType string, device string) error {
+	switch deviceType {
+	case LockoutElectrolyser, LockoutFuelCell, LockoutDryer:
+		n, err := strconv.Atoi(device)
+		if err != nil || n < 0 || n > 255 {
+			return fmt.Errorf("invalid %s device - %s", deviceType, device)
+		}
+		if !deviceRegistered(deviceType, n) {
+			return fmt.Errorf("there is no %s device %d", deviceType, n)
+		}
+	case LockoutRelay:
+		for _, name := range relayNames {
+			if name == device {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid relay - %s", device)
+	default:
+		return fmt.Errorf("invalid device type - %s", deviceType)
+	}
+	return nil
+}
+
+/*
+getLockoutList returns all current lockouts
+URL = /lockout
+*/
+func getLockoutList(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(getLockouts()); err != nil {
+		ReturnJSONError(w, "Lockout", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+setLockout places a device out of service
+URL = /lockout/{type}/{device}
+payload = {"reason":"Replacing the dryer fan","name":"Ian","expires":"2022-06-30 17:00"} expires is optional
+*/
+func setLockout(w http.ResponseWriter, r *http.Request) {
+	var jBody struct {
+		Reason  string `json:"reason"`
+		Name    string `json:"name"`
+		Expires string `json:"expires"`
+	}
+	vars := mux.Vars(r)
+	if err := validLockoutTarget(vars["type"], vars["device"]); err != nil {
+		ReturnJSONError(w, "Lockout", err, http.StatusBadRequest, true)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &jBody)
+	}
+	if err != nil {
+		ReturnJSONError(w, "Lockout", err, http.StatusBadRequest, true)
+		return
+	}
+	// With authentication on the lockout is always placed in the signed in user's name
+	name := operatorName(r, jBody.Name)
+	if jBody.Reason == "" || name == "" {
+		ReturnJSONErrorString(w, "Lockout", "Both a reason and a name are required", http.StatusBadRequest, true)
+		return
+	}
+	lockout := &Lockout{DeviceType: vars["type"], Device: vars["device"], Reason: jBody.Reason, Name: name, Placed: time.Now()}
+	if jBody.Expires != "" {
+		if lockout.Expires, err = time.ParseInLocation("2006-1-2 15:4", jBody.Expires, time.Local); err != nil {
+			ReturnJSONError(w, "Lockout", err, http.StatusBadRequest, true)
+			return
+		}
+		if lockout.Expires.Before(lockout.Placed) {
+			ReturnJSONErrorString(w, "Lockout", "Expiry time is in the past", http.StatusBadRequest, true)
+			return
+		}
+	}
+
+	settingsMu.Lock()
+	expireLockouts()
+	for _, l := range params.Lockouts {
+		if l.DeviceType == lockout.DeviceType && l.Device == lockout.Device {
+			settingsMu.Unlock()
+			ReturnJSONErrorString(w, "Lockout", l.String(), http.StatusConflict, true)
+			return
+		}
+	}
+	params.Lockouts = append(params.Lockouts, lockout)
+	err = params.save()
+	settingsMu.Unlock()
+
+	log.Printf("Lockout placed - %s", lockout)
+	if err != nil {
+		// The lockout is in force but will be lost on a restart
+		ReturnJSONError(w, "Lockout", fmt.Errorf("the lockout is in place but could not be saved - %v", err), http.StatusInternalServerError, true)
+		return
+	}
+	returnJSONSuccess(w)
+}
+
+/*
+clearLockout returns a device to service
+URL = /lockout/{type}/{device}
+*/
+func clearLockout(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	settingsMu.Lock()
+	var removed *Lockout
+	var current []*Lockout
+	for _, l := range params.Lockouts {
+		if l.DeviceType == vars["type"] && l.Device == vars["device"] {
+			removed = l
+		} else {
+			current = append(current, l)
+		}
+	}
+	var err error
+	if removed != nil {
+		params.Lockouts = current
+		err = params.save()
+	}
+	settingsMu.Unlock()
+
+	if removed == nil {
+		ReturnJSONErrorString(w, "Lockout", fmt.Sprintf("%s %s is not locked out", vars["type"], vars["device"]), http.StatusNotFound, true)
+		return
+	}
+	log.Printf("Lockout removed - %s", removed)
+	if err != nil {
+		// The lockout has gone but will come back on a restart
+		ReturnJSONError(w, "Lockout", fmt.Errorf("the lockout has been removed but the change could not be saved - %v", err), http.StatusInternalServerError, true)
+		return
+	}
+	returnJSONSuccess(w)
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/***************
+MQTT client for SCADA and home automation. The status is published as one retained JSON message per device at the
+configured rate under the topic prefix, e.g. with the default prefix of firefly:
+
+	firefly/status                 online or offline (retained, offline is also the last will)
+	firefly/system                 rate, emergency stop, lockouts and stale data sources
+	firefly/relays                 relay states
+	firefly/gas                    gas pressures
+	firefly/water                  water conductivity
+	firefly/ac, firefly/hp         power meters
+	firefly/el/{n}                 electrolyser n
+	firefly/el/{n}/availability    online or offline (retained)
+	firefly/dr                     dryer
+	firefly/fc/{n}                 fuel cell n
+	firefly/fc/{n}/availability    online or offline (retained)
+
+When commands are enabled these topics are subscribed to. They go through the same validation as the HTTP API and the
+outcome of each one is published to firefly/command/result.
+
+	firefly/el/rate/set            0-100 or {"rate":50}
+	firefly/fc/{n}/run/set         ON, OFF or {"state":true}
+	firefly/gas/set                ON, OFF or {"state":true}
+	firefly/spare/set              ON, OFF or {"state":true}
+*/
+
+const MQTTPUBLISHINTERVAL = time.Second * 10 // Default time between status messages
+const MQTTTIMEOUT = time.Second * 5          // Longest we wait for the broker to accept a message
+const MQTTRETRYINTERVAL = time.Second * 10   // Time between attempts to connect to the broker
+const MQTTONLINE = "online"
+const MQTTOFFLINE = "offline"
+const HealthMQTT = "mqtt"
+
+type MQTTSettings struct {
+	Enabled            bool          `json:"enabled"`
+	Broker             string        `json:"broker"` // tcp://host:1883, ssl://host:8883, ws://host:80/mqtt or wss://host:443/mqtt
+	ClientID           string        `json:"clientId"`
+	Username           string        `json:"username"`
+	Password           string        `json:"password"`
+	TopicPrefix        string        `json:"topicPrefix"`
+	PublishInterval    time.Duration `json:"publishInterval"`
+	QoS                byte          `json:"qos"`
+	Commands           bool          `json:"commands"`   // Subscribe to the command topics
+	CACertFile         string        `json:"caCertFile"` // PEM file of the CA that signed the broker certificate. Blank = system roots
+	CertFile           string        `json:"certFile"`   // Client certificate and key for brokers that require them
+	KeyFile            string        `json:"keyFile"`
+	InsecureSkipVerify bool          `json:"insecureSkipVerify"`
+	HomeAssistant      bool          `json:"homeAssistant"` // Publish Home Assistant discovery configs
+	DiscoveryPrefix    string        `json:"discoveryPrefix"`
+}
+
+type MQTTClient struct {
+	client       mqtt.Client
+	settings     MQTTSettings
+	restart      chan struct{}
+	availability map[string]string // Last availability published for each device so we only send changes
+	discovery    map[string]string // Last Home Assistant config published for each discovery topic
+	mu           sync.Mutex
+}
+
+var mqttClient = &MQTTClient{restart: make(chan struct{}, 1), availability: make(map[string]string),
+	discovery: make(map[string]string)}
+
+func NewMQTTSettings() *MQTTSettings {
+	s := new(MQTTSettings)
+	s.TopicPrefix = "firefly"
+	s.PublishInterval = MQTTPUBLISHINTERVAL
+	s.DiscoveryPrefix = HADISCOVERYPREFIX
+	if host, err := os.Hostname(); err == nil {
+		s.ClientID = "firefly-" + host
+	} else {
+		s.ClientID = "firefly"
+	}
+	return s
+}
+
+/*
+validate checks the settings make sense before they are saved
+*/
+func (s *MQTTSettings) validate() error {
+	if s.TopicPrefix == "" || strings.ContainsAny(s.TopicPrefix, "+#") {
+		return fmt.Errorf("the topic prefix must not be blank or contain + or #")
+	}
+	if s.PublishInterval < time.Second {
+		return fmt.Errorf("the publish interval must be at least one second")
+	}
+	if s.HomeAssistant && (s.DiscoveryPrefix == "" || strings.ContainsAny(s.DiscoveryPrefix, "+#")) {
+		return fmt.Errorf("the discovery prefix must not be blank or contain + or #")
+	}
+	if s.QoS > 2 {
+		return fmt.Errorf("QoS must be 0, 1 or 2")
+	}
+	if (s.CertFile == "") != (s.KeyFile == "") {
+		return fmt.Errorf("a client certificate needs both the certificate and the key file")
+	}
+	if !s.Enabled {
+		return nil
+	}
+	if s.ClientID == "" {
+		return fmt.Errorf("a client ID is required")
+	}
+	u, err := url.Parse(s.Broker)
+	if err != nil {
+		return fmt.Errorf("invalid broker - %v", err)
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss":
+	default:
+		return fmt.Errorf("the broker must be a tcp://, ssl://, ws:// or wss:// URL")
+	}
+	return nil
+}
+
+/*
+tlsConfig builds the TLS configuration, or returns nil if the connection is not encrypted
+*/
+func (s *MQTTSettings) tlsConfig() (*tls.Config, error) {
+	secure := strings.HasPrefix(s.Broker, "ssl:") || strings.HasPrefix(s.Broker, "tls:") ||
+		strings.HasPrefix(s.Broker, "mqtts:") || strings.HasPrefix(s.Broker, "wss:")
+	if !secure && s.CACertFile == "" && s.CertFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: s.InsecureSkipVerify}
+	if s.CACertFile != "" {
+		pem, err := os.ReadFile(s.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", s.CACertFile)
+		}
+	}
+	if s.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func (s *MQTTSettings) masked() *MQTTSettings {
+	m := *s
+	if m.Password != "" {
+		m.Password = NOTIFICATIONPASSWORDMASK
+	}
+	return &m
+}
+
+func (mc *MQTTClient) topic(parts ...string) string {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.settings.TopicPrefix + "/" + strings.Join(parts, "/")
+}
+
+/*
+Run connects to the broker and publishes the status until the service stops. It reconnects with the new settings
+whenever they are changed.
+*/
+func (mc *MQTTClient) Run() {
+	for {
+		settingsMu.Lock()
+		settings := *params.MQTT
+		settingsMu.Unlock()
+
+		var tick <-chan time.Time
+		var ticker *time.Ticker
+		if settings.Enabled {
+			if err := mc.connect(settings); err != nil {
+				log.Println("MQTT - ", err)
+				healthFailure(HealthMQTT, err)
+			} else {
+				ticker = time.NewTicker(settings.PublishInterval)
+				tick = ticker.C
+			}
+		}
+
+		restart := false
+		for !restart {
+			select {
+			case <-serviceContext.Done():
+				if ticker != nil {
+					ticker.Stop()
+				}
+				mc.disconnect()
+				return
+			case <-mc.restart:
+				restart = true
+			case <-tick:
+				mc.publishStatus()
+			}
+		}
+		if ticker != nil {
+			ticker.Stop()
+		}
+		mc.disconnect()
+	}
+}
+
+/*
+Restart makes the client pick up new settings
+*/
+func (mc *MQTTClient) Restart() {
+	select {
+	case mc.restart <- struct{}{}:
+	default:
+	}
+}
+
+func (mc *MQTTClient) connect(settings MQTTSettings) error {
+	tlsConfig, err := settings.tlsConfig()
+	if err != nil {
+		return err
+	}
+	mc.mu.Lock()
+	mc.settings = settings
+	mc.mu.Unlock()
+
+	options := mqtt.NewClientOptions()
+	options.AddBroker(settings.Broker)
+	options.SetClientID(settings.ClientID)
+	options.SetUsername(settings.Username)
+	options.SetPassword(settings.Password)
+	if tlsConfig != nil {
+		options.SetTLSConfig(tlsConfig)
+	}
+	options.SetWill(mc.topic("status"), MQTTOFFLINE, 1, true)
+	options.SetAutoReconnect(true)
+	options.SetConnectRetry(true)
+	options.SetConnectRetryInterval(MQTTRETRYINTERVAL)
+	options.SetOrderMatters(false)
+	options.SetOnConnectHandler(mc.onConnect)
+	options.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Println("MQTT connection lost - ", err)
+		healthFailure(HealthMQTT, err)
+	})
+
+	log.Printf("Connecting to the MQTT broker at %s", settings.Broker)
+	client := mqtt.NewClient(options)
+	mc.mu.Lock()
+	mc.client = client
+	mc.mu.Unlock()
+	// With connect retry on this only completes once connected so don't wait for it
+	client.Connect()
+	return nil
+}
+
+/*
+onConnect announces we are online, republishes the availability and subscribes to the commands. Called on every
+connection including reconnections.
+*/
+func (mc *MQTTClient) onConnect(client mqtt.Client) {
+	log.Println("Connected to the MQTT broker")
+	healthSuccess(HealthMQTT)
+	mc.mu.Lock()
+	mc.availability = make(map[string]string)
+	mc.discovery = make(map[string]string)
+	settings := mc.settings
+	mc.mu.Unlock()
+	mc.publish(mc.topic("status"), true, MQTTONLINE)
+	if settings.Commands {
+		filters := map[string]byte{
+			mc.topic("el", "rate", "set"):     settings.QoS,
+			mc.topic("gas", "set"):            settings.QoS,
+			mc.topic("spare", "set"):          settings.QoS,
+			mc.topic("fc", "+", "run", "set"): settings.QoS,
+		}
+		token := client.SubscribeMultiple(filters, mc.onCommand)
+		if token.WaitTimeout(MQTTTIMEOUT) && token.Error() != nil {
+			log.Println("MQTT subscribe failed - ", token.Error())
+			healthFailure(HealthMQTT, token.Error())
+		}
+	}
+	go mc.publishStatus()
+}
+
+func (mc *MQTTClient) disconnect() {
+	client, _ := mc.getClient()
+	if client == nil {
+		return
+	}
+	mc.publish(mc.topic("status"), true, MQTTOFFLINE)
+	client.Disconnect(uint(MQTTTIMEOUT.Milliseconds()))
+	mc.mu.Lock()
+	mc.client = nil
+	mc.mu.Unlock()
+	log.Println("Disconnected from the MQTT broker")
+}
+
+/*
+getClient returns the current client, or nil if we are not configured to connect, and the settings it was started with
+*/
+func (mc *MQTTClient) getClient() (mqtt.Client, MQTTSettings) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.client, mc.settings
+}
+
+/*
+publish sends a message. payload can be a string, bytes or anything that can be marshalled to JSON.
+*/
+func (mc *MQTTClient) publish(topic string, retained bool, payload interface{}) {
+	client, settings := mc.getClient()
+	if client == nil || !client.IsConnectionOpen() {
+		return
+	}
+	switch payload.(type) {
+	case string, []byte:
+	default:
+		bytesArray, err := json.Marshal(payload)
+		if err != nil {
+			log.Println("MQTT - ", err)
+			return
+		}
+		payload = bytesArray
+	}
+	token := client.Publish(topic, settings.QoS, retained, payload)
+	if token.WaitTimeout(MQTTTIMEOUT) && token.Error() != nil {
+		log.Printf("MQTT publish to %s failed - %v", topic, token.Error())
+		healthFailure(HealthMQTT, token.Error())
+	}
+}
+
+/*
+publishAvailability sends the availability of a device if it has changed
+*/
+func (mc *MQTTClient) publishAvailability(device string, valid bool) {
+	state := MQTTOFFLINE
+	if valid {
+		state = MQTTONLINE
+	}
+	mc.mu.Lock()
+	changed := mc.availability[device] != state
+	mc.availability[device] = state
+	mc.mu.Unlock()
+	if changed {
+		mc.publish(mc.topic(device, "availability"), true, state)
+	}
+}
+
+/*
+publishStatus splits the full status into one message per device
+*/
+func (mc *MQTTClient) publishStatus() {
+	client, settings := mc.getClient()
+	if client == nil || !client.IsConnectionOpen() {
+		return
+	}
+	var status struct {
+		Relays        json.RawMessage   `json:"relays"`
+		Electrolysers []json.RawMessage `json:"el"`
+		Dryer         json.RawMessage   `json:"dr"`
+		FuelCells     []json.RawMessage `json:"fc"`
+		Gas           json.RawMessage   `json:"gas"`
+		Tds           float32           `json:"tds"`
+		TdsValid      bool              `json:"tdsValid"`
+		AC            json.RawMessage   `json:"ac"`
+		HP            json.RawMessage   `json:"hp"`
+		Lockouts      json.RawMessage   `json:"lockouts"`
+		EmergencyStop bool              `json:"estop"`
+		Stale         []string          `json:"stale"`
+	}
+	if err := json.Unmarshal([]byte(getFullJsonStatus()), &status); err != nil {
+		log.Println("MQTT - ", err)
+		return
+	}
+	mc.publishDiscovery(settings, status.Electrolysers, status.FuelCells)
+
+	var valid struct {
+		Valid bool `json:"valid"`
+	}
+
+	mc.publish(mc.topic("system"), true, struct {
+		Rate          uint8           `json:"rate"`
+		EmergencyStop bool            `json:"estop"`
+		Lockouts      json.RawMessage `json:"lockouts"`
+		Stale         []string        `json:"stale"`
+	}{CurrentRate, status.EmergencyStop, status.Lockouts, status.Stale})
+	mc.publish(mc.topic("relays"), true, []byte(status.Relays))
+	mc.publish(mc.topic("gas"), true, []byte(status.Gas))
+	mc.publish(mc.topic("water"), true, struct {
+		Tds   float32 `json:"tds"`
+		Valid bool    `json:"valid"`
+	}{status.Tds, status.TdsValid})
+	mc.publish(mc.topic("ac"), true, []byte(status.AC))
+	mc.publish(mc.topic("hp"), true, []byte(status.HP))
+	if len(status.Dryer) > 0 {
+		mc.publish(mc.topic("dr"), true, []byte(status.Dryer))
+	}
+	for device, el := range status.Electrolysers {
+		mc.publish(mc.topic("el", strconv.Itoa(device)), true, []byte(el))
+		valid.Valid = false
+		_ = json.Unmarshal(el, &valid)
+		mc.publishAvailability("el/"+strconv.Itoa(device), valid.Valid)
+	}
+	// Fuel cells are keyed by their CAN bus device number which need not match their position in the list
+	for _, fc := range status.FuelCells {
+		var entry struct {
+			Device uint8 `json:"device"`
+			Valid  bool  `json:"valid"`
+		}
+		if err := json.Unmarshal(fc, &entry); err != nil {
+			log.Println("MQTT - ", err)
+			continue
+		}
+		device := strconv.Itoa(int(entry.Device))
+		mc.publish(mc.topic("fc", device), true, []byte(fc))
+		mc.publishAvailability("fc/"+device, entry.Valid)
+	}
+}
+
+/*
+onCommand handles a message on one of the command topics. The command runs in its own goroutine so a slow device
+doesn't hold up the MQTT client.
+*/
+func (mc *MQTTClient) onCommand(_ mqtt.Client, msg mqtt.Message) {
+	topic := msg.Topic()
+	payload := strings.TrimSpace(string(msg.Payload()))
+	go func() {
+		err := mc.runCommand(strings.TrimPrefix(topic, mc.topic("")), payload, "MQTT "+topic)
+		result := struct {
+			Topic   string `json:"topic"`
+			Payload string `json:"payload"`
+			Success bool   `json:"success"`
+			Error   string `json:"error,omitempty"`
+		}{Topic: topic, Payload: payload, Success: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+			log.Printf("MQTT command %s %s refused - %v", topic, payload, err)
+		}
+		mc.publish(mc.topic("command", "result"), false, result)
+	}()
+}
+
+/*
+runCommand parses a command and passes it to the same command functions the HTTP API uses
+*/
+func (mc *MQTTClient) runCommand(command string, payload string, source string) error {
+	parts := strings.Split(command, "/")
+	switch {
+	case command == "el/rate/set":
+		var jRate struct {
+			Rate int64 `json:"rate"`
+		}
+		if err := json.Unmarshal([]byte(payload), &jRate); err != nil {
+			rate, err := strconv.ParseInt(payload, 10, 64)
+			if err != nil {
+				return fmt.Errorf("expected a rate of 0-100 but got %q", payload)
+			}
+			jRate.Rate = rate
+		}
+		if err := commandElectrolyserRate(jRate.Rate, source); err != nil {
+			return err
+		}
+	case command == "gas/set":
+		on, err := parseOnOffPayload(payload)
+		if err != nil {
+			return err
+		}
+		if err := commandGas(on, source); err != nil {
+			return err
+		}
+	case command == "spare/set":
+		on, err := parseOnOffPayload(payload)
+		if err != nil {
+			return err
+		}
+		if err := commandSpare(on, source); err != nil {
+			return err
+		}
+	case len(parts) == 4 && parts[0] == "fc" && parts[2] == "run" && parts[3] == "set":
+		device, err := strconv.ParseUint(parts[1], 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid fuel cell %q", parts[1])
+		}
+		run, err := parseOnOffPayload(payload)
+		if err != nil {
+			return err
+		}
+		if err := commandFuelCellRun(uint8(device), run, source); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown command topic %s", command)
+	}
+	return nil
+}
+
+/*
+parseOnOffPayload accepts {"state":true} or a plain ON/OFF
+*/
+func parseOnOffPayload(payload string) (bool, error) {
+	var body OnOffPayload
+	if err := json.Unmarshal([]byte(payload), &body); err == nil {
+		return body.State, nil
+	}
+	return parseOnOff(payload)
+}
+
+/*
+checkMQTT reports on the connection to the broker
+*/
+func checkMQTT() (bool, string) {
+	client, settings := mqttClient.getClient()
+	if client == nil {
+		return false, "not connected"
+	}
+	if !client.IsConnectionOpen() {
+		return false, "connecting to " + settings.Broker
+	}
+	return true, "connected to " + settings.Broker
+}
+
+/*
+getMQTTSettings returns the MQTT settings with the password masked
+URL = /mqtt
+*/
+func getMQTTSettings(w http.ResponseWriter, _ *http.Request) {
+	settingsMu.Lock()
+	settings := params.MQTT.masked()
+	settingsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(settings); err != nil {
+		ReturnJSONError(w, "MQTT", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+setMQTTSettings replaces the MQTT settings and reconnects. A password sent back as ******** keeps the saved one.
+URL = /mqtt
+payload = {"enabled":true,"broker":"ssl://broker.example.com:8883","clientId":"firefly-pi","username":"firefly",
+"password":"secret","topicPrefix":"firefly","publishInterval":10000000000,"qos":1,"commands":true,"caCertFile":"/etc/ssl/broker-ca.pem"}
+*/
+func setMQTTSettings(w http.ResponseWriter, r *http.Request) {
+	settings := NewMQTTSettings()
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, settings)
+	}
+	if err != nil {
+		ReturnJSONError(w, "MQTT", err, http.StatusBadRequest, true)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		ReturnJSONError(w, "MQTT", err, http.StatusBadRequest, true)
+		return
+	}
+	if _, err := settings.tlsConfig(); err != nil {
+		ReturnJSONError(w, "MQTT", err, http.StatusBadRequest, true)
+		return
+	}
+
+	settingsMu.Lock()
+	if settings.Password == NOTIFICATIONPASSWORDMASK {
+		settings.Password = params.MQTT.Password
+	}
+	params.MQTT = settings
+	err = params.save()
+	settingsMu.Unlock()
+	if err != nil {
+		ReturnJSONError(w, "MQTT", err, http.StatusInternalServerError, true)
+		return
+	}
+	mqttClient.Restart()
+	log.Println("MQTT settings updated")
+	returnJSONSuccess(w)
+}
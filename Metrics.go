@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/***************
+Prometheus metrics. /metrics returns the plant telemetry, relay states, device state codes and fault bitfields along
+with the service internals in the Prometheus text exposition format. Values from a data source the watchdog has marked
+stale are left out so a dead bus shows as a gap in Grafana rather than a flat line.
+*/
+
+var dbInsertBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+const (
+	DBTableLogging = "logging"
+	DBTableCAN     = "canlog"
+)
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // Count of observations in each bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(value float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+type ServiceMetrics struct {
+	canFrames          uint64 // Updated atomically from the CAN frame handler
+	canSequenceErrors  uint64 // Updated atomically from the CAN frame handler
+	canFramesPerSecond float64
+	lastCANFrames      uint64
+	lastCANSample      time.Time
+	dbInserts          map[string]*histogram
+	dbFailures         map[string]uint64
+	websocketClients   map[string]int
+	mu                 sync.Mutex
+}
+
+var serviceMetrics = &ServiceMetrics{dbInserts: make(map[string]*histogram), dbFailures: make(map[string]uint64),
+	websocketClients: make(map[string]int)}
+
+/*
+canFrame counts a frame received from the CAN bus
+*/
+func (sm *ServiceMetrics) canFrame() {
+	atomic.AddUint64(&sm.canFrames, 1)
+}
+
+/*
+canSequenceError counts a 0x400 frame that arrived out of sequence
+*/
+func (sm *ServiceMetrics) canSequenceError() {
+	atomic.AddUint64(&sm.canSequenceErrors, 1)
+}
+
+/*
+sampleCANRate works out the CAN frame rate since the last sample. Called once per logging cycle.
+*/
+func (sm *ServiceMetrics) sampleCANRate() {
+	now := time.Now()
+	frames := atomic.LoadUint64(&sm.canFrames)
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if !sm.lastCANSample.IsZero() {
+		sm.canFramesPerSecond = float64(frames-sm.lastCANFrames) / now.Sub(sm.lastCANSample).Seconds()
+	}
+	sm.lastCANFrames = frames
+	sm.lastCANSample = now
+}
+
+/*
+dbInsert records how long a database insert took and whether it failed
+*/
+func (sm *ServiceMetrics) dbInsert(table string, started time.Time, err error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if err != nil {
+		sm.dbFailures[table]++
+		return
+	}
+	h, found := sm.dbInserts[table]
+	if !found {
+		h = &histogram{buckets: dbInsertBuckets}
+		sm.dbInserts[table] = h
+	}
+	h.observe(time.Since(started).Seconds())
+}
+
+/*
+websocketClient counts a client connected to a websocket endpoint. Call the returned function when it disconnects.
+*/
+func (sm *ServiceMetrics) websocketClient(endpoint string) func() {
+	sm.mu.Lock()
+	sm.websocketClients[endpoint]++
+	sm.mu.Unlock()
+	return func() {
+		sm.mu.Lock()
+		sm.websocketClients[endpoint]--
+		sm.mu.Unlock()
+	}
+}
+
+/*
+metricWriter writes metrics in the Prometheus text format. The first write error is kept and later writes are skipped.
+*/
+type metricWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (m *metricWriter) printf(format string, args ...interface{}) {
+	if m.err == nil {
+		_, m.err = fmt.Fprintf(m.w, format, args...)
+	}
+}
+
+func (m *metricWriter) header(name string, metricType string, help string) {
+	m.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (m *metricWriter) sample(name string, labels string, value float64) {
+	m.printf("%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+/*
+labels formats name/value pairs as a Prometheus label set
+*/
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+/*
+writePlantMetrics writes the telemetry and the device states
+*/
+func writePlantMetrics(m *metricWriter) {
+	m.header("firefly_telemetry", "gauge", "Current value of each telemetry point.")
+	for _, p := range collectTelemetry() {
+		m.sample("firefly_telemetry", labels("point", p.Name, "units", p.Units), p.Value)
+	}
+
+	type deviceState struct {
+		device string
+		values []float64
+	}
+	type relayState struct {
+		name string
+		on   bool
+	}
+	var relays []relayState
+	var meters []deviceState
+	var electrolysers []deviceState
+	var dryers []deviceState
+
+	SystemStatus.m.Lock()
+	if !commsWatchdog.isStale(DataSourceIO) {
+		r := SystemStatus.Relays
+		relays = []relayState{{"gas", r.GasToFuelCell}, {"fc0Enable", r.FC0Enable}, {"fc0Run", r.FC0Run},
+			{"fc1Enable", r.FC1Enable}, {"fc1Run", r.FC1Run}, {"el0", r.EL0}, {"el1", r.EL1}, {"spare", r.Spare}}
+	}
+	for _, meter := range []struct {
+		name   string
+		status acStatus
+	}{{DataSourceAC, SystemStatus.AC}, {DataSourceHP, SystemStatus.HP}} {
+		if !commsWatchdog.isStale(meter.name) {
+			meters = append(meters, deviceState{meter.name, []float64{float64(meter.status.ACEnergy)}})
+		}
+	}
+	for device, el := range SystemStatus.Electrolysers {
+		state := deviceState{strconv.Itoa(device), []float64{boolValue(el.status.SwitchedOn), boolValue(el.clientConnected)}}
+		if el.status.SwitchedOn && el.clientConnected && !commsWatchdog.isStale(elDataSource(device)) {
+			state.values = append(state.values, float64(el.status.ElState), float64(el.status.SystemState),
+				float64(el.status.Warnings.count), float64(el.status.Errors.count))
+		}
+		electrolysers = append(electrolysers, state)
+	}
+	for _, device := range dryerDevices() {
+		dr := getDryerStatus(device)
+		if dr.On && dr.Connected && !dr.Stale {
+			dryers = append(dryers, deviceState{strconv.Itoa(device), []float64{float64(dr.ErrorCode), float64(dr.WarningCode)}})
+		}
+	}
+	SystemStatus.m.Unlock()
+
+	m.header("firefly_relay_on", "gauge", "Relay state, 1 = on.")
+	for _, relay := range relays {
+		m.sample("firefly_relay_on", labels("relay", relay.name), boolValue(relay.on))
+	}
+	m.header("firefly_energy", "gauge", "Energy reading from the power meter.")
+	for _, meter := range meters {
+		m.sample("firefly_energy", labels("meter", meter.device), meter.values[0])
+	}
+	for i, metric := range []struct{ name, help string }{
+		{"firefly_electrolyser_switched_on", "Electrolyser power state, 1 = on."},
+		{"firefly_electrolyser_connected", "Electrolyser Modbus TCP link state, 1 = connected."},
+		{"firefly_electrolyser_state_code", "Electrolyser state code (register 1200)."},
+		{"firefly_electrolyser_system_state_code", "Electrolyser system state code (register 18)."},
+		{"firefly_electrolyser_warnings", "Number of active electrolyser warnings."},
+		{"firefly_electrolyser_errors", "Number of active electrolyser errors."}} {
+		m.header(metric.name, "gauge", metric.help)
+		for _, el := range electrolysers {
+			if i < len(el.values) {
+				m.sample(metric.name, labels("device", el.device), el.values[i])
+			}
+		}
+	}
+	m.header("firefly_dryer_error_code", "gauge", "Dryer error bitfield.")
+	for _, dr := range dryers {
+		m.sample("firefly_dryer_error_code", labels("device", dr.device), dr.values[0])
+	}
+	m.header("firefly_dryer_warning_code", "gauge", "Dryer warning bitfield.")
+	for _, dr := range dryers {
+		m.sample("firefly_dryer_warning_code", labels("device", dr.device), dr.values[1])
+	}
+
+	var devices []int
+	for device := range canBus.fuelCell {
+		devices = append(devices, int(device))
+	}
+	sort.Ints(devices)
+	m.header("firefly_fuel_cell_state_code", "gauge", "Fuel cell state bitmask, 0 = off.")
+	for _, device := range devices {
+		fc := canBus.fuelCell[uint8(device)]
+		m.sample("firefly_fuel_cell_state_code", labels("device", strconv.Itoa(device)), float64(fc.GetStateCode()))
+	}
+	m.header("firefly_fuel_cell_fault_flags", "gauge", "Fuel cell fault bitfields A to D.")
+	for _, device := range devices {
+		fc := canBus.fuelCell[uint8(device)]
+		if commsWatchdog.isStale(fcDataSource(uint8(device))) {
+			continue
+		}
+		for _, flag := range []struct {
+			name  string
+			value uint32
+		}{{"A", fc.getFaultA()}, {"B", fc.getFaultB()}, {"C", fc.getFaultC()}, {"D", fc.getFaultD()}} {
+			m.sample("firefly_fuel_cell_fault_flags", labels("device", strconv.Itoa(device), "flag", flag.name), float64(flag.value))
+		}
+	}
+
+	m.header("firefly_emergency_stop_latched", "gauge", "1 while the emergency stop is latched.")
+	m.sample("firefly_emergency_stop_latched", "", boolValue(emergencyStop.Latched()))
+	commsWatchdog.mu.Lock()
+	stale := make(map[string]bool, len(commsWatchdog.sources))
+	var sources []string
+	for name, source := range commsWatchdog.sources {
+		sources = append(sources, name)
+		stale[name] = source.Stale
+	}
+	commsWatchdog.mu.Unlock()
+	sort.Strings(sources)
+	m.header("firefly_data_stale", "gauge", "1 while the data from a source is stale.")
+	for _, name := range sources {
+		m.sample("firefly_data_stale", labels("source", name), boolValue(stale[name]))
+	}
+}
+
+/*
+writeServiceMetrics writes the service internals. The values are copied under their locks and written afterwards so
+a slow scraper can't hold up the loops that update them.
+*/
+func writeServiceMetrics(m *metricWriter) {
+	type tableHistogram struct {
+		table     string
+		histogram histogram
+	}
+	type endpointClients struct {
+		endpoint string
+		clients  int
+	}
+
+	healthMu.Lock()
+	modbusErrors := make(map[string]uint64)
+	var buses []string
+	for name, record := range healthRecords {
+		if name == HealthModbusRTU || strings.HasPrefix(name, "el") {
+			bus := name
+			if bus == HealthModbusRTU {
+				bus = "rtu"
+			}
+			buses = append(buses, bus)
+			modbusErrors[bus] = record.errors
+		}
+	}
+	healthMu.Unlock()
+
+	serviceMetrics.mu.Lock()
+	framesPerSecond := serviceMetrics.canFramesPerSecond
+	var inserts []tableHistogram
+	for table, h := range serviceMetrics.dbInserts {
+		hc := *h
+		hc.counts = append([]uint64{}, h.counts...)
+		inserts = append(inserts, tableHistogram{table, hc})
+	}
+	failures := make(map[string]uint64)
+	for _, table := range []string{DBTableLogging, DBTableCAN} {
+		failures[table] = serviceMetrics.dbFailures[table]
+	}
+	var websockets []endpointClients
+	for endpoint, clients := range serviceMetrics.websocketClients {
+		websockets = append(websockets, endpointClients{endpoint, clients})
+	}
+	serviceMetrics.mu.Unlock()
+
+	sort.Strings(buses)
+	m.header("firefly_modbus_errors_total", "counter", "Modbus errors on the RTU bus and each electrolyser link.")
+	for _, bus := range buses {
+		m.sample("firefly_modbus_errors_total", labels("bus", bus), float64(modbusErrors[bus]))
+	}
+
+	m.header("firefly_can_frames_total", "counter", "CAN frames received.")
+	m.sample("firefly_can_frames_total", "", float64(atomic.LoadUint64(&serviceMetrics.canFrames)))
+	m.header("firefly_can_sequence_errors_total", "counter", "0x400 frames received out of sequence.")
+	m.sample("firefly_can_sequence_errors_total", "", float64(atomic.LoadUint64(&serviceMetrics.canSequenceErrors)))
+	m.header("firefly_can_frames_per_second", "gauge", "CAN frames received per second over the last logging cycle.")
+	m.sample("firefly_can_frames_per_second", "", framesPerSecond)
+
+	sort.Slice(inserts, func(i, j int) bool {
+		return inserts[i].table < inserts[j].table
+	})
+	m.header("firefly_db_insert_duration_seconds", "histogram", "Time taken by successful database inserts.")
+	for _, insert := range inserts {
+		h := insert.histogram
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			if i < len(h.counts) {
+				// counts is only made on the first observation
+				cumulative += h.counts[i]
+			}
+			m.sample("firefly_db_insert_duration_seconds_bucket", labels("table", insert.table, "le", strconv.FormatFloat(bound, 'g', -1, 64)), float64(cumulative))
+		}
+		m.sample("firefly_db_insert_duration_seconds_bucket", labels("table", insert.table, "le", "+Inf"), float64(h.count))
+		m.sample("firefly_db_insert_duration_seconds_sum", labels("table", insert.table), h.sum)
+		m.sample("firefly_db_insert_duration_seconds_count", labels("table", insert.table), float64(h.count))
+	}
+	m.header("firefly_db_insert_failures_total", "counter", "Database inserts that failed.")
+	for _, table := range []string{DBTableLogging, DBTableCAN} {
+		m.sample("firefly_db_insert_failures_total", labels("table", table), float64(failures[table]))
+	}
+
+	sort.Slice(websockets, func(i, j int) bool {
+		return websockets[i].endpoint < websockets[j].endpoint
+	})
+	m.header("firefly_websocket_clients", "gauge", "Websocket clients currently connected.")
+	for _, websocket := range websockets {
+		m.sample("firefly_websocket_clients", labels("endpoint", websocket.endpoint), float64(websocket.clients))
+	}
+}
+
+/*
+getMetrics returns everything in the Prometheus text format
+URL = /metrics
+*/
+func getMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := &metricWriter{w: w}
+	writePlantMetrics(m)
+	writeServiceMetrics(m)
+	if m.err != nil {
+		log.Println("Error writing metrics - ", m.err)
+	}
+}
@@ -48,6 +48,9 @@ type ModbusRTUIO struct {
 	rawTankPressure     uint16
 	fuelCellPressure    float32
 	rawFuelCellPressure uint16
+	rawInputs           [8]uint16
+	digitalInputs       []bool
+	lastDigitalUpdate   time.Time
 	lastIOUpdate        time.Time
 
 	acPower       float32
@@ -121,6 +124,7 @@ func (rtu *ModbusRTUIO) StartModbusIO() {
 	mbus, err := modbus.NewClient(&config)
 	if err != nil {
 		log.Println("Modbus configration error -", err)
+		healthFailure(HealthModbusRTU, err)
 		return
 	} else {
 		rtu.mbus = mbus
@@ -129,6 +133,9 @@ func (rtu *ModbusRTUIO) StartModbusIO() {
 	err = mbus.Open()
 	if err != nil {
 		log.Println("Modbus open error -", err)
+		healthFailure(HealthModbusRTU, err)
+		// The emergency stop input can't be read so it is treated as a fault
+		checkHardwareEmergencyStop()
 		return
 	} else {
 		log.Println("Modbus RTU is now open")
@@ -137,10 +144,33 @@ func (rtu *ModbusRTUIO) StartModbusIO() {
 	rtu.Active = true
 
 	for {
-		<-modbusTicker.C
-		rtu.GetHPPower(mbus)
-		rtu.GetACPower(mbus)
-		rtu.GetIO(mbus)
+		select {
+		case <-serviceContext.Done():
+			modbusTicker.Stop()
+			rtu.Close()
+			return
+		case <-modbusTicker.C:
+			rtu.GetHPPower(mbus)
+			rtu.GetACPower(mbus)
+			rtu.GetIO(mbus)
+			checkHardwareEmergencyStop()
+		}
+	}
+}
+
+/*
+Close waits for any transaction in progress to finish and then closes the Modbus RTU port
+*/
+func (rtu *ModbusRTUIO) Close() {
+	rtu.muModbus.Lock()
+	defer rtu.muModbus.Unlock()
+	rtu.Active = false
+	if rtu.mbus != nil {
+		if err := rtu.mbus.Close(); err != nil {
+			log.Println("Error closing Modbus RTU - ", err)
+		} else {
+			log.Println("Modbus RTU is now closed")
+		}
 	}
 }
 
@@ -154,6 +184,7 @@ func (rtu *ModbusRTUIO) GetHPPower(mbus *modbus.ModbusClient) {
 	if err := mbus.SetUnitId(rtu.hpSlaveAddress); err != nil {
 		// Log the error and drop out
 		log.Print(err)
+		healthFailure(HealthModbusRTU, err)
 		return
 	}
 	// We need to sleep between changes in Unit ID
@@ -162,6 +193,7 @@ func (rtu *ModbusRTUIO) GetHPPower(mbus *modbus.ModbusClient) {
 	if result, err := mbus.ReadRegisters(VOLTAGEREGISTER, 10, modbus.INPUT_REGISTER); err != nil {
 		// Log the error and drop out
 		log.Println("Error reading from modbus slave at ", rtu.hpSlaveAddress, err)
+		healthFailure(HealthModbusRTU, err)
 		return
 	} else {
 		// Grab the buffer and save the values read from the modbus client
@@ -186,6 +218,7 @@ func (rtu *ModbusRTUIO) GetACPower(mbus *modbus.ModbusClient) {
 	if err := mbus.SetUnitId(rtu.acSlaveAddress); err != nil {
 		// Log the error and drop out
 		log.Print(err)
+		healthFailure(HealthModbusRTU, err)
 		return
 	}
 	// We need to sleep between changes in Unit ID
@@ -193,6 +226,7 @@ func (rtu *ModbusRTUIO) GetACPower(mbus *modbus.ModbusClient) {
 	if result, err := mbus.ReadRegisters(VOLTAGEREGISTER, 10, modbus.INPUT_REGISTER); err != nil {
 		// Log the error and drop out
 		log.Println(err)
+		healthFailure(HealthModbusRTU, err)
 		return
 	} else {
 		// Grab the buffer and save the values read from the modbus client
@@ -233,6 +267,7 @@ func (rtu *ModbusRTUIO) GetIO(mbus *modbus.ModbusClient) {
 	if err := mbus.SetUnitId(rtu.relaySlaveAddress); err != nil {
 		// Log the error and drop out
 		log.Print(err)
+		healthFailure(HealthModbusRTU, err)
 		return
 	}
 	// We need to sleep between changes in Unit ID
@@ -240,21 +275,31 @@ func (rtu *ModbusRTUIO) GetIO(mbus *modbus.ModbusClient) {
 	if err := mbus.SetEncoding(modbus.BIG_ENDIAN, modbus.LOW_WORD_FIRST); err != nil {
 		// Log the error and drop out
 		log.Print(err)
+		healthFailure(HealthModbusRTU, err)
 		return
 	}
 	coils, err := mbus.ReadCoils(1, 16)
 	if err != nil {
 		// Log the error and drop out
 		log.Println("Modbus error:", err)
+		healthFailure(HealthModbusRTU, err)
 		return
 	}
 	input, err := mbus.ReadRegisters(1, 8, modbus.INPUT_REGISTER)
 	if err != nil {
 		// Log the error and drop out
 		log.Println("Modbus error:", err)
+		healthFailure(HealthModbusRTU, err)
 		return
 	}
 
+	var digitalInputs []bool
+	var digitalErr error
+	if params.EmergencyStopInput < 0 {
+		// Only read the digital inputs if we need them for the emergency stop
+		digitalInputs, digitalErr = mbus.ReadDiscreteInputs(1, 8)
+	}
+
 	analogueInputs.rawWaterConductivity = input[CONDUCTIVITY-1]
 	analogueInputs.rawTankPressure = input[TANKPRESSURE-1]
 	analogueInputs.rawFuelCellPressure = input[FUELCELLPRESSURE-1]
@@ -294,7 +339,19 @@ func (rtu *ModbusRTUIO) GetIO(mbus *modbus.ModbusClient) {
 	rtu.rawConductivity = analogueInputs.rawWaterConductivity
 	rtu.rawTankPressure = analogueInputs.rawTankPressure
 	rtu.rawFuelCellPressure = analogueInputs.rawFuelCellPressure
+	copy(rtu.rawInputs[:], input)
 	rtu.lastIOUpdate = time.Now()
+	if digitalErr != nil {
+		// Keep the analogue readings. The emergency stop treats the digital inputs as faulty if this carries on.
+		log.Println("Modbus error reading the digital inputs:", digitalErr)
+		healthFailure(HealthModbusRTU, digitalErr)
+		return
+	}
+	if digitalInputs != nil {
+		rtu.digitalInputs = digitalInputs
+		rtu.lastDigitalUpdate = rtu.lastIOUpdate
+	}
+	healthSuccess(HealthModbusRTU)
 }
 
 func getFloat32(buffer []uint16) float32 {
@@ -354,6 +411,15 @@ func boolToOnOff(b bool) string {
 	return "OFF"
 }
 func (rtu *ModbusRTUIO) RelayOnOff(relay uint16, on bool) error {
+	// Turning a relay off is always allowed so a locked out device can still be made safe
+	if on {
+		if err := checkEmergencyStop(); err != nil {
+			return err
+		}
+		if err := checkRelayLockout(relay); err != nil {
+			return err
+		}
+	}
 	rtu.muModbus.Lock()
 	defer rtu.muModbus.Unlock()
 	if err := rtu.mbus.SetUnitId(rtu.relaySlaveAddress); err != nil {
@@ -381,8 +447,8 @@ func (rtu *ModbusRTUIO) SpareOnOff(on bool) error {
 EL0OnOff turns on or off the power to Electrolyser 0 and the dryer
 */
 func (rtu *ModbusRTUIO) EL0OnOff(on bool) error {
-	if !on && SystemStatus.ElectrolyserLock {
-		// Just ignore the off command if we are locked
+	if !on && SystemStatus.ElectrolyserLock && !emergencyStop.Latched() {
+		// Just ignore the off command while we are searching for electrolysers
 		return nil
 	}
 	return rtu.RelayOnOff(RELAYEL0, on)
@@ -392,8 +458,8 @@ func (rtu *ModbusRTUIO) EL0OnOff(on bool) error {
 EL1OnOff turns on or off the power to Electrolyser 1
 */
 func (rtu *ModbusRTUIO) EL1OnOff(on bool) error {
-	if !on && SystemStatus.ElectrolyserLock {
-		// Just ignore the off command if we are locked
+	if !on && SystemStatus.ElectrolyserLock && !emergencyStop.Latched() {
+		// Just ignore the off command while we are searching for electrolysers
 		return nil
 	}
 	return rtu.RelayOnOff(RELAYEL1, on)
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/simonvetter/modbus"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/***************
+Optional Modbus TCP server so PLCs and SCADA systems can read the plant and make the same requests as the web pages.
+Every write goes through the same command functions as the HTTP API so the validation, lockouts and interlocks are
+the same. Writes are refused with an illegal function exception unless they are allowed in the settings. Any unit ID
+is accepted. A write that passes the range checks is acknowledged straight away and its command runs in the
+background, as a command can wait in the dispatcher queue for far longer than a Modbus client will wait for a reply.
+A command that is refused or fails after that is logged, and reading the register back shows whether it took effect.
+
+Register map. Addresses are zero based. Scaled values are signed 16 bit with 0x8000 (-32768) meaning no reading. 32 bit
+values take two registers, high word first. Unused addresses inside a block read as 0.
+
+Input registers (function 04)
+
+	System
+	0       Register map version (1)
+	1       Status flags: bit 0 emergency stop latched, bit 1 I/O board data stale, bit 2 AC meter stale,
+	        bit 3 heat pump meter stale, bit 4 writes allowed
+	2       Tank pressure, bar x 100
+	3       Fuel cell gas supply pressure, bar x 100
+	4       Water conductivity, µS/cm x 10
+	5       Electrolyser production rate setpoint, %
+	6       Relays: bit 0 gas, 1 fuel cell 0 enable, 2 fuel cell 0 run, 3 fuel cell 1 enable, 4 fuel cell 1 run,
+	        5 electrolyser 0 power, 6 electrolyser 1 power, 7 spare
+	7-8     AC power, W (32 bit)
+	9-10    AC energy (32 bit)
+	11-12   Heat pump power, W (32 bit)
+	13-14   Heat pump energy (32 bit)
+	15      Active alarms
+	16      Unacknowledged alarms
+	17      Highest active alarm severity: 0 none, 1 low, 2 medium, 3 high, 4 critical
+
+	Electrolyser n, base 100 + 20 x n (n = 0..3)
+	+0      Flags: bit 0 switched on, bit 1 connected, bit 2 data stale
+	+1      State code (electrolyser register 1200)
+	+2      System state code (electrolyser register 18)
+	+3      Production rate, %
+	+4      Hydrogen flow, NL/h x 10
+	+5      Stack current, A x 10
+	+6      Stack voltage, V x 10
+	+7      Electrolyte temperature, °C x 10
+	+8      Inner hydrogen pressure, bar x 100
+	+9      Outer hydrogen pressure, bar x 100
+	+10     Water pressure, bar x 100
+	+11     Number of warnings
+	+12     First warning code
+	+13     Number of errors
+	+14     First error code
+
+	Dryer n, base 200 + 20 x n (n = 0..3)
+	+0      Flags: bit 0 switched on, bit 1 connected, bit 2 data stale
+	+1      Error bitfield
+	+2      Warning bitfield
+	+3..+6  Temperatures 0 to 3, °C x 10
+	+7      Input pressure, bar x 100
+	+8      Output pressure, bar x 100
+
+	Fuel cell n, base 300 + 20 x n (n = 0..1)
+	+0      Flags: bit 0 enabled, bit 1 run requested, bit 2 data stale
+	+1      State bitmask, 0 = off
+	+2      Output power, W
+	+3      Output voltage, V x 10
+	+4      Output current, A x 10
+	+5      Anode pressure, bar x 100
+	+6      Inlet temperature, °C x 10
+	+7      Outlet temperature, °C x 10
+	+8..+15 Fault bitfields A to D (32 bit each)
+
+Holding registers (functions 03, 06 and 16)
+
+	0       Electrolyser production rate setpoint, 0-100%
+	1       Fuel cell 0 run request, 0 = stop, 1 = run. Reads the run relay.
+	2       Fuel cell 1 run request, 0 = stop, 1 = run. Reads the run relay.
+	3       Write 1 to acknowledge every alarm. Reads 0.
+*/
+
+const MODBUSMAPVERSION = 1
+const MODBUSSERVERURL = "tcp://0.0.0.0:502"
+const MODBUSSERVERTIMEOUT = time.Minute // Idle clients are disconnected after this long
+const MODBUSSERVERMAXCLIENTS = 5
+const MODBUSNOREADING = 0x8000
+
+const (
+	mbElectrolyserBase   = 100
+	mbDryerBase          = 200
+	mbFuelCellBase       = 300
+	mbDeviceBlockSize    = 20
+	mbMaxElectrolysers   = 4
+	mbMaxFuelCells       = 2
+	mbInputRegisterCount = mbFuelCellBase + mbMaxFuelCells*mbDeviceBlockSize
+)
+
+const (
+	mbHoldingRate = iota
+	mbHoldingFuelCell0Run
+	mbHoldingFuelCell1Run
+	mbHoldingAcknowledge
+	mbHoldingRegisterCount
+)
+
+type ModbusServerSettings struct {
+	Enabled     bool          `json:"enabled"`
+	URL         string        `json:"url"` // Where to listen, e.g. tcp://0.0.0.0:502
+	MaxClients  uint          `json:"maxClients"`
+	Timeout     time.Duration `json:"timeout"`     // Idle clients are disconnected after this long
+	AllowWrites bool          `json:"allowWrites"` // False makes the server read only
+}
+
+func NewModbusServerSettings() *ModbusServerSettings {
+	s := new(ModbusServerSettings)
+	s.URL = MODBUSSERVERURL
+	s.MaxClients = MODBUSSERVERMAXCLIENTS
+	s.Timeout = MODBUSSERVERTIMEOUT
+	return s
+}
+
+func (s *ModbusServerSettings) validate() error {
+	if !strings.HasPrefix(s.URL, "tcp://") {
+		return fmt.Errorf("the URL must be tcp://address:port")
+	}
+	if s.MaxClients < 1 {
+		return fmt.Errorf("at least one client must be allowed")
+	}
+	if s.Timeout < time.Second {
+		return fmt.Errorf("the timeout must be at least one second")
+	}
+	return nil
+}
+
+/*
+ModbusServerHandler answers the requests from the Modbus clients
+*/
+type ModbusServerHandler struct {
+	restart chan struct{}
+	mu      sync.Mutex
+	writes  bool
+}
+
+var modbusServer = &ModbusServerHandler{restart: make(chan struct{}, 1)}
+
+/*
+Run starts the server if it is enabled and restarts it whenever the settings change
+*/
+func (h *ModbusServerHandler) Run() {
+	for {
+		settingsMu.Lock()
+		settings := *params.ModbusServer
+		settingsMu.Unlock()
+		h.mu.Lock()
+		h.writes = settings.AllowWrites
+		h.mu.Unlock()
+
+		var server *modbus.ModbusServer
+		if settings.Enabled {
+			var err error
+			server, err = modbus.NewServer(&modbus.ServerConfiguration{URL: settings.URL, Timeout: settings.Timeout,
+				MaxClients: settings.MaxClients}, h)
+			if err == nil {
+				err = server.Start()
+			}
+			if err != nil {
+				log.Println("Modbus TCP server - ", err)
+				server = nil
+			} else {
+				log.Printf("Modbus TCP server listening on %s", settings.URL)
+			}
+		}
+
+		stop := false
+		select {
+		case <-serviceContext.Done():
+			stop = true
+		case <-h.restart:
+		}
+		if server != nil {
+			if err := server.Stop(); err != nil {
+				log.Println("Modbus TCP server - ", err)
+			}
+			log.Println("Modbus TCP server stopped")
+		}
+		if stop {
+			return
+		}
+	}
+}
+
+/*
+Restart makes the server pick up new settings
+*/
+func (h *ModbusServerHandler) Restart() {
+	select {
+	case h.restart <- struct{}{}:
+	default:
+	}
+}
+
+func (h *ModbusServerHandler) writesAllowed() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.writes
+}
+
+func (h *ModbusServerHandler) HandleCoils(_ *modbus.CoilsRequest) ([]bool, error) {
+	return nil, modbus.ErrIllegalFunction
+}
+
+func (h *ModbusServerHandler) HandleDiscreteInputs(_ *modbus.DiscreteInputsRequest) ([]bool, error) {
+	return nil, modbus.ErrIllegalFunction
+}
+
+func (h *ModbusServerHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) ([]uint16, error) {
+	if int(req.Addr)+int(req.Quantity) > mbInputRegisterCount {
+		return nil, modbus.ErrIllegalDataAddress
+	}
+	registers := h.inputRegisters()
+	return registers[req.Addr : req.Addr+req.Quantity], nil
+}
+
+func (h *ModbusServerHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	if int(req.Addr)+int(req.Quantity) > mbHoldingRegisterCount {
+		return nil, modbus.ErrIllegalDataAddress
+	}
+	if !req.IsWrite {
+		registers := h.holdingRegisters()
+		return registers[req.Addr : req.Addr+req.Quantity], nil
+	}
+	if !h.writesAllowed() {
+		return nil, modbus.ErrIllegalFunction
+	}
+	source := "Modbus " + req.ClientAddr
+	for i, value := range req.Args {
+		if err := h.write(req.Addr+uint16(i), value, source); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+/*
+write checks a holding register write and passes it to the matching command without waiting for it to finish
+*/
+func (h *ModbusServerHandler) write(addr uint16, value uint16, source string) error {
+	switch addr {
+	case mbHoldingRate:
+		if value > 100 {
+			return modbus.ErrIllegalDataValue
+		}
+		h.runInBackground(addr, value, source, func() *CommandError {
+			return commandElectrolyserRate(int64(value), source)
+		})
+	case mbHoldingFuelCell0Run, mbHoldingFuelCell1Run:
+		if value > 1 {
+			return modbus.ErrIllegalDataValue
+		}
+		h.runInBackground(addr, value, source, func() *CommandError {
+			return commandFuelCellRun(uint8(addr-mbHoldingFuelCell0Run), value == 1, source)
+		})
+	case mbHoldingAcknowledge:
+		if value != 1 {
+			return modbus.ErrIllegalDataValue
+		}
+		alarmManager.AcknowledgeAll(source)
+	}
+	return nil
+}
+
+/*
+runInBackground runs the command for a register write in a goroutine that shutDown waits for. The client has already
+had its reply so a refusal or failure is only logged.
+*/
+func (h *ModbusServerHandler) runInBackground(addr uint16, value uint16, source string, command func() *CommandError) {
+	serviceGroup.Add(1)
+	go func() {
+		defer serviceGroup.Done()
+		if err := command(); err != nil {
+			log.Printf("%s write of %d to holding register %d refused - %v", source, value, addr, err)
+		}
+	}()
+}
+
+func (h *ModbusServerHandler) holdingRegisters() []uint16 {
+	registers := make([]uint16, mbHoldingRegisterCount)
+	registers[mbHoldingRate] = uint16(CurrentRate)
+	SystemStatus.m.Lock()
+	registers[mbHoldingFuelCell0Run] = uint16(boolValue(SystemStatus.Relays.FC0Run))
+	registers[mbHoldingFuelCell1Run] = uint16(boolValue(SystemStatus.Relays.FC1Run))
+	SystemStatus.m.Unlock()
+	return registers
+}
+
+/*
+mbScaled converts a reading to a scaled signed register, or the no reading value if it is not a number or out of range
+*/
+func mbScaled(value float64, scale float64) uint16 {
+	v := math.Round(value * scale)
+	if math.IsNaN(v) || v < math.MinInt16+1 || v > math.MaxInt16 {
+		return MODBUSNOREADING
+	}
+	return uint16(int16(v))
+}
+
+func mbSet32(registers []uint16, addr int, value uint32) {
+	registers[addr] = uint16(value >> 16)
+	registers[addr+1] = uint16(value)
+}
+
+func mbFlags(bits ...bool) uint16 {
+	var flags uint16
+	for i, bit := range bits {
+		if bit {
+			flags |= 1 << i
+		}
+	}
+	return flags
+}
+
+/*
+inputRegisters builds the whole input register map from the current status
+*/
+func (h *ModbusServerHandler) inputRegisters() []uint16 {
+	registers := make([]uint16, mbInputRegisterCount)
+	noReading := func(addrs ...int) {
+		for _, addr := range addrs {
+			registers[addr] = MODBUSNOREADING
+		}
+	}
+	ioStale := commsWatchdog.isStale(DataSourceIO)
+	acStale := commsWatchdog.isStale(DataSourceAC)
+	hpStale := commsWatchdog.isStale(DataSourceHP)
+
+	registers[0] = MODBUSMAPVERSION
+	registers[1] = mbFlags(emergencyStop.Latched(), ioStale, acStale, hpStale, h.writesAllowed())
+	registers[5] = uint16(CurrentRate)
+
+	SystemStatus.m.Lock()
+	if ioStale {
+		noReading(2, 3, 4)
+	} else {
+		registers[2] = mbScaled(SystemStatus.Gas.TankPressure, 100)
+		registers[3] = mbScaled(float64(SystemStatus.Gas.FuelCellPressure), 100)
+		registers[4] = mbScaled(float64(SystemStatus.TDS.TdsReading), 10)
+		r := SystemStatus.Relays
+		registers[6] = mbFlags(r.GasToFuelCell, r.FC0Enable, r.FC0Run, r.FC1Enable, r.FC1Run, r.EL0, r.EL1, r.Spare)
+	}
+	if !acStale {
+		mbSet32(registers, 7, SystemStatus.AC.ACPower/100)
+		mbSet32(registers, 9, SystemStatus.AC.ACEnergy)
+	}
+	if !hpStale {
+		mbSet32(registers, 11, SystemStatus.HP.ACPower/100)
+		mbSet32(registers, 13, SystemStatus.HP.ACEnergy)
+	}
+	fcEnabled := []bool{SystemStatus.Relays.FC0Enable, SystemStatus.Relays.FC1Enable}
+	fcRun := []bool{SystemStatus.Relays.FC0Run, SystemStatus.Relays.FC1Run}
+	for device, el := range SystemStatus.Electrolysers {
+		if device >= mbMaxElectrolysers {
+			break
+		}
+		base := mbElectrolyserBase + device*mbDeviceBlockSize
+		stale := commsWatchdog.isStale(elDataSource(device))
+		registers[base] = mbFlags(el.status.SwitchedOn, el.clientConnected, stale)
+		if !el.status.SwitchedOn || !el.clientConnected || stale {
+			noReading(base+4, base+5, base+6, base+7, base+8, base+9, base+10)
+			continue
+		}
+		registers[base+1] = el.status.ElState
+		registers[base+2] = el.status.SystemState
+		registers[base+3] = uint16(el.GetRate())
+		registers[base+4] = mbScaled(float64(el.status.H2Flow), 10)
+		registers[base+5] = mbScaled(float64(el.status.StackCurrent), 10)
+		registers[base+6] = mbScaled(float64(el.status.StackVoltage), 10)
+		registers[base+7] = mbScaled(float64(el.status.ElectrolyteTemp), 10)
+		registers[base+8] = mbScaled(float64(el.status.InnerH2Pressure), 100)
+		registers[base+9] = mbScaled(float64(el.status.OuterH2Pressure), 100)
+		registers[base+10] = mbScaled(float64(el.status.WaterPressure), 100)
+		warnings, errors := el.electrolyserEventCodes()
+		registers[base+11] = uint16(len(warnings))
+		if len(warnings) > 0 {
+			registers[base+12] = warnings[0]
+		}
+		registers[base+13] = uint16(len(errors))
+		if len(errors) > 0 {
+			registers[base+14] = errors[0]
+		}
+	}
+	SystemStatus.m.Unlock()
+
+	for _, device := range dryerDevices() {
+		if device >= mbMaxElectrolysers {
+			break
+		}
+		dr := getDryerStatus(device)
+		base := mbDryerBase + device*mbDeviceBlockSize
+		registers[base] = mbFlags(dr.On, dr.Connected, dr.Stale)
+		if !dr.On || !dr.Connected || dr.Stale {
+			noReading(base+3, base+4, base+5, base+6, base+7, base+8)
+			continue
+		}
+		registers[base+1] = dr.ErrorCode
+		registers[base+2] = dr.WarningCode
+		for i, temp := range []jsonFloat32{dr.Temp0, dr.Temp1, dr.Temp2, dr.Temp3} {
+			registers[base+3+i] = mbScaled(float64(temp), 10)
+		}
+		registers[base+7] = mbScaled(float64(dr.InputPressure), 100)
+		registers[base+8] = mbScaled(float64(dr.OutputPressure), 100)
+	}
+
+	for device, fc := range canBus.fuelCell {
+		if int(device) >= mbMaxFuelCells {
+			continue
+		}
+		base := mbFuelCellBase + int(device)*mbDeviceBlockSize
+		stale := commsWatchdog.isStale(fcDataSource(device))
+		registers[base] = mbFlags(fcEnabled[device], fcRun[device], stale)
+		if !fcEnabled[device] || stale {
+			noReading(base+2, base+3, base+4, base+5, base+6, base+7)
+			continue
+		}
+		registers[base+1] = uint16(fc.GetStateCode())
+		registers[base+2] = uint16(fc.getOutputPower())
+		registers[base+3] = mbScaled(float64(fc.getOutputVolts()), 10)
+		registers[base+4] = mbScaled(float64(fc.getOutputCurrent()), 10)
+		registers[base+5] = mbScaled(float64(fc.getAnodePressure()), 100)
+		registers[base+6] = mbScaled(float64(fc.getInletTemp()), 10)
+		registers[base+7] = mbScaled(float64(fc.getOutletTemp()), 10)
+		for i, fault := range []uint32{fc.getFaultA(), fc.getFaultB(), fc.getFaultC(), fc.getFaultD()} {
+			mbSet32(registers, base+8+i*2, fault)
+		}
+	}
+
+	var highest uint16
+	for _, alarm := range alarmManager.current() {
+		if alarm.Active {
+			registers[15]++
+			if severity := uint16(4 - alarm.Severity.rank()); severity > highest {
+				highest = severity
+			}
+		}
+		if alarm.Acknowledged == nil {
+			registers[16]++
+		}
+	}
+	registers[17] = highest
+	return registers
+}
+
+/*
+getModbusServerSettings returns the Modbus TCP server settings
+URL = /modbusServer
+*/
+func getModbusServerSettings(w http.ResponseWriter, _ *http.Request) {
+	settingsMu.Lock()
+	settings := *params.ModbusServer
+	settingsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(settings); err != nil {
+		ReturnJSONError(w, "Modbus Server", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+setModbusServerSettings replaces the Modbus TCP server settings and restarts the server
+URL = /modbusServer
+payload = {"enabled":true,"url":"tcp://0.0.0.0:502","maxClients":5,"timeout":60000000000,"allowWrites":false}
+*/
+func setModbusServerSettings(w http.ResponseWriter, r *http.Request) {
+	settings := NewModbusServerSettings()
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, settings)
+	}
+	if err == nil {
+		err = settings.validate()
+	}
+	if err != nil {
+		ReturnJSONError(w, "Modbus Server", err, http.StatusBadRequest, true)
+		return
+	}
+	settingsMu.Lock()
+	params.ModbusServer = settings
+	err = params.save()
+	settingsMu.Unlock()
+	if err != nil {
+		ReturnJSONError(w, "Modbus Server", err, http.StatusInternalServerError, true)
+		return
+	}
+	modbusServer.Restart()
+	log.Println("Modbus TCP server settings updated")
+	returnJSONSuccess(w)
+}
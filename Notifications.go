@@ -0,0 +1,720 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	syslog "github.com/RackSec/srslog"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+/***************
+Notifications tell people outside the plant room that something has happened. Each event is rendered from an editable
+template and sent to the channels routed to it. A channel can be an SMTP mail server, an HTTP webhook or syslog.
+The same event for the same device is only sent once within the dedup window, and each channel is limited to a number
+of messages per period so a fault that keeps coming back cannot flood anyone's inbox.
+The configuration is saved with the settings and is edited through /notifications. Passwords are never returned.
+*/
+
+const (
+	ChannelSMTP    = "smtp"
+	ChannelWebhook = "webhook"
+	ChannelSyslog  = "syslog"
+)
+
+const (
+	EventFuelCellFault = "fuelCellFault"
+	EventTest          = "test"
+)
+
+const NOTIFICATIONTIMEOUT = time.Second * 15     // Longest we wait for a mail server or webhook
+const NOTIFICATIONDEDUPWINDOW = time.Minute * 15 // The same event for the same device is only sent once in this time
+const NOTIFICATIONRATELIMIT = 10                 // Messages allowed per channel in each rate limit period
+const NOTIFICATIONRATEPERIOD = time.Hour         // Rate limit period
+const NOTIFICATIONPASSWORDMASK = "********"      // Returned in place of passwords
+
+type NotificationChannel struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"` // smtp, webhook or syslog
+	Enabled bool   `json:"enabled"`
+	// SMTP
+	Server   string   `json:"server,omitempty"`
+	Port     int      `json:"port,omitempty"`
+	TLS      string   `json:"tls,omitempty"`      // starttls, tls or none
+	Insecure bool     `json:"insecure,omitempty"` // Skip certificate verification
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+	// Webhook
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Syslog
+	Network string `json:"network,omitempty"` // Empty for the local syslog, otherwise udp or tcp
+	Address string `json:"address,omitempty"`
+	Tag     string `json:"tag,omitempty"`
+}
+
+type NotificationTemplate struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+type NotificationSettings struct {
+	Channels    []*NotificationChannel           `json:"channels"`
+	Routes      map[string][]string              `json:"routes"` // Event name to channel names. "*" matches every event
+	Templates   map[string]*NotificationTemplate `json:"templates"`
+	DedupWindow time.Duration                    `json:"dedupWindow"`
+	RateLimit   int                              `json:"rateLimit"`
+	RatePeriod  time.Duration                    `json:"ratePeriod"`
+}
+
+/*
+NotificationData is what the templates are rendered with. Details holds the event specific values.
+*/
+type NotificationData struct {
+	Event   string      `json:"event"`
+	Key     string      `json:"key"`
+	Host    string      `json:"host"`
+	Time    time.Time   `json:"time"`
+	Details interface{} `json:"details"`
+}
+
+type FuelCellFaultDetails struct {
+	Device  uint8    `json:"device"`
+	FaultA  []string `json:"faultA"`
+	FaultB  []string `json:"faultB"`
+	FaultC  []string `json:"faultC"`
+	FaultD  []string `json:"faultD"`
+	Restart int      `json:"restart"`
+}
+
+var defaultNotificationTemplates = map[string]*NotificationTemplate{
+	EventFuelCellFault: {
+		Subject: "Fuel cell {{.Details.Device}} error encountered on {{.Host}}",
+		Body: `The fuel cell has reported an error. I am attempting to restart it.
+Fault A = {{join .Details.FaultA " : "}}
+Fault B = {{join .Details.FaultB " : "}}
+Fault C = {{join .Details.FaultC " : "}}
+Fault D = {{join .Details.FaultD " : "}}
+Restart number = {{.Details.Restart}}`,
+	},
+	EventTest: {
+		Subject: "Test notification from {{.Host}}",
+		Body:    "This is a test notification sent at {{.Time.Format \"2006-01-02 15:04:05\"}}.",
+	},
+}
+
+var templateFuncs = template.FuncMap{"join": strings.Join}
+
+type Notifier struct {
+	sent map[string]time.Time   // Last time each event and key was sent, for deduplication
+	rate map[string][]time.Time // Times of the messages sent on each channel in the current period
+	mu   sync.Mutex
+}
+
+var notifier = &Notifier{sent: make(map[string]time.Time), rate: make(map[string][]time.Time)}
+
+func NewNotificationSettings() *NotificationSettings {
+	return &NotificationSettings{Routes: make(map[string][]string), Templates: make(map[string]*NotificationTemplate),
+		DedupWindow: NOTIFICATIONDEDUPWINDOW, RateLimit: NOTIFICATIONRATELIMIT, RatePeriod: NOTIFICATIONRATEPERIOD}
+}
+
+/*
+template returns the template for an event, falling back to the built in one if it has not been edited
+*/
+func (ns *NotificationSettings) template(event string) *NotificationTemplate {
+	if t, found := ns.Templates[event]; found && t != nil {
+		return t
+	}
+	if t, found := defaultNotificationTemplates[event]; found {
+		return t
+	}
+	return &NotificationTemplate{Subject: "{{.Event}} {{.Key}} on {{.Host}}", Body: "{{.Event}} {{.Key}} at {{.Time.Format \"2006-01-02 15:04:05\"}}"}
+}
+
+/*
+channelsFor returns the enabled channels routed to an event
+*/
+func (ns *NotificationSettings) channelsFor(event string) []*NotificationChannel {
+	names := make(map[string]bool)
+	for _, name := range ns.Routes[event] {
+		names[name] = true
+	}
+	for _, name := range ns.Routes["*"] {
+		names[name] = true
+	}
+	var channels []*NotificationChannel
+	for _, c := range ns.Channels {
+		if c.Enabled && names[c.Name] {
+			channels = append(channels, c)
+		}
+	}
+	return channels
+}
+
+func (ns *NotificationSettings) channel(name string) *NotificationChannel {
+	for _, c := range ns.Channels {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+/*
+renderNotification fills in the subject and body templates for an event
+*/
+func renderNotification(t *NotificationTemplate, data *NotificationData) (string, string, error) {
+	var subject, body bytes.Buffer
+	st, err := template.New("subject").Funcs(templateFuncs).Parse(t.Subject)
+	if err != nil {
+		return "", "", err
+	}
+	bt, err := template.New("body").Funcs(templateFuncs).Parse(t.Body)
+	if err != nil {
+		return "", "", err
+	}
+	if err := st.Execute(&subject, data); err != nil {
+		return "", "", err
+	}
+	if err := bt.Execute(&body, data); err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(subject.String()), body.String(), nil
+}
+
+/*
+allowed checks the dedup window for the event and key. If it can be sent the time is recorded.
+*/
+func (n *Notifier) allowed(key string, window time.Duration, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if last, found := n.sent[key]; found && now.Sub(last) < window {
+		return false
+	}
+	n.sent[key] = now
+	// Forget old entries so the map doesn't grow forever
+	for k, t := range n.sent {
+		if now.Sub(t) > window {
+			delete(n.sent, k)
+		}
+	}
+	return true
+}
+
+/*
+takeRate uses one message from the channel's allowance for the current period
+*/
+func (n *Notifier) takeRate(channel string, limit int, period time.Duration, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var current []time.Time
+	for _, t := range n.rate[channel] {
+		if now.Sub(t) < period {
+			current = append(current, t)
+		}
+	}
+	if limit > 0 && len(current) >= limit {
+		n.rate[channel] = current
+		return false
+	}
+	n.rate[channel] = append(current, now)
+	return true
+}
+
+/*
+notify sends an event to every channel routed to it. key identifies the device or source so the same event from two
+devices is not treated as a duplicate. It returns straight away, the messages are sent in the background. Every event
+is also published on the websocket events topic, whether or not it is routed anywhere.
+*/
+func notify(event string, key string, details interface{}) {
+	data := newNotificationData(event, key, details)
+	wsHub.Publish(TopicEvents, data)
+
+	settingsMu.Lock()
+	ns := params.Notifications
+	if ns == nil {
+		settingsMu.Unlock()
+		return
+	}
+	channels := ns.channelsFor(event)
+	t := ns.template(event)
+	window, limit, period := ns.DedupWindow, ns.RateLimit, ns.RatePeriod
+	settingsMu.Unlock()
+
+	if len(channels) == 0 {
+		return
+	}
+	if !notifier.allowed(event+"|"+key, window, data.Time) {
+		debugPrint("Notification %s %s suppressed as a duplicate", event, key)
+		return
+	}
+	subject, body, err := renderNotification(t, data)
+	if err != nil {
+		log.Printf("Error rendering the %s notification - %v", event, err)
+		return
+	}
+	for _, c := range channels {
+		if !notifier.takeRate(c.Name, limit, period, data.Time) {
+			log.Printf("Notification %s to %s dropped - rate limit reached", event, c.Name)
+			continue
+		}
+		go func(c NotificationChannel) {
+			if err := c.send(subject, body, data); err != nil {
+				log.Printf("Error sending the %s notification to %s - %v", event, c.Name, err)
+			}
+		}(*c)
+	}
+}
+
+func newNotificationData(event string, key string, details interface{}) *NotificationData {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "FireFly"
+	}
+	return &NotificationData{Event: event, Key: key, Host: host, Time: time.Now(), Details: details}
+}
+
+/*
+send delivers one message on the channel
+*/
+func (c *NotificationChannel) send(subject string, body string, data *NotificationData) error {
+	switch c.Type {
+	case ChannelSMTP:
+		return c.sendMail(subject, body)
+	case ChannelWebhook:
+		return c.sendWebhook(subject, body, data)
+	case ChannelSyslog:
+		return c.sendSyslog(subject, body)
+	}
+	return fmt.Errorf("unknown notification channel type %q", c.Type)
+}
+
+/*
+sendMail sends the message through an SMTP server. With tls=starttls (the default) the connection is upgraded after
+connecting, with tls=tls it is encrypted from the start (usually port 465). Credentials are never sent in the clear.
+*/
+func (c *NotificationChannel) sendMail(subject string, body string) error {
+	if c.Server == "" || c.From == "" || len(c.To) == 0 {
+		return fmt.Errorf("the mail server, sender and recipients must all be set")
+	}
+	port := c.Port
+	mode := c.TLS
+	if mode == "" {
+		mode = "starttls"
+	}
+	if port == 0 {
+		if mode == "tls" {
+			port = 465
+		} else {
+			port = 587
+		}
+	}
+	address := net.JoinHostPort(c.Server, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: c.Server, InsecureSkipVerify: c.Insecure}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: NOTIFICATIONTIMEOUT}
+	if mode == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(NOTIFICATIONTIMEOUT)); err != nil {
+		log.Print(err)
+	}
+	client, err := smtp.NewClient(conn, c.Server)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer func() {
+		if err := client.Close(); err != nil {
+			debugPrint("Error closing the mail connection - %v", err)
+		}
+	}()
+	if mode == "starttls" {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if c.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Server)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(c.From); err != nil {
+		return err
+	}
+	for _, to := range c.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	wc, err := client.Data()
+	if err != nil {
+		return err
+	}
+	message := "From: " + c.From + "\r\n" +
+		"To: " + strings.Join(c.To, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n\r\n" +
+		strings.ReplaceAll(body, "\n", "\r\n") + "\r\n"
+	if _, err := wc.Write([]byte(message)); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+/*
+sendWebhook posts the rendered message and the raw event details to the URL as JSON
+*/
+func (c *NotificationChannel) sendWebhook(subject string, body string, data *NotificationData) error {
+	if c.URL == "" {
+		return fmt.Errorf("the webhook URL must be set")
+	}
+	payload := struct {
+		Subject string `json:"subject"`
+		Body    string `json:"body"`
+		*NotificationData
+	}{subject, body, data}
+	bData, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(bData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	client := &http.Client{Timeout: NOTIFICATIONTIMEOUT}
+	if c.Insecure {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Print(err)
+		}
+	}()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		log.Print(err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+/*
+sendSyslog writes the message to the local syslog or to a remote syslog server
+*/
+func (c *NotificationChannel) sendSyslog(subject string, body string) error {
+	tag := c.Tag
+	if tag == "" {
+		tag = "FireFly"
+	}
+	writer, err := syslog.Dial(c.Network, c.Address, syslog.LOG_WARNING|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := writer.Close(); err != nil {
+			log.Print(err)
+		}
+	}()
+	return writer.Warning(subject + " - " + strings.Join(strings.Fields(body), " "))
+}
+
+/*
+validate checks a channel has what it needs to send
+*/
+func (c *NotificationChannel) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("every channel needs a name")
+	}
+	switch c.Type {
+	case ChannelSMTP:
+		if c.Server == "" || c.From == "" || len(c.To) == 0 {
+			return fmt.Errorf("channel %s needs a server, a sender and at least one recipient", c.Name)
+		}
+		switch c.TLS {
+		case "", "starttls", "tls", "none":
+		default:
+			return fmt.Errorf("channel %s has an invalid tls mode %q - use starttls, tls or none", c.Name, c.TLS)
+		}
+		if c.TLS == "none" && c.Username != "" {
+			return fmt.Errorf("channel %s would send its password in the clear - use starttls or tls", c.Name)
+		}
+	case ChannelWebhook:
+		if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+			return fmt.Errorf("channel %s needs an http or https URL", c.Name)
+		}
+	case ChannelSyslog:
+		switch c.Network {
+		case "", "udp", "tcp":
+		default:
+			return fmt.Errorf("channel %s has an invalid syslog network %q - use udp, tcp or leave it empty", c.Name, c.Network)
+		}
+	default:
+		return fmt.Errorf("channel %s has an unknown type %q", c.Name, c.Type)
+	}
+	return nil
+}
+
+/*
+masked returns a copy of the settings with the passwords and the webhook header values hidden
+*/
+func (ns *NotificationSettings) masked() *NotificationSettings {
+	m := *ns
+	m.Channels = nil
+	for _, c := range ns.Channels {
+		mc := *c
+		if mc.Password != "" {
+			mc.Password = NOTIFICATIONPASSWORDMASK
+		}
+		if len(c.Headers) > 0 {
+			// Webhook headers usually carry the credentials, e.g. Authorization
+			mc.Headers = make(map[string]string, len(c.Headers))
+			for key := range c.Headers {
+				mc.Headers[key] = NOTIFICATIONPASSWORDMASK
+			}
+		}
+		m.Channels = append(m.Channels, &mc)
+	}
+	m.Templates = make(map[string]*NotificationTemplate)
+	for event, t := range defaultNotificationTemplates {
+		m.Templates[event] = t
+	}
+	for event, t := range ns.Templates {
+		m.Templates[event] = t
+	}
+	return &m
+}
+
+/*
+getNotificationSettings returns the channels, routes and templates. Events without an edited template show the built in one.
+URL = /notifications
+*/
+func getNotificationSettings(w http.ResponseWriter, _ *http.Request) {
+	settingsMu.Lock()
+	current := params.Notifications
+	if current == nil {
+		current = NewNotificationSettings()
+	}
+	ns := current.masked()
+	settingsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(ns); err != nil {
+		ReturnJSONError(w, "Notifications", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+setNotificationSettings replaces the notification configuration. A password sent back as ******** keeps the saved one.
+URL = /notifications
+payload = {"channels":[{"name":"office","type":"smtp","enabled":true,"server":"mail.example.com","port":587,"tls":"starttls",
+"username":"pi","password":"secret","from":"pi@example.com","to":["ops@example.com"]}],"routes":{"*":["office"]},
+"templates":{"fuelCellFault":{"subject":"...","body":"..."}},"dedupWindow":900000000000,"rateLimit":10,"ratePeriod":3600000000000}
+*/
+func setNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	ns := NewNotificationSettings()
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, ns)
+	}
+	if err != nil {
+		ReturnJSONError(w, "Notifications", err, http.StatusBadRequest, true)
+		return
+	}
+	names := make(map[string]bool)
+	for _, c := range ns.Channels {
+		if err := c.validate(); err != nil {
+			ReturnJSONError(w, "Notifications", err, http.StatusBadRequest, true)
+			return
+		}
+		if names[c.Name] {
+			ReturnJSONErrorString(w, "Notifications", "Channel "+c.Name+" is defined twice", http.StatusBadRequest, true)
+			return
+		}
+		names[c.Name] = true
+	}
+	for event, channels := range ns.Routes {
+		for _, name := range channels {
+			if !names[name] {
+				ReturnJSONErrorString(w, "Notifications", fmt.Sprintf("Route %s refers to unknown channel %s", event, name), http.StatusBadRequest, true)
+				return
+			}
+		}
+	}
+	for event, t := range ns.Templates {
+		if t == nil {
+			delete(ns.Templates, event)
+			continue
+		}
+		// Render it with sample data so a broken template is refused now rather than when the fault happens
+		if _, _, err := renderNotification(t, newNotificationData(event, "test", sampleNotificationDetails(event))); err != nil {
+			ReturnJSONError(w, "Notifications", fmt.Errorf("template %s - %v", event, err), http.StatusBadRequest, true)
+			return
+		}
+		// Don't save the built in templates, only the ones that have been changed
+		if d, found := defaultNotificationTemplates[event]; found && *d == *t {
+			delete(ns.Templates, event)
+		}
+	}
+	if ns.DedupWindow < 0 || ns.RateLimit < 0 || ns.RatePeriod <= 0 {
+		ReturnJSONErrorString(w, "Notifications", "The dedup window, rate limit and rate period cannot be negative", http.StatusBadRequest, true)
+		return
+	}
+
+	settingsMu.Lock()
+	for _, c := range ns.Channels {
+		if c.Password == NOTIFICATIONPASSWORDMASK {
+			c.Password = ""
+			if params.Notifications == nil {
+				continue
+			}
+			if old := params.Notifications.channel(c.Name); old != nil {
+				c.Password = old.Password
+			}
+		}
+		for key, value := range c.Headers {
+			if value != NOTIFICATIONPASSWORDMASK {
+				continue
+			}
+			// Keep the value the header had, or drop it if there wasn't one
+			delete(c.Headers, key)
+			if params.Notifications == nil {
+				continue
+			}
+			if old := params.Notifications.channel(c.Name); old != nil {
+				if oldValue, found := old.Headers[key]; found {
+					c.Headers[key] = oldValue
+				}
+			}
+		}
+	}
+	params.Notifications = ns
+	err = params.save()
+	settingsMu.Unlock()
+
+	if err != nil {
+		ReturnJSONError(w, "Notifications", err, http.StatusInternalServerError, true)
+		return
+	}
+	log.Println("Notification settings updated")
+	returnJSONSuccess(w)
+}
+
+/*
+sampleNotificationDetails returns example values for an event so templates can be checked and tested
+*/
+func sampleNotificationDetails(event string) interface{} {
+	switch event {
+	case EventFuelCellFault:
+		return &FuelCellFaultDetails{Device: 0, FaultA: getFuelCellError('A', 0x00000001), Restart: 1}
+	case EventAlarmRaised, EventAlarmCleared:
+		now := time.Now()
+		return &Alarm{ID: 1, Key: "fc0.A31", Source: AlarmSourceFuelCell, Device: "0", Code: "A31", Severity: SeverityHigh,
+			Message: "Fuel cell 0 - " + getErrorAKey(31), Active: event == EventAlarmRaised, Raised: now}
+	}
+	return nil
+}
+
+/*
+sendTestNotification sends a test message straight away to one channel, or to every enabled channel, ignoring the
+routing, dedup and rate limits. The result for each channel is returned.
+URL = /notifications/test?channel=office&event=fuelCellFault
+*/
+func sendTestNotification(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("channel")
+	event := r.URL.Query().Get("event")
+	if event == "" {
+		event = EventTest
+	}
+
+	settingsMu.Lock()
+	ns := params.Notifications
+	if ns == nil {
+		ns = NewNotificationSettings()
+	}
+	var channels []NotificationChannel
+	for _, c := range ns.Channels {
+		if (name == "" && c.Enabled) || c.Name == name {
+			channels = append(channels, *c)
+		}
+	}
+	t := ns.template(event)
+	settingsMu.Unlock()
+
+	if len(channels) == 0 {
+		ReturnJSONErrorString(w, "Notifications", "No matching notification channel", http.StatusNotFound, false)
+		return
+	}
+	data := newNotificationData(event, "test", sampleNotificationDetails(event))
+	subject, body, err := renderNotification(t, data)
+	if err != nil {
+		ReturnJSONError(w, "Notifications", err, http.StatusBadRequest, true)
+		return
+	}
+
+	type Result struct {
+		Channel string `json:"channel"`
+		Success bool   `json:"success"`
+		Error   string `json:"error,omitempty"`
+	}
+	results := make([]Result, len(channels))
+	var wg sync.WaitGroup
+	for i := range channels {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i].Channel = channels[i].Name
+			if err := channels[i].send(subject, body, data); err != nil {
+				results[i].Error = err.Error()
+			} else {
+				results[i].Success = true
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(results); err != nil {
+		ReturnJSONError(w, "Notifications", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
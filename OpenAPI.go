@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/***************
+OpenAPI 3 document for /api/v1, built at run time from the route table and the Go types of the request and response
+bodies. Structs become component schemas named after the type and their properties follow the json tags the same way
+encoding/json does, so the document describes exactly what the handlers send and accept.
+*/
+
+const OPENAPIVERSION = "3.0.3"
+
+type openAPISchema map[string]interface{}
+
+/*
+openAPIBuilder collects the component schemas while the paths are built
+*/
+type openAPIBuilder struct {
+	schemas map[string]openAPISchema
+}
+
+var (
+	timeType        = reflect.TypeOf(time.Time{})
+	durationType    = reflect.TypeOf(time.Duration(0))
+	jsonFloat32Type = reflect.TypeOf(jsonFloat32(0))
+	priorityType    = reflect.TypeOf(CommandPriority(0))
+	roleType        = reflect.TypeOf(RoleViewer)
+	rawMessageType  = reflect.TypeOf(json.RawMessage{})
+	pathParamRegex  = regexp.MustCompile(`{([^}:]+)(:[^}]*)?}`)
+)
+
+func schemaRef(name string) openAPISchema {
+	return openAPISchema{"$ref": "#/components/schemas/" + name}
+}
+
+/*
+schema returns the schema of a Go type, registering named structs as components
+*/
+func (b *openAPIBuilder) schema(t reflect.Type) openAPISchema {
+	// Types that marshal themselves
+	switch t {
+	case timeType:
+		return openAPISchema{"type": "string", "format": "date-time"}
+	case durationType:
+		return openAPISchema{"type": "integer", "format": "int64", "description": "nanoseconds"}
+	case jsonFloat32Type:
+		return openAPISchema{"type": "number", "format": "float", "nullable": true}
+	case priorityType:
+		return openAPISchema{"type": "string"}
+	case roleType:
+		return openAPISchema{"type": "string", "enum": []string{"viewer", "operator", "engineer", "admin"}}
+	case rawMessageType:
+		return openAPISchema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.schema(t.Elem())
+	case reflect.Bool:
+		return openAPISchema{"type": "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int:
+		return openAPISchema{"type": "integer", "format": "int32"}
+	case reflect.Int64:
+		return openAPISchema{"type": "integer", "format": "int64"}
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint, reflect.Uint64:
+		return openAPISchema{"type": "integer", "minimum": 0}
+	case reflect.Float32:
+		return openAPISchema{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return openAPISchema{"type": "number", "format": "double"}
+	case reflect.String:
+		return openAPISchema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return openAPISchema{"type": "string", "format": "byte"}
+		}
+		return openAPISchema{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return openAPISchema{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		if _, found := b.schemas[t.Name()]; !found {
+			// Register the name first so a type that refers to itself doesn't recurse forever
+			b.schemas[t.Name()] = nil
+			b.schemas[t.Name()] = b.structSchema(t)
+		}
+		return schemaRef(t.Name())
+	}
+	// interface{} and anything else can hold any value
+	return openAPISchema{}
+}
+
+/*
+structSchema describes the fields of a struct as encoding/json would marshal them. Fields of embedded structs are
+promoted into the parent.
+*/
+func (b *openAPIBuilder) structSchema(t reflect.Type) openAPISchema {
+	properties := make(map[string]interface{})
+	var required []string
+	b.addFields(t, properties, &required)
+	s := openAPISchema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func (b *openAPIBuilder) addFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			b.addFields(fieldType, properties, required)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = b.schema(field.Type)
+		if !strings.Contains(tag, ",omitempty") && field.Type.Kind() != reflect.Ptr {
+			*required = append(*required, name)
+		}
+	}
+}
+
+/*
+envelope describes the response wrapper around the data a route returns
+*/
+func (b *openAPIBuilder) envelope(data interface{}) openAPISchema {
+	properties := map[string]interface{}{"success": openAPISchema{"type": "boolean"}}
+	if data != nil {
+		properties["data"] = b.schema(reflect.TypeOf(data))
+	}
+	return openAPISchema{"type": "object", "properties": properties, "required": []string{"success"}}
+}
+
+/*
+operationID makes a unique name for the operation from the method and path, e.g. putElectrolysersDeviceRestartPressure
+*/
+func operationID(method string, path string) string {
+	id := strings.ToLower(method)
+	for _, word := range strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == '-' || r == '{' || r == '}'
+	}) {
+		id += strings.ToUpper(word[:1]) + word[1:]
+	}
+	return id
+}
+
+/*
+buildOpenAPIDocument describes the routes as an OpenAPI document
+*/
+func buildOpenAPIDocument(routes []apiRoute) map[string]interface{} {
+	b := &openAPIBuilder{schemas: make(map[string]openAPISchema)}
+	errorResponse := openAPISchema{
+		"description": "The request was refused or failed",
+		"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(APIResponse{}))}},
+	}
+
+	paths := make(map[string]map[string]interface{})
+	for _, route := range routes {
+		path := pathParamRegex.ReplaceAllString(route.Path, "{$1}")
+		operation := map[string]interface{}{
+			"operationId": operationID(route.Method, path),
+			"summary":     route.Summary,
+			"description": "Needs the " + route.role().String() + " role.",
+			"tags":        []string{route.Tag},
+		}
+
+		var parameters []interface{}
+		for _, match := range pathParamRegex.FindAllStringSubmatch(route.Path, -1) {
+			schema := openAPISchema{"type": "string"}
+			if match[2] == ":[0-9]+" {
+				schema = openAPISchema{"type": "integer", "minimum": 0}
+			}
+			parameters = append(parameters, map[string]interface{}{"name": match[1], "in": "path", "required": true, "schema": schema})
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+
+		if route.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(route.Request))}},
+			}
+		}
+
+		status := route.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		operation["responses"] = map[string]interface{}{
+			fmt.Sprint(status): map[string]interface{}{
+				"description": http.StatusText(status),
+				"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": b.envelope(route.Response)}},
+			},
+			"default": errorResponse,
+		}
+
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": OPENAPIVERSION,
+		"info": map[string]interface{}{
+			"title":   "FireflyWeb API",
+			"version": "1.0.0",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": APIV1PREFIX}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": b.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerToken":   map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"sessionCookie": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": AUTHSESSIONCOOKIE},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearerToken": []string{}},
+			map[string]interface{}{"sessionCookie": []string{}},
+		},
+	}
+}
+
+/*
+getOpenAPIDocument returns the OpenAPI document for the version 1 API
+URL = /api/v1/openapi.json
+*/
+func getOpenAPIDocument(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(buildOpenAPIDocument(apiV1Routes())); err != nil {
+		ReturnJSONError(w, "API", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/***************
+Preheats the electrolyte ahead of planned production so the stacks are ready when the PV surplus arrives.
+Production is planned either from the configured start time or, if none is set, forecast from the time the
+electrolysers reached steady production on previous days. The warm-up rate is estimated from the electrolyte
+temperature trend in logging.el0ElectrolyteTemp and used to work out how far ahead the preheat must start.
+*/
+
+const PREHEATTEMPERATURE = 26             // Default electrolyte temperature below which a preheat is requested (C)
+const PREHEATLEADTIME = time.Minute * 30  // Default minimum time before production to start the preheat
+const PREHEATMAXLEADTIME = time.Hour * 4  // Never start the preheat more than this far ahead of production
+const PREHEATDEFAULTRATE = 0.2            // Warm-up rate (C per minute) to use until we have enough history
+const PREHEATESTIMATEINTERVAL = time.Hour // How often to re-estimate the warm-up rate and production start time
+const PREHEATHISTORYDAYS = 7              // Days of history used for the estimates
+const PREHEATMINIMUMSAMPLES = 10          // Minutes of warming needed before we trust the estimated rate
+const PREHEATFORECAST = time.Duration(-1) // Start time setting that means forecast from history
+
+type PreheatScheduler struct {
+	warmUpRate    float64           // C per minute
+	forecastStart time.Duration     // Forecast production start as time after midnight. -1 if not known
+	lastEstimate  time.Time         // When the estimates were last updated
+	nextStart     time.Time         // Next planned production start
+	preheatedFor  map[int]time.Time // The production start each electrolyser has already been preheated for
+	lastPreheat   map[int]time.Time // When each electrolyser was last sent a preheat request
+	mu            sync.Mutex
+}
+
+var preheatScheduler = &PreheatScheduler{warmUpRate: PREHEATDEFAULTRATE, forecastStart: PREHEATFORECAST,
+	preheatedFor: make(map[int]time.Time), lastPreheat: make(map[int]time.Time)}
+
+/*
+estimate updates the warm-up rate and forecast production start from the logged history
+*/
+func (ps *PreheatScheduler) estimate() {
+	if pDB == nil {
+		return
+	}
+	rows, err := pDB.Query(`SELECT UNIX_TIMESTAMP(logged) DIV 60, AVG(el0ElectrolyteTemp) / 10
+  FROM logging
+ WHERE logged > DATE_ADD(NOW(), INTERVAL ? DAY) AND el0ElectrolyteTemp IS NOT NULL
+ GROUP BY UNIX_TIMESTAMP(logged) DIV 60
+ ORDER BY 1`, 0-PREHEATHISTORYDAYS)
+	if err != nil {
+		log.Println("Error reading the electrolyte temperature trend - ", err)
+		return
+	}
+	var (
+		lastMinute int64
+		lastTemp   float64
+		rise       float64
+		minutes    int
+	)
+	for rows.Next() {
+		var minute int64
+		var temp float64
+		if err := rows.Scan(&minute, &temp); err != nil {
+			log.Print(err)
+			continue
+		}
+		// Only count consecutive minutes where the electrolyte was warming up towards the threshold
+		if minute == lastMinute+1 && temp > lastTemp && lastTemp < float64(params.PreheatTemperature) {
+			rise += temp - lastTemp
+			minutes++
+		}
+		lastMinute = minute
+		lastTemp = temp
+	}
+	if err := rows.Close(); err != nil {
+		log.Println("Error closing query - ", err)
+	}
+
+	var start string
+	if err := pDB.QueryRow(`SELECT IFNULL(SEC_TO_TIME(ROUND(AVG(first))), '')
+  FROM (SELECT MIN(TIME_TO_SEC(logged)) AS first
+          FROM logging
+         WHERE (el0StateCode = 3 OR el1StateCode = 3) AND logged > DATE_ADD(CURRENT_DATE, INTERVAL ? DAY)
+         GROUP BY DATE(logged)) AS starts`, 0-PREHEATHISTORYDAYS).Scan(&start); err != nil {
+		log.Println("Error forecasting the production start time - ", err)
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.lastEstimate = time.Now()
+	if minutes >= PREHEATMINIMUMSAMPLES {
+		ps.warmUpRate = rise / float64(minutes)
+	}
+	ps.forecastStart = PREHEATFORECAST
+	if t, err := time.Parse("15:04:05", start); err == nil {
+		ps.forecastStart = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	}
+}
+
+/*
+plannedStart returns the next planned production start or a zero time if it is not known.
+The caller must hold the scheduler lock
+*/
+func (ps *PreheatScheduler) plannedStart(now time.Time) time.Time {
+	startTime := params.PreheatStartTime
+	if startTime < 0 {
+		startTime = ps.forecastStart
+	}
+	if startTime < 0 {
+		return time.Time{}
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	start := midnight.Add(startTime)
+	if start.Before(now) {
+		start = midnight.AddDate(0, 0, 1).Add(startTime)
+	}
+	return start
+}
+
+/*
+leadTime returns how long before production the preheat must start to get from temp up to the threshold.
+The caller must hold the scheduler lock
+*/
+func (ps *PreheatScheduler) leadTime(temp float32) time.Duration {
+	lead := params.PreheatLeadTime
+	if ps.warmUpRate > 0 && temp < params.PreheatTemperature {
+		warmUp := time.Duration(float64(params.PreheatTemperature-temp) / ps.warmUpRate * float64(time.Minute))
+		if warmUp > lead {
+			lead = warmUp
+		}
+	}
+	if lead > PREHEATMAXLEADTIME {
+		lead = PREHEATMAXLEADTIME
+	}
+	return lead
+}
+
+/*
+Check runs once per logging cycle and requests a preheat from any cold electrolyser when production is due
+*/
+func (ps *PreheatScheduler) Check() {
+	if !params.PreheatEnabled {
+		return
+	}
+	ps.mu.Lock()
+	due := time.Since(ps.lastEstimate) > PREHEATESTIMATEINTERVAL
+	ps.mu.Unlock()
+	if due {
+		ps.estimate()
+	}
+
+	type elState struct {
+		device int
+		el     *Electrolyser
+		temp   float32
+	}
+	var electrolysers []elState
+
+	SystemStatus.m.Lock()
+	for device, el := range SystemStatus.Electrolysers {
+		if el.IsSwitchedOn() && !commsWatchdog.isStale(elDataSource(device)) {
+			electrolysers = append(electrolysers, elState{device: device, el: el, temp: float32(el.status.ElectrolyteTemp)})
+		}
+	}
+	SystemStatus.m.Unlock()
+
+	now := time.Now()
+	ps.mu.Lock()
+	start := ps.plannedStart(now)
+	ps.nextStart = start
+	var preheat []elState
+	if !start.IsZero() {
+		for _, e := range electrolysers {
+			if e.temp >= params.PreheatTemperature || ps.preheatedFor[e.device].Equal(start) || checkElectrolyserLockout(e.device) != nil {
+				continue
+			}
+			if now.After(start.Add(0 - ps.leadTime(e.temp))) {
+				ps.preheatedFor[e.device] = start
+				ps.lastPreheat[e.device] = now
+				preheat = append(preheat, e)
+			}
+		}
+	}
+	ps.mu.Unlock()
+
+	for _, e := range preheat {
+		log.Printf("Preheating electrolyser %d from %0.1fC ready for production at %s", e.device, e.temp, start.Format("15:04"))
+		el := e.el
+		dispatcher.Submit(elQueue(e.device), "preheat", PriorityAutomatic, "preheat scheduler", func() error {
+			el.Preheat()
+			return nil
+		})
+	}
+}
+
+/*
+getPreheatSchedule returns the current preheat schedule and estimates
+*/
+func getPreheatSchedule(w http.ResponseWriter, _ *http.Request) {
+	type elPreheat struct {
+		Device      int     `json:"device"`
+		Temperature float32 `json:"temperature"`
+		LeadTime    string  `json:"leadTime"`
+		PreheatAt   string  `json:"preheatAt,omitempty"`
+		LastPreheat string  `json:"lastPreheat,omitempty"`
+	}
+	var schedule struct {
+		Enabled       bool        `json:"enabled"`
+		Threshold     float32     `json:"threshold"`
+		MinLeadTime   string      `json:"minLeadTime"`
+		WarmUpRate    float64     `json:"warmUpRate"`
+		Forecast      bool        `json:"forecast"`
+		NextStart     string      `json:"nextStart,omitempty"`
+		Electrolysers []elPreheat `json:"electrolysers"`
+	}
+
+	schedule.Enabled = params.PreheatEnabled
+	schedule.Threshold = params.PreheatTemperature
+	schedule.MinLeadTime = params.PreheatLeadTime.String()
+	schedule.Forecast = params.PreheatStartTime < 0
+	schedule.Electrolysers = []elPreheat{}
+
+	SystemStatus.m.Lock()
+	for device, el := range SystemStatus.Electrolysers {
+		schedule.Electrolysers = append(schedule.Electrolysers, elPreheat{Device: device, Temperature: float32(el.status.ElectrolyteTemp)})
+	}
+	SystemStatus.m.Unlock()
+
+	preheatScheduler.mu.Lock()
+	schedule.WarmUpRate = preheatScheduler.warmUpRate
+	start := preheatScheduler.plannedStart(time.Now())
+	if !start.IsZero() {
+		schedule.NextStart = start.Format("2006-01-02 15:04:05")
+	}
+	for i := range schedule.Electrolysers {
+		lead := preheatScheduler.leadTime(schedule.Electrolysers[i].Temperature)
+		schedule.Electrolysers[i].LeadTime = lead.String()
+		if !start.IsZero() {
+			schedule.Electrolysers[i].PreheatAt = start.Add(0 - lead).Format("2006-01-02 15:04:05")
+		}
+		if t, found := preheatScheduler.lastPreheat[schedule.Electrolysers[i].Device]; found {
+			schedule.Electrolysers[i].LastPreheat = t.Format("2006-01-02 15:04:05")
+		}
+	}
+	preheatScheduler.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(schedule); err != nil {
+		ReturnJSONError(w, "Preheat", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
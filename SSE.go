@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/***************
+Server-Sent Events for integrations behind proxies that break websockets. /events streams the same topics as the
+websocket hub, each as an SSE event named after the topic whose data is the hub message:
+	id: kx3f9a-1042
+	event: alarms
+	data: {"topic":"alarms","type":"update","data":{...}}
+
+The status, full and can topics are sent as a whole snapshot every tick rather than as deltas, so a client that
+misses one is never left with a broken state. Alarm, event and job messages are kept in a short in-memory buffer.
+A client that reconnects with Last-Event-ID (browsers send it by themselves) is sent what it missed from the buffer.
+If it has been away too long, or the server has restarted since, it starts again with the current alarms and jobs
+instead. The stream is ended just before the web server's write timeout; the client reconnects and carries on from
+where it left off.
+*/
+
+const (
+	SSEREPLAYSIZE   = 500              // Alarm, event and job messages kept for clients that reconnect
+	SSESENDBUFFER   = 64               // Messages waiting for a client before it is disconnected
+	SSEKEEPALIVE    = time.Second * 20 // Comment sent when there is nothing else so proxies keep the stream open
+	SSERETRY        = time.Second * 5  // Reconnection delay suggested to the client
+	SSESTREAMMARGIN = time.Second * 10 // The stream ends this long before the server's write timeout
+)
+
+var sseDefaultTopics = []string{TopicStatus, TopicAlarms, TopicEvents}
+
+type sseEvent struct {
+	id    uint64
+	topic string
+	data  []byte
+}
+
+type sseClient struct {
+	topics map[string]bool
+	send   chan *sseEvent
+}
+
+type SSEBroker struct {
+	boot    string // Distinguishes the IDs from those given out before a restart
+	lastID  uint64
+	dropped uint64      // ID of the newest message that has fallen out of the replay buffer
+	replay  []*sseEvent // Oldest first
+	clients map[*sseClient]bool
+	mu      sync.Mutex
+}
+
+var sseBroker = &SSEBroker{boot: strconv.FormatInt(time.Now().Unix(), 36), clients: make(map[*sseClient]bool)}
+
+func (b *SSEBroker) eventID(id uint64) string {
+	return b.boot + "-" + strconv.FormatUint(id, 10)
+}
+
+/*
+wanted is true if any client is following the topic
+*/
+func (b *SSEBroker) wanted(topic string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		if c.topics[topic] {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+sendLocked passes the message to every client following its topic. A client that has fallen behind is dropped; it
+gets what it missed from the replay buffer when it reconnects. The caller must hold the lock
+*/
+func (b *SSEBroker) sendLocked(e *sseEvent) {
+	for c := range b.clients {
+		if !c.topics[e.topic] {
+			continue
+		}
+		select {
+		case c.send <- e:
+		default:
+			delete(b.clients, c)
+			close(c.send)
+		}
+	}
+}
+
+/*
+Snapshot sends the latest snapshot of a topic. Snapshots are not kept for replay as the next one replaces them.
+*/
+func (b *SSEBroker) Snapshot(topic string, message []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastID++
+	b.sendLocked(&sseEvent{id: b.lastID, topic: topic, data: message})
+}
+
+/*
+Publish sends an alarm, event or job message and keeps it for clients that reconnect
+*/
+func (b *SSEBroker) Publish(topic string, message []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastID++
+	e := &sseEvent{id: b.lastID, topic: topic, data: message}
+	b.replay = append(b.replay, e)
+	if len(b.replay) > SSEREPLAYSIZE {
+		b.dropped = b.replay[0].id
+		b.replay = b.replay[1:]
+	}
+	b.sendLocked(e)
+}
+
+/*
+subscribe registers the client and returns the messages it missed since lastEventID. If they can't all be replayed
+resumed is false and position is the ID to give the fresh start.
+*/
+func (b *SSEBroker) subscribe(c *sseClient, lastEventID string) (missed []*sseEvent, resumed bool, position uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clients[c] = true
+	if parts := strings.SplitN(lastEventID, "-", 2); len(parts) == 2 && parts[0] == b.boot {
+		if last, err := strconv.ParseUint(parts[1], 10, 64); err == nil && last <= b.lastID && last >= b.dropped {
+			for _, e := range b.replay {
+				if e.id > last && c.topics[e.topic] {
+					missed = append(missed, e)
+				}
+			}
+			return missed, true, b.lastID
+		}
+	}
+	return nil, false, b.lastID
+}
+
+func (b *SSEBroker) unsubscribe(c *sseClient) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.clients[c] {
+		delete(b.clients, c)
+		close(c.send)
+	}
+}
+
+func writeSSEEvent(w *bufio.Writer, id string, topic string, data []byte) error {
+	_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", id, topic, data)
+	return err
+}
+
+/*
+streamEvents streams the topics as Server-Sent Events. Last-Event-ID may also be given as lastEventId for clients
+that can't set headers.
+URL = /events?topics=status,alarms,events
+*/
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		ReturnJSONErrorString(w, "Events", "Streaming is not supported on this connection", http.StatusInternalServerError, true)
+		return
+	}
+	topics := sseDefaultTopics
+	if s := r.URL.Query().Get("topics"); s != "" {
+		topics = strings.Split(s, ",")
+	}
+	c := &sseClient{topics: make(map[string]bool), send: make(chan *sseEvent, SSESENDBUFFER)}
+	for _, topic := range topics {
+		_, snapshot := hubSnapshotTopics[topic]
+		_, update := hubUpdateTopics[topic]
+		if !snapshot && !update {
+			ReturnJSONErrorString(w, "Events", "Unknown topic "+topic, http.StatusBadRequest, false)
+			return
+		}
+		c.topics[topic] = true
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Stop nginx holding the events back
+	w.WriteHeader(http.StatusOK)
+	out := bufio.NewWriter(w)
+
+	missed, resumed, position := sseBroker.subscribe(c, lastEventID)
+	defer sseBroker.unsubscribe(c)
+	if _, err := fmt.Fprintf(out, "retry: %d\n\n", SSERETRY.Milliseconds()); err != nil {
+		return
+	}
+	if !resumed {
+		// Start again from the current state
+		for _, topic := range topics {
+			if current := hubUpdateTopics[topic]; current != nil {
+				message := hubMessage(&HubMessage{Topic: topic, Type: HubSnapshot, Data: current()})
+				if err := writeSSEEvent(out, sseBroker.eventID(position), topic, message); err != nil {
+					return
+				}
+			}
+		}
+	}
+	for _, e := range missed {
+		if err := writeSSEEvent(out, sseBroker.eventID(e.id), e.topic, e.data); err != nil {
+			return
+		}
+	}
+	if out.Flush() != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(SSEKEEPALIVE)
+	defer keepAlive.Stop()
+	var end <-chan time.Time
+	if timeout := getWebServerSettings().WriteTimeout; timeout > SSESTREAMMARGIN {
+		endTimer := time.NewTimer(timeout - SSESTREAMMARGIN)
+		defer endTimer.Stop()
+		end = endTimer.C
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-serviceContext.Done():
+			return
+		case <-end:
+			// The client reconnects with the last ID it had
+			return
+		case e, ok := <-c.send:
+			if !ok {
+				return
+			}
+			if writeSSEEvent(out, sseBroker.eventID(e.id), e.topic, e.data) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := out.WriteString(": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		if out.Flush() != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
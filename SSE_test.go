@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSSEReplay(t *testing.T) {
+	newBroker := func() *SSEBroker {
+		b := &SSEBroker{boot: "boot", clients: make(map[*sseClient]bool)}
+		b.Publish(TopicAlarms, []byte("alarm 1")) // 1
+		b.Snapshot(TopicStatus, []byte("status")) // 2, not kept
+		b.Publish(TopicEvents, []byte("event 1")) // 3
+		b.Publish(TopicAlarms, []byte("alarm 2")) // 4
+		return b
+	}
+	tests := []struct {
+		name        string
+		lastEventID string
+		topics      []string
+		missed      []uint64
+		resumed     bool
+	}{
+		{"first connection", "", []string{TopicAlarms, TopicEvents}, nil, false},
+		{"from the start", "boot-0", []string{TopicAlarms, TopicEvents}, []uint64{1, 3, 4}, true},
+		{"part way", "boot-1", []string{TopicAlarms, TopicEvents}, []uint64{3, 4}, true},
+		{"after a snapshot", "boot-2", []string{TopicAlarms, TopicEvents}, []uint64{3, 4}, true},
+		{"only the topics followed", "boot-0", []string{TopicAlarms}, []uint64{1, 4}, true},
+		{"up to date", "boot-4", []string{TopicAlarms, TopicEvents}, nil, true},
+		{"before a restart", "older-2", []string{TopicAlarms, TopicEvents}, nil, false},
+		{"from the future", "boot-9", []string{TopicAlarms, TopicEvents}, nil, false},
+		{"not a number", "boot-x", []string{TopicAlarms, TopicEvents}, nil, false},
+		{"no boot", "3", []string{TopicAlarms, TopicEvents}, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newBroker()
+			c := &sseClient{topics: make(map[string]bool), send: make(chan *sseEvent, SSESENDBUFFER)}
+			for _, topic := range test.topics {
+				c.topics[topic] = true
+			}
+			missed, resumed, position := b.subscribe(c, test.lastEventID)
+			var ids []uint64
+			for _, e := range missed {
+				ids = append(ids, e.id)
+			}
+			if resumed != test.resumed || !reflect.DeepEqual(ids, test.missed) {
+				t.Errorf("subscribe(%q) = %v resumed %v, want %v resumed %v", test.lastEventID, ids, resumed, test.missed, test.resumed)
+			}
+			if position != 4 {
+				t.Errorf("position = %d, want 4", position)
+			}
+		})
+	}
+}
+
+func TestSSEReplayOverflow(t *testing.T) {
+	b := &SSEBroker{boot: "boot", clients: make(map[*sseClient]bool)}
+	for i := 1; i <= SSEREPLAYSIZE+10; i++ {
+		b.Publish(TopicEvents, []byte("event "+strconv.Itoa(i)))
+	}
+	tests := []struct {
+		name    string
+		last    int
+		missed  int
+		resumed bool
+	}{
+		{"fallen out of the buffer", 5, 0, false},
+		{"oldest dropped", 10, SSEREPLAYSIZE, true},
+		{"still in the buffer", SSEREPLAYSIZE, 10, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &sseClient{topics: map[string]bool{TopicEvents: true}, send: make(chan *sseEvent, SSESENDBUFFER)}
+			missed, resumed, _ := b.subscribe(c, b.eventID(uint64(test.last)))
+			b.unsubscribe(c)
+			if resumed != test.resumed || len(missed) != test.missed {
+				t.Errorf("resuming from %d replayed %d resumed %v, want %d resumed %v", test.last, len(missed), resumed, test.missed, test.resumed)
+			}
+			if resumed && len(missed) > 0 && missed[0].id != uint64(test.last+1) {
+				t.Errorf("replay started at %d, want %d", missed[0].id, test.last+1)
+			}
+		})
+	}
+}
@@ -6,10 +6,14 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 )
 
+var settingsMu sync.RWMutex // Protects the settings sections changed through the API and the settings file
+
 type ElectrolyserConfig struct {
 	ID     uint8  `json:"id"`
 	IP     string `json:"ipaddress"`
@@ -39,6 +43,27 @@ type JsonSettings struct {
 	WaterOffset                      int                   `json:"waterOffset"`
 	GasMultiplier                    int                   `json:"gasMultiplier"`
 	GasOffset                        int                   `json:"gasOffset"`
+	WaterAutoRefill                  bool                  `json:"waterAutoRefill"`
+	WaterRefillHoldOff               time.Duration         `json:"waterRefillHoldOff"`
+	WaterConductivityLimit           float32               `json:"waterConductivityLimit"`
+	BlowdownInterval                 time.Duration         `json:"blowdownInterval"`
+	DryerPerElectrolyser             bool                  `json:"dryerPerElectrolyser"`
+	PreheatEnabled                   bool                  `json:"preheatEnabled"`
+	PreheatTemperature               float32               `json:"preheatTemperature"`
+	PreheatLeadTime                  time.Duration         `json:"preheatLeadTime"`
+	PreheatStartTime                 time.Duration         `json:"preheatStartTime"` // Time after midnight that production is planned to start. -1 = forecast from history
+	Lockouts                         []*Lockout            `json:"lockouts"`
+	EmergencyStopInput               int                   `json:"emergencyStopInput"` // 0 = none, 1..8 = analogue input, -1..-8 = digital input
+	EmergencyStopThreshold           int                   `json:"emergencyStopThreshold"`
+	EmergencyStopInvert              bool                  `json:"emergencyStopInvert"`
+	SafeStateOnShutdown              bool                  `json:"safeStateOnShutdown"` // Run the emergency stop sequence when the service is stopped
+	Notifications                    *NotificationSettings `json:"notifications"`
+	ThresholdRules                   []*ThresholdRule      `json:"thresholdRules"`
+	StaleDataTimeout                 time.Duration         `json:"staleDataTimeout"`
+	MQTT                             *MQTTSettings         `json:"mqtt"`
+	ModbusServer                     *ModbusServerSettings `json:"modbusServer"`
+	Auth                             *AuthSettings         `json:"auth"`
+	WebServer                        *WebServerSettings    `json:"webServer"`
 	filepath                         string
 }
 
@@ -65,6 +90,25 @@ func NewJsonSettings() *JsonSettings {
 	s.GasOffset = 0
 	s.WaterMultiplier = 10
 	s.WaterOffset = 0
+	s.WaterAutoRefill = false
+	s.WaterRefillHoldOff = WATERREFILLHOLDOFF
+	s.WaterConductivityLimit = 0
+	s.BlowdownInterval = 0
+	s.DryerPerElectrolyser = false
+	s.PreheatEnabled = false
+	s.EmergencyStopInput = 0
+	s.EmergencyStopThreshold = ESTOPDEFAULTTHRESHOLD
+	s.EmergencyStopInvert = false
+	s.SafeStateOnShutdown = false
+	s.PreheatTemperature = PREHEATTEMPERATURE
+	s.PreheatLeadTime = PREHEATLEADTIME
+	s.PreheatStartTime = PREHEATFORECAST
+	s.Notifications = NewNotificationSettings()
+	s.StaleDataTimeout = STALEDATATIMEOUT
+	s.MQTT = NewMQTTSettings()
+	s.ModbusServer = NewModbusServerSettings()
+	s.Auth = NewAuthSettings()
+	s.WebServer = NewWebServerSettings()
 	return s
 }
 
@@ -90,19 +134,67 @@ func (s *JsonSettings) ReadSettings(filepath string) error {
 		if err := json.Unmarshal(file, s); err != nil {
 			return err
 		}
+		if err := s.migrate(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+migrate fills in the sections missing from a settings file saved by an older version with what that version did,
+rather than the defaults for a new installation
+*/
+func (s *JsonSettings) migrate(file []byte) error {
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(file, &sections); err != nil {
+		return err
+	}
+	if _, found := sections["notifications"]; !found {
+		// Older versions emailed fuel cell faults to a fixed address. That account is not carried over so nothing is
+		// sent until a channel is set up.
+		log.Println("WARNING - notifications are not configured so fuel cell faults will not be emailed - set up a channel at /notifications")
+		s.Notifications = NewNotificationSettings()
+	} else if s.Notifications == nil {
+		s.Notifications = NewNotificationSettings()
+	}
+	if _, found := sections["auth"]; !found {
+		// Existing clients do not log in so leave authentication off until it is turned on at /auth
+		log.Println("Authentication is off for this existing installation - turn it on at /auth")
+		s.Auth = NewAuthSettings()
+		s.Auth.Enabled = false
+	} else if s.Auth == nil {
+		s.Auth = NewAuthSettings()
 	}
 	return nil
 }
 
+/*
+WriteSettings saves the settings to the settings file
+*/
 func (s *JsonSettings) WriteSettings() error {
-	if bData, err := json.Marshal(s); err != nil {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	return s.save()
+}
+
+/*
+save writes the settings to a temporary file and renames it over the settings file so a crash part way through
+never leaves a truncated file behind. The caller must hold settingsMu
+*/
+func (s *JsonSettings) save() error {
+	bData, err := json.Marshal(s)
+	if err != nil {
 		log.Println("Error converting settings to text -", err)
 		return err
-	} else {
-		if err = ioutil.WriteFile(s.filepath, bData, 0644); err != nil {
-			log.Println("Error writing JSON settings file -", err)
-			return err
-		}
+	}
+	if err := ioutil.WriteFile(s.filepath+".tmp", bData, 0644); err != nil {
+		log.Println("Error writing JSON settings file -", err)
+		return err
+	}
+	if err := os.Rename(s.filepath+".tmp", s.filepath); err != nil {
+		log.Println("Error replacing JSON settings file -", err)
+		return err
 	}
 	return nil
 }
@@ -221,6 +313,27 @@ func getSettings(w http.ResponseWriter, _ *http.Request) {
 	printOptions(w, params.GasMultiplier, 1, 1000, "", "gasMultiplier", "Multiplier (100 = x1) for the fuel cell pressure sensor")
 	printOptions(w, params.WaterOffset, -20, 20, "", "waterOffset", "Offset for the water conductivity sensor")
 	printOptions(w, params.WaterMultiplier, 1, 500, "", "waterMultiplier", "Multiplier (100 = x1) for the water conductivity sensor")
+	printOptions(w, params.EmergencyStopInput, -8, 8, "", "emergencyStopInput", "Emergency stop input (0 = none, 1..8 = analogue, -1..-8 = digital)")
+	printOptions(w, params.EmergencyStopThreshold/100, 0, 40, "x100", "emergencyStopThreshold", "Raw analogue reading below which the emergency stop is active")
+	printSwitch(w, params.EmergencyStopInvert, "emergencyStopInvert", "Emergency stop input is normally open")
+	printSwitch(w, params.SafeStateOnShutdown, "safeStateOnShutdown", "Take the plant to a safe state when the service is stopped")
+	printSwitch(w, params.PreheatEnabled, "preheatEnabled", "Preheat the electrolyte ahead of planned production")
+	printOptions(w, int(params.PreheatTemperature), 10, 50, "C", "preheatTemperature", "Electrolyte temperature below which a preheat is needed")
+	printOptions(w, int(params.PreheatLeadTime.Minutes()), 0, 240, "minutes", "preheatLeadTime", "Minimum time before production to start the preheat")
+	preheatHour := -1
+	preheatMinute := 0
+	if params.PreheatStartTime >= 0 {
+		preheatHour = int(params.PreheatStartTime.Hours())
+		preheatMinute = int(params.PreheatStartTime.Minutes()) % 60
+	}
+	printOptions(w, preheatHour, -1, 23, "hours", "preheatStartHour", "Planned production start hour (-1 = forecast from history)")
+	printOptions(w, preheatMinute, 0, 59, "minutes", "preheatStartMinute", "Planned production start minute")
+	printSwitch(w, params.DryerPerElectrolyser, "dryerPerElectrolyser", "Each electrolyser has its own dryer")
+	printSwitch(w, params.WaterAutoRefill, "waterAutoRefill", "Automatically refill the electrolysers when the electrolyte level is low")
+	printOptions(w, int(params.WaterRefillHoldOff.Minutes()), 1, 60, "minutes", "waterRefillHoldOff", "Minimum time between automatic refills")
+	printOptions(w, int(params.WaterConductivityLimit), 0, 200, "", "waterConductivityLimit", "Water conductivity limit above which production is blocked (0 = disabled)")
+	printOptions(w, int(params.BlowdownInterval.Hours()/24), 0, 60, "days", "blowdownInterval", "Days between scheduled blowdowns (0 = disabled)")
+	printOptions(w, int(params.StaleDataTimeout.Seconds()), 5, 120, "seconds", "staleDataTimeout", "Time without new readings before a device's data is treated as stale")
 	if _, err := fmt.Fprint(w, `<br /><button class="egButton" type="submit" >Update Settings</button></form><a href="/">Main Menu</a></body></html>`); err != nil {
 		log.Println(err)
 	}
@@ -259,6 +372,22 @@ func updateSettings(w http.ResponseWriter, r *http.Request) {
 	waterOffset := r.Form.Get("waterOffset")
 	waterMultiplier := r.Form.Get("waterMultiplier")
 
+	dryerPerElectrolyser := r.Form.Get("dryerPerElectrolyser")
+	preheatEnabled := r.Form.Get("preheatEnabled")
+	emergencyStopInput := r.Form.Get("emergencyStopInput")
+	emergencyStopThreshold := r.Form.Get("emergencyStopThreshold")
+	emergencyStopInvert := r.Form.Get("emergencyStopInvert")
+	safeStateOnShutdown := r.Form.Get("safeStateOnShutdown")
+	preheatTemperature := r.Form.Get("preheatTemperature")
+	preheatLeadTime := r.Form.Get("preheatLeadTime")
+	preheatStartHour := r.Form.Get("preheatStartHour")
+	preheatStartMinute := r.Form.Get("preheatStartMinute")
+	waterAutoRefill := r.Form.Get("waterAutoRefill")
+	waterRefillHoldOff := r.Form.Get("waterRefillHoldOff")
+	waterConductivityLimit := r.Form.Get("waterConductivityLimit")
+	blowdownInterval := r.Form.Get("blowdownInterval")
+	staleDataTimeout := r.Form.Get("staleDataTimeout")
+
 	tankDays := r.Form.Get("tankDays")
 
 	if len(holdoffTime) > 0 {
@@ -365,6 +494,94 @@ func updateSettings(w http.ResponseWriter, r *http.Request) {
 			params.WaterOffset = t
 		}
 	}
+	if len(waterRefillHoldOff) > 0 {
+		t, err := strconv.Atoi(waterRefillHoldOff)
+		if err != nil {
+			log.Println(err)
+		} else {
+			params.WaterRefillHoldOff = time.Minute * time.Duration(t)
+		}
+	}
+	if len(staleDataTimeout) > 0 {
+		t, err := strconv.Atoi(staleDataTimeout)
+		if err != nil {
+			log.Println(err)
+		} else {
+			// The watchdog reads this under the settings lock while the logging loop runs
+			settingsMu.Lock()
+			params.StaleDataTimeout = time.Second * time.Duration(t)
+			settingsMu.Unlock()
+		}
+	}
+	if len(waterConductivityLimit) > 0 {
+		t, err := strconv.Atoi(waterConductivityLimit)
+		if err != nil {
+			log.Println(err)
+		} else {
+			params.WaterConductivityLimit = float32(t)
+		}
+	}
+	if len(blowdownInterval) > 0 {
+		t, err := strconv.Atoi(blowdownInterval)
+		if err != nil {
+			log.Println(err)
+		} else {
+			params.BlowdownInterval = time.Hour * 24 * time.Duration(t)
+		}
+	}
+	params.WaterAutoRefill = (len(waterAutoRefill) > 0)
+	params.DryerPerElectrolyser = (len(dryerPerElectrolyser) > 0)
+	if len(preheatTemperature) > 0 {
+		t, err := strconv.Atoi(preheatTemperature)
+		if err != nil {
+			log.Println(err)
+		} else {
+			params.PreheatTemperature = float32(t)
+		}
+	}
+	if len(preheatLeadTime) > 0 {
+		t, err := strconv.Atoi(preheatLeadTime)
+		if err != nil {
+			log.Println(err)
+		} else {
+			params.PreheatLeadTime = time.Minute * time.Duration(t)
+		}
+	}
+	if len(preheatStartHour) > 0 {
+		h, err := strconv.Atoi(preheatStartHour)
+		m := 0
+		if err == nil && len(preheatStartMinute) > 0 {
+			m, err = strconv.Atoi(preheatStartMinute)
+		}
+		if err != nil {
+			log.Println(err)
+		} else if h < 0 {
+			params.PreheatStartTime = PREHEATFORECAST
+		} else {
+			params.PreheatStartTime = time.Hour*time.Duration(h) + time.Minute*time.Duration(m)
+		}
+	}
+	params.PreheatEnabled = (len(preheatEnabled) > 0)
+	if len(emergencyStopInput) > 0 {
+		t, err := strconv.Atoi(emergencyStopInput)
+		if err != nil {
+			log.Println(err)
+		} else if t < -8 || t > 8 {
+			log.Println("Invalid emergency stop input - ", t)
+		} else {
+			params.EmergencyStopInput = t
+		}
+	}
+	if len(emergencyStopThreshold) > 0 {
+		t, err := strconv.Atoi(emergencyStopThreshold)
+		if err != nil {
+			log.Println(err)
+		} else {
+			params.EmergencyStopThreshold = t * 100
+		}
+	}
+	params.EmergencyStopInvert = (len(emergencyStopInvert) > 0)
+	params.SafeStateOnShutdown = (len(safeStateOnShutdown) > 0)
 
 	if len(tankDays) > 0 {
 		t, err := strconv.Atoi(tankDays)
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/***************
+Graceful shutdown. Every long running loop watches serviceContext and returns when it is cancelled.
+On SIGINT or SIGTERM the web server stops taking requests, the devices are either left as they are or taken
+to a safe state depending on the settings, the loops are stopped so pending database writes and CAN events
+are written, and finally the Modbus and CAN connections and the database are closed.
+*/
+
+const SHUTDOWNTIMEOUT = time.Second * 30         // Give up waiting for a clean shutdown after this long
+const WEBSERVERSHUTDOWNTIMEOUT = time.Second * 5 // Time allowed for in-flight HTTP requests to finish
+
+var serviceContext, cancelService = context.WithCancel(context.Background())
+var serviceGroup sync.WaitGroup
+
+/*
+startService runs fn in its own goroutine and tracks it so shutDown can wait for it to return
+*/
+func startService(name string, fn func()) {
+	serviceGroup.Add(1)
+	go func() {
+		defer serviceGroup.Done()
+		fn()
+		log.Printf("%s stopped", name)
+	}()
+}
+
+/*
+waitForShutdownSignal blocks until the process is asked to stop
+*/
+func waitForShutdownSignal() os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	return <-signals
+}
+
+/*
+shutDown stops the service cleanly. If it takes longer than SHUTDOWNTIMEOUT the process exits anyway.
+*/
+func shutDown() {
+	watchdog := time.AfterFunc(SHUTDOWNTIMEOUT, func() {
+		log.Println("Timed out waiting for a clean shutdown")
+		os.Exit(1)
+	})
+	defer watchdog.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), WEBSERVERSHUTDOWNTIMEOUT)
+	webServer.Shutdown(ctx)
+	cancel()
+
+	// The safe-state sequence needs the Modbus connections so it must run before the loops are stopped
+	if params.SafeStateOnShutdown {
+		log.Println("Taking the plant to a safe state before shutting down")
+		emergencyStop.Trigger("shutdown", "Service shutdown", "")
+		emergencyStop.Wait()
+		// The plant was deliberately made safe so don't start anything again on the next start
+		intendedState.Clear()
+	} else {
+		log.Println("Leaving the devices in their current state")
+	}
+
+	cancelService()
+	serviceGroup.Wait()
+
+	SystemStatus.m.Lock()
+	for _, el := range SystemStatus.Electrolysers {
+		el.Close()
+	}
+	SystemStatus.m.Unlock()
+
+	if pDB != nil {
+		if err := pDB.Close(); err != nil {
+			log.Println("Error closing the database - ", err)
+		}
+		pDB = nil
+	}
+	log.Println("Shutdown complete")
+}
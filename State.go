@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/***************
+The intended state is what the operators and controllers have asked the plant to do: the electrolyser production
+rate, which electrolysers should be powered, which fuel cells should be enabled and running, and whether the
+emergency stop is latched. It is saved to its own file whenever it changes so that a restart of the service can pick
+up where it left off. Lockouts and schedules are already held in the settings file.
+On startup the intended state is reconciled with the relays and the CAN bus. Anything that is already running is left
+alone so a restart never interrupts production or generation, and anything that should be running but is not is
+started again. Fuel cells that have been seen before are registered straight away so they are not pulsed to find them.
+The saved production rate is set again once the electrolysers are back on line.
+*/
+
+const STATEMODBUSTIMEOUT = time.Second * 10      // Time to wait for the first relay readings before reconciling
+const STATEELECTROLYSERTIMEOUT = time.Minute * 2 // Time to wait for the electrolysers to come on line before restoring the rate
+
+type FuelCellIntent struct {
+	Enable bool `json:"enable"`
+	Run    bool `json:"run"`
+}
+
+type IntendedState struct {
+	Rate           uint8             `json:"rate"`
+	Electrolysers  [2]bool           `json:"electrolysers"` // Electrolysers whose power relay should be on
+	FuelCells      [2]FuelCellIntent `json:"fuelCells"`
+	KnownFuelCells []uint8           `json:"knownFuelCells"` // Fuel cells that have been seen on the CAN bus
+	EStopLatched   bool              `json:"eStopLatched"`
+	EStopSource    string            `json:"eStopSource"`
+	EStopReason    string            `json:"eStopReason"`
+	EStopName      string            `json:"eStopName"`
+	EStopTriggered time.Time         `json:"eStopTriggered"`
+	Updated        time.Time         `json:"updated"`
+	filepath       string
+	mu             sync.Mutex
+}
+
+var intendedState = new(IntendedState)
+
+/*
+ReadState loads the intended state. A missing file is not an error, it just means nothing has been requested yet.
+*/
+func (s *IntendedState) ReadState(filepath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filepath = filepath
+	file, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(file, s)
+}
+
+/*
+write saves the intended state. The file is replaced in one step so a crash never leaves it half written.
+The caller must hold the lock.
+*/
+func (s *IntendedState) write() {
+	if s.filepath == "" {
+		return
+	}
+	s.Updated = time.Now()
+	bData, err := json.Marshal(s)
+	if err != nil {
+		log.Println("Error converting intended state to text -", err)
+		return
+	}
+	if err := ioutil.WriteFile(s.filepath+".tmp", bData, 0644); err != nil {
+		log.Println("Error writing intended state file -", err)
+		return
+	}
+	if err := os.Rename(s.filepath+".tmp", s.filepath); err != nil {
+		log.Println("Error replacing intended state file -", err)
+	}
+}
+
+/*
+snapshot returns a copy of the intended state
+*/
+func (s *IntendedState) snapshot() IntendedState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return IntendedState{Rate: s.Rate, Electrolysers: s.Electrolysers, FuelCells: s.FuelCells, KnownFuelCells: append([]uint8{}, s.KnownFuelCells...),
+		EStopLatched: s.EStopLatched, EStopSource: s.EStopSource, EStopReason: s.EStopReason, EStopName: s.EStopName,
+		EStopTriggered: s.EStopTriggered, Updated: s.Updated}
+}
+
+func (s *IntendedState) SetRate(rate uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Rate != rate {
+		s.Rate = rate
+		s.write()
+	}
+}
+
+/*
+SetElectrolyserPower records a request to turn the power to an electrolyser on or off
+*/
+func (s *IntendedState) SetElectrolyserPower(device int, on bool) {
+	if device < 0 || device > 1 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Electrolysers[device] != on {
+		s.Electrolysers[device] = on
+		s.write()
+	}
+}
+
+/*
+ElectrolysersPowered returns true if any electrolyser should be powered
+*/
+func (s *IntendedState) ElectrolysersPowered() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Electrolysers[0] || s.Electrolysers[1]
+}
+
+/*
+SetFuelCellEnable records a request to enable or disable a fuel cell. Disabling it also cancels any run request.
+*/
+func (s *IntendedState) SetFuelCellEnable(device uint8, enable bool) {
+	if device > 1 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	intent := FuelCellIntent{Enable: enable, Run: s.FuelCells[device].Run && enable}
+	if s.FuelCells[device] != intent {
+		s.FuelCells[device] = intent
+		s.write()
+	}
+}
+
+/*
+SetFuelCellRun records a request to run or stop a fuel cell. Running it implies it is enabled.
+*/
+func (s *IntendedState) SetFuelCellRun(device uint8, run bool) {
+	if device > 1 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	intent := FuelCellIntent{Enable: s.FuelCells[device].Enable || run, Run: run}
+	if s.FuelCells[device] != intent {
+		s.FuelCells[device] = intent
+		s.write()
+	}
+}
+
+/*
+AddFuelCell remembers a fuel cell seen on the CAN bus so it can be registered without pulsing it next time
+*/
+func (s *IntendedState) AddFuelCell(device uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fc := range s.KnownFuelCells {
+		if fc == device {
+			return
+		}
+	}
+	s.KnownFuelCells = append(s.KnownFuelCells, device)
+	s.write()
+}
+
+func (s *IntendedState) SetEmergencyStop(latched bool, source string, reason string, name string, triggered time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.EStopLatched = latched
+	s.EStopSource = source
+	s.EStopReason = reason
+	s.EStopName = name
+	s.EStopTriggered = triggered
+	s.write()
+}
+
+/*
+Clear forgets all production and generation requests. Used when the plant is deliberately left in a safe state.
+*/
+func (s *IntendedState) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Rate = 0
+	s.Electrolysers = [2]bool{}
+	s.FuelCells = [2]FuelCellIntent{}
+	s.EStopLatched = false
+	s.write()
+}
+
+/*
+restoreState applies the parts of the intended state that do not need the hardware. Call it before the web server starts.
+*/
+func restoreState() {
+	state := intendedState.snapshot()
+	CurrentRate = state.Rate
+	if state.EStopLatched {
+		emergencyStop.restore(state.EStopSource, state.EStopReason, state.EStopName, state.EStopTriggered)
+	}
+	if !state.Updated.IsZero() {
+		log.Printf("Restored intended state from %s - rate %d%%", state.Updated.Format("2006-01-02 15:04:05"), state.Rate)
+	}
+}
+
+/*
+registerKnownFuelCells adds the fuel cells we have seen before so they do not need to be pulsed to find them.
+Call it before the CAN monitor is started.
+*/
+func registerKnownFuelCells() bool {
+	state := intendedState.snapshot()
+	for _, device := range state.KnownFuelCells {
+		if _, found := canBus.fuelCell[device]; !found {
+			log.Printf("Registering fuel cell %d", device)
+			canBus.fuelCell[device] = NewFCM804(canBus, device)
+		}
+	}
+	return len(state.KnownFuelCells) > 0
+}
+
+/*
+waitForModbus waits until the relay states have been read at least once
+*/
+func waitForModbus(timeout time.Duration) error {
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(time.Second) {
+		mbusRTU.muBuffer.Lock()
+		ready := !mbusRTU.lastIOUpdate.IsZero()
+		mbusRTU.muBuffer.Unlock()
+		if ready {
+			mbusRTU.getRelayStatus()
+			return nil
+		}
+	}
+	return fmt.Errorf("timed out waiting for the Modbus relays to come on line")
+}
+
+/*
+reconcileFuelCell compares the requested state of a fuel cell with its relays. A fuel cell that should be running is
+started again. A fuel cell that is on when it was not requested is left on and the intended state is updated to match.
+*/
+func reconcileFuelCell(device uint8, intent FuelCellIntent) {
+	var enabled, running bool
+	switch device {
+	case 0:
+		enabled, running = SystemStatus.Relays.FC0Enable, SystemStatus.Relays.FC0Run
+	case 1:
+		enabled, running = SystemStatus.Relays.FC1Enable, SystemStatus.Relays.FC1Run
+	}
+	switch {
+	case intent.Run && !running:
+		log.Printf("Fuel cell %d should be running - starting it", device)
+		if err := runCommandWithParams(fcQueue(device), "run", PriorityAutomatic, "startup", CommandParams{"run": true}, func() error {
+			return startFuelCell(device)
+		}); err != nil {
+			log.Printf("Could not restore fuel cell %d - %v", device, err)
+		}
+	case intent.Enable && !enabled:
+		log.Printf("Fuel cell %d should be enabled - turning it on", device)
+		if err := runCommandWithParams(fcQueue(device), "power", PriorityAutomatic, "startup", CommandParams{"on": true}, func() error {
+			return turnOnFuelCell(device)
+		}); err != nil {
+			log.Printf("Could not restore fuel cell %d - %v", device, err)
+		}
+	case running != intent.Run || enabled != intent.Enable:
+		log.Printf("Fuel cell %d is enabled=%v running=%v - leaving it as it is", device, enabled, running)
+		intendedState.mu.Lock()
+		intendedState.FuelCells[device] = FuelCellIntent{Enable: enabled || running, Run: running}
+		intendedState.write()
+		intendedState.mu.Unlock()
+	}
+}
+
+/*
+reconcileElectrolyser compares the requested power state of an electrolyser with its relay. An electrolyser that
+should be powered is turned on again. One that is on when it was not requested is left on and the intended state is
+updated to match.
+*/
+func reconcileElectrolyser(device int, on bool) {
+	var powered bool
+	switch device {
+	case 0:
+		powered = SystemStatus.Relays.EL0
+	case 1:
+		powered = SystemStatus.Relays.EL1
+	}
+	switch {
+	case on && !powered:
+		log.Printf("Electrolyser %d should be powered - turning it on", device)
+		if err := runCommandWithParams(elQueue(device), "power", PriorityAutomatic, "startup", CommandParams{"on": true}, func() error {
+			return mbusRTU.ELOnOff(uint8(device), true)
+		}); err != nil {
+			log.Printf("Could not restore electrolyser %d - %v", device, err)
+		}
+	case powered && !on:
+		log.Printf("Electrolyser %d is powered - leaving it as it is", device)
+		intendedState.SetElectrolyserPower(device, true)
+	}
+}
+
+/*
+restoreRate sets the saved production rate once every electrolyser that should be powered has been read. It gives up
+if they have not come on line by STATEELECTROLYSERTIMEOUT.
+*/
+func restoreRate(rate uint8, powered [2]bool) {
+	for start := time.Now(); ; {
+		ready := true
+		for device, el := range SystemStatus.Electrolysers {
+			if device < len(powered) && powered[device] && checkElectrolyserLockout(device) == nil && el.getLastUpdate().IsZero() {
+				ready = false
+			}
+		}
+		if ready {
+			break
+		}
+		if time.Since(start) > STATEELECTROLYSERTIMEOUT {
+			log.Printf("The electrolysers did not come on line so the rate of %d%% has not been restored", rate)
+			return
+		}
+		select {
+		case <-serviceContext.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+	log.Printf("Restoring the electrolyser rate to %d%%", rate)
+	if err := setProductionRates(rate, PriorityAutomatic, "startup"); err != nil {
+		log.Printf("Could not restore the electrolyser rate - %v", err)
+	}
+}
+
+/*
+reconcileElectrolysers applies the requested power state to each registered electrolyser that is not locked out
+*/
+func reconcileElectrolysers(powered [2]bool) {
+	SystemStatus.m.Lock()
+	count := len(SystemStatus.Electrolysers)
+	SystemStatus.m.Unlock()
+	for device := 0; device < count && device < len(powered); device++ {
+		if checkElectrolyserLockout(device) != nil {
+			continue
+		}
+		reconcileElectrolyser(device, powered[device])
+	}
+}
+
+/*
+reconcileState brings the plant into line with the intended state after a restart without disturbing anything that
+is already running. Fuel cells are only pulsed to find them if none have ever been seen, and the electrolysers are
+only searched for if none are registered and none are powered, as the search turns them off.
+*/
+func reconcileState(fuelCellsKnown bool) {
+	if err := waitForModbus(STATEMODBUSTIMEOUT); err != nil {
+		log.Fatal(err)
+	}
+	waterManager.loadLastBlowdowns()
+
+	state := intendedState.snapshot()
+	var search *Job
+	if len(SystemStatus.Electrolysers) == 0 {
+		if SystemStatus.Relays.EL0 || SystemStatus.Relays.EL1 {
+			log.Println("No electrolysers are registered but they are powered - use /el/search to find them")
+		} else {
+			search = startJob("electrolyser search", "el", "startup", AcquireElectrolysers)
+		}
+	}
+	if !fuelCellsKnown {
+		AcquireFuelCells(state.FuelCells)
+	}
+	if emergencyStop.Latched() {
+		log.Println("Emergency stop is latched - nothing will be started until it is reset")
+		return
+	}
+	if search != nil {
+		// The search runs in the background so the electrolysers it finds are put back once it has finished
+		startService("Electrolyser state restore", func() {
+			if !search.wait() {
+				return
+			}
+			if emergencyStop.Latched() {
+				log.Println("Emergency stop is latched - the electrolysers found will not be started until it is reset")
+				return
+			}
+			reconcileElectrolysers(state.Electrolysers)
+			if state.Rate > 0 && intendedState.ElectrolysersPowered() {
+				restoreRate(state.Rate, intendedState.snapshot().Electrolysers)
+			}
+		})
+	} else {
+		reconcileElectrolysers(state.Electrolysers)
+		if state.Rate > 0 && intendedState.ElectrolysersPowered() {
+			powered := intendedState.snapshot().Electrolysers
+			startService("Electrolyser rate restore", func() {
+				restoreRate(state.Rate, powered)
+			})
+		}
+	}
+	for device := uint8(0); device < 2; device++ {
+		if checkFuelCellLockout(device) != nil {
+			continue
+		}
+		reconcileFuelCell(device, state.FuelCells[device])
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/***************
+Telemetry points give every measured value a stable name such as gas.tankPressure or fc0.inletTemp so it can be used
+by the threshold rules and anything else that needs to refer to a value by name. Only values we currently have a
+reading for are returned, so a device that is switched off or whose data is stale simply has no points.
+*/
+
+type TelemetryPoint struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Units       string  `json:"units"`
+	Value       float64 `json:"value"`
+}
+
+// telemetryPoints lists the names collectTelemetry can return. Device points are prefixed with the device type and,
+// for the electrolysers, dryers and fuel cells, the device number, e.g. el0.stackVoltage
+var telemetryPoints = []string{"gas.tankPressure", "gas.fuelCellPressure", "water.conductivity"}
+var telemetryDevicePoints = map[string][]string{
+	DataSourceAC: {"power", "volts", "current", "frequency", "powerFactor"},
+	DataSourceHP: {"power", "volts", "current", "frequency", "powerFactor"},
+	"el":         {"rate", "electrolyteTemp", "stackVoltage", "stackCurrent", "h2Flow", "innerH2Pressure", "outerH2Pressure", "waterPressure"},
+	"dr":         {"temp0", "temp1", "temp2", "temp3", "inputPressure", "outputPressure"},
+	"fc":         {"inletTemp", "outletTemp", "anodePressure", "outputPower", "outputVolts", "outputCurrent"},
+}
+
+/*
+validTelemetryPoint says whether the name is one collectTelemetry can return, whether or not there is a reading for
+it at the moment
+*/
+func validTelemetryPoint(name string) bool {
+	for _, point := range telemetryPoints {
+		if point == name {
+			return true
+		}
+	}
+	dot := strings.Index(name, ".")
+	if dot < 0 {
+		return false
+	}
+	device, point := name[:dot], name[dot+1:]
+	kind := strings.TrimRight(device, "0123456789")
+	numbered := kind != DataSourceAC && kind != DataSourceHP
+	if numbered != (kind != device) {
+		return false
+	}
+	if numbered {
+		if n, err := strconv.Atoi(device[len(kind):]); err != nil || n > 255 {
+			return false
+		}
+	}
+	for _, p := range telemetryDevicePoints[kind] {
+		if p == point {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+collectTelemetry returns the current value of every telemetry point we have a reading for, sorted by name
+*/
+func collectTelemetry() []TelemetryPoint {
+	var points []TelemetryPoint
+	add := func(name string, description string, units string, value float64) {
+		points = append(points, TelemetryPoint{Name: name, Description: description, Units: units, Value: value})
+	}
+
+	SystemStatus.m.Lock()
+	if !commsWatchdog.isStale(DataSourceIO) {
+		add("gas.tankPressure", "Hydrogen tank pressure", "bar", SystemStatus.Gas.TankPressure)
+		add("gas.fuelCellPressure", "Fuel cell gas supply pressure", "bar", float64(SystemStatus.Gas.FuelCellPressure))
+		add("water.conductivity", "Water conductivity", "µS/cm", float64(SystemStatus.TDS.TdsReading))
+	}
+	for _, ac := range []struct {
+		prefix string
+		label  string
+		status acStatus
+	}{{DataSourceAC, "AC", SystemStatus.AC}, {DataSourceHP, "Heat pump", SystemStatus.HP}} {
+		if commsWatchdog.isStale(ac.prefix) {
+			continue
+		}
+		add(ac.prefix+".power", ac.label+" power", "W", float64(ac.status.ACPower)/100)
+		add(ac.prefix+".volts", ac.label+" voltage", "V", float64(ac.status.ACVolts)/100)
+		add(ac.prefix+".current", ac.label+" current", "A", float64(ac.status.ACCurrent)/100)
+		add(ac.prefix+".frequency", ac.label+" frequency", "Hz", float64(ac.status.ACFrequency)/100)
+		add(ac.prefix+".powerFactor", ac.label+" power factor", "", float64(ac.status.ACPowerFactor)/100)
+	}
+	for device, el := range SystemStatus.Electrolysers {
+		if !el.status.SwitchedOn || !el.clientConnected || commsWatchdog.isStale(elDataSource(device)) {
+			continue
+		}
+		prefix := "el" + strconv.Itoa(device) + "."
+		label := fmt.Sprintf("Electrolyser %d ", device)
+		add(prefix+"rate", label+"production rate", "%", float64(el.GetRate()))
+		add(prefix+"electrolyteTemp", label+"electrolyte temperature", "°C", float64(el.status.ElectrolyteTemp))
+		add(prefix+"stackVoltage", label+"stack voltage", "V", float64(el.status.StackVoltage))
+		add(prefix+"stackCurrent", label+"stack current", "A", float64(el.status.StackCurrent))
+		add(prefix+"h2Flow", label+"hydrogen flow", "NL/h", float64(el.status.H2Flow))
+		add(prefix+"innerH2Pressure", label+"inner hydrogen pressure", "bar", float64(el.status.InnerH2Pressure))
+		add(prefix+"outerH2Pressure", label+"outer hydrogen pressure", "bar", float64(el.status.OuterH2Pressure))
+		add(prefix+"waterPressure", label+"water pressure", "bar", float64(el.status.WaterPressure))
+	}
+	for _, device := range dryerDevices() {
+		dr := getDryerStatus(device)
+		if !dr.On || !dr.Connected || dr.Stale {
+			continue
+		}
+		prefix := "dr" + strconv.Itoa(device) + "."
+		label := fmt.Sprintf("Dryer %d ", device)
+		add(prefix+"temp0", label+"temperature 0", "°C", float64(dr.Temp0))
+		add(prefix+"temp1", label+"temperature 1", "°C", float64(dr.Temp1))
+		add(prefix+"temp2", label+"temperature 2", "°C", float64(dr.Temp2))
+		add(prefix+"temp3", label+"temperature 3", "°C", float64(dr.Temp3))
+		add(prefix+"inputPressure", label+"input pressure", "bar", float64(dr.InputPressure))
+		add(prefix+"outputPressure", label+"output pressure", "bar", float64(dr.OutputPressure))
+	}
+	fc0, fc1 := SystemStatus.Relays.FC0Enable, SystemStatus.Relays.FC1Enable
+	SystemStatus.m.Unlock()
+
+	for device, fc := range canBus.fuelCell {
+		if (device == 0 && !fc0) || (device == 1 && !fc1) || commsWatchdog.isStale(fcDataSource(device)) {
+			continue
+		}
+		prefix := "fc" + strconv.Itoa(int(device)) + "."
+		label := fmt.Sprintf("Fuel cell %d ", device)
+		add(prefix+"inletTemp", label+"inlet temperature", "°C", float64(fc.getInletTemp()))
+		add(prefix+"outletTemp", label+"outlet temperature", "°C", float64(fc.getOutletTemp()))
+		add(prefix+"anodePressure", label+"anode pressure", "bar", float64(fc.getAnodePressure()))
+		add(prefix+"outputPower", label+"output power", "W", float64(fc.getOutputPower()))
+		add(prefix+"outputVolts", label+"output voltage", "V", float64(fc.getOutputVolts()))
+		add(prefix+"outputCurrent", label+"output current", "A", float64(fc.getOutputCurrent()))
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Name < points[j].Name
+	})
+	return points
+}
+
+/*
+telemetryValues returns the current telemetry as a map of point name to value
+*/
+func telemetryValues() map[string]float64 {
+	values := make(map[string]float64)
+	for _, p := range collectTelemetry() {
+		values[p.Name] = p.Value
+	}
+	return values
+}
+
+/*
+getTelemetry returns the current value of every telemetry point
+URL = /api/telemetry
+*/
+func getTelemetry(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(collectTelemetry()); err != nil {
+		ReturnJSONError(w, "Telemetry", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/***************
+Threshold rules put a telemetry point into alarm when it goes outside its limits. A rule can have high-high, high, low
+and low-low limits and a rate of change limit in units per minute. The deadband stops an alarm chattering when the
+value hovers around a limit, the value has to come back inside the limit by the deadband before the alarm clears.
+Delay-on is how many seconds a limit must be exceeded before the alarm is raised and delay-off is how many seconds the
+value must be back inside before it clears. Rules are checked every logging cycle and are saved with the settings.
+*/
+
+const RATEOFCHANGEWINDOW = time.Minute       // Rate of change is measured over this period
+const RATEOFCHANGEMINIMUM = time.Second * 30 // Rate of change is not checked until we have this much history
+
+const (
+	LimitHighHigh     = "hihi"
+	LimitHigh         = "hi"
+	LimitLow          = "lo"
+	LimitLowLow       = "lolo"
+	LimitRateOfChange = "roc"
+)
+
+type ThresholdRule struct {
+	Name         string   `json:"name"`
+	Point        string   `json:"point"`
+	Enabled      bool     `json:"enabled"`
+	HighHigh     *float64 `json:"highHigh,omitempty"`
+	High         *float64 `json:"high,omitempty"`
+	Low          *float64 `json:"low,omitempty"`
+	LowLow       *float64 `json:"lowLow,omitempty"`
+	RateOfChange *float64 `json:"rateOfChange,omitempty"` // Units per minute in either direction
+	Deadband     float64  `json:"deadband"`
+	DelayOn      float64  `json:"delayOn"`  // Seconds
+	DelayOff     float64  `json:"delayOff"` // Seconds
+}
+
+type limitState struct {
+	active  bool
+	changed time.Time // When the condition last changed, zero if it is not waiting on a delay
+}
+
+type sample struct {
+	time  time.Time
+	value float64
+}
+
+type ruleState struct {
+	limits  map[string]*limitState
+	samples []sample
+}
+
+type ThresholdMonitor struct {
+	states map[string]*ruleState
+	mu     sync.Mutex
+}
+
+var thresholdMonitor = &ThresholdMonitor{states: make(map[string]*ruleState)}
+
+/*
+limitSeverity returns the alarm severity for each kind of limit
+*/
+func limitSeverity(limit string) AlarmSeverity {
+	switch limit {
+	case LimitHighHigh, LimitLowLow:
+		return SeverityHigh
+	}
+	return SeverityMedium
+}
+
+func limitDescription(limit string) string {
+	switch limit {
+	case LimitHighHigh:
+		return "high high"
+	case LimitHigh:
+		return "high"
+	case LimitLow:
+		return "low"
+	case LimitLowLow:
+		return "low low"
+	}
+	return "rate of change"
+}
+
+func ruleAlarmKey(rule string, limit string) string {
+	return "rule." + rule + "." + limit
+}
+
+/*
+validate checks the rule makes sense
+*/
+func (r *ThresholdRule) validate() error {
+	if r.Name == "" || r.Point == "" {
+		return fmt.Errorf("a rule needs a name and a telemetry point")
+	}
+	if !validTelemetryPoint(r.Point) {
+		return fmt.Errorf("rule %s is on an unknown telemetry point %q", r.Name, r.Point)
+	}
+	if r.HighHigh == nil && r.High == nil && r.Low == nil && r.LowLow == nil && r.RateOfChange == nil {
+		return fmt.Errorf("rule %s has no limits", r.Name)
+	}
+	if r.HighHigh != nil && r.High != nil && *r.HighHigh < *r.High {
+		return fmt.Errorf("rule %s high-high limit is below the high limit", r.Name)
+	}
+	if r.LowLow != nil && r.Low != nil && *r.LowLow > *r.Low {
+		return fmt.Errorf("rule %s low-low limit is above the low limit", r.Name)
+	}
+	if r.High != nil && r.Low != nil && *r.High <= *r.Low {
+		return fmt.Errorf("rule %s high limit must be above the low limit", r.Name)
+	}
+	if r.RateOfChange != nil && *r.RateOfChange <= 0 {
+		return fmt.Errorf("rule %s rate of change limit must be greater than zero", r.Name)
+	}
+	if r.Deadband < 0 || r.DelayOn < 0 || r.DelayOff < 0 {
+		return fmt.Errorf("rule %s deadband and delays cannot be negative", r.Name)
+	}
+	return nil
+}
+
+/*
+exceeded says whether the value is outside a limit. active is the current state of the limit so the deadband is
+applied on the way back.
+*/
+func exceeded(limit string, threshold float64, value float64, deadband float64, active bool) bool {
+	switch limit {
+	case LimitHighHigh, LimitHigh, LimitRateOfChange:
+		if active {
+			return value > threshold-deadband
+		}
+		return value > threshold
+	default:
+		if active {
+			return value < threshold+deadband
+		}
+		return value < threshold
+	}
+}
+
+/*
+rateOfChange returns the rate of change per minute over the samples held, and false if there is not enough history
+*/
+func (s *ruleState) rateOfChange(now time.Time, value float64) (float64, bool) {
+	s.samples = append(s.samples, sample{now, value})
+	for len(s.samples) > 1 && now.Sub(s.samples[0].time) > RATEOFCHANGEWINDOW {
+		s.samples = s.samples[1:]
+	}
+	elapsed := now.Sub(s.samples[0].time)
+	if elapsed < RATEOFCHANGEMINIMUM {
+		return 0, false
+	}
+	return (value - s.samples[0].value) / elapsed.Minutes(), true
+}
+
+/*
+check evaluates one rule against its value and returns the limits that should now be raised and cleared
+*/
+func (tm *ThresholdMonitor) check(rule *ThresholdRule, value float64, now time.Time) (raise []AlarmSpec, clear []string) {
+	state, found := tm.states[rule.Name]
+	if !found {
+		state = &ruleState{limits: make(map[string]*limitState)}
+		tm.states[rule.Name] = state
+	}
+	limits := map[string]*float64{LimitHighHigh: rule.HighHigh, LimitHigh: rule.High, LimitLow: rule.Low, LimitLowLow: rule.LowLow}
+	var roc float64
+	rocValid := false
+	if rule.RateOfChange != nil {
+		roc, rocValid = state.rateOfChange(now, value)
+		if rocValid {
+			limits[LimitRateOfChange] = rule.RateOfChange
+		}
+	}
+
+	for limit, threshold := range limits {
+		if threshold == nil {
+			continue
+		}
+		ls, found := state.limits[limit]
+		if !found {
+			// Pick up an alarm left active from before a restart so it can clear
+			ls = &limitState{active: alarmManager.isActive(ruleAlarmKey(rule.Name, limit))}
+			state.limits[limit] = ls
+		}
+		v := value
+		if limit == LimitRateOfChange {
+			v = math.Abs(roc)
+		}
+		out := exceeded(limit, *threshold, v, rule.Deadband, ls.active)
+		if out == ls.active {
+			// No change so cancel any pending delay
+			ls.changed = time.Time{}
+			continue
+		}
+		if ls.changed.IsZero() {
+			ls.changed = now
+		}
+		delay := rule.DelayOff
+		if out {
+			delay = rule.DelayOn
+		}
+		if now.Sub(ls.changed) < time.Duration(delay*float64(time.Second)) {
+			continue
+		}
+		ls.active = out
+		ls.changed = time.Time{}
+		key := ruleAlarmKey(rule.Name, limit)
+		if out {
+			message := fmt.Sprintf("%s %s - %s is %0.2f, limit %0.2f", rule.Name, limitDescription(limit), rule.Point, value, *threshold)
+			if limit == LimitRateOfChange {
+				message = fmt.Sprintf("%s %s - %s is changing by %0.2f per minute, limit %0.2f", rule.Name, limitDescription(limit), rule.Point, roc, *threshold)
+			}
+			raise = append(raise, AlarmSpec{Key: key, Source: AlarmSourceThreshold, Device: rule.Point, Code: limit,
+				Message: message, Severity: limitSeverity(limit)})
+		} else {
+			clear = append(clear, key)
+		}
+	}
+	return
+}
+
+/*
+Check evaluates every enabled rule against the current telemetry. Points with no reading are skipped and any delay
+in progress is cancelled, the alarm state is left as it was. Called once per logging cycle.
+*/
+func (tm *ThresholdMonitor) Check() {
+	settingsMu.Lock()
+	var rules []ThresholdRule
+	for _, r := range params.ThresholdRules {
+		if r.Enabled {
+			rules = append(rules, *r)
+		}
+	}
+	settingsMu.Unlock()
+	if len(rules) == 0 {
+		return
+	}
+
+	values := telemetryValues()
+	now := time.Now()
+	var raise []AlarmSpec
+	var clear []string
+	tm.mu.Lock()
+	for i := range rules {
+		value, found := values[rules[i].Point]
+		if !found {
+			if state, found := tm.states[rules[i].Name]; found {
+				for _, ls := range state.limits {
+					ls.changed = time.Time{}
+				}
+				state.samples = nil
+			}
+			continue
+		}
+		r, c := tm.check(&rules[i], value, now)
+		raise = append(raise, r...)
+		clear = append(clear, c...)
+	}
+	tm.mu.Unlock()
+
+	for _, spec := range raise {
+		alarmManager.Raise(spec)
+	}
+	for _, key := range clear {
+		alarmManager.Clear(key)
+	}
+}
+
+/*
+reset forgets the state of a rule and clears its alarms. Used when a rule is changed or removed.
+*/
+func (tm *ThresholdMonitor) reset(name string) {
+	tm.mu.Lock()
+	delete(tm.states, name)
+	tm.mu.Unlock()
+	for _, limit := range []string{LimitHighHigh, LimitHigh, LimitLow, LimitLowLow, LimitRateOfChange} {
+		alarmManager.Clear(ruleAlarmKey(name, limit))
+	}
+}
+
+/*
+getThresholdRules returns all the threshold rules
+URL = /api/rules
+*/
+func getThresholdRules(w http.ResponseWriter, _ *http.Request) {
+	settingsMu.Lock()
+	rules := make([]ThresholdRule, 0, len(params.ThresholdRules))
+	for _, r := range params.ThresholdRules {
+		rules = append(rules, *r)
+	}
+	settingsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(rules); err != nil {
+		ReturnJSONError(w, "Rules", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+setThresholdRule adds a rule or replaces the rule with the same name
+URL = /api/rules/{name}
+payload = {"point":"gas.tankPressure","enabled":true,"high":30,"highHigh":33,"deadband":0.5,"delayOn":10,"delayOff":30}
+*/
+func setThresholdRule(w http.ResponseWriter, r *http.Request) {
+	rule := new(ThresholdRule)
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, rule)
+	}
+	if err != nil {
+		ReturnJSONError(w, "Rules", err, http.StatusBadRequest, true)
+		return
+	}
+	rule.Name = mux.Vars(r)["name"]
+	if err := rule.validate(); err != nil {
+		ReturnJSONError(w, "Rules", err, http.StatusBadRequest, true)
+		return
+	}
+
+	settingsMu.Lock()
+	replaced := false
+	for i, existing := range params.ThresholdRules {
+		if existing.Name == rule.Name {
+			params.ThresholdRules[i] = rule
+			replaced = true
+		}
+	}
+	if !replaced {
+		params.ThresholdRules = append(params.ThresholdRules, rule)
+	}
+	err = params.save()
+	settingsMu.Unlock()
+
+	thresholdMonitor.reset(rule.Name)
+	if err != nil {
+		ReturnJSONError(w, "Rules", err, http.StatusInternalServerError, true)
+		return
+	}
+	log.Printf("Threshold rule %s set on %s", rule.Name, rule.Point)
+	returnJSONSuccess(w)
+}
+
+/*
+deleteThresholdRule removes a rule and clears its alarms
+URL = /api/rules/{name}
+*/
+func deleteThresholdRule(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	settingsMu.Lock()
+	var current []*ThresholdRule
+	for _, rule := range params.ThresholdRules {
+		if rule.Name != name {
+			current = append(current, rule)
+		}
+	}
+	found := len(current) != len(params.ThresholdRules)
+	var err error
+	if found {
+		params.ThresholdRules = current
+		err = params.save()
+	}
+	settingsMu.Unlock()
+
+	if !found {
+		ReturnJSONErrorString(w, "Rules", "No rule called "+name, http.StatusNotFound, true)
+		return
+	}
+	thresholdMonitor.reset(name)
+	if err != nil {
+		ReturnJSONError(w, "Rules", err, http.StatusInternalServerError, true)
+		return
+	}
+	log.Printf("Threshold rule %s removed", name)
+	returnJSONSuccess(w)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExceeded(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     string
+		threshold float64
+		value     float64
+		deadband  float64
+		active    bool
+		want      bool
+	}{
+		{"high below", LimitHigh, 10, 9, 1, false, false},
+		{"high at the limit", LimitHigh, 10, 10, 1, false, false},
+		{"high above", LimitHigh, 10, 10.5, 1, false, true},
+		{"high active inside the deadband", LimitHigh, 10, 9.5, 1, true, true},
+		{"high active below the deadband", LimitHigh, 10, 8.5, 1, true, false},
+		{"high high above", LimitHighHigh, 20, 21, 0, false, true},
+		{"rate of change above", LimitRateOfChange, 5, 6, 0, false, true},
+		{"low above", LimitLow, 2, 3, 0.5, false, false},
+		{"low below", LimitLow, 2, 1.5, 0.5, false, true},
+		{"low active inside the deadband", LimitLow, 2, 2.2, 0.5, true, true},
+		{"low active above the deadband", LimitLow, 2, 2.6, 0.5, true, false},
+		{"low low below", LimitLowLow, 1, 0.5, 0, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := exceeded(test.limit, test.threshold, test.value, test.deadband, test.active); got != test.want {
+				t.Errorf("exceeded = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestThresholdCheck(t *testing.T) {
+	limit := func(v float64) *float64 { return &v }
+	type step struct {
+		after float64 // Seconds since the first value
+		value float64
+		raise []string
+		clear []string
+	}
+	tests := []struct {
+		name  string
+		rule  ThresholdRule
+		steps []step
+	}{
+		{"raise and clear", ThresholdRule{High: limit(10)}, []step{
+			{0, 5, nil, nil},
+			{1, 11, []string{LimitHigh}, nil},
+			{2, 12, nil, nil},
+			{3, 9, nil, []string{LimitHigh}},
+		}},
+		{"deadband holds the alarm", ThresholdRule{High: limit(10), Deadband: 2}, []step{
+			{0, 11, []string{LimitHigh}, nil},
+			{1, 9, nil, nil},
+			{2, 7.5, nil, []string{LimitHigh}},
+		}},
+		{"delay on", ThresholdRule{High: limit(10), DelayOn: 5}, []step{
+			{0, 11, nil, nil},
+			{3, 11, nil, nil},
+			{5, 11, []string{LimitHigh}, nil},
+		}},
+		{"delay on cancelled", ThresholdRule{High: limit(10), DelayOn: 5}, []step{
+			{0, 11, nil, nil},
+			{3, 9, nil, nil},
+			{4, 11, nil, nil},
+			{8, 11, nil, nil},
+			{9, 11, []string{LimitHigh}, nil},
+		}},
+		{"delay off", ThresholdRule{Low: limit(2), DelayOff: 10}, []step{
+			{0, 1, []string{LimitLow}, nil},
+			{1, 3, nil, nil},
+			{5, 3, nil, nil},
+			{11, 3, nil, []string{LimitLow}},
+		}},
+		{"high and high high", ThresholdRule{High: limit(10), HighHigh: limit(20)}, []step{
+			{0, 25, []string{LimitHigh, LimitHighHigh}, nil},
+			{1, 15, nil, []string{LimitHighHigh}},
+		}},
+		{"rate of change needs history", ThresholdRule{RateOfChange: limit(5)}, []step{
+			{0, 0, nil, nil},
+			{10, 100, nil, nil},
+			{30, 100, []string{LimitRateOfChange}, nil},
+		}},
+	}
+	start := time.Now()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tm := &ThresholdMonitor{states: make(map[string]*ruleState)}
+			rule := test.rule
+			rule.Name = "test " + test.name
+			rule.Point = "gas.tankPressure"
+			for _, s := range test.steps {
+				raise, clear := tm.check(&rule, s.value, start.Add(time.Duration(s.after*float64(time.Second))))
+				var raised []string
+				for _, spec := range raise {
+					raised = append(raised, spec.Code)
+				}
+				var cleared []string
+				for _, key := range clear {
+					cleared = append(cleared, key[len(ruleAlarmKey(rule.Name, "")):])
+				}
+				if !sameLimits(raised, s.raise) || !sameLimits(cleared, s.clear) {
+					t.Errorf("at %gs value %g raised %v cleared %v, want raised %v cleared %v", s.after, s.value, raised, cleared, s.raise, s.clear)
+				}
+			}
+		})
+	}
+}
+
+/*
+sameLimits compares two lists of limits ignoring their order, as check works through the limits in map order
+*/
+func sameLimits(got []string, want []string) bool {
+	count := func(limits []string) map[string]int {
+		m := make(map[string]int)
+		for _, l := range limits {
+			m[l]++
+		}
+		return m
+	}
+	return reflect.DeepEqual(count(got), count(want))
+}
+
+func TestThresholdRuleValidate(t *testing.T) {
+	limit := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name  string
+		rule  ThresholdRule
+		valid bool
+	}{
+		{"valid", ThresholdRule{Name: "r", Point: "el0.stackVoltage", High: limit(50)}, true},
+		{"ac point", ThresholdRule{Name: "r", Point: "ac.power", High: limit(5000)}, true},
+		{"unknown point", ThresholdRule{Name: "r", Point: "el0.nothing", High: limit(50)}, false},
+		{"unknown device", ThresholdRule{Name: "r", Point: "xx0.stackVoltage", High: limit(50)}, false},
+		{"missing device number", ThresholdRule{Name: "r", Point: "el.stackVoltage", High: limit(50)}, false},
+		{"numbered meter", ThresholdRule{Name: "r", Point: "ac1.power", High: limit(5000)}, false},
+		{"no limits", ThresholdRule{Name: "r", Point: "gas.tankPressure"}, false},
+		{"high below low", ThresholdRule{Name: "r", Point: "gas.tankPressure", High: limit(1), Low: limit(2)}, false},
+		{"high high below high", ThresholdRule{Name: "r", Point: "gas.tankPressure", High: limit(10), HighHigh: limit(5)}, false},
+		{"negative delay", ThresholdRule{Name: "r", Point: "gas.tankPressure", High: limit(10), DelayOn: -1}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.rule.validate(); (err == nil) != test.valid {
+				t.Errorf("validate() = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
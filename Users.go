@@ -0,0 +1,504 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+/***************
+User accounts and API tokens. They are kept in their own file, readable only by the service, rather than the settings
+so a copy of the settings never carries them. Passwords are stored as salted PBKDF2-SHA256 hashes and tokens as a
+SHA-256 hash, so the token itself is only ever shown once when it is created.
+If there are no users when the service starts an admin user is created with a random password which is written to the
+log. Log in with it and change it.
+*/
+
+const (
+	PASSWORDHASHSCHEME     = "pbkdf2-sha256"
+	PASSWORDHASHITERATIONS = 60000
+	PASSWORDSALTLENGTH     = 16
+	PASSWORDKEYLENGTH      = 32
+	APITOKENPREFIX         = "fft_"
+	APITOKENLENGTH         = 24
+)
+
+var userNameRegex = regexp.MustCompile(`^[A-Za-z0-9._-]{1,32}$`)
+
+type User struct {
+	Name     string    `json:"name"`
+	Role     Role      `json:"role"`
+	Password string    `json:"password"` // PBKDF2 hash
+	Disabled bool      `json:"disabled"`
+	Created  time.Time `json:"created"`
+}
+
+type APIToken struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Role      Role       `json:"role"`
+	Hash      string     `json:"hash"` // SHA-256 of the token
+	CreatedBy string     `json:"createdBy"`
+	Created   time.Time  `json:"created"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+/*
+UserInfo is a user without the password hash
+*/
+type UserInfo struct {
+	Name     string    `json:"name"`
+	Role     Role      `json:"role"`
+	Disabled bool      `json:"disabled"`
+	Created  time.Time `json:"created"`
+}
+
+/*
+APITokenInfo is a token without its hash. Token is only filled in when the token is created.
+*/
+type APITokenInfo struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Role      Role       `json:"role"`
+	CreatedBy string     `json:"createdBy"`
+	Created   time.Time  `json:"created"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Token     string     `json:"token,omitempty"`
+}
+
+type UserStore struct {
+	Users    []*User     `json:"users"`
+	Tokens   []*APIToken `json:"tokens"`
+	filepath string
+	mu       sync.Mutex
+}
+
+var userStore = new(UserStore)
+
+// dummyPasswordHash is checked when there is no such user so the answer takes the same time either way
+var dummyPasswordHash = hashPassword(randomHex(PASSWORDSALTLENGTH))
+
+/*
+pbkdf2SHA256 derives a key from the password as described in RFC 8018
+*/
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLength int) []byte {
+	return pbkdf2.Key(password, salt, iterations, keyLength, sha256.New)
+}
+
+/*
+hashPassword returns the password hash as scheme$iterations$salt$key
+*/
+func hashPassword(password string) string {
+	salt, _ := hex.DecodeString(randomHex(PASSWORDSALTLENGTH))
+	key := pbkdf2SHA256([]byte(password), salt, PASSWORDHASHITERATIONS, PASSWORDKEYLENGTH)
+	return strings.Join([]string{PASSWORDHASHSCHEME, strconv.Itoa(PASSWORDHASHITERATIONS),
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)}, "$")
+}
+
+func checkPasswordHash(hash string, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != PASSWORDHASHSCHEME {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(password), salt, iterations, len(key)), key) == 1
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validatePassword(password string) error {
+	if len(password) < AUTHMINPASSWORD {
+		return fmt.Errorf("passwords must be at least %d characters", AUTHMINPASSWORD)
+	}
+	return nil
+}
+
+/*
+ReadUsers loads the users and tokens, creating an admin user if there are none. The new admin password is written to
+a file beside the users file that only the service user can read.
+*/
+func (s *UserStore) ReadUsers(filepath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filepath = filepath
+	file, err := ioutil.ReadFile(filepath)
+	if err == nil {
+		err = json.Unmarshal(file, s)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(s.Users) == 0 {
+		password := randomHex(8)
+		s.Users = append(s.Users, &User{Name: AUTHDEFAULTADMIN, Role: RoleAdmin, Password: hashPassword(password), Created: time.Now()})
+		if err := s.write(); err != nil {
+			return err
+		}
+		// The password never goes to the log, only to a file that just the service user can read
+		passwordFile := s.filepath + ".admin"
+		if err := os.Remove(passwordFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := ioutil.WriteFile(passwordFile, []byte(password+"\n"), 0600); err != nil {
+			return err
+		}
+		log.Printf("No users found - created user %s. The password is in %s, log in, change it and delete the file.", AUTHDEFAULTADMIN, passwordFile)
+	}
+	return nil
+}
+
+/*
+write saves the users and tokens. The file is replaced in one step so a crash never leaves it half written.
+The caller must hold the lock.
+*/
+func (s *UserStore) write() error {
+	if s.filepath == "" {
+		return nil
+	}
+	bData, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.filepath+".tmp", bData, 0600); err != nil {
+		return err
+	}
+	return os.Rename(s.filepath+".tmp", s.filepath)
+}
+
+func (s *UserStore) findLocked(name string) *User {
+	for _, user := range s.Users {
+		if strings.EqualFold(user.Name, name) {
+			return user
+		}
+	}
+	return nil
+}
+
+/*
+adminsLocked counts the admins that can still log in
+*/
+func (s *UserStore) adminsLocked() int {
+	admins := 0
+	for _, user := range s.Users {
+		if user.Role == RoleAdmin && !user.Disabled {
+			admins++
+		}
+	}
+	return admins
+}
+
+/*
+user returns the user if they exist and are not disabled
+*/
+func (s *UserStore) user(name string) *AuthUser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user := s.findLocked(name); user != nil && !user.Disabled {
+		return &AuthUser{Name: user.Name, Role: user.Role}
+	}
+	return nil
+}
+
+/*
+checkPassword returns the user if the password is right
+*/
+func (s *UserStore) checkPassword(name string, password string) *AuthUser {
+	s.mu.Lock()
+	user := s.findLocked(name)
+	hash := ""
+	if user != nil && !user.Disabled {
+		hash = user.Password
+	}
+	s.mu.Unlock()
+	if hash == "" {
+		// Check against a dummy hash so an unknown user takes as long to refuse as a wrong password
+		checkPasswordHash(dummyPasswordHash, password)
+		return nil
+	}
+	if !checkPasswordHash(hash, password) {
+		return nil
+	}
+	return &AuthUser{Name: user.Name, Role: user.Role}
+}
+
+/*
+tokenUser returns the token's identity if the token is valid
+*/
+func (s *UserStore) tokenUser(token string) *AuthUser {
+	if !strings.HasPrefix(token, APITOKENPREFIX) {
+		return nil
+	}
+	hash := hashToken(token)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			if t.Expires != nil && now.After(*t.Expires) {
+				return nil
+			}
+			return &AuthUser{Name: t.CreatedBy, Role: t.Role, Token: t.Name}
+		}
+	}
+	return nil
+}
+
+func (u *User) info() *UserInfo {
+	return &UserInfo{Name: u.Name, Role: u.Role, Disabled: u.Disabled, Created: u.Created}
+}
+
+func (t *APIToken) info() *APITokenInfo {
+	return &APITokenInfo{ID: t.ID, Name: t.Name, Role: t.Role, CreatedBy: t.CreatedBy, Created: t.Created, Expires: t.Expires}
+}
+
+// Request bodies for the user API
+
+type APIUserRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Role     Role   `json:"role"`
+}
+
+type APIUserUpdate struct {
+	Password string `json:"password,omitempty"`
+	Role     *Role  `json:"role,omitempty"`
+	Disabled *bool  `json:"disabled,omitempty"`
+}
+
+type APIPasswordChange struct {
+	Current string `json:"current"`
+	New     string `json:"new"`
+}
+
+type APITokenRequest struct {
+	Name    string     `json:"name"`
+	Role    Role       `json:"role"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func apiGetMe(r *http.Request) (interface{}, *CommandError) {
+	return requestUser(r), nil
+}
+
+func apiChangeMyPassword(r *http.Request) (interface{}, *CommandError) {
+	user := requestUser(r)
+	if user == nil || user.Token != "" {
+		return nil, commandRefused(http.StatusForbidden, "Log in with a password to change it")
+	}
+	var request APIPasswordChange
+	if err := decodeAPIBody(r, &request); err != nil {
+		return nil, err
+	}
+	if userStore.checkPassword(user.Name, request.Current) == nil {
+		time.Sleep(AUTHFAILUREDELAY)
+		return nil, commandRefused(http.StatusForbidden, "The current password is wrong")
+	}
+	if err := validatePassword(request.New); err != nil {
+		return nil, commandRefused(http.StatusBadRequest, err.Error())
+	}
+	userStore.mu.Lock()
+	defer userStore.mu.Unlock()
+	u := userStore.findLocked(user.Name)
+	if u == nil {
+		return nil, commandRefused(http.StatusNotFound, "User "+user.Name+" no longer exists")
+	}
+	u.Password = hashPassword(request.New)
+	if err := userStore.write(); err != nil {
+		return nil, commandFailed(err)
+	}
+	log.Printf("%s changed their password", user.Name)
+	return nil, nil
+}
+
+func apiGetUsers(_ *http.Request) (interface{}, *CommandError) {
+	userStore.mu.Lock()
+	defer userStore.mu.Unlock()
+	users := []*UserInfo{}
+	for _, user := range userStore.Users {
+		users = append(users, user.info())
+	}
+	return users, nil
+}
+
+func apiAddUser(r *http.Request) (interface{}, *CommandError) {
+	var request APIUserRequest
+	if err := decodeAPIBody(r, &request); err != nil {
+		return nil, err
+	}
+	if !userNameRegex.MatchString(request.Name) {
+		return nil, commandRefused(http.StatusBadRequest, "User names are 1 to 32 letters, digits, '.', '_' or '-'")
+	}
+	if request.Role == RolePublic {
+		return nil, commandRefused(http.StatusBadRequest, "A role is required")
+	}
+	if err := validatePassword(request.Password); err != nil {
+		return nil, commandRefused(http.StatusBadRequest, err.Error())
+	}
+	userStore.mu.Lock()
+	defer userStore.mu.Unlock()
+	if userStore.findLocked(request.Name) != nil {
+		return nil, commandRefused(http.StatusConflict, "User "+request.Name+" already exists")
+	}
+	user := &User{Name: request.Name, Role: request.Role, Password: hashPassword(request.Password), Created: time.Now()}
+	userStore.Users = append(userStore.Users, user)
+	if err := userStore.write(); err != nil {
+		return nil, commandFailed(err)
+	}
+	log.Printf("User %s added as %s by %s", user.Name, user.Role, requestSource(r))
+	return user.info(), nil
+}
+
+func apiUpdateUser(r *http.Request) (interface{}, *CommandError) {
+	name := mux.Vars(r)["name"]
+	var request APIUserUpdate
+	if err := decodeAPIBody(r, &request); err != nil {
+		return nil, err
+	}
+	if request.Password != "" {
+		if err := validatePassword(request.Password); err != nil {
+			return nil, commandRefused(http.StatusBadRequest, err.Error())
+		}
+	}
+	userStore.mu.Lock()
+	defer userStore.mu.Unlock()
+	user := userStore.findLocked(name)
+	if user == nil {
+		return nil, commandRefused(http.StatusNotFound, "User "+name+" does not exist")
+	}
+	updated := *user
+	if request.Role != nil {
+		updated.Role = *request.Role
+	}
+	if request.Disabled != nil {
+		updated.Disabled = *request.Disabled
+	}
+	if request.Password != "" {
+		updated.Password = hashPassword(request.Password)
+	}
+	if user.Role == RoleAdmin && !user.Disabled && (updated.Role != RoleAdmin || updated.Disabled) && userStore.adminsLocked() == 1 {
+		return nil, commandRefused(http.StatusConflict, "The last admin cannot be demoted or disabled")
+	}
+	*user = updated
+	if err := userStore.write(); err != nil {
+		return nil, commandFailed(err)
+	}
+	if request.Password != "" || user.Disabled {
+		authenticator.endUserSessions(user.Name)
+	}
+	log.Printf("User %s updated by %s", user.Name, requestSource(r))
+	return user.info(), nil
+}
+
+func apiDeleteUser(r *http.Request) (interface{}, *CommandError) {
+	name := mux.Vars(r)["name"]
+	userStore.mu.Lock()
+	defer userStore.mu.Unlock()
+	for idx, user := range userStore.Users {
+		if strings.EqualFold(user.Name, name) {
+			if user.Role == RoleAdmin && !user.Disabled && userStore.adminsLocked() == 1 {
+				return nil, commandRefused(http.StatusConflict, "The last admin cannot be removed")
+			}
+			userStore.Users = append(userStore.Users[:idx], userStore.Users[idx+1:]...)
+			if err := userStore.write(); err != nil {
+				return nil, commandFailed(err)
+			}
+			authenticator.endUserSessions(user.Name)
+			log.Printf("User %s removed by %s", user.Name, requestSource(r))
+			return nil, nil
+		}
+	}
+	return nil, commandRefused(http.StatusNotFound, "User "+name+" does not exist")
+}
+
+func apiGetTokens(_ *http.Request) (interface{}, *CommandError) {
+	userStore.mu.Lock()
+	defer userStore.mu.Unlock()
+	tokens := []*APITokenInfo{}
+	for _, token := range userStore.Tokens {
+		tokens = append(tokens, token.info())
+	}
+	return tokens, nil
+}
+
+func apiAddToken(r *http.Request) (interface{}, *CommandError) {
+	var request APITokenRequest
+	if err := decodeAPIBody(r, &request); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(request.Name) == "" {
+		return nil, commandRefused(http.StatusBadRequest, "A name is required so the token can be recognised later")
+	}
+	if request.Role == RolePublic {
+		return nil, commandRefused(http.StatusBadRequest, "A role is required")
+	}
+	if request.Expires != nil && !request.Expires.After(time.Now()) {
+		return nil, commandRefused(http.StatusBadRequest, "The token would already have expired")
+	}
+	creator := "anonymous"
+	if user := requestUser(r); user != nil {
+		creator = user.Name
+	}
+	secret := APITOKENPREFIX + randomHex(APITOKENLENGTH)
+	token := &APIToken{ID: randomHex(4), Name: request.Name, Role: request.Role, Hash: hashToken(secret),
+		CreatedBy: creator, Created: time.Now(), Expires: request.Expires}
+
+	userStore.mu.Lock()
+	defer userStore.mu.Unlock()
+	userStore.Tokens = append(userStore.Tokens, token)
+	if err := userStore.write(); err != nil {
+		return nil, commandFailed(err)
+	}
+	log.Printf("API token %s (%s) created as %s by %s", token.ID, token.Name, token.Role, requestSource(r))
+	info := token.info()
+	info.Token = secret
+	return info, nil
+}
+
+func apiDeleteToken(r *http.Request) (interface{}, *CommandError) {
+	id := mux.Vars(r)["id"]
+	userStore.mu.Lock()
+	defer userStore.mu.Unlock()
+	for idx, token := range userStore.Tokens {
+		if token.ID == id {
+			userStore.Tokens = append(userStore.Tokens[:idx], userStore.Tokens[idx+1:]...)
+			if err := userStore.write(); err != nil {
+				return nil, commandFailed(err)
+			}
+			log.Printf("API token %s (%s) revoked by %s", token.ID, token.Name, requestSource(r))
+			return nil, nil
+		}
+	}
+	return nil, &CommandError{Status: http.StatusNotFound, Err: errors.New("Token " + id + " does not exist"), Quiet: true}
+}
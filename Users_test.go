@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+/*
+The inputs are the RFC 6070 test vectors. RFC 6070 gives the results for HMAC-SHA1 so the expected keys here are the
+published HMAC-SHA256 results for the same inputs.
+*/
+func TestPBKDF2SHA256(t *testing.T) {
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		key        string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096,
+			"348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+		{"pass\x00word", "sa\x00lt", 4096, "89b69d0516f829893c696226650a8687"},
+	}
+	for _, test := range tests {
+		want, err := hex.DecodeString(test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := pbkdf2SHA256([]byte(test.password), []byte(test.salt), test.iterations, len(want))
+		if hex.EncodeToString(got) != test.key {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %x, want %s", test.password, test.salt, test.iterations, got, test.key)
+		}
+	}
+}
+
+func TestCheckPasswordHash(t *testing.T) {
+	hash := hashPassword("correct horse")
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+	}{
+		{"right password", hash, "correct horse", true},
+		{"wrong password", hash, "correct horse battery", false},
+		{"empty password", hash, "", false},
+		{"not a hash", "plain text", "plain text", false},
+		{"unknown scheme", "md5$1$c2FsdA$a2V5", "password", false},
+		{"bad iterations", PASSWORDHASHSCHEME + "$0$c2FsdA$a2V5", "password", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := checkPasswordHash(test.hash, test.password); got != test.want {
+				t.Errorf("checkPasswordHash = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/***************
+The communications watchdog tracks how fresh the data from each source is: the Modbus RTU I/O board, the AC and heat
+pump power meters, each electrolyser and each fuel cell. A source that should be sending data but has not for longer
+than the stale data timeout is marked stale. Its values are flagged invalid in the status JSON, written as NULL to the
+database and left out of the telemetry, a communications alarm is raised and the automatic controllers leave the
+device alone until fresh data arrives. Devices that are switched off are not expected to send anything.
+*/
+
+const STALEDATATIMEOUT = time.Second * 15 // Default time without new readings before a source is stale
+
+const (
+	DataSourceIO = "io"
+	DataSourceAC = "ac"
+	DataSourceHP = "hp"
+)
+
+func elDataSource(device int) string {
+	return "el" + strconv.Itoa(device)
+}
+
+func fcDataSource(device uint8) string {
+	return "fc" + strconv.Itoa(int(device))
+}
+
+type DataSourceStatus struct {
+	Name          string     `json:"name"`
+	Description   string     `json:"description"`
+	Expected      bool       `json:"expected"` // False while the device is switched off
+	LastUpdate    *time.Time `json:"lastUpdate,omitempty"`
+	Age           float64    `json:"age"` // Seconds since the last update
+	Stale         bool       `json:"stale"`
+	StaleSince    *time.Time `json:"staleSince,omitempty"`
+	expectedSince time.Time
+}
+
+type CommsWatchdog struct {
+	sources map[string]*DataSourceStatus
+	mu      sync.Mutex
+}
+
+var commsWatchdog = &CommsWatchdog{sources: make(map[string]*DataSourceStatus)}
+
+/*
+getLastUpdate returns the time the electrolyser values were last read successfully
+*/
+func (e *Electrolyser) getLastUpdate() time.Time {
+	e.status.mu.Lock()
+	defer e.status.mu.Unlock()
+	return e.status.lastUpdate
+}
+
+type dataSourceReading struct {
+	name        string
+	description string
+	expected    bool
+	lastUpdate  time.Time
+}
+
+/*
+readings gathers the last update time of every data source and whether we expect it to be sending
+*/
+func readings() []dataSourceReading {
+	var r []dataSourceReading
+	if mbusRTU != nil {
+		mbusRTU.muBuffer.Lock()
+		io, ac, hp := mbusRTU.lastIOUpdate, mbusRTU.lastACUpdate, mbusRTU.lastHPUpdate
+		mbusRTU.muBuffer.Unlock()
+		r = append(r, dataSourceReading{DataSourceIO, "Modbus RTU I/O board", true, io})
+		// The power meters are optional so they are only watched once they have been heard from
+		r = append(r, dataSourceReading{DataSourceAC, "AC power meter", !ac.IsZero(), ac})
+		r = append(r, dataSourceReading{DataSourceHP, "Heat pump power meter", !hp.IsZero(), hp})
+	}
+
+	SystemStatus.m.Lock()
+	for device, el := range SystemStatus.Electrolysers {
+		on := (device == 0 && SystemStatus.Relays.EL0) || (device == 1 && SystemStatus.Relays.EL1)
+		r = append(r, dataSourceReading{elDataSource(device), fmt.Sprintf("Electrolyser %d", device), on, el.getLastUpdate()})
+	}
+	fc0, fc1 := SystemStatus.Relays.FC0Enable, SystemStatus.Relays.FC1Enable
+	SystemStatus.m.Unlock()
+
+	for device, fc := range canBus.fuelCell {
+		on := (device == 0 && fc0) || (device == 1 && fc1)
+		r = append(r, dataSourceReading{fcDataSource(device), fmt.Sprintf("Fuel cell %d", device), on, fc.getLastUpdate()})
+	}
+	return r
+}
+
+/*
+staleDataTimeout returns how long a data source can go without a reading before its data is treated as stale
+*/
+func staleDataTimeout() time.Duration {
+	settingsMu.RLock()
+	timeout := params.StaleDataTimeout
+	settingsMu.RUnlock()
+	if timeout <= 0 {
+		timeout = STALEDATATIMEOUT
+	}
+	return timeout
+}
+
+/*
+Check updates the freshness of every data source and raises or clears the communications alarms. Called once per
+logging cycle straight after the values are read.
+*/
+func (cw *CommsWatchdog) Check() {
+	now := time.Now()
+	timeout := staleDataTimeout()
+	var raise []AlarmSpec
+	var clear []string
+
+	// Read before taking our lock, the status functions call isStale while holding the SystemStatus lock
+	current := readings()
+	cw.mu.Lock()
+	for _, reading := range current {
+		source, found := cw.sources[reading.name]
+		if !found {
+			source = &DataSourceStatus{Name: reading.name, expectedSince: now}
+			cw.sources[reading.name] = source
+		}
+		source.Description = reading.description
+		if reading.expected && !source.Expected {
+			// Give a device that has just been switched on time to start sending
+			source.expectedSince = now
+		}
+		source.Expected = reading.expected
+		source.LastUpdate = nil
+		source.Age = 0
+		since := source.expectedSince
+		if !reading.lastUpdate.IsZero() {
+			t := reading.lastUpdate
+			source.LastUpdate = &t
+			source.Age = now.Sub(t).Seconds()
+			if t.After(since) {
+				since = t
+			}
+		}
+		stale := reading.expected && now.Sub(since) > timeout
+		if stale && !source.Stale {
+			source.StaleSince = &now
+			log.Printf("No data from the %s for %s - marking it stale", reading.description, now.Sub(since).Round(time.Second))
+			raise = append(raise, AlarmSpec{Key: "comms." + reading.name, Source: AlarmSourceComms, Device: reading.name,
+				Code: "stale", Severity: SeverityHigh, Message: "No data from the " + reading.description})
+		} else if !stale && source.Stale {
+			source.StaleSince = nil
+			log.Printf("The %s is %s", reading.description, map[bool]string{true: "sending data again", false: "switched off"}[reading.expected])
+			clear = append(clear, "comms."+reading.name)
+		}
+		source.Stale = stale
+	}
+	cw.mu.Unlock()
+
+	for _, spec := range raise {
+		alarmManager.Raise(spec)
+	}
+	for _, key := range clear {
+		alarmManager.Clear(key)
+	}
+}
+
+/*
+isStale says whether the data from a source should not be trusted
+*/
+func (cw *CommsWatchdog) isStale(name string) bool {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	source, found := cw.sources[name]
+	return found && source.Stale
+}
+
+/*
+staleSources returns the names of the sources that are currently stale
+*/
+func (cw *CommsWatchdog) staleSources() []string {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	stale := []string{}
+	for name, source := range cw.sources {
+		if source.Stale {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+/*
+nullIfStale returns the values to be logged for a source, or NULLs if the source is stale
+*/
+func nullIfStale(source string, values ...interface{}) []interface{} {
+	if commsWatchdog.isStale(source) {
+		return make([]interface{}, len(values))
+	}
+	return values
+}
+
+/*
+getDataSources returns the freshness of every data source
+URL = /api/comms
+*/
+func getDataSources(w http.ResponseWriter, _ *http.Request) {
+	commsWatchdog.mu.Lock()
+	sources := make([]DataSourceStatus, 0, len(commsWatchdog.sources))
+	for _, source := range commsWatchdog.sources {
+		sources = append(sources, *source)
+	}
+	commsWatchdog.mu.Unlock()
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Name < sources[j].Name
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(sources); err != nil {
+		ReturnJSONError(w, "Comms", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
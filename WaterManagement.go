@@ -0,0 +1,460 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/***************
+Manages the electrolyte and water supply for the electrolysers.
+Refills are requested when the electrolyte level drops to Low, production is blocked while the water conductivity
+is above the configured limit and blowdowns are run on a schedule. Every action is counted and recorded in the
+WaterEvents table so trends can warn of leaks or a failing water purifier.
+*/
+
+const WATERREFILLHOLDOFF = time.Minute * 10 // Minimum time between automatic refill requests to the same electrolyser
+const WATERCONDUCTIVITYHYSTERESIS = 0.9     // Conductivity must fall below this fraction of the limit before production is unblocked
+const BLOWDOWNMAXOUTERPRESSURE = 25         // The electrolyser will not run a blowdown above this outer pressure (bar)
+const WATEREVENTBUFFER = 64                 // Events waiting to be written before new ones are only logged
+const WATEREVENTSTABLE = `CREATE TABLE IF NOT EXISTS WaterEvents (
+	id INT AUTO_INCREMENT PRIMARY KEY,
+	logged DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	Device TINYINT NULL,
+	Action VARCHAR(32) NOT NULL,
+	Detail VARCHAR(255) NULL,
+	INDEX (logged))`
+
+const (
+	WaterActionRefill            = "refill"
+	WaterActionBlowdown          = "blowdown"
+	WaterActionConductivityBlock = "conductivityBlock"
+	WaterActionConductivityClear = "conductivityClear"
+)
+
+type WaterManager struct {
+	productionBlocked bool
+	blockedSince      time.Time
+	lastRefill        map[int]time.Time
+	lastBlowdown      map[int]time.Time
+	counts            map[string]uint32 // Number of times each action has been taken since the service started
+	events            chan *waterEvent  // Written to the WaterEvents table by Run
+	mu                sync.Mutex
+}
+
+type waterEvent struct {
+	device int
+	action string
+	detail string
+}
+
+var waterManager *WaterManager
+
+func init() {
+	databaseTables = append(databaseTables, WATEREVENTSTABLE)
+}
+
+func NewWaterManager() *WaterManager {
+	wm := new(WaterManager)
+	wm.lastRefill = make(map[int]time.Time)
+	wm.lastBlowdown = make(map[int]time.Time)
+	wm.counts = make(map[string]uint32)
+	wm.events = make(chan *waterEvent, WATEREVENTBUFFER)
+	// Start the blowdown clock from now so we don't blow down every electrolyser as soon as we start
+	now := time.Now()
+	for device := range params.Electrolysers {
+		wm.lastBlowdown[device] = now
+	}
+	return wm
+}
+
+/*
+loadLastBlowdowns picks up the time of the last scheduled blowdown for each electrolyser so a restart does not
+put the next one off
+*/
+func (wm *WaterManager) loadLastBlowdowns() {
+	if pDB == nil {
+		return
+	}
+	rows, err := pDB.Query(`SELECT Device, UNIX_TIMESTAMP(MAX(logged)) FROM WaterEvents WHERE Action = ? AND Device IS NOT NULL GROUP BY Device`, WaterActionBlowdown)
+	if err != nil {
+		log.Println("Error reading the last blowdown times - ", err)
+		return
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Println("Error closing query - ", err)
+		}
+	}()
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	for rows.Next() {
+		var device int
+		var logged int64
+		if err := rows.Scan(&device, &logged); err != nil {
+			log.Print(err)
+			continue
+		}
+		wm.lastBlowdown[device] = time.Unix(logged, 0)
+	}
+}
+
+/*
+ProductionBlocked returns true if hydrogen production is currently blocked because of poor water quality
+*/
+func (wm *WaterManager) ProductionBlocked() bool {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	return wm.productionBlocked
+}
+
+/*
+recordEvent counts the action and queues it for the WaterEvents table. It never blocks the logging loop; if the
+writer has fallen behind the event is only logged.
+*/
+func (wm *WaterManager) recordEvent(device int, action string, detail string) {
+	wm.mu.Lock()
+	wm.counts[action]++
+	wm.mu.Unlock()
+
+	log.Printf("Water management : %s electrolyser %d - %s", action, device, detail)
+	select {
+	case wm.events <- &waterEvent{device: device, action: action, detail: detail}:
+	default:
+		log.Printf("Water event buffer full - %s electrolyser %d not recorded", action, device)
+	}
+}
+
+/*
+Run writes the water events to the database until the service stops
+*/
+func (wm *WaterManager) Run() {
+	for {
+		select {
+		case <-serviceContext.Done():
+			// Write whatever is still waiting
+			for {
+				select {
+				case event := <-wm.events:
+					event.save()
+				default:
+					return
+				}
+			}
+		case event := <-wm.events:
+			event.save()
+		}
+	}
+}
+
+func (e *waterEvent) save() {
+	if pDB == nil {
+		return
+	}
+	var dev interface{}
+	if e.device >= 0 {
+		dev = e.device
+	}
+	if _, err := pDB.Exec("INSERT INTO WaterEvents (Device, Action, Detail) VALUES (?, ?, ?)", dev, e.action, e.detail); err != nil {
+		log.Println("Error recording water event - ", err)
+	}
+}
+
+/*
+Check runs once per logging cycle and takes any water management actions required
+*/
+func (wm *WaterManager) Check() {
+	type elState struct {
+		device        int
+		el            *Electrolyser
+		level         electrolyteLevel
+		levelRead     bool
+		outerPressure jsonFloat32
+		elState       uint16
+	}
+	var electrolysers []elState
+
+	SystemStatus.m.Lock()
+	conductivity := SystemStatus.TDS.TdsReading
+	for device, el := range SystemStatus.Electrolysers {
+		if el.IsSwitchedOn() && !commsWatchdog.isStale(elDataSource(device)) {
+			electrolysers = append(electrolysers, elState{device: device, el: el, level: el.status.ElectrolyteLevel, levelRead: el.status.levelRead,
+				outerPressure: el.status.OuterH2Pressure, elState: el.status.ElState})
+		}
+	}
+	SystemStatus.m.Unlock()
+
+	if !commsWatchdog.isStale(DataSourceIO) {
+		wm.checkConductivity(conductivity)
+	}
+
+	now := time.Now()
+	for _, e := range electrolysers {
+		if checkElectrolyserLockout(e.device) != nil {
+			continue
+		}
+		// Refill when the electrolyte drops to low. Until the level has been read it shows as empty so leave it alone.
+		if params.WaterAutoRefill && e.levelRead && e.level <= low {
+			wm.mu.Lock()
+			due := now.Sub(wm.lastRefill[e.device]) > params.WaterRefillHoldOff
+			if due {
+				wm.lastRefill[e.device] = now
+			}
+			wm.mu.Unlock()
+			if due {
+				el := e.el
+				dispatcher.Submit(elQueue(e.device), "refill", PriorityAutomatic, "water manager", func() error {
+					el.Refill()
+					return nil
+				})
+				wm.recordEvent(e.device, WaterActionRefill, fmt.Sprintf("Electrolyte level %s", e.level))
+			}
+		}
+		// Scheduled blowdown
+		if params.BlowdownInterval > 0 && e.elState != ElSteady && e.outerPressure < BLOWDOWNMAXOUTERPRESSURE {
+			wm.mu.Lock()
+			last, found := wm.lastBlowdown[e.device]
+			if !found {
+				last = now
+				wm.lastBlowdown[e.device] = now
+			}
+			due := now.Sub(last) > params.BlowdownInterval
+			if due {
+				wm.lastBlowdown[e.device] = now
+			}
+			wm.mu.Unlock()
+			if due {
+				el := e.el
+				dispatcher.Submit(elQueue(e.device), "blowdown", PriorityAutomatic, "water manager", func() error {
+					el.Blowdown()
+					return nil
+				})
+				wm.recordEvent(e.device, WaterActionBlowdown, "Scheduled blowdown")
+			}
+		}
+	}
+}
+
+/*
+checkConductivity blocks production when the water conductivity rises above the configured limit and unblocks it
+when it has fallen back below the limit
+*/
+func (wm *WaterManager) checkConductivity(conductivity float32) {
+	if params.WaterConductivityLimit <= 0 {
+		// Limit is disabled so make sure we are not holding the electrolysers off
+		wm.mu.Lock()
+		wasBlocked := wm.productionBlocked
+		wm.productionBlocked = false
+		wm.mu.Unlock()
+		if wasBlocked {
+			wm.recordEvent(-1, WaterActionConductivityClear, "Conductivity limit disabled")
+		}
+		return
+	}
+
+	wm.mu.Lock()
+	blocked := wm.productionBlocked
+	wm.mu.Unlock()
+
+	if !blocked && conductivity > params.WaterConductivityLimit {
+		wm.mu.Lock()
+		wm.productionBlocked = true
+		wm.blockedSince = time.Now()
+		wm.mu.Unlock()
+		wm.recordEvent(-1, WaterActionConductivityBlock, fmt.Sprintf("Conductivity %0.1f exceeds limit %0.1f", conductivity, params.WaterConductivityLimit))
+		// Stop production without holding up the logging loop
+		go func() {
+			if err := setProductionRates(0, PriorityAutomatic, "water manager"); err != nil {
+				log.Println(err)
+			}
+		}()
+	} else if blocked && conductivity < params.WaterConductivityLimit*WATERCONDUCTIVITYHYSTERESIS {
+		wm.mu.Lock()
+		wm.productionBlocked = false
+		wm.mu.Unlock()
+		wm.recordEvent(-1, WaterActionConductivityClear, fmt.Sprintf("Conductivity %0.1f is back within limit %0.1f", conductivity, params.WaterConductivityLimit))
+	}
+}
+
+/*
+getWaterStatus returns the current state of the water management system
+*/
+func getWaterStatus(w http.ResponseWriter, _ *http.Request) {
+	var status struct {
+		ProductionBlocked bool              `json:"productionBlocked"`
+		BlockedSince      string            `json:"blockedSince,omitempty"`
+		Conductivity      float32           `json:"conductivity"`
+		ConductivityLimit float32           `json:"conductivityLimit"`
+		AutoRefill        bool              `json:"autoRefill"`
+		BlowdownInterval  string            `json:"blowdownInterval"`
+		LastRefill        map[int]string    `json:"lastRefill"`
+		LastBlowdown      map[int]string    `json:"lastBlowdown"`
+		Counts            map[string]uint32 `json:"counts"`
+	}
+
+	SystemStatus.m.Lock()
+	status.Conductivity = SystemStatus.TDS.TdsReading
+	SystemStatus.m.Unlock()
+
+	status.ConductivityLimit = params.WaterConductivityLimit
+	status.AutoRefill = params.WaterAutoRefill
+	status.BlowdownInterval = params.BlowdownInterval.String()
+	status.LastRefill = make(map[int]string)
+	status.LastBlowdown = make(map[int]string)
+	status.Counts = make(map[string]uint32)
+
+	waterManager.mu.Lock()
+	status.ProductionBlocked = waterManager.productionBlocked
+	if waterManager.productionBlocked {
+		status.BlockedSince = waterManager.blockedSince.Format("2006-01-02 15:04:05")
+	}
+	for device, t := range waterManager.lastRefill {
+		status.LastRefill[device] = t.Format("2006-01-02 15:04:05")
+	}
+	for device, t := range waterManager.lastBlowdown {
+		status.LastBlowdown[device] = t.Format("2006-01-02 15:04:05")
+	}
+	for action, count := range waterManager.counts {
+		status.Counts[action] = count
+	}
+	waterManager.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(status); err != nil {
+		ReturnJSONError(w, "Water", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+getWaterHistory returns the number of times each water management action was taken per day over the last {days} days
+*/
+func getWaterHistory(w http.ResponseWriter, r *http.Request) {
+	type Row struct {
+		Day    string `json:"day"`
+		Device *int   `json:"device"`
+		Action string `json:"action"`
+		Count  int    `json:"count"`
+	}
+	var results []*Row
+
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	days, err := strconv.Atoi(vars["days"])
+	if err != nil || days < 1 || days > 366 {
+		ReturnJSONErrorString(w, "Water", "days must be between 1 and 366", http.StatusBadRequest, true)
+		return
+	}
+	if pDB == nil {
+		ReturnJSONErrorString(w, "Water", "database is not connected", http.StatusServiceUnavailable, true)
+		return
+	}
+	rows, err := pDB.Query(`SELECT DATE_FORMAT(logged, '%Y-%m-%d') AS day, Device, Action, COUNT(*)
+  FROM WaterEvents
+ WHERE logged > DATE_ADD(CURRENT_DATE, INTERVAL ? DAY)
+ GROUP BY day, Device, Action
+ ORDER BY day, Device, Action`, 0-days)
+	if err != nil {
+		ReturnJSONError(w, "Water", err, http.StatusInternalServerError, true)
+		return
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Println("Error closing query - ", err)
+		}
+	}()
+	for rows.Next() {
+		row := new(Row)
+		var device sql.NullInt64
+		if err := rows.Scan(&row.Day, &device, &row.Action, &row.Count); err != nil {
+			log.Print(err)
+		} else {
+			if device.Valid {
+				d := int(device.Int64)
+				row.Device = &d
+			}
+			results = append(results, row)
+		}
+	}
+	if JSON, err := json.Marshal(results); err != nil {
+		ReturnJSONError(w, "Water", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(JSON)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+waterAction handles manual refill and blowdown requests for an electrolyser
+URL = /water/{device}/{action}
+*/
+func waterAction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	device, err := strconv.ParseInt(vars["device"], 10, 8)
+	if err == nil {
+		err = validateDevice(uint8(device))
+	}
+	if err != nil {
+		ReturnJSONErrorString(w, "Water", "Invalid electrolyser - "+vars["device"], http.StatusBadRequest, true)
+		return
+	}
+	if err := checkElectrolyserLockout(int(device)); err != nil {
+		ReturnJSONError(w, "Water", err, http.StatusConflict, true)
+		return
+	}
+	SystemStatus.m.Lock()
+	el := SystemStatus.Electrolysers[device]
+	SystemStatus.m.Unlock()
+	el.status.mu.Lock()
+	outerPressure := el.status.OuterH2Pressure
+	el.status.mu.Unlock()
+	if !el.IsSwitchedOn() {
+		ReturnJSONErrorString(w, "Water", "Electrolyser is not powered on", http.StatusBadRequest, true)
+		return
+	}
+	switch vars["action"] {
+	case "refill":
+		if err := runCommand(elQueue(int(device)), "refill", PriorityManual, requestSource(r), func() error {
+			el.Refill()
+			return nil
+		}); err != nil {
+			ReturnJSONError(w, "Water", err, http.StatusInternalServerError, true)
+			return
+		}
+		waterManager.mu.Lock()
+		waterManager.lastRefill[int(device)] = time.Now()
+		waterManager.mu.Unlock()
+		waterManager.recordEvent(int(device), WaterActionRefill, "Manual refill")
+	case "blowdown":
+		if outerPressure >= BLOWDOWNMAXOUTERPRESSURE {
+			ReturnJSONErrorString(w, "Water", fmt.Sprintf("Outer pressure must be below %d bar to run a blowdown", BLOWDOWNMAXOUTERPRESSURE), http.StatusBadRequest, true)
+			return
+		}
+		if err := runCommand(elQueue(int(device)), "blowdown", PriorityManual, requestSource(r), func() error {
+			el.Blowdown()
+			return nil
+		}); err != nil {
+			ReturnJSONError(w, "Water", err, http.StatusInternalServerError, true)
+			return
+		}
+		waterManager.mu.Lock()
+		waterManager.lastBlowdown[int(device)] = time.Now()
+		waterManager.mu.Unlock()
+		waterManager.recordEvent(int(device), WaterActionBlowdown, "Manual blowdown")
+	default:
+		ReturnJSONErrorString(w, "Water", "Unknown action - "+vars["action"], http.StatusBadRequest, true)
+		return
+	}
+	returnJSONSuccess(w)
+}
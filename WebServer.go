@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/***************
+The web server listeners. The address, TLS and timeouts come from the webServer section of the settings and can be
+changed through /webServer without restarting the service; if the new settings can't be used the old ones are put
+back. With TLS turned on
+  - the certificate and key files are read again whenever they change, or straight away on SIGHUP, so a renewed
+    certificate is picked up without dropping any connections
+  - a self-signed certificate for this host is created on first start if asked for and the files don't exist yet
+  - a second plain HTTP listener can redirect everything to HTTPS
+*/
+
+const (
+	WEBSERVERLISTEN            = ":20080"
+	WEBSERVERCERTFILE          = "/etc/FireFlyWeb.crt"
+	WEBSERVERKEYFILE           = "/etc/FireFlyWeb.key"
+	WEBSERVERREADHEADERTIMEOUT = time.Second * 10
+	WEBSERVERREADTIMEOUT       = time.Minute
+	WEBSERVERWRITETIMEOUT      = time.Minute * 5 // Long enough for the history and CAN exports
+	WEBSERVERIDLETIMEOUT       = time.Minute * 2
+	CERTIFICATECHECKINTERVAL   = time.Minute // How often the certificate files are checked for changes
+	SELFSIGNEDVALIDITY         = time.Hour * 24 * 365 * 10
+)
+
+/*
+WebServerSettings holds the listen address, TLS and timeout options
+*/
+type WebServerSettings struct {
+	Listen            string        `json:"listen"`
+	TLS               bool          `json:"tls"`
+	CertFile          string        `json:"certFile"`
+	KeyFile           string        `json:"keyFile"`
+	SelfSigned        bool          `json:"selfSigned"`     // Create a self-signed certificate if the files don't exist
+	RedirectListen    string        `json:"redirectListen"` // Plain HTTP address that redirects to HTTPS, e.g. ":80". Empty for none
+	ReadHeaderTimeout time.Duration `json:"readHeaderTimeout"`
+	ReadTimeout       time.Duration `json:"readTimeout"`
+	WriteTimeout      time.Duration `json:"writeTimeout"`
+	IdleTimeout       time.Duration `json:"idleTimeout"`
+}
+
+func NewWebServerSettings() *WebServerSettings {
+	s := new(WebServerSettings)
+	s.Listen = WEBSERVERLISTEN
+	s.TLS = false
+	s.CertFile = WEBSERVERCERTFILE
+	s.KeyFile = WEBSERVERKEYFILE
+	s.SelfSigned = false
+	s.RedirectListen = ""
+	s.ReadHeaderTimeout = WEBSERVERREADHEADERTIMEOUT
+	s.ReadTimeout = WEBSERVERREADTIMEOUT
+	s.WriteTimeout = WEBSERVERWRITETIMEOUT
+	s.IdleTimeout = WEBSERVERIDLETIMEOUT
+	return s
+}
+
+func (s *WebServerSettings) validate() error {
+	if _, _, err := net.SplitHostPort(s.Listen); err != nil {
+		return fmt.Errorf("invalid listen address %q - %v", s.Listen, err)
+	}
+	if s.TLS {
+		if s.CertFile == "" || s.KeyFile == "" {
+			return fmt.Errorf("TLS needs a certificate file and a key file")
+		}
+		if s.RedirectListen != "" {
+			if _, _, err := net.SplitHostPort(s.RedirectListen); err != nil {
+				return fmt.Errorf("invalid redirect address %q - %v", s.RedirectListen, err)
+			}
+			if s.RedirectListen == s.Listen {
+				return fmt.Errorf("the redirect address must be different to the listen address")
+			}
+		}
+	}
+	if s.ReadHeaderTimeout < 0 || s.ReadTimeout < 0 || s.WriteTimeout < 0 || s.IdleTimeout < 0 {
+		return fmt.Errorf("timeouts cannot be negative, use 0 for none")
+	}
+	return nil
+}
+
+func getWebServerSettings() WebServerSettings {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	return *params.WebServer
+}
+
+/*
+certificateLoader serves the certificate from the files, reading them again when they change
+*/
+type certificateLoader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modified time.Time
+	checked  time.Time
+	mu       sync.Mutex
+}
+
+func fileModified(path string) time.Time {
+	if info, err := os.Stat(path); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
+
+/*
+load reads the certificate and key if they have changed since they were last read
+*/
+func (l *certificateLoader) load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.loadLocked(false)
+}
+
+func (l *certificateLoader) loadLocked(force bool) error {
+	l.checked = time.Now()
+	modified := fileModified(l.certFile)
+	if keyModified := fileModified(l.keyFile); keyModified.After(modified) {
+		modified = keyModified
+	}
+	if !force && l.cert != nil && !modified.After(l.modified) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	if l.cert != nil {
+		log.Printf("Certificate %s reloaded", l.certFile)
+	}
+	l.cert = &cert
+	l.modified = modified
+	return nil
+}
+
+/*
+GetCertificate is used by the TLS listener for every handshake. A certificate that can't be read is logged and the
+last good one kept, e.g. while the key has been replaced but the certificate not yet.
+*/
+func (l *certificateLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.checked) > CERTIFICATECHECKINTERVAL {
+		if err := l.loadLocked(false); err != nil {
+			log.Println("Error reloading the certificate - ", err)
+		}
+	}
+	return l.cert, nil
+}
+
+/*
+reload reads the certificate and key again now
+*/
+func (l *certificateLoader) reload() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.loadLocked(true); err != nil {
+		log.Println("Error reloading the certificate - ", err)
+	}
+}
+
+/*
+createSelfSignedCertificate makes a certificate for this host's name and addresses if there isn't one already
+*/
+func createSelfSignedCertificate(certFile string, keyFile string) error {
+	if _, err := os.Stat(certFile); err == nil {
+		return nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "firefly"
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"FireflyWeb"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(SELFSIGNEDVALIDITY),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{hostname, hostname + ".local", "localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if addresses, err := net.InterfaceAddrs(); err == nil {
+		for _, address := range addresses {
+			if ipNet, ok := address.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	// Write the key first so there is never a certificate without its key
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	log.Printf("Created a self-signed certificate for %s in %s", hostname, certFile)
+	return nil
+}
+
+func writePEM(path string, blockType string, der []byte, mode os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(file, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+/*
+httpsRedirect sends plain HTTP requests to the same host and path on the HTTPS listener
+*/
+func httpsRedirect(listen string) http.Handler {
+	_, port, _ := net.SplitHostPort(listen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+/*
+WebServerManager runs the listeners and restarts them when the settings change
+*/
+type WebServerManager struct {
+	handler http.Handler
+	servers []*http.Server
+	certs   *certificateLoader
+	mu      sync.Mutex
+}
+
+var webServer = new(WebServerManager)
+
+/*
+Start begins serving the handler with the saved settings
+*/
+func (ws *WebServerManager) Start(handler http.Handler) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.handler = handler
+	return ws.startLocked(getWebServerSettings())
+}
+
+func (ws *WebServerManager) newServer(settings WebServerSettings, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              settings.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: settings.ReadHeaderTimeout,
+		ReadTimeout:       settings.ReadTimeout,
+		WriteTimeout:      settings.WriteTimeout,
+		IdleTimeout:       settings.IdleTimeout,
+	}
+}
+
+/*
+startLocked opens the listeners. Nothing is left open if any of them fail. The caller must hold the lock.
+*/
+func (ws *WebServerManager) startLocked(settings WebServerSettings) error {
+	var certs *certificateLoader
+	if settings.TLS {
+		if settings.SelfSigned {
+			if err := createSelfSignedCertificate(settings.CertFile, settings.KeyFile); err != nil {
+				return fmt.Errorf("cannot create the self-signed certificate - %v", err)
+			}
+		}
+		certs = &certificateLoader{certFile: settings.CertFile, keyFile: settings.KeyFile}
+		if err := certs.load(); err != nil {
+			return fmt.Errorf("cannot load the certificate - %v", err)
+		}
+	}
+
+	server := ws.newServer(settings, ws.handler)
+	if certs != nil {
+		server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+	}
+	listener, err := net.Listen("tcp", settings.Listen)
+	if err != nil {
+		return err
+	}
+	servers := []*http.Server{server}
+	listeners := []net.Listener{listener}
+	if certs != nil && settings.RedirectListen != "" {
+		redirect := ws.newServer(settings, httpsRedirect(settings.Listen))
+		redirect.Addr = settings.RedirectListen
+		redirectListener, err := net.Listen("tcp", settings.RedirectListen)
+		if err != nil {
+			_ = listener.Close()
+			return err
+		}
+		servers = append(servers, redirect)
+		listeners = append(listeners, redirectListener)
+	}
+
+	for idx, srv := range servers {
+		go func(srv *http.Server, listener net.Listener) {
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ServeTLS(listener, "", "")
+			} else {
+				err = srv.Serve(listener)
+			}
+			if err != http.ErrServerClosed {
+				log.Printf("WEB server on %s stopped - %v", srv.Addr, err)
+			}
+		}(srv, listeners[idx])
+	}
+	ws.servers = servers
+	ws.certs = certs
+	if certs != nil {
+		log.Printf("Starting WEB server on %s with TLS", settings.Listen)
+		if settings.RedirectListen != "" {
+			log.Printf("Redirecting HTTP on %s to HTTPS", settings.RedirectListen)
+		}
+	} else {
+		log.Printf("Starting WEB server on %s", settings.Listen)
+	}
+	return nil
+}
+
+func (ws *WebServerManager) shutdownLocked(ctx context.Context) {
+	for _, server := range ws.servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("Error stopping the WEB server - ", err)
+		}
+	}
+	ws.servers = nil
+	ws.certs = nil
+}
+
+/*
+Shutdown stops taking requests and waits for those in flight to finish
+*/
+func (ws *WebServerManager) Shutdown(ctx context.Context) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.shutdownLocked(ctx)
+}
+
+/*
+Restart moves the listeners to the new settings, going back to the old ones if the new ones can't be used
+*/
+func (ws *WebServerManager) Restart(old WebServerSettings, settings WebServerSettings) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), WEBSERVERSHUTDOWNTIMEOUT)
+	ws.shutdownLocked(ctx)
+	cancel()
+	if err := ws.startLocked(settings); err != nil {
+		log.Println("Cannot start the WEB server with the new settings - ", err)
+		if err := ws.startLocked(old); err != nil {
+			log.Println("Cannot start the WEB server with the old settings either - ", err)
+		}
+		return err
+	}
+	return nil
+}
+
+/*
+ReloadCertificates reads the certificate files again on SIGHUP
+*/
+func (ws *WebServerManager) ReloadCertificates() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-serviceContext.Done():
+			return
+		case <-hangup:
+			ws.mu.Lock()
+			certs := ws.certs
+			ws.mu.Unlock()
+			if certs != nil {
+				certs.reload()
+			}
+		}
+	}
+}
+
+/*
+getWebServerSettingsHandler returns the web server settings
+URL = /webServer
+*/
+func getWebServerSettingsHandler(w http.ResponseWriter, _ *http.Request) {
+	settings := getWebServerSettings()
+	w.Header().Set("Content-Type", "application/json")
+	if bytesArray, err := json.Marshal(settings); err != nil {
+		ReturnJSONError(w, "WEB server", err, http.StatusInternalServerError, true)
+	} else {
+		if _, err := fmt.Fprint(w, string(bytesArray)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+setWebServerSettings replaces the web server settings and restarts the listeners. The response is sent before the
+restart so the client isn't cut off; it should reconnect on the new address.
+URL = /webServer
+payload = {"listen":":20443","tls":true,"certFile":"/etc/FireFlyWeb.crt","keyFile":"/etc/FireFlyWeb.key","selfSigned":true,
+"redirectListen":":20080","readHeaderTimeout":10000000000,"readTimeout":60000000000,"writeTimeout":300000000000,"idleTimeout":120000000000}
+*/
+func setWebServerSettings(w http.ResponseWriter, r *http.Request) {
+	settings := NewWebServerSettings()
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, settings)
+	}
+	if err != nil {
+		ReturnJSONError(w, "WEB server", err, http.StatusBadRequest, true)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		ReturnJSONError(w, "WEB server", err, http.StatusBadRequest, true)
+		return
+	}
+	if settings.TLS && !settings.SelfSigned {
+		if _, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile); err != nil {
+			ReturnJSONError(w, "WEB server", err, http.StatusBadRequest, true)
+			return
+		}
+	}
+
+	settingsMu.Lock()
+	old := *params.WebServer
+	params.WebServer = settings
+	err = params.save()
+	settingsMu.Unlock()
+	if err != nil {
+		ReturnJSONError(w, "WEB server", err, http.StatusInternalServerError, true)
+		return
+	}
+	log.Printf("WEB server settings updated by %s", requestSource(r))
+	returnJSONSuccess(w)
+
+	go func() {
+		if err := webServer.Restart(old, *settings); err != nil {
+			// Put the settings that are actually in use back in the file
+			settingsMu.Lock()
+			params.WebServer = &old
+			if err := params.save(); err != nil {
+				log.Println("Error saving the WEB server settings - ", err)
+			}
+			settingsMu.Unlock()
+		}
+	}()
+}
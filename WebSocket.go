@@ -1,82 +1,535 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+)
+
+/***************
+Websockets. Everything pushed to the browsers goes through the hub, which builds each snapshot once per tick of the
+logging loop and fans it out to the clients, so the cost no longer grows with the number of pages open.
+
+/wsHub is publish/subscribe. Clients send requests such as
+	{"id":"1","action":"subscribe","topics":["status","alarms"]}
+	{"id":"2","action":"unsubscribe","topics":["alarms"]}
+or name the topics when they connect with /wsHub?topics=status,alarms, and receive
+	{"topic":"status","type":"snapshot","data":{...}}   the whole value when they subscribe
+	{"topic":"status","type":"delta","data":{...}}      a JSON merge patch (RFC 7386) to apply each time it changes
+	{"topic":"alarms","type":"update","data":{...}}     each alarm change, event or job update as it happens
+	{"id":"1","type":"subscribed","topics":[...]}       the reply to a request, or type "error" with the reason
+As in any merge patch a null in a delta removes the value. Clients can also send commands, see WebSocketCommands.go.
+
+The topics are
+	status   the minimal status, as sent on /ws
+	full     the full status, as sent on /wsFull
+	can      the live CAN values from each fuel cell
+	alarms   alarm changes, starting with the active alarms
+	events   the events sent to the notification channels
+	jobs     job progress, starting with the jobs still in memory
+
+The server pings every 30 seconds and drops clients that stop answering. Each client has a bounded send buffer. A
+client that falls behind is disconnected rather than sent a broken chain of deltas; it gets a fresh snapshot when it
+reconnects. /ws and /wsFull still send the whole status every tick for the existing pages. The same topics are
+streamed as Server-Sent Events on /events, see SSE.go.
+*/
+
+const (
+	HUBSENDBUFFER = 64               // Messages waiting for a client before it is disconnected
+	HUBWRITEWAIT  = time.Second * 10 // Longest a write to a client may take
+	HUBPONGWAIT   = time.Second * 60 // Clients that send nothing, not even a pong, for this long are dropped
+	HUBPINGPERIOD = time.Second * 30 // Must be less than HUBPONGWAIT
+	HUBMAXREQUEST = 4096             // Largest request accepted from a client
+)
+
+const (
+	TopicStatus = "status"
+	TopicFull   = "full"
+	TopicCAN    = "can"
+	TopicAlarms = "alarms"
+	TopicEvents = "events"
+	TopicJobs   = "jobs"
+)
+
+const (
+	HubSnapshot   = "snapshot"
+	HubDelta      = "delta"
+	HubUpdate     = "update"
+	HubSubscribed = "subscribed"
+	HubError      = "error"
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:    1024,
 	WriteBufferSize:   1024,
 	EnableCompression: true,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	CheckOrigin:       checkWebSocketOrigin,
 }
 
-var dataSignal *sync.Cond
-var statusSignal *sync.Cond
+/*
+hubSnapshotTopics build the topics that are sent as a snapshot followed by deltas, once per tick. A delta replaces a
+whole list when anything in it changes, so the lists must be built in the same order every time - the fuel cells are
+listed by device number rather than in map order.
+*/
+var hubSnapshotTopics = map[string]func() ([]byte, error){
+	TopicStatus: func() ([]byte, error) {
+		return []byte(getMinJsonStatus()), nil
+	},
+	TopicFull: func() ([]byte, error) {
+		return json.Marshal(getFullStatus())
+	},
+	TopicCAN: func() ([]byte, error) {
+		values := make(map[string]*CANLiveValues)
+		if canBus != nil {
+			for device, fc := range canBus.fuelCell {
+				values[fcQueue(device)] = fc.liveValues()
+			}
+		}
+		return json.Marshal(values)
+	},
+}
 
-/**
-Start the Web Socket server. This sends out data to all subscribers on a regular schedule so subscribers don't need to poll for updates.
+/*
+hubUpdateTopics are sent as each update happens. The function, if there is one, gives the starting state.
 */
-func startDataWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+var hubUpdateTopics = map[string]func() interface{}{
+	TopicAlarms: func() interface{} {
+		return alarmManager.current()
+	},
+	TopicEvents: nil,
+	TopicJobs: func() interface{} {
+		return jobManager.current()
+	},
+}
+
+type HubMessage struct {
+	ID      string      `json:"id,omitempty"`
+	Topic   string      `json:"topic,omitempty"`
+	Type    string      `json:"type"`
+	Topics  []string    `json:"topics,omitempty"`
+	Command string      `json:"command,omitempty"`
+	Status  int         `json:"status,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+type HubRequest struct {
+	ID      string          `json:"id"`
+	Action  string          `json:"action"`
+	Topics  []string        `json:"topics"`
+	Command string          `json:"command"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type hubClient struct {
+	conn     *websocket.Conn
+	send     chan []byte
+	topics   map[string]bool // Guarded by the hub lock
+	legacy   string          // Clients of /ws and /wsFull get the whole of this topic every tick
+	user     *AuthUser
+	token    string // The API token or session the client connected with, checked again for every command
+	session  string
+	source   string
+	ip       string
+	commands chan struct{} // Commands in progress
+}
+
+type hubSnapshot struct {
+	data interface{} // Decoded so the next tick can be compared with it
+	raw  []byte
+}
+
+type WebSocketHub struct {
+	clients   map[*hubClient]bool
+	snapshots map[string]*hubSnapshot
+	mu        sync.Mutex
+}
+
+var wsHub = &WebSocketHub{clients: make(map[*hubClient]bool), snapshots: make(map[string]*hubSnapshot)}
+
+func hubMessage(message *HubMessage) []byte {
+	bytesArray, err := json.Marshal(message)
 	if err != nil {
-		log.Println(err)
+		log.Printf("Error encoding the %s websocket message - %v", message.Topic, err)
+		return nil
+	}
+	return bytesArray
+}
+
+/*
+mergePatch returns the JSON merge patch (RFC 7386) that turns old into new, or false if they are the same
+*/
+func mergePatch(old interface{}, new interface{}) (interface{}, bool) {
+	oldMap, oldIsMap := old.(map[string]interface{})
+	newMap, newIsMap := new.(map[string]interface{})
+	if !oldIsMap || !newIsMap {
+		if reflect.DeepEqual(old, new) {
+			return nil, false
+		}
+		return new, true
+	}
+	patch := make(map[string]interface{})
+	for key, value := range newMap {
+		if previous, found := oldMap[key]; found {
+			if change, changed := mergePatch(previous, value); changed {
+				patch[key] = change
+			}
+		} else {
+			patch[key] = value
+		}
+	}
+	for key := range oldMap {
+		if _, found := newMap[key]; !found {
+			patch[key] = nil
+		}
+	}
+	return patch, len(patch) > 0
+}
+
+/*
+queueLocked hands a message to the client's writer. A client whose buffer is full is disconnected. The caller must
+hold the lock
+*/
+func (h *WebSocketHub) queueLocked(c *hubClient, message []byte) {
+	if message == nil || !h.clients[c] {
 		return
 	}
-	for {
-		dataSignal.L.Lock()   // Get the signal and lock it.
-		dataSignal.Wait()     // Wait for it to be signalled again. It is unlocked while we wait then locked again before returning
-		dataSignal.L.Unlock() // Unlock it
+	select {
+	case c.send <- message:
+	default:
+		log.Printf("Websocket client %s is not keeping up - disconnecting it", c.source)
+		h.removeLocked(c)
+	}
+}
 
-		w, err := conn.NextWriter(websocket.TextMessage)
-		if err != nil {
-			//			log.Println("Failed to get the values websocket writer - ", err)
-			return
+/*
+removeLocked drops the client. Closing its send channel tells the writer to close the connection. The caller must
+hold the lock
+*/
+func (h *WebSocketHub) removeLocked(c *hubClient) {
+	if h.clients[c] {
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+func (h *WebSocketHub) register(c *hubClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = true
+}
+
+func (h *WebSocketHub) unregister(c *hubClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(c)
+}
+
+func (h *WebSocketHub) reply(c *hubClient, message *HubMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.queueLocked(c, hubMessage(message))
+}
+
+/*
+subscribe adds the topics and sends the client their current state
+*/
+func (h *WebSocketHub) subscribe(c *hubClient, topics []string) error {
+	for _, topic := range topics {
+		if _, found := hubSnapshotTopics[topic]; found {
+			continue
+		}
+		if _, found := hubUpdateTopics[topic]; !found {
+			return fmt.Errorf("unknown topic %q", topic)
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, topic := range topics {
+		if c.topics[topic] {
+			continue
+		}
+		c.topics[topic] = true
+		if _, found := hubSnapshotTopics[topic]; found {
+			// Without a snapshot yet the client gets one on the next tick
+			if snapshot := h.snapshots[topic]; snapshot != nil {
+				h.queueLocked(c, hubMessage(&HubMessage{Topic: topic, Type: HubSnapshot, Data: snapshot.data}))
+			}
+		} else if current := hubUpdateTopics[topic]; current != nil {
+			h.queueLocked(c, hubMessage(&HubMessage{Topic: topic, Type: HubSnapshot, Data: current()}))
+		}
+	}
+	return nil
+}
+
+func (h *WebSocketHub) unsubscribe(c *hubClient, topics []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, topic := range topics {
+		delete(c.topics, topic)
+	}
+}
+
+/*
+subscriptions lists the client's topics
+*/
+func (h *WebSocketHub) subscriptions(c *hubClient) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+/*
+wanted is true if any client is subscribed to the topic
+*/
+func (h *WebSocketHub) wanted(topic string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if c.topics[topic] || c.legacy == topic {
+			return true
 		}
-		var sJSON = getMinJsonStatus()
-		_, err = fmt.Fprint(w, sJSON)
+	}
+	return false
+}
+
+/*
+Tick builds each snapshot topic that has subscribers and sends the changes since the last tick. It is called by the
+logging loop once it has read the status.
+*/
+func (h *WebSocketHub) Tick() {
+	for topic, build := range hubSnapshotTopics {
+		streamed := sseBroker.wanted(topic)
+		if !streamed && !h.wanted(topic) {
+			continue
+		}
+		raw, err := build()
 		if err != nil {
-			log.Println("failed to write the values message to the websocket - ", err)
-			return
+			log.Printf("Error building the %s websocket snapshot - %v", topic, err)
+			continue
+		}
+		var data interface{}
+		if err := json.Unmarshal(raw, &data); err != nil {
+			log.Printf("Error decoding the %s websocket snapshot - %v", topic, err)
+			continue
+		}
+		if streamed {
+			sseBroker.Snapshot(topic, hubMessage(&HubMessage{Topic: topic, Type: HubSnapshot, Data: json.RawMessage(raw)}))
+		}
+
+		h.mu.Lock()
+		previous := h.snapshots[topic]
+		h.snapshots[topic] = &hubSnapshot{data: data, raw: raw}
+		var message []byte
+		if previous == nil {
+			message = hubMessage(&HubMessage{Topic: topic, Type: HubSnapshot, Data: data})
+		} else if patch, changed := mergePatch(previous.data, data); changed {
+			message = hubMessage(&HubMessage{Topic: topic, Type: HubDelta, Data: patch})
+		}
+		for c := range h.clients {
+			if c.legacy == topic {
+				h.queueLocked(c, raw)
+			} else if c.topics[topic] {
+				h.queueLocked(c, message)
+			}
 		}
-		if err := w.Close(); err != nil {
-			//			log.Println("Failed to close the values websocket writer - ", err)
+		h.mu.Unlock()
+	}
+}
+
+/*
+Publish sends an update to every client subscribed to the topic, and to the Server-Sent Events stream
+*/
+func (h *WebSocketHub) Publish(topic string, data interface{}) {
+	message := hubMessage(&HubMessage{Topic: topic, Type: HubUpdate, Data: data})
+	if message != nil {
+		sseBroker.Publish(topic, message)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if c.topics[topic] {
+			h.queueLocked(c, message)
+		}
+	}
+}
+
+/*
+Run passes the alarm and job updates to the subscribers and disconnects every client when the service stops
+*/
+func (h *WebSocketHub) Run() {
+	alarms, _ := alarmManager.subscribe()
+	defer alarmManager.unsubscribe(alarms)
+	jobs := jobManager.subscribe()
+	defer jobManager.unsubscribe(jobs)
+	for {
+		select {
+		case <-serviceContext.Done():
+			h.mu.Lock()
+			for c := range h.clients {
+				h.removeLocked(c)
+			}
+			h.mu.Unlock()
 			return
+		case update := <-alarms:
+			h.Publish(TopicAlarms, update)
+		case job := <-jobs:
+			h.Publish(TopicJobs, job)
 		}
 	}
 }
 
-func startStatusWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+/*
+handle carries out a request from a client
+*/
+func (h *WebSocketHub) handle(c *hubClient, request *HubRequest) {
+	var err error
+	switch request.Action {
+	case "subscribe":
+		err = h.subscribe(c, request.Topics)
+	case "unsubscribe":
+		h.unsubscribe(c, request.Topics)
+	case "command":
+		// The result is sent when the command has finished
+		c.runCommand(request)
+		return
+	default:
+		err = fmt.Errorf("unknown action %q", request.Action)
+	}
 	if err != nil {
-		log.Println(err)
+		h.reply(c, &HubMessage{ID: request.ID, Type: HubError, Error: err.Error()})
 		return
 	}
-	for {
-		statusSignal.L.Lock()   // Get the signal and lock it.
-		statusSignal.Wait()     // Wait for it to be signalled again. It is unlocked while we wait then locked again before returning
-		statusSignal.L.Unlock() // Unlock it
+	h.reply(c, &HubMessage{ID: request.ID, Type: HubSubscribed, Topics: h.subscriptions(c)})
+}
 
-		w, err := conn.NextWriter(websocket.TextMessage)
+/*
+readRequests reads the client's requests until it goes away or stops answering pings
+*/
+func (c *hubClient) readRequests() {
+	c.conn.SetReadLimit(HUBMAXREQUEST)
+	if err := c.conn.SetReadDeadline(time.Now().Add(HUBPONGWAIT)); err != nil {
+		return
+	}
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(HUBPONGWAIT))
+	})
+	for {
+		_, reader, err := c.conn.NextReader()
 		if err != nil {
-			//			log.Println("Failed to get the values websocket writer - ", err)
 			return
 		}
-		var sJSON = getFullJsonStatus()
-		_, err = fmt.Fprint(w, sJSON)
-		if err != nil {
-			log.Println("failed to write the values message to the websocket - ", err)
+		if err := c.conn.SetReadDeadline(time.Now().Add(HUBPONGWAIT)); err != nil {
 			return
 		}
-		if err := w.Close(); err != nil {
-			//			log.Println("Failed to close the values websocket writer - ", err)
-			return
+		if c.legacy != "" {
+			continue // The status pages don't send requests
+		}
+		var request HubRequest
+		if err := json.NewDecoder(reader).Decode(&request); err != nil {
+			wsHub.reply(c, &HubMessage{Type: HubError, Error: "invalid request - " + err.Error()})
+			continue
+		}
+		wsHub.handle(c, &request)
+	}
+}
+
+/*
+writeMessages is the only writer to the connection. It sends the queued messages and the pings.
+*/
+func (c *hubClient) writeMessages() {
+	ticker := time.NewTicker(HUBPINGPERIOD)
+	defer ticker.Stop()
+	defer func() {
+		// Closing the connection also ends readRequests
+		_ = c.conn.Close()
+	}()
+	for {
+		select {
+		case message, ok := <-c.send:
+			if err := c.conn.SetWriteDeadline(time.Now().Add(HUBWRITEWAIT)); err != nil {
+				return
+			}
+			if !ok {
+				_ = c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.SetWriteDeadline(time.Now().Add(HUBWRITEWAIT)); err != nil {
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+/*
+serveHubClient upgrades the connection and runs the client until it disconnects
+*/
+func serveHubClient(w http.ResponseWriter, r *http.Request, endpoint string, legacy string, topics []string) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer serviceMetrics.websocketClient(endpoint)()
+	c := &hubClient{conn: conn, send: make(chan []byte, HUBSENDBUFFER), topics: make(map[string]bool), legacy: legacy,
+		user: requestUser(r), source: requestSource(r), ip: hostOnly(r.RemoteAddr), commands: make(chan struct{}, HUBMAXCOMMANDS)}
+	c.token, c.session = requestCredentials(r)
+	wsHub.register(c)
+	defer wsHub.unregister(c)
+	go c.writeMessages()
+	if len(topics) > 0 {
+		if err := wsHub.subscribe(c, topics); err != nil {
+			wsHub.reply(c, &HubMessage{Type: HubError, Error: err.Error()})
+		} else {
+			wsHub.reply(c, &HubMessage{Type: HubSubscribed, Topics: wsHub.subscriptions(c)})
 		}
 	}
+	c.readRequests()
+}
+
+/*
+startHubWebSocket connects a client to the publish/subscribe hub
+URL = /wsHub?topics=status,alarms
+*/
+func startHubWebSocket(w http.ResponseWriter, r *http.Request) {
+	var topics []string
+	if s := r.URL.Query().Get("topics"); s != "" {
+		topics = strings.Split(s, ",")
+	}
+	serveHubClient(w, r, "hub", "", topics)
+}
+
+/*
+startDataWebSocket sends the minimal status every tick so the pages don't need to poll for updates
+URL = /ws
+*/
+func startDataWebSocket(w http.ResponseWriter, r *http.Request) {
+	serveHubClient(w, r, "data", TopicStatus, nil)
+}
+
+/*
+startStatusWebSocket sends the full status every tick
+URL = /wsFull
+*/
+func startStatusWebSocket(w http.ResponseWriter, r *http.Request) {
+	serveHubClient(w, r, "status", TopicFull, nil)
 }
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+/***************
+Commands over the /wsHub websocket, so a dashboard on a poor link can control the plant without a second HTTP
+connection. A command is sent as
+	{"id":"42","action":"command","command":"setRate","params":{"rate":60}}
+and when it has finished the client gets
+	{"id":"42","type":"result","command":"setRate","data":{...}}
+or
+	{"id":"42","type":"error","command":"setRate","status":409,"error":"..."}
+The id is chosen by the client to match the result to the command.
+
+Each command stands for a version 1 API route. It needs the same role as that route and goes through the same
+validation and the same dispatcher queue, and it is recorded in the audit trail.
+	setRate           {"rate":60}                    PUT /api/v1/electrolysers/rate
+	fuelCellRun       {"device":0,"state":true}      PUT /api/v1/fuel-cells/{device}/run
+	gas               {"state":true}                 PUT /api/v1/relays/gas
+	acknowledgeAlarm  {"id":12}                      POST /api/v1/alarms/{id}/acknowledge
+*/
+
+const HUBMAXCOMMANDS = 8 // Commands one client may have in progress at once
+
+const HubResult = "result"
+
+type HubDeviceStateParams struct {
+	Device int64 `json:"device"`
+	State  bool  `json:"state"`
+}
+
+type HubAlarmParams struct {
+	ID int64 `json:"id"`
+}
+
+type hubCommand struct {
+	Method   string // The version 1 route the command stands for, which sets the role needed
+	Path     string
+	Params   func() interface{}
+	PreState func(params interface{}) interface{} // The state the command changes, for the audit trail
+	Run      func(c *hubClient, user *AuthUser, params interface{}) (interface{}, *CommandError)
+}
+
+var hubCommands = map[string]*hubCommand{
+	"setRate": {Method: http.MethodPut, Path: "/electrolysers/rate",
+		Params: func() interface{} { return new(APIRateRequest) },
+		PreState: func(interface{}) interface{} {
+			SystemStatus.m.Lock()
+			count := len(SystemStatus.Electrolysers)
+			SystemStatus.m.Unlock()
+			state := make(map[string]interface{}, count)
+			for device := 0; device < count; device++ {
+				state[elQueue(device)] = commandPreState(elQueue(device))
+			}
+			return state
+		},
+		Run: func(c *hubClient, _ *AuthUser, params interface{}) (interface{}, *CommandError) {
+			if err := commandElectrolyserRate(params.(*APIRateRequest).Rate, c.source); err != nil {
+				return nil, err
+			}
+			return getElectrolyserRateStatus(), nil
+		}},
+	"fuelCellRun": {Method: http.MethodPut, Path: "/fuel-cells/{device:[0-9]+}/run",
+		Params: func() interface{} { return new(HubDeviceStateParams) },
+		PreState: func(params interface{}) interface{} {
+			return commandPreState(fmt.Sprintf("fc%d", params.(*HubDeviceStateParams).Device))
+		},
+		Run: func(c *hubClient, _ *AuthUser, params interface{}) (interface{}, *CommandError) {
+			request := params.(*HubDeviceStateParams)
+			fc, cmdErr := fuelCellDevice(request.Device, request.State)
+			if cmdErr != nil {
+				return nil, cmdErr
+			}
+			return nil, commandFuelCellRun(fc, request.State, c.source)
+		}},
+	"gas": {Method: http.MethodPut, Path: "/relays/gas",
+		Params:   func() interface{} { return new(APIStateRequest) },
+		PreState: func(interface{}) interface{} { return commandPreState(RelayQueue) },
+		Run: func(c *hubClient, _ *AuthUser, params interface{}) (interface{}, *CommandError) {
+			return nil, commandGas(params.(*APIStateRequest).State, c.source)
+		}},
+	"acknowledgeAlarm": {Method: http.MethodPost, Path: "/alarms/{id:[0-9]+}/acknowledge",
+		Params: func() interface{} { return new(HubAlarmParams) },
+		PreState: func(params interface{}) interface{} {
+			if alarm := alarmManager.alarm(params.(*HubAlarmParams).ID); alarm != nil {
+				return alarm
+			}
+			return nil
+		},
+		Run: func(c *hubClient, user *AuthUser, params interface{}) (interface{}, *CommandError) {
+			// The alarm is acknowledged in the name of the signed in user
+			if err := alarmManager.Acknowledge(params.(*HubAlarmParams).ID, user.Name); err != nil {
+				return nil, &CommandError{Status: http.StatusNotFound, Err: err, Quiet: true}
+			}
+			return nil, nil
+		}},
+}
+
+/*
+role returns the role needed by the version 1 route the command stands for
+*/
+func (command *hubCommand) role() Role {
+	for _, route := range apiV1Routes() {
+		if route.Method == command.Method && route.Path == command.Path {
+			return route.role()
+		}
+	}
+	return RoleAdmin
+}
+
+/*
+decodeHubParams reads the command parameters, refusing anything that isn't exactly one object of the right shape
+*/
+func decodeHubParams(raw json.RawMessage, v interface{}) *CommandError {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		if err == io.EOF {
+			return commandRefused(http.StatusBadRequest, "The command needs params")
+		}
+		return commandRefused(http.StatusBadRequest, "Invalid params - "+err.Error())
+	}
+	return nil
+}
+
+/*
+currentUser checks the token or session the client connected with again, so a token that has been revoked or has
+expired, or a session that has ended through a log out or a password change, can't carry on sending commands. The
+user is looked up again too so a disabled account or a lesser role takes effect straight away.
+*/
+func (c *hubClient) currentUser() *AuthUser {
+	settings := getAuthSettings()
+	if !settings.Enabled {
+		return &AuthUser{Name: "anonymous", Role: RoleAdmin}
+	}
+	return authenticator.credentialsUser(c.token, c.session, settings)
+}
+
+/*
+checkCommand finds the command and checks the client may run it
+*/
+func (c *hubClient) checkCommand(request *HubRequest) (*hubCommand, *AuthUser, *CommandError) {
+	command, found := hubCommands[request.Command]
+	if !found {
+		return nil, nil, commandRefused(http.StatusNotFound, fmt.Sprintf("Unknown command %q", request.Command))
+	}
+	user := c.currentUser()
+	if user == nil {
+		return nil, nil, commandRefused(http.StatusUnauthorized, "Sign in again to send commands")
+	}
+	if role := command.role(); user.Role < role {
+		return nil, user, commandRefused(http.StatusForbidden, fmt.Sprintf("%s needs the %s role but %s only has %s", request.Command, role, user.Name, user.Role))
+	}
+	return command, user, nil
+}
+
+/*
+runCommand carries out a command from the client in the background and sends the result when it has finished.
+The read loop carries on meanwhile so pings are still answered during a slow command.
+*/
+func (c *hubClient) runCommand(request *HubRequest) {
+	select {
+	case c.commands <- struct{}{}:
+	default:
+		wsHub.reply(c, &HubMessage{ID: request.ID, Type: HubError, Command: request.Command, Status: http.StatusTooManyRequests,
+			Error: fmt.Sprintf("Only %d commands may be in progress at once", HUBMAXCOMMANDS)})
+		return
+	}
+	go func() {
+		defer func() { <-c.commands }()
+		entry := &AuditEntry{Kind: AuditRequest, Actor: "anonymous", IP: c.ip, Source: c.source,
+			Action: "WS " + request.Command, Result: AuditOK}
+		var params interface{}
+		if json.Unmarshal(request.Params, &params) == nil {
+			entry.Params = auditJSON(params)
+		}
+
+		entry.Time = time.Now()
+		data, cmdErr := c.execute(request, entry)
+		entry.DurationMs = time.Since(entry.Time).Milliseconds()
+
+		if cmdErr != nil {
+			if !cmdErr.Quiet && cmdErr.Status >= http.StatusInternalServerError {
+				log.Printf("Websocket command %s from %s - %v", request.Command, c.source, cmdErr)
+			}
+			entry.Result = AuditRefused
+			if cmdErr.Status >= http.StatusInternalServerError {
+				entry.Result = AuditFailed
+			}
+			entry.Error = fmt.Sprintf("%d %s", cmdErr.Status, cmdErr.Error())
+			auditTrail.Record(entry)
+			wsHub.reply(c, &HubMessage{ID: request.ID, Type: HubError, Command: request.Command, Status: cmdErr.Status, Error: cmdErr.Error()})
+			if cmdErr.Status == http.StatusUnauthorized {
+				// The token or session is no longer valid so the client has to connect again. The error is sent first.
+				log.Printf("Websocket client %s is no longer signed in - disconnecting it", c.source)
+				wsHub.unregister(c)
+			}
+			return
+		}
+		auditTrail.Record(entry)
+		wsHub.reply(c, &HubMessage{ID: request.ID, Type: HubResult, Command: request.Command, Data: data})
+	}()
+}
+
+/*
+execute checks and runs the command, filling in who sent it and the state before it for the audit entry
+*/
+func (c *hubClient) execute(request *HubRequest, entry *AuditEntry) (interface{}, *CommandError) {
+	command, user, cmdErr := c.checkCommand(request)
+	if user != nil {
+		entry.Actor = user.Name
+		if user.Token != "" {
+			entry.Actor += " (token " + user.Token + ")"
+		}
+	}
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	params := command.Params()
+	if cmdErr := decodeHubParams(request.Params, params); cmdErr != nil {
+		return nil, cmdErr
+	}
+	if command.PreState != nil {
+		entry.PreState = auditJSON(command.PreState(params))
+	}
+	return command.Run(c, user, params)
+}
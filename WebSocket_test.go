@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		old     string
+		new     string
+		patch   string
+		changed bool
+	}{
+		{"same object", `{"a":1,"b":{"c":2}}`, `{"a":1,"b":{"c":2}}`, `null`, false},
+		{"changed value", `{"a":1,"b":2}`, `{"a":1,"b":3}`, `{"b":3}`, true},
+		{"added key", `{"a":1}`, `{"a":1,"b":2}`, `{"b":2}`, true},
+		{"removed key", `{"a":1,"b":2}`, `{"a":1}`, `{"b":null}`, true},
+		{"nested change", `{"a":{"b":1,"c":2}}`, `{"a":{"b":1,"c":3}}`, `{"a":{"c":3}}`, true},
+		{"nested removal", `{"a":{"b":1,"c":2}}`, `{"a":{"b":1}}`, `{"a":{"c":null}}`, true},
+		{"object replaced by value", `{"a":{"b":1}}`, `{"a":5}`, `{"a":5}`, true},
+		{"value replaced by object", `{"a":5}`, `{"a":{"b":1}}`, `{"a":{"b":1}}`, true},
+		{"array replaced whole", `{"a":[1,2,3]}`, `{"a":[1,2,4]}`, `{"a":[1,2,4]}`, true},
+		{"same array", `{"a":[1,2,3]}`, `{"a":[1,2,3]}`, `null`, false},
+		{"top level value", `1`, `2`, `2`, true},
+		{"same top level value", `"x"`, `"x"`, `null`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var old, new, want interface{}
+			for _, v := range []struct {
+				raw string
+				to  *interface{}
+			}{{test.old, &old}, {test.new, &new}, {test.patch, &want}} {
+				if err := json.Unmarshal([]byte(v.raw), v.to); err != nil {
+					t.Fatal(err)
+				}
+			}
+			patch, changed := mergePatch(old, new)
+			if changed != test.changed {
+				t.Errorf("changed = %v, want %v", changed, test.changed)
+			}
+			// The patch is only used when something has changed
+			if changed && !reflect.DeepEqual(patch, want) {
+				t.Errorf("patch = %v, want %v", patch, want)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 )
 
 /**
@@ -17,6 +18,10 @@ func setUpWebSite() {
 	router.HandleFunc("/ws", startDataWebSocket).Methods("GET")
 	// Same as /ws but includes more data. This is used for the text based status page woth everything on it.
 	router.HandleFunc("/wsFull", startStatusWebSocket).Methods("GET")
+	// Publish/subscribe websocket with topics and deltas
+	router.HandleFunc("/wsHub", startHubWebSocket).Methods("GET")
+	// The same topics as Server-Sent Events for clients that can't use websockets
+	router.HandleFunc("/events", streamEvents).Methods("GET")
 	// Returns the status page with text based information on all components
 	router.HandleFunc("/status", getStatus).Methods("GET")
 	// Returns JSON data containing error flag information from the fuel cell
@@ -46,6 +51,7 @@ func setUpWebSite() {
 	// Turn the spare relay on or off payloa = {"state":true} or {"state":false}
 	router.HandleFunc("/spare", setSpare).Methods("PUT")
 
+	router.HandleFunc("/el/search", searchElectrolysers).Methods("POST")
 	router.HandleFunc("/el/{device}", elCommand).Methods("PUT")
 
 	router.HandleFunc("/eldetail/{device}/{from}/{to}", getElectrolyserDetail).Methods("GET")
@@ -61,13 +67,19 @@ func setUpWebSite() {
 	router.HandleFunc("/el/start", startAllElectrolysers).Methods("GET", "POST")
 	router.HandleFunc("/el/stop", stopAllElectrolysers).Methods("GET", "POST")
 	router.HandleFunc("/el/reboot", rebootAllElectrolysers).Methods("POST")
+	router.HandleFunc("/el/preheat/schedule", getPreheatSchedule).Methods("GET")
 	router.HandleFunc("/el/preheat", preheatAllElectrolysers).Methods("GET", "POST")
 	router.HandleFunc("/el/setrate", setElectrolyserRate).Methods("POST")
 	router.HandleFunc("/el/getRate", getElectrolyserRate).Methods("GET")
 	router.HandleFunc("/el/on", setAllElOn).Methods("POST")
 	router.HandleFunc("/el/off", setAllElOff).Methods("POST")
 	router.HandleFunc("/miscdata/{from}/{to}", getHistory).Methods("GET")
+	router.HandleFunc("/dr/status", getAllDryersJsonStatus).Methods("GET")
+	router.HandleFunc("/dr/{device:[0-9]+}", getDryerDeviceJsonStatus).Methods("GET")
 	router.HandleFunc("/dr/{device}/status", getDryerJsonStatus).Methods("GET")
+	router.HandleFunc("/dr/{device}/history/{from}/{to}", getDryerHistory).Methods("GET")
+	router.HandleFunc("/dr/{device}/events/{days}", getDryerEvents).Methods("GET")
+	router.HandleFunc("/dr/{device}/{command}", dryerCommand).Methods("POST")
 	router.HandleFunc("/dr/reboot", rebootDryer).Methods("POST")
 	router.HandleFunc("/minStatus", getMinHtmlStatus).Methods("GET")
 	router.HandleFunc("/eldata/{from}/{to}", getElectrolyserHistory).Methods("GET")
@@ -78,13 +90,62 @@ func setUpWebSite() {
 	router.HandleFunc("/candumpEvent/{event}", candumpEvent).Methods("GET")
 	router.HandleFunc("/canrecord/{to}", canRecord).Methods("GET")
 	router.HandleFunc("/canEvents", listCANEvents).Methods("GET")
+	router.HandleFunc("/water/status", getWaterStatus).Methods("GET")
+	router.HandleFunc("/water/history/{days}", getWaterHistory).Methods("GET")
+	router.HandleFunc("/water/{device}/{action}", waterAction).Methods("POST")
+	router.HandleFunc("/estop", getEmergencyStopStatus).Methods("GET")
+	router.HandleFunc("/estop", setEmergencyStop).Methods("PUT", "POST")
+	router.HandleFunc("/estop/reset", resetEmergencyStop).Methods("POST")
+	router.HandleFunc("/commands", getCommandList).Methods("GET")
+	router.HandleFunc("/commands/{id}", getCommandStatus).Methods("GET")
+	router.HandleFunc("/api/jobs", getJobHistory).Methods("GET")
+	router.HandleFunc("/api/audit", getAuditTrail).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}", getJobStatus).Methods("GET")
+	router.HandleFunc("/wsJobs", startJobsWebSocket).Methods("GET")
+	router.HandleFunc("/api/telemetry", getTelemetry).Methods("GET")
+	router.HandleFunc("/api/comms", getDataSources).Methods("GET")
+	// Liveness and readiness probes for systemd, monitoring and load balancers
+	router.HandleFunc("/healthz", getHealth).Methods("GET", "HEAD")
+	router.HandleFunc("/readyz", getReadiness).Methods("GET", "HEAD")
+	// Prometheus metrics
+	router.HandleFunc("/metrics", getMetrics).Methods("GET")
+	router.HandleFunc("/api/rules", getThresholdRules).Methods("GET")
+	router.HandleFunc("/api/rules/{name}", setThresholdRule).Methods("PUT")
+	router.HandleFunc("/api/rules/{name}", deleteThresholdRule).Methods("DELETE")
+	router.HandleFunc("/lockout", getLockoutList).Methods("GET")
+	router.HandleFunc("/lockout/{type}/{device}", setLockout).Methods("PUT", "POST")
+	router.HandleFunc("/lockout/{type}/{device}", clearLockout).Methods("DELETE")
+	router.HandleFunc("/notifications", getNotificationSettings).Methods("GET")
+	router.HandleFunc("/notifications", setNotificationSettings).Methods("PUT")
+	router.HandleFunc("/notifications/test", sendTestNotification).Methods("POST")
+	router.HandleFunc("/mqtt", getMQTTSettings).Methods("GET")
+	router.HandleFunc("/mqtt", setMQTTSettings).Methods("PUT")
+	router.HandleFunc("/modbusServer", getModbusServerSettings).Methods("GET")
+	router.HandleFunc("/modbusServer", setModbusServerSettings).Methods("PUT")
+	router.HandleFunc("/api/alarms", getAlarmList).Methods("GET")
+	router.HandleFunc("/api/alarms/history", getAlarmHistory).Methods("GET")
+	router.HandleFunc("/api/alarms/acknowledge", acknowledgeAllAlarms).Methods("PUT")
+	router.HandleFunc("/api/alarms/{id:[0-9]+}/acknowledge", acknowledgeAlarm).Methods("PUT")
+	router.HandleFunc("/api/alarms/{id:[0-9]+}/shelve", shelveAlarm).Methods("PUT")
+	router.HandleFunc("/api/alarms/{id:[0-9]+}/unshelve", unshelveAlarm).Methods("PUT")
+	router.HandleFunc("/wsAlarms", startAlarmsWebSocket).Methods("GET")
 	router.HandleFunc("/settings", getSettings).Methods("GET")
 	router.HandleFunc("/settings", updateSettings).Methods("POST")
+	router.HandleFunc("/login", showLoginPage).Methods("GET")
+	router.HandleFunc("/login", login).Methods("POST")
+	router.HandleFunc("/logout", logout).Methods("GET", "POST")
+	router.HandleFunc("/auth", getAuthSettingsHandler).Methods("GET")
+	router.HandleFunc("/auth", setAuthSettings).Methods("PUT")
+	router.HandleFunc("/webServer", getWebServerSettingsHandler).Methods("GET")
+	router.HandleFunc("/webServer", setWebServerSettings).Methods("PUT")
+	setUpAPIv1(router)
 	fileServer := http.FileServer(neuteredFileSystem{http.Dir("/Firefly/web")})
 	router.PathPrefix("/").Handler(http.StripPrefix("/", fileServer))
+	router.Use(authenticator.Middleware, auditTrail.Middleware)
 
-	log.Println("Starting WEB server")
-	log.Fatal(http.ListenAndServe(":20080", router))
+	if err := webServer.Start(router); err != nil {
+		log.Fatal(err)
+	}
 }
 
 /**
@@ -109,21 +170,8 @@ func setFcRun(w http.ResponseWriter, r *http.Request) {
 
 	log.Println(jBody)
 
-	// Device should be 0 or 1.
-	if (err != nil) || (jBody.Device > 1) {
-		ReturnJSONErrorString(w, "Fuel Cell", "Invalid fuel cell in 'run' request", http.StatusBadRequest, true)
-		return
-	}
-
-	if jBody.State {
-		// Start the cell
-		err = startFuelCell(jBody.Device)
-	} else {
-		// Stop the cell
-		err = stopFuelCell(jBody.Device)
-	}
-	if err != nil {
-		ReturnJSONError(w, "Fuel Cell", err, http.StatusInternalServerError, true)
+	if err := commandFuelCellRun(jBody.Device, jBody.State, requestSource(r)); err != nil {
+		ReturnCommandError(w, "Fuel Cell", err)
 		return
 	}
 	returnJSONSuccess(w)
@@ -149,50 +197,30 @@ func setFcOnOff(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Device should be 0 or 1.
-	if (err != nil) || (jBody.Device > 1) {
-		ReturnJSONErrorString(w, "Fuel Cell", "Invalid fuel cell in 'on/off' request", http.StatusBadRequest, true)
+	job, cmdErr := commandFuelCellEnable(jBody.Device, jBody.State, requestSource(r))
+	if cmdErr != nil {
+		ReturnCommandError(w, "Fuel Cell", cmdErr)
 		return
 	}
-
-	if jBody.State {
-		// Start the cell
-		log.Print("Turn on the fuel cell")
-		err = turnOnFuelCell(jBody.Device)
-	} else {
-		// Stop the cell
-		log.Print("Turn off the fuel cell")
-		err = turnOffFuelCell(jBody.Device)
-	}
-	if err != nil {
-		ReturnJSONError(w, "Fuel Cell", err, http.StatusInternalServerError, true)
+	if job != nil {
+		returnJSONJob(w, job)
 		return
 	}
 	returnJSONSuccess(w)
 }
 
 func fcRestart(w http.ResponseWriter, r *http.Request) {
-	var jErr JSONError
-
-	vars := mux.Vars(r)
-	device, err := parseDevice(vars["device"])
-	if (err != nil) || (device > 1) || (device < 0) {
-		log.Println(jErr.AddErrorString("Fuel Cell", "Invalid fuel cell in 'status' request"))
-		jErr.ReturnError(w, 400)
-		return
-	}
-
-	// Device should be 0 or 1.
-	if (err != nil) || (device > 1) {
-		ReturnJSONErrorString(w, "Fuel Cell", "Invalid fuel cell in 'on/off' request", http.StatusBadRequest, true)
+	device, err := strconv.ParseInt(mux.Vars(r)["device"], 10, 8)
+	if err != nil {
+		ReturnJSONErrorString(w, "Fuel Cell", "Invalid fuel cell in 'restart' request", http.StatusBadRequest, true)
 		return
 	}
-
-	if err = restartFc(device); err != nil {
-		ReturnJSONError(w, "Fuel Cell", err, http.StatusInternalServerError, true)
+	job, cmdErr := commandFuelCellRestart(device, requestSource(r))
+	if cmdErr != nil {
+		ReturnCommandError(w, "Fuel Cell", cmdErr)
 		return
 	}
-	returnJSONSuccess(w)
+	returnJSONJob(w, job)
 }
 
 func setFcMaintenance(w http.ResponseWriter, r *http.Request) {
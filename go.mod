@@ -5,8 +5,10 @@ go 1.16
 require (
 	github.com/RackSec/srslog v0.0.0-20180709174129-a4725f04ec91
 	github.com/brutella/can v0.0.2
+	github.com/eclipse/paho.mqtt.golang v1.3.5
 	github.com/go-sql-driver/mysql v1.6.0
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.4.2
 	github.com/simonvetter/modbus v1.4.0
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 )
@@ -60,6 +60,10 @@ func ReturnJSONError(w http.ResponseWriter, device string, err error, httpReturn
 
 	_ = jErr.AddError(device, err)
 	jErr.Success = false
+	// A command refused because the device is locked out is always a conflict whatever the caller asked for
+	if _, locked := err.(*LockoutError); locked {
+		httpReturnCode = http.StatusConflict
+	}
 	jErr.ReturnError(w, httpReturnCode)
 	if bLog {
 		_, caller, line, _ := runtime.Caller(1)
@@ -67,6 +71,13 @@ func ReturnJSONError(w http.ResponseWriter, device string, err error, httpReturn
 	}
 }
 
+/*
+ReturnCommandError reports a refused or failed command
+*/
+func ReturnCommandError(w http.ResponseWriter, device string, err *CommandError) {
+	ReturnJSONError(w, device, err.Err, err.Status, !err.Quiet)
+}
+
 func ReturnJSONErrorString(w http.ResponseWriter, device string, errStr string, httpReturnCode int, bLog bool) {
 	var jErr JSONError
 